@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deployments that aren't public can limit who reaches repkg at all, with
+// config.AllowedIPs, and who is served packages, with config.AccessKeys.
+// Both are checked before routing, resolution or any disk access. Keys are
+// asked for on every route that serves content or fetches it, the API's
+// included; only health checks, metrics and the routes with tokens of
+// their own (admin and registry hooks) are left open. Preflight requests
+// carry no key, so they are answered without one.
+
+// accessKeyCtx is where the label of the key a request was let in with is
+// kept, for the access log.
+const accessKeyCtx = "repkg.accessKey"
+
+var (
+	accessKeyRequests = newCounter("repkg_access_key_requests_total", "Requests that needed an access key, by its label.")
+	accessDenied      = newCounter("repkg_access_denied_total", "Requests refused by allowedIPs or accessKeys, by reason.")
+
+	// allowedNets is config.AllowedIPs, parsed.
+	allowedNets []*net.IPNet
+)
+
+// parseAllowedIPs reads CIDRs and single addresses; an address is a network
+// of one.
+func parseAllowedIPs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither an IP address nor a CIDR", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientAddr is the address an allowlist is checked against: the peer's,
+// or the one the proxies in config.TrustedProxies forwarded for.
+func clientAddr(c *gin.Context) net.IP {
+	if len(config.TrustedProxies) > 0 {
+		return net.ParseIP(c.ClientIP())
+	}
+	return net.ParseIP(c.RemoteIP())
+}
+
+// allowIPs refuses requests from addresses outside config.AllowedIPs with a
+// 403, whatever the route.
+func allowIPs(c *gin.Context) {
+	if len(allowedNets) == 0 {
+		return
+	}
+	if ip := clientAddr(c); ip != nil {
+		for _, n := range allowedNets {
+			if n.Contains(ip) {
+				return
+			}
+		}
+	}
+	accessDenied.Inc("reason", "ip")
+	writeError(c, newError(http.StatusForbidden, codeAddressNotAllowed, "access from this address is not allowed"))
+	c.Abort()
+}
+
+// requireAccessKey refuses requests to routes that aren't open without one of
+// config.AccessKeys, in X-Repkg-Key or ?key=, with a 401. A tenant's API
+// key, or the admin token, does as well.
+func requireAccessKey(c *gin.Context) {
+	if len(config.AccessKeys) == 0 || c.Request.Method == http.MethodOptions || openPath(c.Request.URL.Path) {
+		return
+	}
+	key := c.GetHeader("X-Repkg-Key")
+	if key == "" {
+		key = c.Query("key")
+	}
+	label := accessKeyLabel(key)
+	switch {
+	case label != "":
+	case tenantOf(c) != nil:
+		// selectTenant has checked its X-Api-Key.
+		label = "tenant:" + tenantOf(c).name
+	case tenantByKey(key) != nil:
+		label = "tenant:" + tenantByKey(key).name
+	case isAdmin(c.Request):
+		label = "admin"
+	default:
+		reason := "missing"
+		if key != "" {
+			reason = "invalid"
+		}
+		accessDenied.Inc("reason", "key_"+reason)
+		writeError(c, newError(http.StatusUnauthorized, codeUnauthorized, "an access key is required, in X-Repkg-Key or ?key="))
+		c.Abort()
+		return
+	}
+	c.Set(accessKeyCtx, label)
+	accessKeyRequests.Inc("key", label)
+}
+
+// withAccessKey adds the ?key= a request was let in with to u, a redirect
+// target or link of repkg's, so following it needs nothing more. A key sent
+// in X-Repkg-Key is sent again by the client and isn't copied. Content
+// that is cached, such as source maps or inlined CSS, never takes a key.
+func withAccessKey(c *gin.Context, u string) string {
+	if len(config.AccessKeys) == 0 || c.GetHeader("X-Repkg-Key") != "" {
+		return u
+	}
+	key, ok := c.GetQuery("key")
+	if !ok || key == "" {
+		return u
+	}
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + "key=" + url.QueryEscape(key)
+}
+
+// accessKeyLabel is the label of key in config.AccessKeys, or "". Every key
+// is compared, so the time taken doesn't tell which came close.
+func accessKeyLabel(key string) string {
+	if key == "" {
+		return ""
+	}
+	found := ""
+	for label, k := range config.AccessKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			found = label
+		}
+	}
+	return found
+}
+
+// openPaths are the routes served without an access key: health checks,
+// metrics, and those with tokens of their own. A path ending in "/" is a
+// prefix.
+var openPaths = []string{"/metrics", "/api/health", "/api/ready", "/api/admin/", "/api/hooks/"}
+
+// openPath tells whether p, below a /t/<tenant> prefix or not, is one of
+// openPaths. Everything else, /api/batch, /api/search and /api/diff among
+// it, serves or fetches package content.
+func openPath(p string) bool {
+	if rest, ok := strings.CutPrefix(p, "/t/"); ok && len(tenants) > 0 {
+		_, p, _ = strings.Cut(rest, "/")
+		p = "/" + p
+	}
+	for _, open := range openPaths {
+		if p == open || strings.HasSuffix(open, "/") && strings.HasPrefix(p, open) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessKeyStats is the number of requests made with each access key, for
+// /api/stats.
+func accessKeyStats() map[string]int64 {
+	stats := map[string]int64{}
+	labels := make([]string, 0, len(config.AccessKeys))
+	for label := range config.AccessKeys {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		stats[label] = int64(accessKeyRequests.Value("key", label))
+	}
+	return stats
+}
+
+// accessLog is gin's log line, with the label of the access key at the end
+// and the key itself left out of the query.
+func accessLog(p gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if p.IsOutputColor() {
+		statusColor, methodColor, resetColor = p.StatusCodeColor(), p.MethodColor(), p.ResetColor()
+	}
+	if p.Latency > time.Minute {
+		p.Latency = p.Latency.Truncate(time.Second)
+	}
+	path := p.Path
+	if before, query, ok := strings.Cut(path, "?"); ok {
+		if q, err := url.ParseQuery(query); err == nil && q.Has("key") {
+			q.Set("key", "redacted")
+			path = before + "?" + q.Encode()
+		}
+	}
+	key, _ := p.Keys[accessKeyCtx].(string)
+	if key == "" {
+		key = "-"
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v | key %s\n%s",
+		p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, p.StatusCode, resetColor,
+		p.Latency,
+		p.ClientIP,
+		methodColor, p.Method, resetColor,
+		path,
+		key,
+		p.ErrorMessage,
+	)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccessKeyHeader(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AccessKeys = map[string]string{"ci": "k1"}
+	})
+
+	res := s.get("/npm/left-pad@1.0.0/index.js")
+	if res.StatusCode != 401 || responseCode(t, res) != codeUnauthorized {
+		t.Fatalf("no key: got %s", res.Status)
+	}
+	res = s.get("/npm/left-pad@1.0.0/index.js", "X-Repkg-Key", "wrong")
+	if res.StatusCode != 401 {
+		t.Fatalf("wrong key: got %s", res.Status)
+	}
+
+	loc := s.follow(s.get("/npm/left-pad@1.0.0/index.js", "X-Repkg-Key", "k1"), 302)
+	if want := "/packages/left-pad@1.0.0/index.js"; loc != want {
+		t.Errorf("redirected to %s, want %s", loc, want)
+	}
+	if body := responseBody(t, s.get(loc, "X-Repkg-Key", "k1"), 200); body != "padded" {
+		t.Errorf("got %q", body)
+	}
+	responseBody(t, s.get("/api/health"), 200)
+}
+
+func TestAccessKeyQuery(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"lib/a.js": "a", "lib/b.js": "b"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AccessKeys = map[string]string{"ci": "k 1&"}
+	})
+
+	if res := s.get("/npm/left-pad@1.0.0/lib/a.js?key=wrong"); res.StatusCode != 401 {
+		t.Fatalf("wrong key: got %s", res.Status)
+	}
+
+	loc := s.follow(s.get("/npm/left-pad@1.0.0/lib/a.js?key=k+1%26"), 302)
+	if want := "/packages/left-pad@1.0.0/lib/a.js?key=k+1%26"; loc != want {
+		t.Errorf("redirected to %s, want %s", loc, want)
+	}
+	if body := responseBody(t, s.get(loc), 200); body != "a" {
+		t.Errorf("got %q", body)
+	}
+
+	loc = s.follow(s.get("/packages/left-pad@1.0.0/lib?key=k+1%26"), 301)
+	if want := "/packages/left-pad@1.0.0/lib/?key=k+1%26"; loc != want {
+		t.Errorf("directory redirected to %s, want %s", loc, want)
+	}
+	listing := responseBody(t, s.get(loc), 200)
+	for _, link := range []string{`href="./a.js?key=k+1%26"`, `href="./b.js?key=k+1%26"`} {
+		if !strings.Contains(listing, link) {
+			t.Errorf("listing has no %s:\n%s", link, listing)
+		}
+	}
+	if body := responseBody(t, s.get("/packages/left-pad@1.0.0/lib/b.js?key=k+1%26"), 200); body != "b" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestAllowedIPs(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AllowedIPs = []string{"192.0.2.7", "127.0.0.0/8"}
+	})
+
+	responseBody(t, s.get("/api/health"), 200)
+	loc := s.follow(s.get("/npm/left-pad@1.0.0/index.js"), 302)
+	if body := responseBody(t, s.get(loc), 200); body != "padded" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestAllowedIPsDenied(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AllowedIPs = []string{"10.0.0.0/8"}
+	})
+
+	for _, p := range []string{"/api/health", "/npm/left-pad@1.0.0/index.js", "/packages/left-pad@1.0.0/index.js"} {
+		res := s.get(p)
+		if res.StatusCode != 403 {
+			t.Errorf("%s: got %s, want 403", p, res.Status)
+			continue
+		}
+		if code := responseCode(t, res); code != codeAddressNotAllowed {
+			t.Errorf("%s: code %q", p, code)
+		}
+	}
+	if reg.hits("/left-pad") != 0 {
+		t.Errorf("a denied request reached the registry")
+	}
+}
+
+// TestAllowedIPsInvalid checks that a bad entry keeps repkg from
+// starting rather than leaving the list empty, which would let everyone
+// in.
+func TestAllowedIPsInvalid(t *testing.T) {
+	reg := newFakeRegistry(t)
+	for _, tc := range []struct {
+		key    string
+		change func(cfg *Config)
+	}{
+		{"allowedIPs", func(cfg *Config) { cfg.AllowedIPs = []string{"10.0.0.0/8", "10.0.0.300"} }},
+		{"allowedIPs", func(cfg *Config) { cfg.AllowedIPs = []string{"10.0.0.0/33"} }},
+		{"trustedProxies", func(cfg *Config) { cfg.TrustedProxies = []string{"proxy.internal"} }},
+	} {
+		cfg := defaultConfig()
+		cfg.DataDir = t.TempDir()
+		cfg.Registry = reg.URL
+		tc.change(&cfg)
+		resetState()
+		if _, err := NewServer(cfg); err == nil || !strings.HasPrefix(err.Error(), tc.key+":") {
+			t.Errorf("%v, %v: NewServer: %v", cfg.AllowedIPs, cfg.TrustedProxies, err)
+		}
+	}
+}
+
+func TestAccessKeyAPI(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	reg.publish("left-pad", "1.1.0", map[string]string{"index.js": "padded more"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AccessKeys = map[string]string{"ci": "k1"}
+		cfg.AdminToken = "admin"
+	})
+
+	for _, r := range []struct{ method, target, body string }{
+		{"GET", "/api/batch?paths=left-pad@1.0.0/index.js", ""},
+		{"POST", "/api/batch", `{"paths": ["left-pad@1.0.0/index.js"]}`},
+		{"GET", "/api/search/left-pad/1.0.0?q=padded&type=content", ""},
+		{"GET", "/api/diff/left-pad/1.0.0/1.1.0?file=index.js&fetch=true", ""},
+		{"GET", "/api/meta/left-pad@1.0.0", ""},
+		{"POST", "/api/resolve", `{"dependencies": {"left-pad": "^1"}}`},
+		{"POST", "/api/prefetch", `{"packages": ["left-pad@1.0.0"]}`},
+		{"GET", "/api/packages", ""},
+		{"GET", "/api/version", ""},
+	} {
+		for _, key := range []string{"", "wrong"} {
+			res := s.request(r.method, r.target, strings.NewReader(r.body), "Content-Type", "application/json", "X-Repkg-Key", key)
+			if res.StatusCode != 401 || responseCode(t, res) != codeUnauthorized {
+				t.Errorf("%s %s with key %q: got %s", r.method, r.target, key, res.Status)
+			}
+		}
+	}
+	if n := reg.hits("/left-pad") + reg.hits(tarballPath("left-pad", "1.0.0")) + reg.hits(tarballPath("left-pad", "1.1.0")); n != 0 {
+		t.Errorf("refused requests made %d registry requests", n)
+	}
+
+	// With a key, the same requests go through.
+	body := responseBody(t, s.request("GET", "/api/batch?paths=left-pad@1.0.0/index.js", nil, "X-Repkg-Key", "k1"), 200)
+	if !strings.Contains(body, "padded") {
+		t.Errorf("batch: %s", body)
+	}
+	responseBody(t, s.get("/api/search/left-pad/1.0.0?q=padded&type=content&key=k1"), 200)
+	responseBody(t, s.get("/api/diff/left-pad/1.0.0/1.1.0?file=index.js&fetch=true&key=k1"), 200)
+
+	// Health checks, metrics and the admin routes don't need one.
+	for _, p := range []string{"/api/health", "/api/ready", "/metrics"} {
+		responseBody(t, s.get(p), 200)
+	}
+	responseBody(t, s.request("GET", "/api/admin/failures", nil, "Authorization", "Bearer admin"), 200)
+	if res := s.get("/api/admin/failures"); res.StatusCode != 401 {
+		t.Errorf("admin route without its token: got %s", res.Status)
+	}
+}
+
+func TestOpenPath(t *testing.T) {
+	for p, open := range map[string]bool{
+		"/api/health":            true,
+		"/api/ready":             true,
+		"/metrics":               true,
+		"/api/admin/purge":       true,
+		"/api/hooks/registry":    true,
+		"/api/healthz":           false,
+		"/api/admin":             false,
+		"/api":                   false,
+		"/":                      false,
+		"/api/batch":             false,
+		"/api/search/left-pad/1": false,
+		"/api/diff/a/1/2":        false,
+		"/npm/left-pad":          false,
+		"/metrics/x":             false,
+	} {
+		if got := openPath(p); got != open {
+			t.Errorf("openPath(%q) = %v", p, got)
+		}
+	}
+}
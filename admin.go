@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isAdmin reports whether r carries config.AdminToken as a bearer token.
+func isAdmin(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// requireAdmin reports whether the request is an admin one, answering 401
+// when it is not.
+func requireAdmin(c *gin.Context) bool {
+	if isAdmin(c.Request) {
+		return true
+	}
+	writeError(c, newError(http.StatusUnauthorized, codeUnauthorized, "admin token required"))
+	return false
+}
+
+type versionRequest struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Pinned  *bool  `json:"pinned"`
+}
+
+// cachedVersions returns the cached versions of the tenant a request names:
+// the one given or, without a version, all of the package's.
+func (r *versionRequest) cachedVersions(t *tenant) ([]indexEntry, error) {
+	if !validPackageName(r.Package) || (r.Version != "" && !validVersion(r.Version)) {
+		return nil, newError(http.StatusBadRequest, codeBadRequest, "invalid package %q or version %q", r.Package, r.Version)
+	}
+	var list []indexEntry
+	for _, e := range index.entriesFor(t) {
+		if e.Name == r.Package && (r.Version == "" || e.Version == r.Version) {
+			list = append(list, e)
+		}
+	}
+	if len(list) == 0 && r.Version != "" {
+		return nil, newError(http.StatusNotFound, codeNotFound, "%s@%s is not cached", r.Package, r.Version)
+	}
+	if len(list) == 0 {
+		return nil, newError(http.StatusNotFound, codeNotFound, "%s has no cached versions", r.Package)
+	}
+	return list, nil
+}
+
+// servePin pins or unpins cached versions ({"package", "version",
+// "pinned"}, pinning by default). Pinned versions are served even when
+// withdrawn upstream and are never evicted.
+func servePin(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req versionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request"))
+		return
+	}
+	pinned := req.Pinned == nil || *req.Pinned
+
+	list, err := req.cachedVersions(tenantOf(c))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	versions := []string{}
+	for _, e := range list {
+		dir := versionDir(e.tenant, e.Name, e.Version)
+		if _, err := updateManifest(e.tenant, dir, e.Name, e.Version, func(m *Manifest) { m.Pinned = pinned }); err != nil {
+			writeError(c, err)
+			return
+		}
+		log.Printf("admin: %s@%s pinned=%t", e.Name, e.Version, pinned)
+		versions = append(versions, e.Version)
+	}
+	c.JSON(http.StatusOK, gin.H{"package": req.Package, "versions": versions, "pinned": pinned})
+}
+
+// servePurge removes cached versions ({"package", "version"}; all of the
+// package's without a version), or with ?dry-run=true lists them. With
+// ?registry=, only those fetched from that registry go, and the package
+// may be left out to remove all of them.
+func servePurge(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req versionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request"))
+		return
+	}
+
+	registry := registryFilter(c)
+	var list []indexEntry
+	var err error
+	if req.Package == "" && registry != "" {
+		list = index.entriesFor(tenantOf(c))
+	} else if list, err = req.cachedVersions(tenantOf(c)); err != nil {
+		writeError(c, err)
+		return
+	}
+	if registry != "" {
+		list = slices.DeleteFunc(list, func(e indexEntry) bool { return e.Registry != registry })
+	}
+	dryRun := c.Query("dry-run") == "true"
+	purged := []string{}
+	var bytes int64
+	for _, e := range list {
+		if !dryRun {
+			if err := removeVersion(e.tenant, e.Name, e.Version); err != nil {
+				writeError(c, err)
+				return
+			}
+			log.Printf("admin: purged %s@%s", e.Name, e.Version)
+			emitVersionEvent(e.tenant, eventVersionPurged, e.Name, e.Version)
+		}
+		if req.Package == "" {
+			purged = append(purged, e.Name+"@"+e.Version)
+		} else {
+			purged = append(purged, e.Version)
+		}
+		bytes += e.Size
+	}
+	res := gin.H{"package": req.Package, "purged": purged, "bytes": bytes}
+	if registry != "" {
+		res["registry"] = registry
+	}
+	if dryRun {
+		res["dryRun"] = true
+	}
+	c.JSON(http.StatusOK, res)
+}
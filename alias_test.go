@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Headers that differ between any two responses.
+var volatileHeaders = []string{"Date", "X-Request-Id", "Server-Timing", "X-Response-Time"}
+
+// compareResponses reports how got differs from want, but for
+// volatileHeaders.
+func compareResponses(t *testing.T, name string, got, want *http.Response) {
+	t.Helper()
+	if got.StatusCode != want.StatusCode {
+		t.Errorf("%s: got %s, want %s", name, got.Status, want.Status)
+		return
+	}
+	wantHeader, gotHeader := want.Header.Clone(), got.Header.Clone()
+	for _, h := range volatileHeaders {
+		wantHeader.Del(h)
+		gotHeader.Del(h)
+	}
+	for h := range wantHeader {
+		if gotHeader.Get(h) != wantHeader.Get(h) {
+			t.Errorf("%s: %s %q, want %q", name, h, gotHeader.Get(h), wantHeader.Get(h))
+		}
+	}
+	for h := range gotHeader {
+		if wantHeader.Values(h) == nil {
+			t.Errorf("%s: %s %q, which wasn't wanted", name, h, gotHeader.Get(h))
+		}
+	}
+	if g, w := responseBody(t, got, got.StatusCode), responseBody(t, want, want.StatusCode); g != w {
+		t.Errorf("%s: body %q, want %q", name, g, w)
+	}
+}
+
+// TestPathStyles checks that the path of each style is answered exactly
+// as repkg's own /npm/<name>/<version>/<file>.
+func TestPathStyles(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "1"})
+	reg.publish("left-pad", "1.1.0", map[string]string{"index.js": "1.1", "lib/util.js": "util"})
+	reg.tag("left-pad", "stable", "1.0.0")
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{"lib/main.js": "scoped", "package.json": `{"name": "@scope/pkg", "version": "1.0.0", "main": "lib/main.js"}`})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.PathStyles = []string{pathStyleJSDelivr, pathStyleUnpkg}
+	})
+
+	for _, tc := range []struct {
+		// path is as the styles have it, native as repkg's own.
+		path, native string
+		status       int
+	}{
+		{"left-pad@1.0.0/index.js", "left-pad/1.0.0/index.js", 302},
+		{"left-pad@^1/lib/util.js", "left-pad/^1/lib/util.js", 302},
+		{"left-pad@stable/index.js", "left-pad/stable/index.js", 302},
+		{"left-pad@latest", "left-pad/latest", 302},
+		{"left-pad", "left-pad", 302},
+		{"@scope/pkg@1.0.0/lib/main.js", "@scope/pkg/1.0.0/lib/main.js", 302},
+		{"@scope/pkg@1", "@scope/pkg/1", 302},
+		{"left-pad@9.9.9/index.js", "left-pad/9.9.9/index.js", 404},
+		{"no-such-package@1.0.0/index.js", "no-such-package/1.0.0/index.js", 404},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			if res := s.request(method, "/npm/"+tc.native, nil); method == http.MethodGet && res.StatusCode != tc.status {
+				t.Errorf("GET /npm/%s: got %s, want %d", tc.native, res.Status, tc.status)
+			}
+			for _, target := range []string{"/npm/" + tc.path, "/" + tc.path} {
+				res := s.request(method, target, nil)
+				compareResponses(t, method+" "+target, res, s.request(method, "/npm/"+tc.native, nil))
+			}
+		}
+	}
+
+	// repkg's own paths aren't taken for package names.
+	responseBody(t, s.get("/api/health"), 200)
+	if body := responseBody(t, s.get("/packages/left-pad@1.0.0/index.js"), 200); body != "1" {
+		t.Errorf("got %q", body)
+	}
+	for _, p := range []string{"/api", "/packages", "/npm", "/hash", "/metrics"} {
+		if n := reg.hits(p); n != 0 {
+			t.Errorf("the registry was asked for %s", p)
+		}
+	}
+}
+
+// TestPathStylesEnabled checks that each style is only answered when
+// enabled, and repkg's own paths whichever are.
+func TestPathStylesEnabled(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "1"})
+	for _, tc := range []struct {
+		name            string
+		styles          []string
+		jsdelivr, unpkg bool
+	}{
+		{name: "default", styles: nil, jsdelivr: true},
+		{name: "none", styles: []string{}},
+		{name: "jsdelivr", styles: []string{pathStyleJSDelivr}, jsdelivr: true},
+		{name: "unpkg", styles: []string{pathStyleUnpkg}, unpkg: true},
+		{name: "both", styles: []string{pathStyleUnpkg, pathStyleJSDelivr}, jsdelivr: true, unpkg: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, reg, func(cfg *Config) {
+				if tc.styles != nil {
+					cfg.PathStyles = tc.styles
+				}
+			})
+			hits := reg.hits("/left-pad")
+			for _, style := range []struct {
+				target  string
+				enabled bool
+			}{
+				{"/left-pad@1.0.0/index.js", tc.unpkg},
+				{"/npm/left-pad@1.0.0/index.js", tc.jsdelivr},
+			} {
+				for _, method := range []string{http.MethodGet, http.MethodHead} {
+					res := s.request(method, style.target, nil)
+					switch {
+					case style.enabled && method == http.MethodGet:
+						s.follow(res, 302)
+					case style.enabled:
+						// Cached by the GET.
+						if res.StatusCode != http.StatusOK || res.Header.Get("X-Cache") != "HIT" {
+							t.Errorf("HEAD %s: got %s, X-Cache %q", style.target, res.Status, res.Header.Get("X-Cache"))
+						}
+					case res.StatusCode != http.StatusNotFound:
+						t.Errorf("%s %s: got %s, want 404", method, style.target, res.Status)
+					}
+				}
+			}
+			if !tc.jsdelivr && !tc.unpkg && reg.hits("/left-pad") != hits {
+				t.Errorf("the registry was asked for left-pad")
+			}
+			if body := responseBody(t, s.get(s.follow(s.get("/npm/left-pad/1.0.0/index.js"), 302)), 200); body != "1" {
+				t.Errorf("/npm/left-pad/1.0.0/index.js: got %q", body)
+			}
+
+			var version struct{ Features map[string]bool }
+			if err := json.Unmarshal([]byte(responseBody(t, s.get("/api/version"), 200)), &version); err != nil {
+				t.Fatal(err)
+			}
+			if version.Features["jsdelivrPaths"] != tc.jsdelivr || version.Features["unpkgPaths"] != tc.unpkg {
+				t.Errorf("features %v", version.Features)
+			}
+		})
+	}
+
+	cfg := defaultConfig()
+	cfg.PathStyles = []string{"esm.sh"}
+	data, _ := json.Marshal(cfg)
+	name := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(name, true); err == nil || !strings.Contains(err.Error(), "esm.sh") {
+		t.Errorf("readConfig: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// With config.TagAliases, each package's directory also holds an alias per
+// dist-tag, <data dir>/<registry>/<name>/<tag>, for consumers that read the
+// data dir directly, such as build machines mounting it over NFS. An alias is a
+// symlink to a version directory or, where symlinks can't be made, a file
+// holding the version. It points at the newest cached version that is not
+// newer than the tag's, and prereleases only for tags on a prerelease.
+// Aliases are replaced atomically, as versions are cached and packuments
+// fetched, and before the version they point at is removed, so they never
+// dangle. Nothing repkg serves goes through them.
+
+var (
+	aliasMu sync.Mutex
+
+	aliasProbe    sync.Once
+	aliasSymlinks bool
+)
+
+// symlinksWork reports whether symlinks can be made in the data dir.
+func symlinksWork() bool {
+	aliasProbe.Do(func() {
+		dir, err := newStagingDir()
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(dir)
+		aliasSymlinks = os.Symlink("probe", filepath.Join(dir, "link")) == nil
+		if !aliasSymlinks {
+			log.Printf("aliases: symlinks don't work in %s, writing alias files instead", config.DataDir)
+		}
+	})
+	return aliasSymlinks
+}
+
+// validAliasTag accepts dist-tags that are safe as a name next to version
+// directories.
+func validAliasTag(tag string) bool {
+	if tag == "" || len(tag) > 100 || tag[0] == '.' || validVersion(tag) || strings.HasSuffix(tag, ".tmp") {
+		return false
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// aliasTarget returns the version an alias of a tag on tagVersion points
+// at among the cached versions, "" for none.
+func aliasTarget(tagVersion string, cached []string) string {
+	tv, ok := parseSemver(tagVersion)
+	if !ok {
+		return ""
+	}
+	var best *semver
+	target := ""
+	for _, v := range cached {
+		sv, ok := parseSemver(v)
+		if !ok || sv.compare(tv) > 0 || (len(sv.Pre) > 0 && len(tv.Pre) == 0) {
+			continue
+		}
+		if best == nil || sv.compareBuild(*best) > 0 {
+			best, target = &sv, v
+		}
+	}
+	return target
+}
+
+// readAliases returns the aliases in a package directory, by tag.
+func readAliases(dir string) map[string]string {
+	aliases := map[string]string{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return aliases
+	}
+	for _, e := range entries {
+		if !validAliasTag(e.Name()) {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		switch {
+		case e.Type()&fs.ModeSymlink != 0:
+			if v, err := os.Readlink(p); err == nil {
+				aliases[e.Name()] = v
+			}
+		case e.Type().IsRegular():
+			if data, err := os.ReadFile(p); err == nil && validVersion(strings.TrimSpace(string(data))) {
+				aliases[e.Name()] = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	return aliases
+}
+
+// updateAliases points the aliases of a package at its cached versions,
+// leaving out except, which is about to be removed. Without
+// config.TagAliases, it only removes the aliases that point at except.
+// Each partition's package directory has aliases of its own versions.
+func updateAliases(t *tenant, packageName, except string) {
+	if config.ReadOnly || (!config.TagAliases && except == "") {
+		return
+	}
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	pruneMu.RLock()
+	defer pruneMu.RUnlock()
+
+	cached := map[string][]string{
+		filepath.Join(t.dataDir(), partitionName(t.registry()), filepath.FromSlash(packageName)): nil,
+	}
+	for _, e := range index.entriesFor(t) {
+		if e.Name != packageName {
+			continue
+		}
+		dir := filepath.Dir(e.Dir)
+		if e.Version != except {
+			cached[dir] = append(cached[dir], e.Version)
+		} else if _, ok := cached[dir]; !ok {
+			cached[dir] = nil
+		}
+	}
+	p, ok := localPackument(t, packageName)
+	for dir, versions := range cached {
+		updatePackageAliases(dir, packageName, except, versions, p, ok)
+	}
+}
+
+func updatePackageAliases(dir, packageName, except string, cached []string, p *Packument, ok bool) {
+	existing := readAliases(dir)
+	want := map[string]string{}
+	if config.TagAliases && ok {
+		for tag, v := range p.DistTags {
+			if target := aliasTarget(v, cached); target != "" && validAliasTag(tag) {
+				want[tag] = target
+			}
+		}
+	} else {
+		// Without the tags, the aliases are kept unless they would dangle.
+		for tag, v := range existing {
+			if v != except && slices.Contains(cached, v) {
+				want[tag] = v
+			}
+		}
+	}
+
+	for tag, v := range want {
+		if existing[tag] == v {
+			continue
+		}
+		if err := writeAlias(dir, tag, v); err != nil {
+			log.Printf("aliases: %s/%s: %s", packageName, tag, err)
+			continue
+		}
+		log.Printf("aliases: %s/%s -> %s", packageName, tag, v)
+	}
+	for tag := range existing {
+		if _, ok := want[tag]; !ok {
+			if err := os.Remove(filepath.Join(dir, tag)); err != nil {
+				log.Printf("aliases: %s/%s: %s", packageName, tag, err)
+			}
+		}
+	}
+}
+
+// writeAlias replaces an alias at once, by renaming a new one over it.
+func writeAlias(dir, tag, version string) error {
+	tmp := filepath.Join(dir, "."+tag+".tmp")
+	os.Remove(tmp)
+	var err error
+	if symlinksWork() {
+		err = os.Symlink(version, tmp)
+	} else {
+		err = os.WriteFile(tmp, []byte(version+"\n"), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, tag)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// updateAllAliases brings the aliases of every cached package up to date,
+// at startup, for versions cached before config.TagAliases was set.
+func updateAllAliases() {
+	if !config.TagAliases || config.ReadOnly {
+		return
+	}
+	type pkg struct {
+		t    *tenant
+		name string
+	}
+	seen := map[pkg]bool{}
+	for _, e := range index.entries() {
+		k := pkg{e.tenant, e.Name}
+		if !seen[k] {
+			seen[k] = true
+			updateAliases(e.tenant, e.Name, "")
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parsePackageParams splits a catch-all route parameter such as
+// "/@scope/name/1.0.0" or "/name/1.0.0" into the package name and the
+// remaining path segments. "/name@1.0.0" is the same as "/name/1.0.0".
+func parsePackageParams(p string) (packageName string, rest []string, err error) {
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+	n := 1
+	if strings.HasPrefix(segs[0], "@") {
+		n = 2
+	}
+	if len(segs) >= n {
+		if i := strings.Index(segs[n-1], "@"); i > 0 {
+			last := segs[n-1]
+			segs = append(append(append([]string{}, segs[:n-1]...), last[:i], last[i+1:]), segs[n:]...)
+		}
+	}
+	if len(segs) < n || !validPackageName(strings.Join(segs[:n], "/")) {
+		return "", nil, newError(http.StatusBadRequest, codeBadRequest, "invalid package name %q", strings.Trim(p, "/"))
+	}
+	return strings.Join(segs[:n], "/"), segs[n:], nil
+}
+
+// versionInName reports whether a path as parsePackageParams takes gives
+// the version after the name, as "/name@1.0.0".
+func versionInName(p string) bool {
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+	n := 1
+	if strings.HasPrefix(segs[0], "@") {
+		n = 2
+	}
+	return len(segs) >= n && strings.Index(segs[n-1], "@") > 0
+}
+
+// serveMeta handles /api/meta/:scope/:name/:version, returning the version
+// manifest. The version may be a tag or range and defaults to latest.
+func serveMeta(c *gin.Context) {
+	packageName, rest, err := parsePackageParams(c.Param("package"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	spec := ""
+	if len(rest) > 0 {
+		spec = rest[0]
+	}
+
+	before, err := parseBefore(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	t := tenantOf(c)
+	ep, err := ensurePackage(packageName, spec, fetchOptions{Tenant: t, Admin: isAdmin(c.Request), Before: before, IncludePrerelease: c.Query("include-prerelease") == "true", FetchedBy: fetchedBy(c)})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	var versions []metaVersion
+	if !before.IsZero() {
+		if versions, err = versionsBefore(t, packageName, before, requestSpan(c)); err != nil {
+			writeError(c, err)
+			return
+		}
+	}
+
+	setResolveHeaders(c.Writer, ep)
+	m := ep.Manifest
+	if !isAdmin(c.Request) && m.FetchedBy != nil {
+		public := *m
+		public.FetchedBy = m.FetchedBy.public()
+		m = &public
+	}
+	files := make([]metaFile, len(m.Files))
+	for i := range m.Files {
+		files[i] = metaFile{m.Files[i], hashedURL(t, &m.Files[i])}
+	}
+	writeJSON(c, http.StatusOK, struct {
+		*Manifest
+		Files    []metaFile       `json:"files"`
+		Peers    []peerDependency `json:"peers"`
+		Versions []metaVersion    `json:"versions,omitempty"`
+	}{m, files, readPackageJSON(versionDir(t, m.Name, m.Version), m).peers(), versions})
+}
+
+// metaVersion is a published version as /api/meta?before= lists it.
+type metaVersion struct {
+	Version   string    `json:"version"`
+	Published time.Time `json:"published"`
+}
+
+// versionsBefore lists the versions of a package published by before, in
+// semver order.
+func versionsBefore(t *tenant, packageName string, before time.Time, s *span) ([]metaVersion, error) {
+	p, err := getPackument(t, packageName, s)
+	if err != nil {
+		return nil, err
+	}
+	if p, err = packumentBefore(p, before); err != nil {
+		return nil, err
+	}
+	list := make([]metaVersion, 0, len(p.Versions))
+	for v, pv := range p.Versions {
+		list = append(list, metaVersion{v, pv.Published.UTC()})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return versionLess(packageName, list[i].Version, packageName, list[j].Version)
+	})
+	return list, nil
+}
+
+// metaFile is a manifest file as /api/meta reports it.
+type metaFile struct {
+	ManifestFile
+	HashedURL string `json:"hashedUrl,omitempty"`
+}
+
+// serveStats handles GET /api/stats, reporting the tenant's cache usage and
+// heaviest versions (?top=, default 20), those fetched from one registry
+// with ?registry=.
+func serveStats(c *gin.Context) {
+	top := 20
+	if q := c.Query("top"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 0 {
+			writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid top %q", q))
+			return
+		}
+		top = n
+	}
+
+	c.JSON(http.StatusOK, statsFor(tenantOf(c), top, registryFilter(c)))
+}
+
+// registryFilter is the registryID of a request's ?registry=, a registry
+// URL or already an ID such as "registry.npmjs.org"; "" without one.
+func registryFilter(c *gin.Context) string {
+	q := c.Query("registry")
+	if id := registryID(q); id != "" || q == "" {
+		return id
+	}
+	return strings.ToLower(strings.TrimRight(q, "/"))
+}
+
+// registryUsage is what the versions fetched from one registry take.
+type registryUsage struct {
+	Versions int   `json:"versions"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// statsFor is the /api/stats document of a tenant, or of its versions
+// fetched from registry (a registryID) if not "".
+func statsFor(t *tenant, top int, registry string) gin.H {
+	entries := index.entriesFor(t)
+	registries := map[string]*registryUsage{}
+	for _, e := range entries {
+		id := e.Registry
+		if id == "" {
+			id = "unknown"
+		}
+		if registries[id] == nil {
+			registries[id] = &registryUsage{}
+		}
+		registries[id].Versions++
+		registries[id].Bytes += e.Size
+	}
+	versions, versionBytes, internalBytes := index.totalsFor(t)
+	if registry != "" {
+		entries = slices.DeleteFunc(entries, func(e indexEntry) bool { return e.Registry != registry })
+		versions, versionBytes = len(entries), 0
+		for _, e := range entries {
+			versionBytes += e.Size
+		}
+	}
+	requests24h, requests7d := 0, 0
+	for _, p := range withUsage(entries) {
+		requests24h += p.Requests24h
+		requests7d += p.Requests7d
+	}
+	h := gin.H{
+		"versions":     versions,
+		"bytes":        versionBytes,
+		"requests24h":  requests24h,
+		"requests7d":   requests7d,
+		"largest":      largestOf(entries, top),
+		"popular":      popularOf(entries, top),
+		"registries":   registries,
+		"quotas":       quotaUsageFor(t),
+		"verification": verificationFor(t),
+	}
+	if len(config.AccessKeys) > 0 {
+		h["accessKeys"] = accessKeyStats()
+	}
+	if registry != "" {
+		h["registry"] = registry
+	} else {
+		h["internalBytes"] = internalBytes
+	}
+	return h
+}
+
+// servePackages lists the tenant's cached versions with their request
+// counts, or with ?top=N the N most requested over the last week.
+func servePackages(c *gin.Context) {
+	q := c.Query("top")
+	if q == "" {
+		after, limit, err := pageParams(c)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		list, total, more := index.page(tenantOf(c), after, limit)
+		h := gin.H{"packages": fetchedByFor(c, withUsage(list)), "total": total}
+		if more {
+			last := list[len(list)-1]
+			h["nextCursor"] = encodeCursor(last.Name + "@" + last.Version)
+		}
+		writeJSON(c, http.StatusOK, h)
+		return
+	}
+	n, err := strconv.Atoi(q)
+	if err != nil || n < 0 {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid top %q", q))
+		return
+	}
+	writeJSON(c, http.StatusOK, gin.H{"packages": fetchedByFor(c, popular(tenantOf(c), n))})
+}
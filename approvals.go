@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With config.Approvals, a package is only fetched for the first time once
+// an admin approved it. Requests for one that isn't get a 451
+// approval_required naming the request they were queued as, an admin lists
+// the queue at /api/admin/approvals and approves or denies each request.
+// Approving adds the package, or a range of its versions, to the approved
+// list, which is kept in approvalsPath with the queue. Packages with cached
+// versions and no approval of their own, cached before approvals were
+// turned on, are approved as they are. The allowlist still applies first:
+// approvals never let through a package it leaves out.
+
+// Request statuses.
+const (
+	approvalPending = "pending"
+	approvalDenied  = "denied"
+)
+
+var approvalsQueued = newCounter("repkg_fetches_awaiting_approval_total", "Fetches refused because the package isn't approved yet.")
+
+// approval lets a package, or the versions of it in Range, be fetched.
+type approval struct {
+	Tenant   string    `json:"tenant,omitempty"`
+	Package  string    `json:"package"`
+	Range    string    `json:"range,omitempty"`
+	Approved time.Time `json:"approved"`
+	// Request is the request it answered, if any.
+	Request string `json:"request,omitempty"`
+}
+
+// approvalRequest is a package that was asked for without being approved.
+// Requests for it are counted against the same one until it expires, and a
+// denied one keeps refusing them until then.
+type approvalRequest struct {
+	ID       string    `json:"id"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Package  string    `json:"package"`
+	Versions []string  `json:"versions"` // asked for
+	Status   string    `json:"status"`
+	Requests int       `json:"requests"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Expires  time.Time `json:"expires"`
+}
+
+type approvalQueue struct {
+	mu       sync.Mutex
+	Approved []approval        `json:"approved"`
+	Requests []approvalRequest `json:"requests"`
+}
+
+var approvals = &approvalQueue{}
+
+func approvalsPath() string {
+	return filepath.Join(config.DataDir, internalDir, "approvals.json")
+}
+
+// approves reports whether a is for version of the package.
+func (a *approval) approves(version string) bool {
+	if a.Range == "" {
+		return true
+	}
+	v, ok := parseSemver(version)
+	r, err := parseRange(a.Range)
+	return ok && err == nil && r.match(v)
+}
+
+// check queues a request for a version of a package that isn't approved,
+// and returns the error to answer with.
+func (q *approvalQueue) check(t *tenant, name, version string) error {
+	if !config.Approvals {
+		return nil
+	}
+	tn := t.Name()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.prune(now)
+
+	known := false
+	for _, a := range q.Approved {
+		if a.Tenant == tn && a.Package == name {
+			if a.approves(version) {
+				return nil
+			}
+			known = true
+		}
+	}
+	if !known && slices.ContainsFunc(index.entriesFor(t), func(e indexEntry) bool { return e.Name == name }) {
+		return nil
+	}
+
+	i := slices.IndexFunc(q.Requests, func(r approvalRequest) bool { return r.Tenant == tn && r.Package == name })
+	if i < 0 {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		q.Requests = append(q.Requests, approvalRequest{
+			ID: hex.EncodeToString(buf), Tenant: tn, Package: name, Status: approvalPending,
+			First: now, Expires: now.Add(config.ApprovalTTL.Duration),
+		})
+		i = len(q.Requests) - 1
+		log.Printf("approvals: %s@%s queued as %s", name, version, q.Requests[i].ID)
+	}
+	r := &q.Requests[i]
+	if !slices.Contains(r.Versions, version) {
+		r.Versions = append(r.Versions, version)
+	}
+	r.Requests++
+	r.Last = now
+	q.save()
+	approvalsQueued.Inc("status", r.Status)
+
+	e := newError(http.StatusUnavailableForLegalReasons, codeApprovalRequired, "%s needs an admin's approval before it is fetched (request %s)", name, r.ID)
+	if r.Status == approvalDenied {
+		e.Message = name + " was denied (request " + r.ID + ")"
+	}
+	e.Details = map[string]any{"package": name, "version": version, "requestId": r.ID, "status": r.Status, "expires": r.Expires}
+	return e
+}
+
+// approve adds an approval, replacing those of the package it covers.
+// Callers hold q.mu.
+func (q *approvalQueue) approve(a approval) {
+	q.Approved = slices.DeleteFunc(q.Approved, func(b approval) bool {
+		return b.Tenant == a.Tenant && b.Package == a.Package && (a.Range == "" || b.Range == a.Range)
+	})
+	q.Approved = append(q.Approved, a)
+	q.Requests = slices.DeleteFunc(q.Requests, func(r approvalRequest) bool {
+		return r.Tenant == a.Tenant && r.Package == a.Package && !slices.ContainsFunc(r.Versions, func(v string) bool { return !a.approves(v) })
+	})
+	q.save()
+}
+
+func (q *approvalQueue) prune(now time.Time) {
+	q.Requests = slices.DeleteFunc(q.Requests, func(r approvalRequest) bool { return now.After(r.Expires) })
+}
+
+func (q *approvalQueue) load() error {
+	data, err := os.ReadFile(approvalsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return json.Unmarshal(data, q)
+}
+
+// save writes the approvals and the queue. Callers hold q.mu.
+func (q *approvalQueue) save() {
+	data, err := json.Marshal(q)
+	if err == nil {
+		err = writeDerived(approvalsPath(), data)
+	}
+	if err != nil {
+		log.Printf("approvals: saving %s: %s", approvalsPath(), err)
+	}
+}
+
+// serveApprovals handles GET /api/admin/approvals, the tenant's open
+// requests, oldest first, and its approved packages, by name.
+func serveApprovals(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	tn := tenantOf(c).Name()
+	approvals.mu.Lock()
+	approvals.prune(time.Now())
+	requests, approved := []approvalRequest{}, []approval{}
+	for _, r := range approvals.Requests {
+		if r.Tenant == tn {
+			requests = append(requests, r)
+		}
+	}
+	for _, a := range approvals.Approved {
+		if a.Tenant == tn {
+			approved = append(approved, a)
+		}
+	}
+	approvals.mu.Unlock()
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].First.Before(requests[j].First) })
+	sort.SliceStable(approved, func(i, j int) bool {
+		if approved[i].Package != approved[j].Package {
+			return approved[i].Package < approved[j].Package
+		}
+		return approved[i].Range < approved[j].Range
+	})
+	c.JSON(http.StatusOK, gin.H{"enabled": config.Approvals, "requests": requests, "approved": approved})
+}
+
+type approvalDecision struct {
+	// Package is for approving one no request asked for yet.
+	Package string `json:"package"`
+	// Decision is "approve", the default, or "deny".
+	Decision string `json:"decision"`
+	// Range limits an approval to some versions; empty approves them all.
+	Range string `json:"range"`
+	// Fetch fetches the versions the request asked for that the approval
+	// covers, as a prefetch job.
+	Fetch bool `json:"fetch"`
+}
+
+// serveApprove handles POST /api/admin/approvals/:id, approving or denying
+// a request, and POST /api/admin/approvals, approving a package ahead of
+// any request.
+func serveApprove(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req approvalDecision
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request"))
+		return
+	}
+	if req.Decision != "" && req.Decision != "approve" && req.Decision != "deny" {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, `decision is "approve" or "deny", not %q`, req.Decision))
+		return
+	}
+	if req.Range != "" {
+		if _, err := parseRange(req.Range); err != nil {
+			writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid range"))
+			return
+		}
+	}
+	t := tenantOf(c)
+	tn := t.Name()
+	id := c.Param("id")
+
+	approvals.mu.Lock()
+	approvals.prune(time.Now())
+	var r approvalRequest
+	if id != "" {
+		i := slices.IndexFunc(approvals.Requests, func(r approvalRequest) bool { return r.ID == id && r.Tenant == tn })
+		if i < 0 {
+			approvals.mu.Unlock()
+			writeError(c, newError(http.StatusNotFound, codeNotFound, "no approval request %s", id))
+			return
+		}
+		r = approvals.Requests[i]
+		req.Package = r.Package
+		if req.Decision == "deny" {
+			approvals.Requests[i].Status = approvalDenied
+			approvals.Requests[i].Expires = time.Now().Add(config.ApprovalTTL.Duration)
+			r = approvals.Requests[i]
+			approvals.save()
+			approvals.mu.Unlock()
+			log.Printf("approvals: denied %s (request %s)", r.Package, r.ID)
+			c.JSON(http.StatusOK, gin.H{"request": r})
+			return
+		}
+	} else if req.Decision == "deny" {
+		approvals.mu.Unlock()
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "only requests can be denied"))
+		return
+	}
+	if !validPackageName(req.Package) {
+		approvals.mu.Unlock()
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid package %q", req.Package))
+		return
+	}
+	if err := checkAllowed(t, req.Package); err != nil {
+		approvals.mu.Unlock()
+		writeError(c, err)
+		return
+	}
+	a := approval{Tenant: tn, Package: req.Package, Range: req.Range, Approved: time.Now().UTC(), Request: r.ID}
+	approvals.approve(a)
+	approvals.mu.Unlock()
+	log.Printf("approvals: approved %s %s", a.Package, a.Range)
+
+	res := gin.H{"approved": a}
+	if req.Fetch {
+		var items []*prefetchItem
+		for _, v := range r.Versions {
+			if a.approves(v) {
+				items = append(items, &prefetchItem{Package: a.Package, Spec: v})
+			}
+		}
+		if len(items) > 0 {
+			res["prefetchJob"] = enqueuePrefetch(items, fetchOptions{Tenant: t, FetchedBy: fetchedBy(c)}).ID
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchEntry is one line of a batch response. Content is UTF-8 text, or
+// base64 for binary files.
+type batchEntry struct {
+	Path        string `json:"path"`
+	Package     string `json:"package,omitempty"`
+	Version     string `json:"version,omitempty"`
+	File        string `json:"file,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Integrity   string `json:"integrity,omitempty"`
+	HashedURL   string `json:"hashedUrl,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// batchBudget hands out the bytes a batch response may still carry. A
+// zero limit is unlimited.
+type batchBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+func (b *batchBudget) take(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// serveBatch handles POST /api/batch with {"paths": [...]} and GET
+// /api/batch?paths=a,b. Paths look like the ones below /packages, except
+// that the version may be a tag or range, or be left out for latest. The
+// response is NDJSON with one line per path, in request order.
+func serveBatch(c *gin.Context) {
+	var paths []string
+	if c.Request.Method == http.MethodGet {
+		for _, p := range strings.Split(c.Query("paths"), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	} else {
+		var body struct {
+			Paths []string `json:"paths"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request body"))
+			return
+		}
+		paths = body.Paths
+	}
+
+	if len(paths) == 0 {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "no paths given"))
+		return
+	}
+	if config.BatchMaxEntries > 0 && len(paths) > config.BatchMaxEntries {
+		writeError(c, newError(http.StatusBadRequest, codeBatchTooLarge, "%d paths requested, at most %d are allowed per batch", len(paths), config.BatchMaxEntries))
+		return
+	}
+
+	opts := fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), FetchedBy: fetchedBy(c)}
+	budget := &batchBudget{limit: config.BatchMaxBytes}
+
+	results := make([]chan *batchEntry, len(paths))
+	sem := make(chan struct{}, 8)
+	for i, p := range paths {
+		results[i] = make(chan *batchEntry, 1)
+		go func(p string, out chan<- *batchEntry) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			out <- batchFile(p, opts, budget)
+		}(p, results[i])
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	for _, ch := range results {
+		enc.Encode(<-ch)
+		c.Writer.Flush()
+	}
+}
+
+// batchFile resolves and reads a single batch path.
+func batchFile(p string, opts fetchOptions, budget *batchBudget) *batchEntry {
+	entry := &batchEntry{Path: p}
+	fail := func(err error) *batchEntry {
+		entry.Code, entry.Error = errorCode(err), err.Error()
+		return entry
+	}
+
+	pkgDir, rel := splitPackagePath(strings.TrimPrefix(p, "/packages"))
+	name, spec := parsePkgDir(pkgDir)
+	rel = normalizePath(strings.Trim(rel, "/"))
+	if !validPackageName(name) {
+		return fail(newError(http.StatusBadRequest, codeBadRequest, "invalid package name %q", name))
+	}
+	if rel == "" {
+		return fail(newError(http.StatusBadRequest, codeBadRequest, "no file given in %q", p))
+	}
+	entry.Package, entry.File = name, rel
+
+	ep, err := ensurePackage(name, spec, opts)
+	if err != nil {
+		return fail(err)
+	}
+	m := ep.Manifest
+	entry.Version = m.Version
+
+	f, ok := m.Lookup(rel)
+	if !ok || deny.denied(rel) {
+		return fail(newError(http.StatusNotFound, codeNotFound, "%s@%s has no file %s", name, m.Version, rel))
+	}
+	if !budget.take(f.Size) {
+		return fail(newError(http.StatusRequestEntityTooLarge, codeBatchTooLarge, "%s does not fit in the remaining batch size", rel))
+	}
+
+	data, err := readStoredFile(versionDir(opts.Tenant, name, m.Version), f)
+	if err != nil {
+		return fail(err)
+	}
+
+	entry.Size, entry.Integrity = f.Size, f.Integrity
+	entry.HashedURL = hashedURL(opts.Tenant, f)
+	entry.ContentType = f.fileType()
+	if entry.ContentType == "" {
+		entry.ContentType = "application/octet-stream"
+	}
+	if utf8.Valid(data) && !strings.ContainsRune(string(data), 0) {
+		entry.Encoding, entry.Content = "utf8", string(data)
+	} else {
+		entry.Encoding, entry.Content = "base64", base64.StdEncoding.EncodeToString(data)
+	}
+	return entry
+}
+
+// readStoredFile returns the original bytes of a manifest file, decoding it
+// when it is stored compressed.
+func readStoredFile(dir string, f *ManifestFile) ([]byte, error) {
+	p := f.diskPath(dir)
+	if f.Stored == "br" {
+		return readBrotli(p + ".br")
+	}
+	return os.ReadFile(p)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Request bodies are read before the handler runs, up to
+// config.MaxBodyBytes. Routes registered with BulkBody, which take whole
+// lockfiles, take up to config.BulkBodyMaxBytes, and gzipped bodies too:
+// the limit is on what they decompress to, so a small gzip bomb is refused
+// like a large body.
+
+var bodiesRejected = newCounter("repkg_request_bodies_rejected_total", "Request bodies refused for their size or encoding, by reason.")
+
+// readBodies reads the body of c into memory for the handler, refusing it
+// with a 413 past the route's limit, a 415 for encodings other than gzip
+// on bulk routes, and a 400 for gzip streams that don't decompress.
+func readBodies(bulk bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := config.MaxBodyBytes
+		if bulk {
+			limit = config.BulkBodyMaxBytes
+		}
+		body, reason, err := readBody(c.Request, bulk, limit)
+		if err != nil {
+			bodiesRejected.Inc("reason", reason)
+			writeError(c, err)
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		c.Next()
+	}
+}
+
+func readBody(r *http.Request, bulk bool, limit int64) ([]byte, string, error) {
+	var src io.Reader = r.Body
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); {
+	case enc == "" || enc == "identity":
+	case enc == "gzip" && bulk:
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, "invalid_gzip", wrapError(http.StatusBadRequest, codeBadRequest, err, "the body is not valid gzip")
+		}
+		defer zr.Close()
+		src = zr
+		r.Header.Del("Content-Encoding")
+	case enc == "gzip":
+		return nil, "encoding", newError(http.StatusUnsupportedMediaType, codeUnsupportedEncoding, "this route doesn't take gzipped bodies")
+	default:
+		return nil, "encoding", newError(http.StatusUnsupportedMediaType, codeUnsupportedEncoding, "unsupported Content-Encoding %q; bodies are sent as is or, on bulk routes, gzipped", enc)
+	}
+	if limit > 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+	body, err := io.ReadAll(src)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+		return nil, "invalid_gzip", wrapError(http.StatusBadRequest, codeBadRequest, err, "the gzipped body is truncated or corrupt")
+	}
+	if err != nil {
+		return nil, "read", wrapError(http.StatusBadRequest, codeBadRequest, err, "reading the body")
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		e := newError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, "the body is over the limit of %s", formatBytes(limit))
+		e.Details = map[string]any{"limit": limit}
+		return nil, "size", e
+	}
+	return body, "", nil
+}
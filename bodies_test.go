@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRequestBodies(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.MaxBodyBytes = 256
+		cfg.BulkBodyMaxBytes = 4096
+	})
+
+	pkg := `{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`
+	// Well under the limit gzipped, over it once decompressed.
+	bomb := `{"name": "app", "description": "` + strings.Repeat("a", 8192) + `", "dependencies": {"left-pad": "^1.0.0"}}`
+	valid := gzipped(t, pkg)
+
+	for _, tc := range []struct {
+		name     string
+		target   string
+		body     []byte
+		encoding string
+		status   int
+		code     string
+	}{
+		{"plain", "/api/normalize", []byte(pkg), "", http.StatusOK, ""},
+		{"gzipped", "/api/normalize", valid, "gzip", http.StatusOK, ""},
+		{"gzipped, in capitals", "/api/normalize", valid, " GZIP ", http.StatusOK, ""},
+		{"over the limit decompressed", "/api/normalize", gzipped(t, bomb), "gzip", http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"over the limit", "/api/normalize", []byte(bomb), "", http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{"truncated", "/api/normalize", valid[:len(valid)-12], "gzip", http.StatusBadRequest, codeBadRequest},
+		{"corrupt checksum", "/api/normalize", append(append([]byte{}, valid[:len(valid)-8]...), 0, 0, 0, 0, 0, 0, 0, 0), "gzip", http.StatusBadRequest, codeBadRequest},
+		{"not gzip", "/api/normalize", []byte(pkg), "gzip", http.StatusBadRequest, codeBadRequest},
+		{"other encoding", "/api/normalize", []byte(pkg), "br", http.StatusUnsupportedMediaType, codeUnsupportedEncoding},
+		{"gzipped, not a bulk route", "/api/batch", gzipped(t, `{"files": []}`), "gzip", http.StatusUnsupportedMediaType, codeUnsupportedEncoding},
+		{"over the limit, not a bulk route", "/api/batch", []byte(`{"files": ["` + strings.Repeat("a", 300) + `"]}`), "", http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+	} {
+		headers := []string{"Content-Type", "application/json"}
+		if tc.encoding != "" {
+			headers = append(headers, "Content-Encoding", tc.encoding)
+		}
+		res := s.request(http.MethodPost, tc.target, bytes.NewReader(tc.body), headers...)
+		body := responseBody(t, res, tc.status)
+		if tc.code == "" {
+			if !strings.Contains(body, `"left-pad"`) {
+				t.Errorf("%s: got %s", tc.name, body)
+			}
+			continue
+		}
+		var e struct {
+			Code  string
+			Limit int64
+		}
+		if err := json.Unmarshal([]byte(body), &e); err != nil || e.Code != tc.code {
+			t.Errorf("%s: code %q, %v; want %s", tc.name, e.Code, err, tc.code)
+		}
+		if want := map[string]int64{"/api/normalize": 4096, "/api/batch": 256}[tc.target]; tc.code == codeBodyTooLarge && e.Limit != want {
+			t.Errorf("%s: limit %d, want %d", tc.name, e.Limit, want)
+		}
+	}
+
+	// Refused bodies never got to the handler, which would have looked
+	// left-pad up.
+	hits := reg.hits("/left-pad")
+	res := s.request(http.MethodPost, "/api/normalize", bytes.NewReader(gzipped(t, bomb)), "Content-Encoding", "gzip")
+	responseBody(t, res, http.StatusRequestEntityTooLarge)
+	if reg.hits("/left-pad") != hits {
+		t.Errorf("a refused body was handled")
+	}
+
+	metrics := responseBody(t, s.get("/metrics"), 200)
+	for _, reason := range []string{"size", "invalid_gzip", "encoding"} {
+		if !strings.Contains(metrics, `repkg_request_bodies_rejected_total{reason="`+reason+`"}`) {
+			t.Errorf("no rejections counted for %s", reason)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/gin-gonic/gin"
+)
+
+// Files of cached versions are handed to esbuild in this namespace as
+// "name@version/path", so that every lookup goes through the manifests.
+const bundleNamespace = "repkg"
+
+// styleModule marks the stylesheets imported from JavaScript, which are
+// loaded as modules adding them to the document: a bundle is one file.
+// Those imported with { type: "css" } are sheetModule, loaded as modules
+// exporting a CSSStyleSheet as browsers would.
+const (
+	styleModule = "style"
+	sheetModule = "sheet"
+)
+
+// bundler builds one bundle, fetching the packages it imports through the
+// normal pipeline.
+type bundler struct {
+	opts     fetchOptions
+	external map[string]bool
+
+	mu       sync.Mutex
+	packages map[string]*ensuredPackage
+}
+
+// Derived artifacts are served at /packages/name@version/-/<artifact>.
+const derivedPrefix = "-/"
+
+// transformVersion identifies the output of the transforms built into this
+// binary. Bump it whenever a change alters the bytes of derived artifacts:
+// each version has its own directory, and artifacts left by an older one are
+// rebuilt when next asked for rather than served.
+const transformVersion = 3
+
+// derivedSpec is what an artifact was built from. It is stored next to the
+// artifact so that a newer release can rebuild it.
+type derivedSpec struct {
+	TransformVersion int      `json:"transformVersion"`
+	Kind             string   `json:"kind,omitempty"` // "" for bundles
+	File             string   `json:"file,omitempty"`
+	External         []string `json:"external,omitempty"`
+
+	Overrides map[string]string `json:"overrides,omitempty"`
+	// Env is "" for production, which bundles were built for before
+	// ?env=.
+	Env string `json:"env,omitempty"`
+}
+
+// derivedDir holds everything derived from a version.
+func derivedDir(t *tenant, packageName, version string) string {
+	return filepath.Join(t.dataDir(), internalDir, "derived", filepath.FromSlash(packageName), version)
+}
+
+// derivedPath is where an artifact computed from a version is cached.
+func derivedPath(t *tenant, packageName, version, name string) string {
+	return filepath.Join(derivedDir(t, packageName, version), "t"+strconv.Itoa(transformVersion), name)
+}
+
+// The spec of an artifact is a dot file, which serveDerived never serves.
+func derivedSpecName(name string) string {
+	return "." + name + ".json"
+}
+
+// derivedURL is the URL an artifact is served at. The transform version in
+// the query makes it safe to cache for good.
+func derivedURL(t *tenant, packageName, version, name string) string {
+	return packageURL(t, packageName, version, derivedPrefix+name) + "?tv=" + strconv.Itoa(transformVersion)
+}
+
+// Bundles built with ?override= are named apart from the others.
+const overridePrefix = "override-"
+
+// serveBundle answers ?bundle: the package entry (or file) as a single ESM
+// file with its dependencies inlined, except its peer dependencies and
+// those named in ?external=. The bundle is built once and then redirected
+// to, so its source map resolves next to it.
+func serveBundle(c *gin.Context, ep *ensuredPackage, file string, opts fetchOptions) {
+	m := ep.Manifest
+	if file == "" {
+		if err := securityHolderEntry(m); err != nil {
+			setResolveHeaders(c.Writer, ep)
+			writeError(c, err)
+			return
+		}
+	}
+
+	var external []string
+	for _, name := range strings.Split(c.Query("external"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			external = append(external, name)
+		}
+	}
+	// Peers are left for the page to provide, as one instance shared with
+	// the rest of it.
+	peers := readPackageJSON(versionDir(opts.Tenant, m.Name, m.Version), m).peers()
+	for _, p := range peers {
+		if !slices.Contains(external, p.Name) {
+			external = append(external, p.Name)
+		}
+	}
+	sort.Strings(external)
+
+	key := []string{m.Name, m.Version, file, strings.Join(external, ",")}
+	env := ""
+	if opts.Env == envDevelopment {
+		env = envDevelopment
+		key = append(key, "env="+env)
+	}
+	prefix := "bundle-"
+	if len(opts.Overrides) > 0 {
+		// Built for the one response, and never cached publicly.
+		overrides, _ := json.Marshal(opts.Overrides)
+		key = append(key, string(overrides))
+		prefix = overridePrefix
+	}
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	name := prefix + hex.EncodeToString(sum[:8]) + ".js"
+	spec := &derivedSpec{TransformVersion: transformVersion, File: file, External: external, Overrides: opts.Overrides, Env: env}
+	if err := buildDerived(m.Name, m.Version, name, spec, opts); err != nil {
+		writeError(c, err)
+		return
+	}
+
+	setResolveHeaders(c.Writer, ep)
+	if env == "" {
+		env = envProduction
+	}
+	c.Header("X-Repkg-Env", env)
+	setPeerHeader(c.Writer, peers, true)
+	setServerTiming(c.Writer, opts.Timing)
+	c.Redirect(http.StatusFound, withAccessKey(c, derivedURL(opts.Tenant, m.Name, m.Version, name)))
+}
+
+// buildDerived builds an artifact on the transform pool unless it exists
+// already. The spec is written last, once code and map are in place.
+func buildDerived(packageName, version, name string, spec *derivedSpec, opts fetchOptions) error {
+	if config.ReadOnly {
+		return notCached(packageName + "@" + version + "/" + derivedPrefix + name)
+	}
+	out := derivedPath(opts.Tenant, packageName, version, name)
+	if _, err := os.Stat(out); err == nil {
+		return nil
+	}
+	kind := spec.Kind
+	if kind == "" {
+		kind = "bundle"
+	}
+	return runTransform(out, kind, opts.Timing, func() error {
+		if _, err := os.Stat(out); err == nil {
+			// Built while this one waited.
+			return nil
+		}
+		return buildDerivedNow(packageName, version, name, out, spec, opts)
+	})
+}
+
+func buildDerivedNow(packageName, version, name, out string, spec *derivedSpec, opts fetchOptions) error {
+	opts.Overrides, opts.Env = spec.Overrides, spec.Env
+	if opts.Inputs == nil {
+		opts.Inputs = newBuildInputs(nil)
+	}
+	ts := opts.Timing.begin("transform")
+	ts.set("repkg.package", packageName)
+	ts.set("repkg.version", version)
+	ts.set("repkg.file", spec.File)
+	defer ts.finish()
+	if spec.Kind == derivedInlineCSS || spec.Kind == derivedModule {
+		build := buildInlineCSS
+		if spec.Kind == derivedModule {
+			build = buildModule
+		}
+		code, err := build(packageName, version, spec.File, opts)
+		if err != nil {
+			ts.fail(err)
+			return err
+		}
+		if err := writeDerived(out, code); err != nil {
+			return err
+		}
+	} else {
+		code, sourceMap, err := buildBundle(packageName, version, spec.File, spec.External, opts)
+		if err != nil {
+			ts.fail(err)
+			return err
+		}
+		if err := writeTransformed(opts.Tenant, out, code, sourceMap); err != nil {
+			return err
+		}
+	}
+	ts.finish()
+	if err := writeDerivedMeta(out, spec, opts.Inputs); err != nil {
+		return err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return writeDerived(filepath.Join(filepath.Dir(out), derivedSpecName(name)), data)
+}
+
+// rebuildDerived looks for an artifact (or its map) left by an older
+// transform version and rebuilds it with this one. It reports false when
+// there is nothing to rebuild.
+func rebuildDerived(packageName, version, name string, opts fetchOptions) (bool, error) {
+	artifact := strings.TrimSuffix(name, ".map")
+	specs, _ := filepath.Glob(filepath.Join(derivedDir(opts.Tenant, packageName, version), "*", derivedSpecName(artifact)))
+	for _, p := range specs {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var spec derivedSpec
+		if err := json.Unmarshal(data, &spec); err != nil || spec.TransformVersion == transformVersion {
+			continue
+		}
+
+		log.Printf("rebuilding %s@%s/%s%s from transform version %d", packageName, version, derivedPrefix, artifact, spec.TransformVersion)
+		spec.TransformVersion = transformVersion
+		if err := buildDerived(packageName, version, artifact, &spec, opts); err != nil {
+			return false, err
+		}
+		old := filepath.Dir(p)
+		for _, f := range []string{artifact, artifact + ".map", derivedMetaName(artifact), derivedSpecName(artifact)} {
+			os.Remove(filepath.Join(old, f))
+			index.removeFile(filepath.Join(old, f))
+		}
+		os.Remove(old) // once empty
+		return true, nil
+	}
+	return false, nil
+}
+
+// writeTransformed stores transformed code along with its source map
+// sidecar. The map is written first so the code is never served without
+// it.
+func writeTransformed(t *tenant, p string, code, sourceMap []byte) error {
+	code, sourceMap, err := linkSourceMap(t, code, sourceMap, filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	if err := writeDerived(p+".map", sourceMap); err != nil {
+		return err
+	}
+	return writeDerived(p, code)
+}
+
+// serveDerived serves an artifact built from a version, found below
+// derivedPrefix in the version's URL space. It reports false when there is
+// no such artifact.
+func serveDerived(c *gin.Context, packageName, version, name string) bool {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return false
+	}
+	p := derivedPath(tenantOf(c), packageName, version, name)
+	if _, err := os.Stat(p); err != nil {
+		ok, err := rebuildDerived(packageName, version, name, fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), FetchedBy: fetchedBy(c)})
+		if err != nil {
+			writeError(c, err)
+			return true
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	// Artifacts are only as immutable as the transforms that built them:
+	// URLs naming this transform version are cached for good, others are
+	// revalidated against the weak ETag so an upgrade is picked up. Those
+	// built with overrides are for the browser that asked only.
+	tv := strconv.Itoa(transformVersion)
+	scope := "public"
+	if strings.HasPrefix(name, overridePrefix) {
+		scope = "private"
+	}
+	if c.Query("tv") == tv {
+		c.Header("Cache-Control", scope+", max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", scope+", no-cache")
+	}
+	c.Header("ETag", `W/"t`+tv+"-"+name+`"`)
+	c.Header("Content-Type", contentType(name))
+	applyHeaderRules(c, packageName, derivedPrefix+name)
+	applyHeaderOverrides(c, packageName, derivedPrefix+name)
+	http.ServeFile(c.Writer, c.Request, p)
+	return true
+}
+
+func writeDerived(p string, data []byte) error {
+	err := makeParents(p, func() error {
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	index.setFileSize(p, int64(len(data)))
+	return nil
+}
+
+func buildBundle(packageName, version, file string, external []string, opts fetchOptions) (code, sourceMap []byte, err error) {
+	b := &bundler{opts: opts, external: map[string]bool{}, packages: map[string]*ensuredPackage{}}
+	for _, name := range external {
+		b.external[name] = true
+	}
+
+	entry := packageName + "@" + version
+	if file != "" {
+		entry += "/" + file
+	}
+	nodeEnv := opts.Env
+	if nodeEnv == "" {
+		nodeEnv = envProduction
+	}
+
+	options := api.BuildOptions{
+		EntryPoints: []string{entry},
+		Bundle:      true,
+		Write:       false,
+		Format:      api.FormatESModule,
+		Platform:    api.PlatformBrowser,
+		Target:      api.ES2020,
+		TreeShaking: api.TreeShakingTrue,
+		Outfile:     "bundle.js",
+		Sourcemap:   api.SourceMapExternal,
+		// Import attributes of imports left external are kept, however
+		// old the target: browsers refuse JSON and CSS modules without.
+		Supported: map[string]bool{"import-attributes": true},
+		Define:    map[string]string{"process.env.NODE_ENV": `"` + nodeEnv + `"`},
+		LogLevel:  api.LogLevelSilent,
+		Plugins: []api.Plugin{{
+			Name:  "repkg",
+			Setup: b.setup,
+		}},
+	}
+	opts.Inputs.build(options)
+	result := api.Build(options)
+
+	if len(result.Errors) > 0 {
+		diagnostics := make([]gin.H, 0, len(result.Errors))
+		for _, msg := range result.Errors {
+			d := gin.H{"text": msg.Text}
+			if msg.Location != nil {
+				d["file"], d["line"], d["column"] = msg.Location.File, msg.Location.Line, msg.Location.Column
+			}
+			diagnostics = append(diagnostics, d)
+		}
+		log.Printf("bundling %s: %s", entry, result.Errors[0].Text)
+		e := newError(http.StatusInternalServerError, codeBuildFailed, "bundling %s failed: %s", entry, result.Errors[0].Text)
+		e.Details = map[string]any{"diagnostics": diagnostics}
+		return nil, nil, e
+	}
+	for _, f := range result.OutputFiles {
+		if strings.HasSuffix(f.Path, ".map") {
+			sourceMap = f.Contents
+		} else {
+			code = f.Contents
+		}
+	}
+	return code, sourceMap, nil
+}
+
+func (b *bundler) setup(build api.PluginBuild) {
+	build.OnResolve(api.OnResolveOptions{Filter: ".*"}, b.resolveModule)
+	build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: bundleNamespace}, b.load)
+}
+
+// ensure fetches a package imported with rng, once per bundle.
+func (b *bundler) ensure(packageName, rng string) (*ensuredPackage, error) {
+	key := packageName + "@" + rng
+	b.mu.Lock()
+	ep, ok := b.packages[key]
+	b.mu.Unlock()
+	if ok {
+		return ep, nil
+	}
+
+	ep, err := ensurePackage(packageName, rng, b.opts)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.packages[key] = ep
+	b.mu.Unlock()
+	return ep, nil
+}
+
+// resolveModule is resolve, marking the stylesheets that JavaScript imports.
+func (b *bundler) resolveModule(args api.OnResolveArgs) (api.OnResolveResult, error) {
+	res, err := b.resolve(args)
+	if err == nil && res.Namespace == bundleNamespace && strings.EqualFold(path.Ext(res.Path), ".css") {
+		switch args.Kind {
+		case api.ResolveJSImportStatement, api.ResolveJSRequireCall, api.ResolveJSDynamicImport:
+			res.PluginData = styleModule
+			if args.With["type"] == "css" {
+				res.PluginData = sheetModule
+			}
+		}
+	}
+	return res, err
+}
+
+func (b *bundler) resolve(args api.OnResolveArgs) (api.OnResolveResult, error) {
+	spec := args.Path
+
+	if args.Kind == api.ResolveEntryPoint {
+		pkgDir, file := splitPackagePath(spec)
+		name, version := parsePkgDir(pkgDir)
+		res, err := b.resolvePackage(name, version, file)
+		if err != nil && file != "" {
+			// A file asked for by path rather than an exported subpath.
+			m, merr := loadManifest(versionDir(b.opts.Tenant, name, version), name, version)
+			if p, ok := resolveFile(m, file); merr == nil && ok {
+				return bundleFile(m, pkgDir, p), nil
+			}
+		}
+		return res, err
+	}
+
+	if strings.HasPrefix(spec, "./") || strings.HasPrefix(spec, "../") || spec == "." || spec == ".." {
+		if args.Namespace != bundleNamespace {
+			return api.OnResolveResult{}, fmt.Errorf("cannot resolve %s outside a package", spec)
+		}
+		pkgDir, rel := splitPackagePath(args.Importer)
+		name, version := parsePkgDir(pkgDir)
+		m, err := loadManifest(versionDir(b.opts.Tenant, name, version), name, version)
+		if err != nil {
+			return api.OnResolveResult{}, err
+		}
+		p, ok := resolveFile(m, path.Join(path.Dir(rel), spec))
+		if !ok || deny.denied(p) {
+			return api.OnResolveResult{}, fmt.Errorf("%s@%s has no file %s", name, version, path.Join(path.Dir(rel), spec))
+		}
+		return bundleFile(m, pkgDir, p), nil
+	}
+
+	if strings.HasPrefix(spec, "/") || strings.Contains(spec, ":") {
+		return api.OnResolveResult{Path: spec, External: true}, nil
+	}
+
+	// A bare specifier: "name", "name/sub", "@scope/name/sub".
+	n := 1
+	if strings.HasPrefix(spec, "@") {
+		n = 2
+	}
+	segs := strings.SplitN(spec, "/", n+1)
+	name := strings.Join(segs[:min(n, len(segs))], "/")
+	file := ""
+	if len(segs) > n {
+		file = segs[n]
+	}
+	if b.external[name] {
+		return api.OnResolveResult{Path: spec, External: true}, nil
+	}
+
+	rng := ""
+	if args.Namespace == bundleNamespace {
+		pkgDir, _ := splitPackagePath(args.Importer)
+		importer, version := parsePkgDir(pkgDir)
+		if importer == name {
+			// A package importing itself by name.
+			return b.resolvePackage(name, version, file)
+		}
+		dir := versionDir(b.opts.Tenant, importer, version)
+		if m, err := loadManifest(dir, importer, version); err == nil {
+			rng = readPackageJSON(dir, m).dependencyRange(name)
+		}
+	}
+	if unsupportedSpec(rng) != nil {
+		rng = ""
+	}
+	ep, err := b.ensure(name, rng)
+	if err != nil {
+		return api.OnResolveResult{}, err
+	}
+	return b.resolvePackage(name, ep.Manifest.Version, file)
+}
+
+// resolvePackage resolves an import of file ("" for the package itself) in
+// a version that has been fetched already.
+func (b *bundler) resolvePackage(name, version, file string) (api.OnResolveResult, error) {
+	dir := versionDir(b.opts.Tenant, name, version)
+	m, err := loadManifest(dir, name, version)
+	if err != nil {
+		return api.OnResolveResult{}, err
+	}
+
+	subpath := "."
+	if file != "" {
+		subpath = "./" + file
+	} else if err := securityHolderEntry(m); err != nil {
+		return api.OnResolveResult{}, err
+	}
+	p, err := resolveSubpath(dir, m, subpath, b.opts.Env)
+	if err != nil {
+		return api.OnResolveResult{}, err
+	}
+	// What resolved it.
+	if f, ok := m.Lookup("package.json"); ok {
+		b.opts.Inputs.read(m, f)
+	}
+	return bundleFile(m, name+"@"+version, p), nil
+}
+
+// bundleFile is the resolution of file p of a version, which esbuild may
+// drop when unused if its package.json says it has no side effects.
+func bundleFile(m *Manifest, pkgDir, p string) api.OnResolveResult {
+	res := api.OnResolveResult{Path: pkgDir + "/" + p, Namespace: bundleNamespace}
+	if m.Package != nil && !m.Package.SideEffects.has(p) {
+		res.SideEffects = api.SideEffectsFalse
+	}
+	return res
+}
+
+func (b *bundler) load(args api.OnLoadArgs) (api.OnLoadResult, error) {
+	pkgDir, rel := splitPackagePath(args.Path)
+	name, version := parsePkgDir(pkgDir)
+	dir := versionDir(b.opts.Tenant, name, version)
+	m, err := loadManifest(dir, name, version)
+	if err != nil {
+		return api.OnLoadResult{}, err
+	}
+	f, ok := m.Lookup(rel)
+	if !ok || deny.denied(rel) {
+		return api.OnLoadResult{}, fmt.Errorf("%s@%s has no file %s", name, version, rel)
+	}
+	data, err := readStoredFile(dir, f)
+	if err != nil {
+		return api.OnLoadResult{}, err
+	}
+	b.opts.Inputs.read(m, f)
+
+	contents := string(data)
+	if args.PluginData == sheetModule {
+		contents = cssModuleScript(contents)
+		return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+	}
+	if args.PluginData == styleModule {
+		css, _ := json.Marshal(contents)
+		contents = "if (typeof document !== \"undefined\") {\n" +
+			"  const style = document.createElement(\"style\");\n" +
+			"  style.textContent = " + string(css) + ";\n" +
+			"  document.head.appendChild(style);\n" +
+			"}\n"
+		return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+	}
+	return api.OnLoadResult{Contents: &contents, Loader: bundleLoader(rel)}, nil
+}
+
+func bundleLoader(p string) api.Loader {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".js", ".mjs", ".cjs":
+		return api.LoaderJS
+	case ".jsx":
+		return api.LoaderJSX
+	case ".ts", ".mts", ".cts":
+		return api.LoaderTS
+	case ".tsx":
+		return api.LoaderTSX
+	case ".json":
+		return api.LoaderJSON
+	case ".css":
+		return api.LoaderCSS
+	}
+	return api.LoaderDataURL
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBundleSideEffects(t *testing.T) {
+	ui := map[string]string{
+		"index.js": `import "./styles/button.css";
+import "./lib/polyfill.js";
+export { Button } from "./button.js";
+export { unused } from "./unused.js";`,
+		"button.js":         `export const Button = "a-button";`,
+		"styles/button.css": `.button { color: rebeccapurple; }`,
+		"lib/polyfill.js":   `globalThis.polyfilled = true;`,
+		"unused.js":         `console.log("unused module ran"); export const unused = 1;`,
+	}
+	reg := newFakeRegistry(t)
+	for _, v := range []struct{ version, sideEffects string }{
+		{"1.0.0", `["*.css", "./lib/polyfill.js"]`},
+		{"2.0.0", `false`},
+		{"3.0.0", ``},
+	} {
+		pkg := `{"name": "ui", "version": "` + v.version + `", "main": "index.js", "files": ["index.js", "button.js", "unused.js", "lib", "styles"]`
+		if v.sideEffects != "" {
+			pkg += `, "sideEffects": ` + v.sideEffects
+		}
+		reg.publish("ui", v.version, withFile(ui, "package.json", pkg+"}"))
+		reg.publish("app", v.version, map[string]string{
+			"package.json": `{"name": "app", "version": "` + v.version + `", "main": "index.js", "dependencies": {"ui": "` + v.version + `"}}`,
+			"index.js":     `import { Button } from "ui"; export default Button;`,
+		})
+	}
+	s := newTestServer(t, reg, nil)
+
+	for _, tc := range []struct {
+		version       string
+		kept, dropped []string
+	}{
+		// The stylesheet, matched in a subdirectory by "*.css", and the
+		// polyfill have side effects; the unused module goes.
+		{"1.0.0", []string{"a-button", "rebeccapurple", "polyfilled"}, []string{"unused module ran"}},
+		// Nothing has: a package that says so loses its imports for effect.
+		{"2.0.0", []string{"a-button"}, []string{"rebeccapurple", "polyfilled", "unused module ran"}},
+		// Without sideEffects, every module might have them.
+		{"3.0.0", []string{"a-button", "rebeccapurple", "polyfilled", "unused module ran"}, nil},
+	} {
+		code := responseBody(t, s.get(s.follow(s.get("/npm/app@"+tc.version+"?bundle"), 302)), 200)
+		for _, want := range tc.kept {
+			if !strings.Contains(code, want) {
+				t.Errorf("%s: %q was dropped:\n%s", tc.version, want, code)
+			}
+		}
+		for _, unwanted := range tc.dropped {
+			if strings.Contains(code, unwanted) {
+				t.Errorf("%s: %q was kept:\n%s", tc.version, unwanted, code)
+			}
+		}
+	}
+
+	var meta struct {
+		Package struct {
+			SideEffects any
+			Files       []string
+		}
+	}
+	if err := json.Unmarshal([]byte(responseBody(t, s.get("/api/meta/ui@1.0.0"), 200)), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if se, _ := json.Marshal(meta.Package.SideEffects); string(se) != `["*.css","./lib/polyfill.js"]` || len(meta.Package.Files) != 5 {
+		t.Errorf("package %+v", meta.Package)
+	}
+}
+
+// newReactRegistry publishes packages built as React is: a CommonJS entry
+// picking its build by process.env.NODE_ENV, and one, like its friends,
+// picking it by the development and production export conditions.
+func newReactRegistry(t *testing.T) *fakeRegistry {
+	reg := newFakeRegistry(t)
+	reg.publish("react", "18.2.0", map[string]string{
+		"package.json": `{"name": "react", "version": "18.2.0", "main": "index.js",
+			"exports": {".": {"react-server": "./react.shared-subset.js", "default": "./index.js"}, "./package.json": "./package.json", "./jsx-runtime": "./jsx-runtime.js"}}`,
+		"index.js": `'use strict';
+if (process.env.NODE_ENV === 'production') {
+  module.exports = require('./cjs/react.production.min.js');
+} else {
+  module.exports = require('./cjs/react.development.js');
+}`,
+		"jsx-runtime.js": `'use strict';
+if (process.env.NODE_ENV === 'production') {
+  module.exports = require('./cjs/react-jsx-runtime.production.min.js');
+} else {
+  module.exports = require('./cjs/react-jsx-runtime.development.js');
+}`,
+		"react.shared-subset.js":                  `export const build = "react server build";`,
+		"cjs/react.production.min.js":             `'use strict';exports.build="react production build";`,
+		"cjs/react-jsx-runtime.production.min.js": `'use strict';exports.jsx="jsx production build";`,
+		"cjs/react-jsx-runtime.development.js":    `'use strict';exports.jsx="jsx development build";`,
+		"cjs/react.development.js": `'use strict';
+if (process.env.NODE_ENV !== "production") {
+  (function() {
+    exports.build = "react development build";
+  })();
+}`,
+	})
+	reg.publish("store", "1.0.0", map[string]string{
+		"package.json": `{"name": "store", "version": "1.0.0", "type": "module",
+			"exports": {".": {"development": "./store.development.js", "production": "./store.production.js", "default": "./store.production.js"}}}`,
+		"store.development.js": `export const build = "store development build";`,
+		"store.production.js":  `export const build = "store production build";`,
+	})
+	reg.publish("app", "1.0.0", map[string]string{
+		"package.json": `{"name": "app", "version": "1.0.0", "main": "index.js", "dependencies": {"react": "^18.2.0", "store": "^1.0.0"}}`,
+		"index.js": `import React from "react";
+import { jsx } from "react/jsx-runtime";
+import { build } from "store";
+export default [React.build, jsx, build];`,
+	})
+	return reg
+}
+
+func TestBundleEnv(t *testing.T) {
+	s := newTestServer(t, newReactRegistry(t), nil)
+
+	bundles := map[string]string{}
+	for _, tc := range []struct {
+		query, env    string
+		kept, dropped []string
+	}{
+		{"", "production",
+			[]string{"react production build", "jsx production build", "store production build"},
+			[]string{"development build", "react server build"}},
+		{"&env=production", "production",
+			[]string{"react production build", "jsx production build", "store production build"},
+			[]string{"development build", "react server build"}},
+		{"&env=development", "development",
+			[]string{"react development build", "jsx development build", "store development build"},
+			[]string{"production build", "react server build"}},
+	} {
+		res := s.get("/npm/app@1.0.0?bundle" + tc.query)
+		if got := res.Header.Get("X-Repkg-Env"); got != tc.env {
+			t.Errorf("%q: X-Repkg-Env %q", tc.query, got)
+		}
+		loc := s.follow(res, 302)
+		code := responseBody(t, s.get(loc), 200)
+		for _, want := range tc.kept {
+			if !strings.Contains(code, want) {
+				t.Errorf("%q: %q was dropped:\n%s", tc.query, want, code)
+			}
+		}
+		for _, unwanted := range tc.dropped {
+			if strings.Contains(code, unwanted) {
+				t.Errorf("%q: %q was kept:\n%s", tc.query, unwanted, code)
+			}
+		}
+		if strings.Contains(code, "process.env.NODE_ENV") {
+			t.Errorf("%q: process.env.NODE_ENV wasn't defined:\n%s", tc.query, code)
+		}
+		bundles[tc.env] = bundles[tc.env] + " " + loc
+	}
+	// Production is the default, and development bundles are cached
+	// apart from it.
+	prod, dev := strings.Fields(bundles["production"]), strings.Fields(bundles["development"])
+	if len(prod) != 2 || prod[0] != prod[1] || len(dev) != 1 || dev[0] == prod[0] {
+		t.Errorf("bundles %q", bundles)
+	}
+}
+
+func TestEnvEntry(t *testing.T) {
+	s := newTestServer(t, newReactRegistry(t), nil)
+
+	for _, tc := range []struct{ pkg, query, env, entry string }{
+		{"store@1.0.0", "", "production", "store.production.js"},
+		{"store@1.0.0", "&env=production", "production", "store.production.js"},
+		{"store@1.0.0", "&env=development", "development", "store.development.js"},
+		// React picks its build at run time, from the one entry.
+		{"react@18.2.0", "", "production", "index.js"},
+		{"react@18.2.0", "&env=development", "development", "index.js"},
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			res := s.request(method, "/npm/"+tc.pkg+"?format=js"+tc.query, nil)
+			if got := res.Header.Get("X-Repkg-Env"); got != tc.env {
+				t.Errorf("%s %s%s: X-Repkg-Env %q", method, tc.pkg, tc.query, got)
+			}
+			if got := res.Header.Get("X-Resolved-Path"); got != tc.entry {
+				t.Errorf("%s %s%s: entry %q, want %q", method, tc.pkg, tc.query, got, tc.entry)
+			}
+			if method == "GET" {
+				if loc := s.follow(res, 302); !strings.HasSuffix(loc, "/"+tc.entry) {
+					t.Errorf("GET %s%s: redirected to %s", tc.pkg, tc.query, loc)
+				}
+			}
+		}
+	}
+
+	for _, target := range []string{"/npm/store@1.0.0?format=js&env=test", "/npm/app@1.0.0?bundle&env=Development"} {
+		res := s.get(target)
+		var e struct{ Code string }
+		if err := json.Unmarshal([]byte(responseBody(t, res, 400)), &e); err != nil || e.Code != codeBadRequest {
+			t.Errorf("%s: code %q, %v", target, e.Code, err)
+		}
+	}
+}
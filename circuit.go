@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An upstream host that answers 429 gets its circuit opened for as long as
+// its Retry-After asks, and one that fails config.CircuitFailures times in a
+// row within config.CircuitWindow (errors, timeouts, 5xx) for
+// config.CircuitCooldown. Requests to it then fail at once rather than hang
+// or add to the load, until a single probe request is let through and, if
+// it succeeds, closes the circuit again.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+const (
+	defaultRetryAfter = 30 * time.Second
+	maxRetryAfter     = 10 * time.Minute
+)
+
+var (
+	upstreamRateLimited = newCounter("repkg_upstream_rate_limited_total", "429 responses received from upstream hosts.")
+	upstreamShed        = newCounter("repkg_upstream_shed_total", "Upstream requests failed fast because the host's circuit was open.")
+	upstreamCircuit     = newGauge("repkg_upstream_circuit_state", "Circuit state per upstream host: 0 closed, 1 open, 2 half-open.")
+	circuitTransitions  = newCounter("repkg_upstream_circuit_transitions_total", "Circuit state changes per upstream host and new state.")
+)
+
+type circuit struct {
+	host string
+
+	mu     sync.Mutex
+	state  circuitState
+	until  time.Time
+	delay  time.Duration
+	reason string
+
+	failures     int
+	firstFailure time.Time
+}
+
+var (
+	circuitsMu sync.Mutex
+	circuits   = map[string]*circuit{}
+)
+
+func circuitFor(host string) *circuit {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	c, ok := circuits[host]
+	if !ok {
+		c = &circuit{host: host}
+		circuits[host] = c
+	}
+	return c
+}
+
+// errCircuitOpen is returned for requests to a host whose circuit is open.
+type errCircuitOpen struct {
+	Host   string
+	Until  time.Time
+	Reason string
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("%s is unavailable (%s) until %s", e.Host, e.Reason, e.Until.Format(time.RFC3339))
+}
+
+// allow reports whether a request may be sent. Once an open circuit's time
+// is up, the next request becomes the half-open probe and the others keep
+// failing until it completes.
+func (c *circuit) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.state == circuitClosed:
+		return nil
+	case c.state == circuitOpen && !time.Now().Before(c.until):
+		c.setState(circuitHalfOpen)
+		return nil
+	}
+	until := c.until
+	if c.state == circuitHalfOpen {
+		until = time.Now().Add(time.Second)
+	}
+	return &errCircuitOpen{Host: c.host, Until: until, Reason: c.reason}
+}
+
+func (c *circuit) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = 0
+	if c.state != circuitClosed {
+		c.delay, c.reason = 0, ""
+		c.setState(circuitClosed)
+	}
+}
+
+// failed records a request that failed. A failed probe opens the circuit
+// again for the same time as before; otherwise enough consecutive failures
+// within the window open it for the cooldown.
+func (c *circuit) failed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.state == circuitHalfOpen {
+		c.until = now.Add(c.delay)
+		c.setState(circuitOpen)
+		return
+	}
+	if config.CircuitFailures <= 0 || c.state != circuitClosed {
+		return
+	}
+
+	if c.failures == 0 || now.Sub(c.firstFailure) > config.CircuitWindow.Duration {
+		c.failures, c.firstFailure = 0, now
+	}
+	c.failures++
+	if c.failures >= config.CircuitFailures {
+		c.failures = 0
+		c.delay, c.reason = config.CircuitCooldown.Duration, "failing"
+		c.until = now.Add(c.delay)
+		c.setState(circuitOpen)
+	}
+}
+
+func (c *circuit) trip(d time.Duration, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay, c.reason = d, reason
+	c.until = time.Now().Add(d)
+	c.setState(circuitOpen)
+}
+
+func (c *circuit) setState(s circuitState) {
+	if s != c.state {
+		log.Printf("upstream: %s circuit %s -> %s", c.host, c.state, s)
+		circuitTransitions.Inc("host", c.host, "state", s.String())
+	}
+	c.state = s
+	upstreamCircuit.Set(float64(s), "host", c.host)
+}
+
+// circuitTransport applies the circuits to every upstream request.
+type circuitTransport struct {
+	base http.RoundTripper
+}
+
+var upstreamRoundTripper http.RoundTripper = &circuitTransport{base: upstreamTransport}
+
+func (t *circuitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := circuitFor(req.URL.Host)
+	if err := c.allow(); err != nil {
+		upstreamShed.Inc("host", c.host)
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		c.failed()
+		return nil, err
+	}
+	if res.StatusCode >= 500 {
+		c.failed()
+		return res, nil
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		res.Body.Close()
+		d := retryAfter(res.Header.Get("Retry-After"))
+		c.trip(d, "rate limited")
+		upstreamRateLimited.Inc("host", c.host)
+		return nil, &errCircuitOpen{Host: c.host, Until: time.Now().Add(d), Reason: "rate limited"}
+	}
+	c.succeeded()
+	return res, nil
+}
+
+// retryAfter reads a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(v string) time.Duration {
+	d := defaultRetryAfter
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+	return min(max(d, time.Second), maxRetryAfter)
+}
+
+type circuitStatus struct {
+	Host   string     `json:"host"`
+	State  string     `json:"state"`
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+func circuitStatuses() []circuitStatus {
+	circuitsMu.Lock()
+	list := make([]*circuit, 0, len(circuits))
+	for _, c := range circuits {
+		list = append(list, c)
+	}
+	circuitsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].host < list[j].host })
+
+	statuses := make([]circuitStatus, 0, len(list))
+	for _, c := range list {
+		c.mu.Lock()
+		s := circuitStatus{Host: c.host, State: c.state.String(), Reason: c.reason}
+		if c.state == circuitOpen {
+			until := c.until
+			s.Until = &until
+		}
+		c.mu.Unlock()
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// serveHealth reports "degraded" while any upstream circuit is not closed,
+// or a replica's index is behind; cached files are still served then, so
+// it answers 200 either way.
+func serveHealth(c *gin.Context) {
+	status := "ok"
+	statuses := circuitStatuses()
+	for _, s := range statuses {
+		if s.State != circuitClosed.String() {
+			status = "degraded"
+		}
+	}
+	body := gin.H{"status": status, "mode": "read-write", "upstreams": statuses}
+	if config.ReadOnly {
+		h, ok := replicaHealth()
+		body["mode"], body["index"] = "read-only", h
+		if !ok {
+			body["status"] = "degraded"
+		}
+	}
+	c.JSON(http.StatusOK, body)
+}
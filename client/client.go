@@ -0,0 +1,622 @@
+// Package client talks to a repkg server over its HTTP API.
+//
+//	c := client.New("http://localhost:8001", client.WithToken(os.Getenv("REPKG_ADMIN_TOKEN")))
+//	job, err := c.Prefetch(ctx, "react@18.2.0", "react-dom@^18")
+//	if err == nil {
+//		job, err = c.WaitPrefetch(ctx, job.ID, time.Second)
+//	}
+//	version, err := c.ResolveVersion(ctx, "react", "latest")
+//	f, err := c.GetFile(ctx, "react", version, "index.js")
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes the server reports, as in Error.Code.
+const (
+	CodeNotFound            = "not_found"
+	CodeBadRequest          = "bad_request"
+	CodeUpstream            = "upstream_error"
+	CodeInternal            = "internal_error"
+	CodeVersionNotFound     = "version_not_found"
+	CodeIntegrity           = "integrity_mismatch"
+	CodeSignatureMissing    = "signature_missing"
+	CodeSignatureInvalid    = "signature_invalid"
+	CodeNotAllowed          = "package_not_allowed"
+	CodeUnsupportedSpec     = "unsupported_specifier"
+	CodeTooLarge            = "package_too_large"
+	CodeBatchTooLarge       = "batch_too_large"
+	CodeBuildFailed         = "build_failed"
+	CodeWithdrawn           = "version_withdrawn"
+	CodeUnauthorized        = "unauthorized"
+	CodeDiffTooLarge        = "diff_too_large"
+	CodeQuotaExceeded       = "quota_exceeded"
+	CodeURITooLong          = "uri_too_long"
+	CodeCorrupt             = "version_corrupt"
+	CodeVerifyRunning       = "verification_running"
+	CodeNotCached           = "not_cached"
+	CodeReadOnly            = "read_only"
+	CodeStarting            = "starting"
+	CodeStopping            = "stopping"
+	CodeExtractFailed       = "extraction_failed"
+	CodeApprovalRequired    = "approval_required"
+	CodeSecurityHolder      = "security_holder"
+	CodeTransformsBusy      = "transforms_busy"
+	CodeBodyTooLarge        = "body_too_large"
+	CodeUnsupportedEncoding = "unsupported_encoding"
+	CodeAddressNotAllowed   = "address_not_allowed"
+	CodeTampered            = "version_tampered"
+
+	CodeUpstreamForbidden   = "upstream_forbidden"
+	CodeUpstreamDNS         = "upstream_dns_error"
+	CodeUpstreamUnreachable = "upstream_unreachable"
+	CodeUpstreamUnavailable = "upstream_unavailable"
+	CodeUpstreamAuth        = "upstream_auth_failed"
+	CodeUpstreamContent     = "upstream_wrong_content"
+)
+
+// Error is an error response of the server.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	// Details holds the other fields of the response, such as "limit" or
+	// "suggestions".
+	Details map[string]any
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("repkg: %d %s", e.Status, e.Code)
+	}
+	return fmt.Sprintf("repkg: %s (%s)", e.Message, e.Code)
+}
+
+// IsCode reports whether err is an Error with the given code.
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// Client calls one repkg server. Its methods are safe for concurrent use.
+type Client struct {
+	base   string
+	token  string
+	apiKey string
+	tenant string
+	http   *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken sends the admin token, which Purge needs and which lifts the
+// server's package size limits.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTenant makes requests below /t/<name>/, sending the tenant's API key
+// when it has one.
+func WithTenant(name, apiKey string) Option {
+	return func(c *Client) { c.tenant, c.apiKey = name, apiKey }
+}
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// New returns a client for the server at baseURL, such as
+// "http://localhost:8001".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{base: strings.TrimSuffix(baseURL, "/"), http: http.DefaultClient}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Manifest describes a cached version and its files.
+type Manifest struct {
+	Name              string             `json:"name"`
+	Version           string             `json:"version"`
+	Deprecated        string             `json:"deprecated,omitempty"`
+	TarballSize       int64              `json:"tarballSize,omitempty"`
+	UnpackedSize      int64              `json:"unpackedSize"`
+	Upstream          string             `json:"upstream,omitempty"`
+	Origin            *Origin            `json:"origin,omitempty"`
+	Registry          string             `json:"registry,omitempty"`
+	Verified          string             `json:"verified,omitempty"`
+	IntegrityMismatch *IntegrityMismatch `json:"integrityMismatch,omitempty"`
+	Extracted         time.Time          `json:"extracted"`
+	Publisher         *User              `json:"publisher,omitempty"`
+	Maintainers       []User             `json:"maintainers,omitempty"`
+	Provenance        *Provenance        `json:"provenance,omitempty"`
+	Package           *Essentials        `json:"package,omitempty"`
+	Files             []File             `json:"files"`
+	Warnings          []string           `json:"warnings,omitempty"`
+	Pinned            bool               `json:"pinned,omitempty"`
+	Withdrawn         *Withdrawal        `json:"withdrawn,omitempty"`
+	SecurityHolder    bool               `json:"securityHolder,omitempty"`
+	FetchedBy         *FetchedBy         `json:"fetchedBy,omitempty"`
+
+	// Peers is only filled in by GetMetadata.
+	Peers []Peer `json:"peers,omitempty"`
+}
+
+// Peer is a peer dependency of a version. Bundled ones are also regular
+// dependencies of it.
+type Peer struct {
+	Name     string `json:"name"`
+	Range    string `json:"range"`
+	Optional bool   `json:"optional,omitempty"`
+	Bundled  bool   `json:"bundled,omitempty"`
+}
+
+// Origin is what a version's tarball was downloaded with: the registry's
+// validators and Date as it sent them, the integrity the packument
+// published and the sha512 of the tarball.
+type Origin struct {
+	ETag              string `json:"etag,omitempty"`
+	LastModified      string `json:"lastModified,omitempty"`
+	Date              string `json:"date,omitempty"`
+	ExpectedIntegrity string `json:"expectedIntegrity,omitempty"`
+	Integrity         string `json:"integrity,omitempty"`
+}
+
+// FetchedBy is when a version was first cached and what asked for it:
+// Source is "request", "prefetch-job:<id>" or "warm-start". IP and
+// UserAgent are only reported to admins.
+type FetchedBy struct {
+	At        time.Time `json:"at"`
+	Source    string    `json:"source,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// IntegrityMismatch tells of a version cached although its tarball didn't
+// match its published integrity, under the server's warn policy.
+type IntegrityMismatch struct {
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Registry string    `json:"registry,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// User is a publisher or maintainer of a version.
+type User struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// Provenance is where a version's attestations are, with how checking them
+// went when the server verifies provenance.
+type Provenance struct {
+	URL           string `json:"url"`
+	PredicateType string `json:"predicateType,omitempty"`
+	Check         *struct {
+		Status    string    `json:"status"` // verified, signed, failed or error
+		Error     string    `json:"error,omitempty"`
+		Identity  string    `json:"identity,omitempty"`
+		CheckedAt time.Time `json:"checkedAt"`
+	} `json:"check,omitempty"`
+}
+
+// Essentials are the entry points and license from a version's
+// package.json.
+type Essentials struct {
+	Main    string `json:"main,omitempty"`
+	Module  string `json:"module,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Browser string `json:"browser,omitempty"`
+	Types   string `json:"types,omitempty"`
+	Exports bool   `json:"exports,omitempty"`
+	License string `json:"license,omitempty"`
+}
+
+// File is a file of a cached version.
+type File struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+	Integrity   string `json:"integrity,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	// ModuleType is "esm" or "cjs" for JavaScript files.
+	ModuleType string `json:"moduleType,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+
+	// HashedURL is only filled in by GetMetadata.
+	HashedURL string `json:"hashedUrl,omitempty"`
+}
+
+// Withdrawal tells why a version was withdrawn upstream.
+type Withdrawal struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// Package is a cached version as listed by ListPackages.
+type Package struct {
+	Tenant         string     `json:"tenant,omitempty"`
+	Name           string     `json:"name"`
+	Version        string     `json:"version"`
+	Size           int64      `json:"size"`
+	TarballSize    int64      `json:"tarballSize,omitempty"`
+	UnpackedSize   int64      `json:"unpackedSize"`
+	Files          int        `json:"files"`
+	CachedAt       time.Time  `json:"cachedAt"`
+	Pinned         bool       `json:"pinned,omitempty"`
+	Withdrawn      bool       `json:"withdrawn,omitempty"`
+	SecurityHolder bool       `json:"securityHolder,omitempty"`
+	Registry       string     `json:"registry,omitempty"`
+	FetchedBy      *FetchedBy `json:"fetchedBy,omitempty"`
+	Requests24h    int        `json:"requests24h"`
+	Requests7d     int        `json:"requests7d"`
+	LastRequested  *time.Time `json:"lastRequested,omitempty"`
+}
+
+// Values of PrefetchJob.Status.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// PrefetchJob is the state of a prefetch.
+type PrefetchJob struct {
+	ID       string         `json:"id"`
+	Status   string         `json:"status"`
+	Created  time.Time      `json:"created"`
+	Finished time.Time      `json:"finished"`
+	Total    int            `json:"total"`
+	Done     int            `json:"done"`
+	Failed   int            `json:"failed"`
+	Warnings int            `json:"warnings"`
+	Items    []PrefetchItem `json:"items"`
+}
+
+// PrefetchItem is one package of a prefetch. Version is set once it is
+// cached, Code and Error when it failed.
+type PrefetchItem struct {
+	Package string `json:"package"`
+	Spec    string `json:"spec,omitempty"`
+	Version string `json:"version,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// Optional items failing count as Warnings, not Failed.
+	Optional bool `json:"optional,omitempty"`
+}
+
+// ResolveVersion asks the server which version spec (a version, tag or
+// range; "" for latest) of a package refers to, without downloading it.
+func (c *Client) ResolveVersion(ctx context.Context, name, spec string) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, "/npm/"+packagePath(name, spec, "")+"?resolve=remote", nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	// Versions that aren't cached are reported as a 404 miss, still with
+	// the version they resolve to.
+	if v := resp.Header.Get("X-Resolved-Version"); v != "" {
+		return v, nil
+	}
+	return "", responseError(resp)
+}
+
+// GetMetadata returns the manifest of the version spec refers to, fetching
+// it into the cache if needed.
+func (c *Client) GetMetadata(ctx context.Context, name, spec string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := c.getJSON(ctx, "/api/meta/"+packagePath(name, spec, ""), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetFile streams a file of the version spec refers to, fetching it into
+// the cache if needed. The caller must close it.
+func (c *Client) GetFile(ctx context.Context, name, spec, file string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/npm/"+packagePath(name, spec, file), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Prefetch starts caching packages ("name@spec") in the background. Follow
+// the job with PrefetchStatus or WaitPrefetch.
+func (c *Client) Prefetch(ctx context.Context, packages ...string) (*PrefetchJob, error) {
+	job := &PrefetchJob{}
+	if err := c.postJSON(ctx, "/api/prefetch", map[string]any{"packages": packages}, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// PrefetchStatus returns the current state of a prefetch job.
+func (c *Client) PrefetchStatus(ctx context.Context, id string) (*PrefetchJob, error) {
+	job := &PrefetchJob{}
+	if err := c.getJSON(ctx, "/api/prefetch/"+url.PathEscape(id), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// WaitPrefetch polls a prefetch job every interval until it is done or ctx
+// ends.
+func (c *Client) WaitPrefetch(ctx context.Context, id string, interval time.Duration) (*PrefetchJob, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.PrefetchStatus(ctx, id)
+		if err != nil || job.Status == JobDone {
+			return job, err
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListPackages lists every cached version with its request counts, by
+// name and then version, fetching one page after another.
+func (c *Client) ListPackages(ctx context.Context) ([]Package, error) {
+	var list []Package
+	cursor := ""
+	for {
+		page, err := c.ListPackagesPage(ctx, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, page.Packages...)
+		if page.NextCursor == "" {
+			return list, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// PackagePage is a page of ListPackagesPage.
+type PackagePage struct {
+	Packages []Package `json:"packages"`
+	Total    int       `json:"total"`
+
+	// NextCursor fetches the next page; it is "" on the last one.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListPackagesPage lists up to limit cached versions (0 for the server's
+// maximum) after cursor, "" for the first page.
+func (c *Client) ListPackagesPage(ctx context.Context, cursor string, limit int) (*PackagePage, error) {
+	q := url.Values{}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	p := "/api/packages"
+	if len(q) > 0 {
+		p += "?" + q.Encode()
+	}
+	page := &PackagePage{}
+	if err := c.getJSON(ctx, p, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Purge removes a cached version, or every cached version of the package
+// when version is "", and returns the versions removed. It needs the admin
+// token.
+func (c *Client) Purge(ctx context.Context, name, version string) ([]string, error) {
+	var body struct {
+		Purged []string `json:"purged"`
+	}
+	if err := c.postJSON(ctx, "/api/admin/purge", map[string]string{"package": name, "version": version}, &body); err != nil {
+		return nil, err
+	}
+	return body.Purged, nil
+}
+
+// SigningKey is a public key the server signs files with, or did until
+// Until.
+type SigningKey struct {
+	KeyID     string     `json:"keyId"`
+	Algorithm string     `json:"algorithm"` // ed25519
+	PublicKey string     `json:"publicKey"` // base64
+	Current   bool       `json:"current,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// SigningKeys returns the keys that VerifySignature checks the server's
+// files with. Fetch them over a connection you trust, or pin them.
+func (c *Client) SigningKeys(ctx context.Context) ([]SigningKey, error) {
+	var body struct {
+		Keys []SigningKey `json:"keys"`
+	}
+	if err := c.getJSON(ctx, "/api/signing-key", &body); err != nil {
+		return nil, err
+	}
+	return body.Keys, nil
+}
+
+// ErrUnsigned is returned by VerifySignature for responses without an
+// X-Repkg-Signature header.
+var ErrUnsigned = errors.New("client: response is not signed")
+
+// VerifySignature checks the X-Repkg-Signature header of a file served by a
+// repkg server against keys, and that body, the file's content (decoded,
+// when it was sent with Content-Encoding), is the one signed. It returns
+// the file the signature is for, as name@version/path with the path's
+// segments percent-encoded, for the caller to check it is the one asked
+// for.
+func VerifySignature(keys []SigningKey, header http.Header, body []byte) (string, error) {
+	v := header.Get("X-Repkg-Signature")
+	if v == "" {
+		return "", ErrUnsigned
+	}
+	params := map[string]string{}
+	for _, p := range strings.Split(v, ";") {
+		k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+		params[k] = val
+	}
+	file, hash := params["file"], params["sha256"]
+	sum := sha256.Sum256(body)
+	if hash != hex.EncodeToString(sum[:]) {
+		return "", fmt.Errorf("client: %s: the body isn't the one signed", file)
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["sig"])
+	if err != nil {
+		return "", fmt.Errorf("client: invalid signature: %w", err)
+	}
+	for _, k := range keys {
+		if k.KeyID != params["keyid"] || k.Algorithm != "ed25519" {
+			continue
+		}
+		pub, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("client: key %s is invalid", k.KeyID)
+		}
+		if !ed25519.Verify(pub, []byte("repkg-signature-v1\n"+file+"\n"+hash), sig) {
+			return "", fmt.Errorf("client: %s: invalid signature", file)
+		}
+		return file, nil
+	}
+	return "", fmt.Errorf("client: %s is signed with key %q, which isn't among the keys", file, params["keyid"])
+}
+
+// packagePath renders name/spec/file for /npm and /api/meta URLs, which
+// the server takes whichever pathStyles it has. A file without a spec is
+// of latest: name/file would take the file for one.
+func packagePath(name, spec, file string) string {
+	if spec == "" && file != "" {
+		spec = "latest"
+	}
+	p := escapeSegments(name)
+	if spec != "" {
+		p += "/" + url.PathEscape(spec)
+	}
+	if file != "" {
+		p += "/" + escapeSegments(strings.TrimPrefix(file, "/"))
+	}
+	return p
+}
+
+func escapeSegments(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+func (c *Client) do(ctx context.Context, method, p string, body io.Reader) (*http.Response, error) {
+	prefix := ""
+	if c.tenant != "" {
+		prefix = "/t/" + url.PathEscape(c.tenant)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+prefix+p, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-Api-Key", c.apiKey)
+	}
+	return c.http.Do(req)
+}
+
+func (c *Client) getJSON(ctx context.Context, p string, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, v)
+}
+
+func (c *Client) postJSON(ctx context.Context, p string, in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, p, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, out)
+}
+
+func decodeResponse(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError reads the server's {"code", "error", ...} body, when there
+// is one.
+func responseError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+	var body map[string]any
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body) == nil {
+		e.Code, _ = body["code"].(string)
+		e.Message, _ = body["error"].(string)
+		delete(body, "code")
+		delete(body, "error")
+		e.Details = body
+	}
+	if e.Code == "" {
+		e.Code = statusCode(resp.StatusCode)
+	}
+	return e
+}
+
+// statusCode guesses the code of a response without a body, such as one to
+// HEAD.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeNotAllowed
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusServiceUnavailable:
+		return CodeUpstreamUnavailable
+	}
+	return CodeInternal
+}
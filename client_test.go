@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/odoe/repkg-go/client"
+)
+
+// The client is tested against the real handlers, so the two can't drift.
+
+func newClientServer(t *testing.T) (*testServer, *fakeRegistry) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "1.0"})
+	reg.publish("left-pad", "1.1.0", map[string]string{"index.js": "1.1"})
+	reg.publish("@scope/pkg", "2.0.0", map[string]string{
+		"package.json": `{"name": "@scope/pkg", "version": "2.0.0", "main": "lib/main.js", "peerDependencies": {"react": "^18"}}`,
+		"lib/main.js":  "scoped",
+	})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AdminToken = "admin"
+	})
+	return s, reg
+}
+
+func TestClientQueries(t *testing.T) {
+	s, reg := newClientServer(t)
+	ctx := context.Background()
+	c := client.New(s.URL + "/")
+
+	// Resolving doesn't fetch.
+	if v, err := c.ResolveVersion(ctx, "left-pad", "latest"); err != nil || v != "1.1.0" {
+		t.Errorf("ResolveVersion(latest) = %q, %v", v, err)
+	}
+	if v, err := c.ResolveVersion(ctx, "left-pad", "~1.0.0"); err != nil || v != "1.0.0" {
+		t.Errorf("ResolveVersion(~1.0.0) = %q, %v", v, err)
+	}
+	if reg.hits(tarballPath("left-pad", "1.1.0")) != 0 {
+		t.Errorf("ResolveVersion downloaded the version")
+	}
+	if _, err := c.ResolveVersion(ctx, "no-such-package", ""); !client.IsCode(err, client.CodeNotFound) {
+		t.Errorf("ResolveVersion of a missing package: %v", err)
+	}
+
+	m, err := c.GetMetadata(ctx, "@scope/pkg", "^2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "@scope/pkg" || m.Version != "2.0.0" || len(m.Files) != 2 || m.Package == nil || m.Package.Main != "lib/main.js" {
+		t.Errorf("GetMetadata = %+v", m)
+	}
+	if len(m.Peers) != 1 || m.Peers[0].Name != "react" || m.Peers[0].Range != "^18" {
+		t.Errorf("peers %+v", m.Peers)
+	}
+	for _, f := range m.Files {
+		if !strings.HasPrefix(f.HashedURL, "/hash/"+f.SHA256+"/") {
+			t.Errorf("%s: hashed URL %q", f.Path, f.HashedURL)
+		}
+	}
+	if _, err := c.GetMetadata(ctx, "left-pad", "9.9.9"); !client.IsCode(err, client.CodeVersionNotFound) {
+		t.Errorf("GetMetadata of a missing version: %v", err)
+	}
+
+	for _, tc := range []struct{ name, spec, file, want string }{
+		{"left-pad", "1.0.0", "index.js", "1.0"},
+		{"left-pad", "", "index.js", "1.1"},
+		{"@scope/pkg", "2.0.0", "lib/main.js", "scoped"},
+	} {
+		f, err := c.GetFile(ctx, tc.name, tc.spec, tc.file)
+		if err != nil {
+			t.Errorf("GetFile(%s, %s, %s): %v", tc.name, tc.spec, tc.file, err)
+			continue
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != tc.want {
+			t.Errorf("GetFile(%s, %s, %s) = %q, %v", tc.name, tc.spec, tc.file, data, err)
+		}
+	}
+	_, err = c.GetFile(ctx, "left-pad", "1.0.0", "no-such-file.js")
+	var e *client.Error
+	if !client.IsCode(err, client.CodeNotFound) || !errors.As(err, &e) || e.Status != 404 || e.Details["suggestions"] == nil {
+		t.Errorf("GetFile of a missing file: %#v", err)
+	}
+}
+
+func TestClientPrefetchAndPurge(t *testing.T) {
+	s, _ := newClientServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.New(s.URL)
+	admin := client.New(s.URL, client.WithToken("admin"))
+
+	job, err := c.Prefetch(ctx, "left-pad@1.0.0", "left-pad@^1", "@scope/pkg@2", "no-such-package@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = c.WaitPrefetch(ctx, job.ID, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != client.JobDone || job.Total != 4 || job.Done != 4 || job.Failed != 1 {
+		t.Errorf("job %+v", job)
+	}
+	versions := map[string]string{}
+	for _, item := range job.Items {
+		versions[item.Package+"@"+item.Spec] = item.Version + item.Code
+	}
+	want := map[string]string{"left-pad@1.0.0": "1.0.0", "left-pad@^1": "1.1.0", "@scope/pkg@2": "2.0.0", "no-such-package@1": client.CodeNotFound}
+	for k, v := range want {
+		if versions[k] != v {
+			t.Errorf("%s: %q, want %q", k, versions[k], v)
+		}
+	}
+
+	list, err := c.ListPackages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := packageKeys(list); got != "@scope/pkg@2.0.0 left-pad@1.0.0 left-pad@1.1.0" {
+		t.Errorf("ListPackages = %s", got)
+	}
+	page, err := c.ListPackagesPage(ctx, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Packages) != 2 || page.Total != 3 || page.NextCursor == "" {
+		t.Errorf("first page %+v", page)
+	}
+	if page, err = c.ListPackagesPage(ctx, page.NextCursor, 2); err != nil || packageKeys(page.Packages) != "left-pad@1.1.0" || page.NextCursor != "" {
+		t.Errorf("second page %+v, %v", page, err)
+	}
+
+	if _, err := c.Purge(ctx, "left-pad", ""); !client.IsCode(err, client.CodeUnauthorized) {
+		t.Errorf("Purge without the token: %v", err)
+	}
+	purged, err := admin.Purge(ctx, "left-pad", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(purged)
+	if strings.Join(purged, " ") != "1.0.0 1.1.0" {
+		t.Errorf("Purge = %v", purged)
+	}
+	if list, err = c.ListPackages(ctx); err != nil || packageKeys(list) != "@scope/pkg@2.0.0" {
+		t.Errorf("after purging, ListPackages = %s, %v", packageKeys(list), err)
+	}
+}
+
+func packageKeys(list []client.Package) string {
+	keys := make([]string, len(list))
+	for i, p := range list {
+		keys[i] = p.Name + "@" + p.Version
+	}
+	return strings.Join(keys, " ")
+}
+
+// TestClientErrorCodes checks that the client knows every code the server
+// sends.
+func TestClientErrorCodes(t *testing.T) {
+	server := constantValues(t, "errors.go", "code")
+	known := constantValues(t, filepath.Join("client", "client.go"), "Code")
+	for v, name := range server {
+		if _, ok := known[v]; !ok {
+			t.Errorf("%s (%q) has no constant in the client", name, v)
+		}
+	}
+}
+
+// constantValues returns the names of the string constants of a file that
+// start with prefix, by value.
+func constantValues(t *testing.T, file, prefix string) map[string]string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, name := range vs.Names {
+				if i >= len(vs.Values) || !strings.HasPrefix(name.Name, prefix) {
+					continue
+				}
+				lit, ok := vs.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				v, _ := strconv.Unquote(lit.Value)
+				values[v] = name.Name
+			}
+		}
+	}
+	return values
+}
+
+// TestClientRoutes checks that every method of the client only makes
+// requests that GET /api advertises.
+func TestClientRoutes(t *testing.T) {
+	s, _ := newClientServer(t)
+	var mu sync.Mutex
+	var requests []string
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	})
+
+	var catalogue struct {
+		BasePath string
+		Routes   []struct{ Method, Path string }
+	}
+	if err := json.Unmarshal([]byte(responseBody(t, s.get("/api"), 200)), &catalogue); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.New(s.URL, client.WithToken("admin"))
+	calls := map[string]func() error{
+		"ResolveVersion": func() error { _, err := c.ResolveVersion(ctx, "@scope/pkg", "^2"); return err },
+		"GetMetadata":    func() error { _, err := c.GetMetadata(ctx, "@scope/pkg", "2.0.0"); return err },
+		"GetFile": func() error {
+			f, err := c.GetFile(ctx, "@scope/pkg", "2.0.0", "lib/main.js")
+			if err == nil {
+				f.Close()
+			}
+			return err
+		},
+		"Prefetch":       func() error { _, err := c.Prefetch(ctx, "left-pad@1.0.0"); return err },
+		"PrefetchStatus": func() error { _, err := c.PrefetchStatus(ctx, "no-such-job"); return err },
+		"WaitPrefetch": func() error {
+			job, err := c.Prefetch(ctx, "left-pad@1.1.0")
+			if err == nil {
+				_, err = c.WaitPrefetch(ctx, job.ID, 10*time.Millisecond)
+			}
+			return err
+		},
+		"ListPackages":     func() error { _, err := c.ListPackages(ctx); return err },
+		"ListPackagesPage": func() error { _, err := c.ListPackagesPage(ctx, "", 1); return err },
+		"Purge":            func() error { _, err := c.Purge(ctx, "left-pad", "1.0.0"); return err },
+		"SigningKeys":      func() error { _, err := c.SigningKeys(ctx); return err },
+	}
+
+	typ := reflect.TypeOf(c)
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		call, ok := calls[name]
+		if !ok {
+			t.Errorf("Client.%s isn't called here", name)
+			continue
+		}
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+		err := call()
+		mu.Lock()
+		made := requests
+		mu.Unlock()
+		if len(made) == 0 {
+			t.Errorf("Client.%s made no requests: %v", name, err)
+		}
+		for _, r := range made {
+			method, p, _ := strings.Cut(r, " ")
+			advertised := false
+			for _, route := range catalogue.Routes {
+				if route.Method == method && matchRoute(catalogue.BasePath+route.Path, p) {
+					advertised = true
+					break
+				}
+			}
+			if !advertised {
+				t.Errorf("Client.%s: %s isn't an advertised route", name, r)
+			}
+		}
+	}
+}
+
+// matchRoute reports whether p matches a route pattern, with gin's :param
+// and *wildcard segments.
+func matchRoute(pattern, p string) bool {
+	want := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	got := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, seg := range want {
+		if strings.HasPrefix(seg, "*") {
+			return true
+		}
+		if i >= len(got) || (got[i] != seg && !(strings.HasPrefix(seg, ":") && got[i] != "")) {
+			return false
+		}
+	}
+	return len(got) == len(want)
+}
@@ -0,0 +1,818 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Addr     string `json:"addr"`
+	Registry string `json:"registry"`
+	DataDir  string `json:"dataDir"`
+
+	// FallbackRegistry is used for packuments and tarballs while the
+	// registry's circuit is open.
+	FallbackRegistry string `json:"fallbackRegistry"`
+
+	// Denylist holds path patterns that are never extracted or served.
+	// Leave it empty to use defaultDenylist.
+	Denylist        []string `json:"denylist"`
+	DisableDenylist bool     `json:"disableDenylist"`
+
+	// DisableHTML turns off generated HTML (package pages, directory
+	// listings, error pages); JSON is returned instead.
+	DisableHTML bool `json:"disableHTML"`
+
+	// PathStyles lists the URL styles of other CDNs served like
+	// /npm/<name>/<version>/<file>: "jsdelivr" for
+	// /npm/<name>@<version>/<file>, as on cdn.jsdelivr.net, and "unpkg" for
+	// /<name>@<version>/<file>, as on unpkg.com.
+	PathStyles []string `json:"pathStyles"`
+
+	// CaseInsensitiveFallback redirects requests whose path only differs
+	// in case from a packaged file to the file's canonical casing.
+	CaseInsensitiveFallback bool `json:"caseInsensitiveFallback"`
+
+	// SkipDeprecated makes tag and range resolution prefer the newest
+	// matching version that is not deprecated.
+	SkipDeprecated bool `json:"skipDeprecated"`
+	// SecurityHolders is what requests for the entry point of npm's
+	// security holding packages get: "block" (a 404 saying why) or
+	// "serve" (the entry point, as for any version).
+	SecurityHolders string `json:"securityHolders"`
+
+	// IntegrityPolicy is what becomes of tarballs that don't match their
+	// published integrity: "reject" them, "warn" (cache and serve them,
+	// recording the mismatch) or "ignore" it. IntegrityPolicyRegistries
+	// overrides it for the tarballs of a registry, by its URL, and
+	// IntegrityPolicyScopes for scopes ("@org").
+	IntegrityPolicy           string            `json:"integrityPolicy"`
+	IntegrityPolicyRegistries map[string]string `json:"integrityPolicyRegistries"`
+	IntegrityPolicyScopes     map[string]string `json:"integrityPolicyScopes"`
+
+	// Signatures controls verification of the registry's ECDSA package
+	// signatures: "off", "warn" or "require".
+	Signatures       string   `json:"signatures"`
+	SignatureKeysTTL duration `json:"signatureKeysTTL"`
+
+	// VerifyProvenance checks the Sigstore provenance of the versions that
+	// have one as they are fetched, recording how it went in the manifest
+	// without refusing any. ProvenanceRoots is a PEM file of the Fulcio
+	// certificates the signing certificates must chain to.
+	VerifyProvenance bool   `json:"verifyProvenance"`
+	ProvenanceRoots  string `json:"provenanceRoots"`
+
+	// SigningKey is a PEM file with an Ed25519 private key (PKCS #8) that
+	// package files are signed with, in X-Repkg-Signature.
+	// PreviousSigningKeys are published at /api/signing-key along with
+	// its public key, for a while after a rotation.
+	SigningKey          string               `json:"signingKey"`
+	PreviousSigningKeys []PreviousSigningKey `json:"previousSigningKeys"`
+
+	// Allowlist restricts which packages may be fetched, as name globs like
+	// "@myorg/*". Empty allows everything.
+	Allowlist []string `json:"allowlist"`
+	// With Approvals, packages are only fetched for the first time once an
+	// admin approved them; requests for them wait for approval for
+	// ApprovalTTL.
+	Approvals   bool     `json:"approvals"`
+	ApprovalTTL duration `json:"approvalTTL"`
+
+	PackumentTTL    duration `json:"packumentTTL"`
+	ResolveMaxDepth int      `json:"resolveMaxDepth"`
+
+	// StaleIfError is how long past PackumentTTL a cached packument is
+	// still used when the registry can't revalidate it; zero never uses
+	// it. With StaleIfNotFound the registry answering 404 counts too.
+	StaleIfError    duration `json:"staleIfError"`
+	StaleIfNotFound bool     `json:"staleIfNotFound"`
+	PrefetchWorkers int      `json:"prefetchWorkers"`
+
+	// TransformWorkers is how many bundles and other transforms are built
+	// at once, zero for GOMAXPROCS-1; TransformQueue how many more may
+	// wait for one before they are refused with a 503.
+	TransformWorkers int `json:"transformWorkers"`
+	TransformQueue   int `json:"transformQueue"`
+
+	// Storage is "raw" or "brotli". With brotli, text files of newly cached
+	// versions are kept compressed and decoded for clients that need it.
+	Storage string `json:"storage"`
+
+	// HotCacheMaxBytes bounds the in-memory cache of small files; zero
+	// disables it. Only files up to HotCacheMaxFileSize are cached.
+	HotCacheMaxBytes    int64 `json:"hotCacheMaxBytes"`
+	HotCacheMaxFileSize int64 `json:"hotCacheMaxFileSize"`
+
+	// MaxPackageSize (unpacked bytes) and MaxPackageFiles refuse oversized
+	// packages unless the request is made with AdminToken. Zero disables a
+	// limit.
+	MaxPackageSize  int64 `json:"maxPackageSize"`
+	MaxPackageFiles int   `json:"maxPackageFiles"`
+
+	// Umask is the octal mask applied to the modes of extracted files,
+	// which otherwise keep the mode of their tarball entry (owners can
+	// always read and write them). SpecialEntries decides what becomes of
+	// tarball entries other than files, directories and hard links (the
+	// latter are extracted as copies): "skip" them with a warning or
+	// "fail" the fetch.
+	Umask          string `json:"umask"`
+	SpecialEntries string `json:"specialEntries"`
+
+	// AdminToken is expected as "Authorization: Bearer <token>" on admin
+	// requests. Empty disables admin access.
+	AdminToken string `json:"adminToken"`
+
+	// AllowedIPs, addresses or CIDRs, limits every route to requests from
+	// them; the address is the peer's unless it is one of TrustedProxies,
+	// which are then believed about X-Forwarded-For. AccessKeys, by a label
+	// for logs and stats, makes every route but health checks, metrics
+	// and the admin routes ask for one of them.
+	AllowedIPs     []string          `json:"allowedIPs"`
+	TrustedProxies []string          `json:"trustedProxies"`
+	AccessKeys     map[string]string `json:"accessKeys"`
+
+	// BatchMaxEntries and BatchMaxBytes bound /api/batch requests. Zero
+	// disables a limit.
+	BatchMaxEntries int   `json:"batchMaxEntries"`
+	BatchMaxBytes   int64 `json:"batchMaxBytes"`
+
+	// MaxBodyBytes bounds request bodies, but for those of /api/prefetch,
+	// /api/resolve and /api/normalize, which may be gzipped and are
+	// bounded by what they decompress to, BulkBodyMaxBytes. Zero disables
+	// a limit.
+	MaxBodyBytes     int64 `json:"maxBodyBytes"`
+	BulkBodyMaxBytes int64 `json:"bulkBodyMaxBytes"`
+
+	// UpstreamHosts lists hosts besides the registry's that tarball URLs
+	// and redirects may point at, as "host", "host:port" or "*.domain".
+	// BlockPrivateNetworks refuses upstream connections to loopback,
+	// private and link-local addresses other than the registry's, and
+	// can't be combined with a proxy from HTTPS_PROXY or HTTP_PROXY.
+	UpstreamHosts        []string `json:"upstreamHosts"`
+	BlockPrivateNetworks bool     `json:"blockPrivateNetworks"`
+
+	// RegistryToken is sent as "Authorization: Bearer <token>" to the
+	// registry. On redirects it is carried over according to RedirectAuth:
+	// "same-origin", "always" or "never". Upstream requests follow at most
+	// MaxRedirects redirects.
+	RegistryToken string `json:"registryToken"`
+	RedirectAuth  string `json:"redirectAuth"`
+	MaxRedirects  int    `json:"maxRedirects"`
+
+	// RegistryAuth sends basic auth to registries that don't take bearer
+	// tokens, in place of RegistryToken.
+	RegistryAuth *BasicAuth `json:"registryAuth"`
+
+	// HostOverrides pins upstream hostnames to IP addresses. DNSCacheTTL
+	// keeps successful lookups of other hosts for that long; zero leaves
+	// caching to the system resolver. IPFamily is "dual", "ipv4" or
+	// "ipv6".
+	HostOverrides map[string]string `json:"hostOverrides"`
+	DNSCacheTTL   duration          `json:"dnsCacheTTL"`
+	DialTimeout   duration          `json:"dialTimeout"`
+	IPFamily      string            `json:"ipFamily"`
+
+	// UpstreamBandwidth caps the bytes per second all tarball downloads
+	// take together, DownloadBandwidth those of each one. Zero disables
+	// either. Serving cached files is never throttled.
+	UpstreamBandwidth int64 `json:"upstreamBandwidth"`
+	DownloadBandwidth int64 `json:"downloadBandwidth"`
+
+	// Tarballs over SegmentedDownloadThreshold bytes are downloaded in
+	// DownloadSegments parallel byte ranges when the server allows it,
+	// each retried DownloadSegmentRetries times. A zero threshold or a
+	// single segment disables it.
+	SegmentedDownloadThreshold int64 `json:"segmentedDownloadThreshold"`
+	DownloadSegments           int   `json:"downloadSegments"`
+	DownloadSegmentRetries     int   `json:"downloadSegmentRetries"`
+
+	// MaxCacheBytes bounds the space versions take on disk; zero disables
+	// eviction. EvictionPolicy is "lru" (least recently requested first)
+	// or "popularity" (least requested over the last week first).
+	MaxCacheBytes  int64  `json:"maxCacheBytes"`
+	EvictionPolicy string `json:"evictionPolicy"`
+	// TagAliases keeps an alias for each dist-tag in package directories,
+	// pointing at a cached version, for consumers of the data dir.
+	TagAliases bool `json:"tagAliases"`
+
+	// EvictionReportOnly makes the background eviction log what it would
+	// remove instead of removing it.
+	EvictionReportOnly bool `json:"evictionReportOnly"`
+
+	// Quotas bound the bytes a scope ("@web", within each tenant) or a
+	// tenant ("tenant:web", "tenant:default" for the top level) may cache.
+	// A version that doesn't fit is refused with a 507 ("fail"), or the
+	// scope's own least recently requested versions are evicted to make
+	// room ("evict"), per QuotaPolicy. Both can be changed by reloading
+	// the config with SIGHUP.
+	Quotas      map[string]int64 `json:"quotas"`
+	QuotaPolicy string           `json:"quotaPolicy"`
+
+	// WithdrawalCheckInterval is how often cached versions are checked
+	// for having been unpublished or taken down upstream; zero disables
+	// the check. WithdrawnPolicy is "block" (410 or 451) or "warn" (serve
+	// with a Warning header). HookSecret verifies X-Npm-Signature on
+	// registry webhooks.
+	WithdrawalCheckInterval duration `json:"withdrawalCheckInterval"`
+	WithdrawnPolicy         string   `json:"withdrawnPolicy"`
+	HookSecret              string   `json:"hookSecret"`
+
+	// StatsSnapshotInterval is how often a snapshot of /api/stats and the
+	// counters is written to the data dir, zero for never. Snapshots are
+	// kept for StatsSnapshotRetention.
+	StatsSnapshotInterval  duration `json:"statsSnapshotInterval"`
+	StatsSnapshotRetention duration `json:"statsSnapshotRetention"`
+
+	// EventsRetained is how many of the latest cache events GET
+	// /api/events can replay to a client catching up.
+	EventsRetained int `json:"eventsRetained"`
+
+	// VerifyBandwidth caps the bytes per second verification reads, so it
+	// leaves the disk to serving; zero is unlimited. Versions it finds
+	// corrupt are served with a Warning header until repaired when
+	// VerifyQuarantine is "warn", refused with 503 when "block" and served
+	// as usual when "off".
+	VerifyBandwidth  int64  `json:"verifyBandwidth"`
+	VerifyQuarantine string `json:"verifyQuarantine"`
+
+	// IntegrityGuard checks the size and mtime of every file served
+	// against the manifest, and hashes it in full one time in
+	// IntegrityGuardSample, quarantining versions changed on disk.
+	IntegrityGuard       bool    `json:"integrityGuard"`
+	IntegrityGuardSample float64 `json:"integrityGuardSample"`
+
+	// After CircuitFailures consecutive failures within CircuitWindow, an
+	// upstream host is not contacted for CircuitCooldown. Zero failures
+	// disables the breaker; 429s open the circuit regardless.
+	CircuitFailures int      `json:"circuitFailures"`
+	CircuitWindow   duration `json:"circuitWindow"`
+	CircuitCooldown duration `json:"circuitCooldown"`
+
+	// Headers adds response headers to the files served from /packages
+	// that match each rule. Leave it out to send defaultHeaderRules; an
+	// empty list sends none.
+	Headers []HeaderRule `json:"headers"`
+	// HeaderOverrides are rules applied last, over the headers repkg sets
+	// itself (Cache-Control, the HTML policy's CSP and so on), to files
+	// of /packages, /hash and derived files alike.
+	HeaderOverrides []HeaderRule `json:"headerOverrides"`
+	// FontAllowOrigin is the Access-Control-Allow-Origin that font files
+	// are always served with, whether or not the request had an Origin:
+	// "*" by default, an origin, or "" to leave it to the CORS middleware.
+	FontAllowOrigin string `json:"fontAllowOrigin"`
+
+	// HTMLPolicy is how HTML and SVG files of packages are served:
+	// "render" them sandboxed, "download" them as attachments or "block"
+	// them. HTMLPolicyScopes overrides it for scopes ("@org").
+	HTMLPolicy       string            `json:"htmlPolicy"`
+	HTMLPolicyScopes map[string]string `json:"htmlPolicyScopes"`
+
+	// ContentTypes sets the type of files by name, such as
+	// {"LICENSE": "text/plain; charset=utf-8"}, over whatever their
+	// extension or content suggest.
+	ContentTypes map[string]string `json:"contentTypes"`
+
+	// Refresh lets /npm requests with "Cache-Control: no-cache" or
+	// "X-Repkg-Refresh: 1" fetch the version again, for registries where
+	// versions get republished: "off", "admin" (with the admin token) or
+	// "on", limited to requests from RefreshOrigins when set. A package is
+	// refreshed at most once per RefreshInterval.
+	Refresh         string   `json:"refresh"`
+	RefreshOrigins  []string `json:"refreshOrigins"`
+	RefreshInterval duration `json:"refreshInterval"`
+
+	// Tenants lets one deployment serve several teams, each keyed by a
+	// name used in /t/<name>/ URLs. See TenantConfig.
+	Tenants map[string]TenantConfig `json:"tenants"`
+
+	// WarmStart is a file or URL listing package@version entries to
+	// prefetch after startup, at most WarmStartRate per second. With
+	// WarmStartSave, that many of the most requested versions are saved to
+	// the data dir and prefetched on the next start too.
+	WarmStart     string  `json:"warmStart"`
+	WarmStartRate float64 `json:"warmStartRate"`
+	WarmStartSave int     `json:"warmStartSave"`
+
+	// Requests with longer URLs, or more path segments or query parameters,
+	// are refused before routing. Zero disables a limit.
+	MaxURLLength    int `json:"maxURLLength"`
+	MaxPathSegments int `json:"maxPathSegments"`
+	MaxQueryParams  int `json:"maxQueryParams"`
+
+	// VersionRegistryHosts lists the registries' hostnames in /api/version.
+	VersionRegistryHosts bool `json:"versionRegistryHosts"`
+
+	// ReadOnly (or -read-only) serves DataDir as another instance fills
+	// it, without ever writing to it or asking the registry. Misses are a
+	// 404, or a redirect to WriterURL when set. The index is read again
+	// from DataDir every ReplicaRefresh.
+	ReadOnly       bool     `json:"readOnly"`
+	WriterURL      string   `json:"writerURL"`
+	ReplicaRefresh duration `json:"replicaRefresh"`
+
+	// OTLPEndpoint is an OpenTelemetry collector's OTLP/HTTP base URL,
+	// such as http://localhost:4318, that spans are sent to. Requests
+	// without a traceparent header start a trace TraceSampleRatio of the
+	// time.
+	OTLPEndpoint     string  `json:"otlpEndpoint"`
+	TraceSampleRatio float64 `json:"traceSampleRatio"`
+
+	// On SIGTERM or SIGINT, /api/ready fails for ShutdownDelay, for load
+	// balancers to stop sending requests, then the server stops taking
+	// them and waits up to ShutdownTimeout for those in flight.
+	ShutdownDelay   duration `json:"shutdownDelay"`
+	ShutdownTimeout duration `json:"shutdownTimeout"`
+
+	// A version that fails to fetch FailureThreshold times in a row fails
+	// fast for FailureBackoff, or TransientFailureBackoff when the
+	// registry was at fault. Zero disables this.
+	FailureThreshold        int      `json:"failureThreshold"`
+	FailureBackoff          duration `json:"failureBackoff"`
+	TransientFailureBackoff duration `json:"transientFailureBackoff"`
+
+	// EntryFallbacks are tried in order when package.json leads to no
+	// entry point: a path, or a glob that must match exactly one file.
+	EntryFallbacks []string `json:"entryFallbacks"`
+
+	// Debug logs more of what goes wrong, like the start of registry
+	// responses that aren't what they should be.
+	Debug bool `json:"debug"`
+}
+
+// TenantConfig describes one tenant. Requests reach it under /t/<name>/ or
+// with its APIKey in an X-Api-Key header, which /t/<name>/ requires too
+// when set. An empty Registry or Allowlist means the top-level one;
+// RegistryToken only goes with the tenant's own Registry.
+type TenantConfig struct {
+	APIKey        string     `json:"apiKey"`
+	Registry      string     `json:"registry"`
+	RegistryToken string     `json:"registryToken"`
+	RegistryAuth  *BasicAuth `json:"registryAuth"`
+	Allowlist     []string   `json:"allowlist"`
+}
+
+// BasicAuth is a username and a password, given inline or, to keep it out
+// of the config file, read from PasswordFile or the environment variable
+// PasswordEnv when the config is loaded.
+type BasicAuth struct {
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	PasswordEnv  string `json:"passwordEnv,omitempty"`
+
+	password string
+}
+
+// load reads the password from where it is configured.
+func (a *BasicAuth) load() error {
+	sources := 0
+	for _, s := range []string{a.Password, a.PasswordFile, a.PasswordEnv} {
+		if s != "" {
+			sources++
+		}
+	}
+	switch {
+	case a.Username == "":
+		return errors.New("username is required")
+	case sources != 1:
+		return errors.New("exactly one of password, passwordFile and passwordEnv must be set")
+	case a.PasswordFile != "":
+		data, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return err
+		}
+		a.password = strings.TrimRight(string(data), "\r\n")
+	case a.PasswordEnv != "":
+		v, ok := os.LookupEnv(a.PasswordEnv)
+		if !ok {
+			return fmt.Errorf("environment variable %s is not set", a.PasswordEnv)
+		}
+		a.password = v
+	default:
+		a.password = a.Password
+	}
+	return nil
+}
+
+// HeaderRule sets Headers on files of the packages matching Package (a
+// pattern like the allowlist's) whose path inside the package matches Path
+// (a pattern like the denylist's); empty patterns match everything.
+// Identity serves matching files without a Content-Encoding, which worker
+// scripts loaded by WebAssembly tooling may need.
+type HeaderRule struct {
+	Package  string            `json:"package"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers"`
+	Identity bool              `json:"identity"`
+}
+
+// duration reads "1h30m" style strings, or a number of seconds.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		d.Duration = v
+		return nil
+	}
+
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	d.Duration = time.Duration(secs * float64(time.Second))
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		Addr:     ":8001",
+		Registry: "http://localhost:4873",
+		DataDir:  defaultDataDir(),
+
+		PathStyles: []string{pathStyleJSDelivr},
+
+		Signatures:       signaturesOff,
+		SignatureKeysTTL: duration{24 * time.Hour},
+
+		PackumentTTL:    duration{5 * time.Minute},
+		StaleIfError:    duration{24 * time.Hour},
+		ResolveMaxDepth: 10,
+		PrefetchWorkers: 2,
+
+		TransformQueue: 64,
+
+		Storage: storageRaw,
+
+		HotCacheMaxBytes:    64 << 20,
+		HotCacheMaxFileSize: 256 << 10,
+
+		MaxPackageSize: 512 << 20,
+
+		Umask:          "022",
+		SpecialEntries: specialSkip,
+
+		BatchMaxEntries: 100,
+		BatchMaxBytes:   16 << 20,
+
+		MaxBodyBytes:     1 << 20,
+		BulkBodyMaxBytes: 64 << 20,
+
+		RedirectAuth: redirectAuthSameOrigin,
+		MaxRedirects: 5,
+
+		DialTimeout: duration{30 * time.Second},
+		IPFamily:    ipFamilyDual,
+
+		EvictionPolicy: evictLRU,
+		QuotaPolicy:    quotaFail,
+
+		WithdrawnPolicy: withdrawnBlock,
+		SecurityHolders: securityHolderBlock,
+		HTMLPolicy:      htmlRender,
+		IntegrityPolicy: integrityReject,
+		FontAllowOrigin: "*",
+
+		StatsSnapshotRetention: duration{7 * 24 * time.Hour},
+
+		EventsRetained: 10000,
+
+		VerifyBandwidth:  16 << 20,
+		VerifyQuarantine: quarantineWarn,
+
+		IntegrityGuardSample: 0.01,
+
+		Refresh:         refreshOff,
+		RefreshInterval: duration{time.Minute},
+
+		CircuitFailures: 5,
+		CircuitWindow:   duration{30 * time.Second},
+		CircuitCooldown: duration{30 * time.Second},
+
+		WarmStartRate: 2,
+
+		ReplicaRefresh: duration{time.Minute},
+
+		TraceSampleRatio: 1,
+
+		ShutdownTimeout: duration{5 * time.Second},
+
+		FailureThreshold:        3,
+		FailureBackoff:          duration{time.Hour},
+		ApprovalTTL:             duration{7 * 24 * time.Hour},
+		TransientFailureBackoff: duration{30 * time.Second},
+
+		EntryFallbacks: []string{"index.js", "index.mjs", "*.css", "index.json"},
+
+		MaxURLLength:    16384,
+		MaxPathSegments: 128,
+		MaxQueryParams:  32,
+
+		SegmentedDownloadThreshold: 64 << 20,
+		DownloadSegments:           4,
+		DownloadSegmentRetries:     2,
+	}
+}
+
+// The config file loadConfig read, for reloadConfig to read again.
+var (
+	configPath     string
+	configExplicit bool
+)
+
+// debugf logs when config.Debug is set.
+func debugf(format string, args ...any) {
+	if config.Debug {
+		log.Printf(format, args...)
+	}
+}
+
+// loadConfig reads the JSON config file given by -config (or REPKG_CONFIG)
+// on top of the defaults, then the environment. A missing file is only an
+// error when it was named explicitly. -read-only sets readOnly whatever the
+// file says.
+func loadConfig() (Config, error) {
+	var readOnly bool
+	path, explicit := os.LookupEnv(envPrefix + "CONFIG")
+	if !explicit {
+		path = "repkg.json"
+	}
+	flag.StringVar(&configPath, "config", path, "path to the JSON config file")
+	flag.BoolVar(&readOnly, "read-only", false, "serve the data dir as a read-only replica")
+	flag.Parse()
+
+	configExplicit = explicit
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configExplicit = true
+		}
+	})
+	cfg, err := readConfig(configPath, configExplicit)
+	cfg.ReadOnly = cfg.ReadOnly || readOnly
+	return cfg, err
+}
+
+// reloadConfig reads the config file again on SIGHUP and applies the
+// settings that can change while running: quotas, quotaPolicy, headers and
+// headerOverrides. Other changes are only picked up by a restart.
+func reloadConfig() {
+	cfg, err := readConfig(configPath, configExplicit)
+	if err != nil {
+		log.Printf("config: reload: %s, keeping the current config", err)
+		return
+	}
+	quotas.set(cfg.Quotas, cfg.QuotaPolicy)
+	headerRules.set(cfg)
+	log.Printf("config: reloaded %s: %d quotas, policy %s, %d header rules and %d overrides", configPath, len(cfg.Quotas), cfg.QuotaPolicy, len(cfg.Headers), len(cfg.HeaderOverrides))
+}
+
+func readConfig(path string, explicit bool) (Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &cfg)
+	} else if errors.Is(err, os.ErrNotExist) && !explicit {
+		err = nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := applyEnv(&cfg, os.Environ()); err != nil {
+		return cfg, err
+	}
+
+	switch cfg.Signatures {
+	case signaturesOff, signaturesWarn, signaturesRequire:
+	default:
+		return cfg, fmt.Errorf("signatures must be %q, %q or %q", signaturesOff, signaturesWarn, signaturesRequire)
+	}
+	if cfg.ProvenanceRoots != "" {
+		if _, err := os.Stat(cfg.ProvenanceRoots); err != nil {
+			return cfg, fmt.Errorf("provenanceRoots: %w", err)
+		}
+	}
+	if cfg.Storage != storageRaw && cfg.Storage != storageBrotli {
+		return cfg, fmt.Errorf("storage must be %q or %q", storageRaw, storageBrotli)
+	}
+	switch cfg.RedirectAuth {
+	case redirectAuthSameOrigin, redirectAuthAlways, redirectAuthNever:
+	default:
+		return cfg, fmt.Errorf("redirectAuth must be %q, %q or %q", redirectAuthSameOrigin, redirectAuthAlways, redirectAuthNever)
+	}
+	switch cfg.IPFamily {
+	case ipFamilyDual, ipFamilyIPv4, ipFamilyIPv6:
+	default:
+		return cfg, fmt.Errorf("ipFamily must be %q, %q or %q", ipFamilyDual, ipFamilyIPv4, ipFamilyIPv6)
+	}
+	if cfg.EvictionPolicy != evictLRU && cfg.EvictionPolicy != evictPopularity {
+		return cfg, fmt.Errorf("evictionPolicy must be %q or %q", evictLRU, evictPopularity)
+	}
+	if cfg.WithdrawnPolicy != withdrawnBlock && cfg.WithdrawnPolicy != withdrawnWarn {
+		return cfg, fmt.Errorf("withdrawnPolicy must be %q or %q", withdrawnBlock, withdrawnWarn)
+	}
+	if cfg.SecurityHolders != securityHolderBlock && cfg.SecurityHolders != securityHolderServe {
+		return cfg, fmt.Errorf("securityHolders must be %q or %q", securityHolderBlock, securityHolderServe)
+	}
+	if cfg.VerifyQuarantine != quarantineOff && cfg.VerifyQuarantine != quarantineWarn && cfg.VerifyQuarantine != quarantineBlock {
+		return cfg, fmt.Errorf("verifyQuarantine must be %q, %q or %q", quarantineOff, quarantineWarn, quarantineBlock)
+	}
+	if cfg.VerifyBandwidth < 0 {
+		return cfg, fmt.Errorf("verifyBandwidth can't be negative")
+	}
+	if cfg.IntegrityGuardSample < 0 || cfg.IntegrityGuardSample > 1 {
+		return cfg, fmt.Errorf("integrityGuardSample must be between 0 and 1")
+	}
+	if n, err := strconv.ParseUint(cfg.Umask, 8, 32); err != nil || n > 0777 {
+		return cfg, fmt.Errorf("umask must be an octal mode like \"022\", not %q", cfg.Umask)
+	}
+	if cfg.SpecialEntries != specialSkip && cfg.SpecialEntries != specialFail {
+		return cfg, fmt.Errorf("specialEntries must be %q or %q", specialSkip, specialFail)
+	}
+	for _, style := range cfg.PathStyles {
+		if style != pathStyleJSDelivr && style != pathStyleUnpkg {
+			return cfg, fmt.Errorf("pathStyles: %q is not %q or %q", style, pathStyleJSDelivr, pathStyleUnpkg)
+		}
+	}
+	for i, r := range cfg.Headers {
+		if err := validateHeaderRule(r); err != nil {
+			return cfg, fmt.Errorf("headers[%d]: %s", i, err)
+		}
+	}
+	for i, r := range cfg.HeaderOverrides {
+		if err := validateHeaderRule(r); err != nil {
+			return cfg, fmt.Errorf("headerOverrides[%d]: %s", i, err)
+		}
+		if r.Identity {
+			return cfg, fmt.Errorf("headerOverrides[%d]: identity is for headers rules", i)
+		}
+	}
+	if err := validateFontAllowOrigin(cfg.FontAllowOrigin); err != nil {
+		return cfg, err
+	}
+	if err := validateIntegrityPolicies(cfg); err != nil {
+		return cfg, err
+	}
+	if err := validateHTMLPolicies(cfg); err != nil {
+		return cfg, err
+	}
+	for name, t := range cfg.ContentTypes {
+		if name == "" || strings.Contains(name, "/") {
+			return cfg, fmt.Errorf("contentTypes: %q is not a file name", name)
+		}
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return cfg, fmt.Errorf("contentTypes[%q]: %q is not a content type", name, t)
+		}
+	}
+	switch cfg.Refresh {
+	case refreshOff, refreshAdmin, refreshOn:
+	default:
+		return cfg, fmt.Errorf("refresh must be %q, %q or %q", refreshOff, refreshAdmin, refreshOn)
+	}
+	if cfg.UpstreamBandwidth < 0 || cfg.DownloadBandwidth < 0 {
+		return cfg, fmt.Errorf("upstreamBandwidth and downloadBandwidth can't be negative")
+	}
+	if cfg.WriterURL != "" {
+		if u, err := url.Parse(cfg.WriterURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("writerURL must be an http or https URL, not %q", cfg.WriterURL)
+		}
+	}
+	if cfg.ReplicaRefresh.Duration < 0 {
+		return cfg, fmt.Errorf("replicaRefresh can't be negative")
+	}
+	if d := cfg.StatsSnapshotInterval.Duration; d < 0 || (d > 0 && d < time.Minute) {
+		return cfg, fmt.Errorf("statsSnapshotInterval must be zero or at least a minute")
+	}
+	if cfg.StatsSnapshotInterval.Duration > 0 && cfg.StatsSnapshotRetention.Duration < cfg.StatsSnapshotInterval.Duration {
+		return cfg, fmt.Errorf("statsSnapshotRetention must be at least statsSnapshotInterval")
+	}
+	if cfg.OTLPEndpoint != "" {
+		if u, err := url.Parse(cfg.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("otlpEndpoint must be an http or https URL, not %q", cfg.OTLPEndpoint)
+		}
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return cfg, fmt.Errorf("traceSampleRatio must be between 0 and 1")
+	}
+	if cfg.ShutdownDelay.Duration < 0 || cfg.ShutdownTimeout.Duration < 0 {
+		return cfg, fmt.Errorf("shutdownDelay and shutdownTimeout can't be negative")
+	}
+	if cfg.ApprovalTTL.Duration <= 0 {
+		return cfg, fmt.Errorf("approvalTTL must be positive")
+	}
+	if cfg.FailureThreshold < 0 || cfg.FailureBackoff.Duration < 0 || cfg.TransientFailureBackoff.Duration < 0 {
+		return cfg, fmt.Errorf("failureThreshold, failureBackoff and transientFailureBackoff can't be negative")
+	}
+	for _, pattern := range cfg.EntryFallbacks {
+		if !validEntryPattern(pattern) {
+			return cfg, fmt.Errorf("entryFallbacks: invalid pattern %q", pattern)
+		}
+	}
+	if cfg.StaleIfError.Duration < 0 {
+		return cfg, fmt.Errorf("staleIfError can't be negative")
+	}
+	if cfg.MaxBodyBytes < 0 || cfg.BulkBodyMaxBytes < 0 {
+		return cfg, fmt.Errorf("maxBodyBytes and bulkBodyMaxBytes can't be negative")
+	}
+	if cfg.EventsRetained < 1 {
+		return cfg, fmt.Errorf("eventsRetained must be at least 1")
+	}
+	if cfg.TransformWorkers < 0 || cfg.TransformQueue < 0 {
+		return cfg, fmt.Errorf("transformWorkers and transformQueue can't be negative")
+	}
+	if cfg.MaxURLLength < 0 || cfg.MaxPathSegments < 0 || cfg.MaxQueryParams < 0 {
+		return cfg, fmt.Errorf("maxURLLength, maxPathSegments and maxQueryParams can't be negative")
+	}
+	if cfg.SegmentedDownloadThreshold < 0 || cfg.DownloadSegments < 1 || cfg.DownloadSegmentRetries < 0 {
+		return cfg, fmt.Errorf("segmentedDownloadThreshold and downloadSegmentRetries can't be negative, and downloadSegments must be at least 1")
+	}
+	if cfg.QuotaPolicy != quotaFail && cfg.QuotaPolicy != quotaEvict {
+		return cfg, fmt.Errorf("quotaPolicy must be %q or %q", quotaFail, quotaEvict)
+	}
+	for key, limit := range cfg.Quotas {
+		if !validQuotaKey(key, cfg) {
+			return cfg, fmt.Errorf("quotas: %q is neither a scope like \"@web\" nor \"tenant:<name>\" of a configured tenant", key)
+		}
+		if limit <= 0 {
+			return cfg, fmt.Errorf("quotas: %s must be a positive number of bytes", key)
+		}
+	}
+	if cfg.RegistryAuth != nil {
+		if cfg.RegistryToken != "" {
+			return cfg, errors.New("registryToken and registryAuth can't both be set")
+		}
+		if err := cfg.RegistryAuth.load(); err != nil {
+			return cfg, fmt.Errorf("registryAuth: %w", err)
+		}
+	}
+	keys := map[string]string{}
+	for name, t := range cfg.Tenants {
+		if !validTenantName(name) {
+			return cfg, fmt.Errorf("tenants: invalid tenant name %q", name)
+		}
+		if t.RegistryAuth != nil {
+			if t.RegistryToken != "" {
+				return cfg, fmt.Errorf("tenants: %s: registryToken and registryAuth can't both be set", name)
+			}
+			if err := t.RegistryAuth.load(); err != nil {
+				return cfg, fmt.Errorf("tenants: %s: registryAuth: %w", name, err)
+			}
+		}
+		if t.APIKey == "" {
+			continue
+		}
+		if other, ok := keys[t.APIKey]; ok {
+			return cfg, fmt.Errorf("tenants: %s and %s have the same apiKey", other, name)
+		}
+		keys[t.APIKey] = name
+	}
+	if _, err := parseAllowedIPs(cfg.AllowedIPs); err != nil {
+		return cfg, fmt.Errorf("allowedIPs: %w", err)
+	}
+	if _, err := parseAllowedIPs(cfg.TrustedProxies); err != nil {
+		return cfg, fmt.Errorf("trustedProxies: %w", err)
+	}
+	for label, key := range cfg.AccessKeys {
+		if label == "" || key == "" {
+			return cfg, fmt.Errorf("accessKeys: labels and keys can't be empty")
+		}
+		if label == "admin" || strings.HasPrefix(label, "tenant:") {
+			return cfg, fmt.Errorf("accessKeys: %q labels requests made with the admin token or a tenant's key", label)
+		}
+		if other, ok := keys[key]; ok {
+			return cfg, fmt.Errorf("accessKeys: %s has the apiKey of tenant %s", label, other)
+		}
+	}
+	overrides := map[string]string{}
+	for host, ip := range cfg.HostOverrides {
+		if net.ParseIP(ip) == nil {
+			return cfg, fmt.Errorf("hostOverrides: %q is not an IP address for %s", ip, host)
+		}
+		overrides[strings.ToLower(host)] = ip
+	}
+	cfg.HostOverrides = overrides
+
+	return cfg, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// Files that tarballs sometimes ship by accident and that should never be
+// handed out to clients.
+var defaultDenylist = []string{
+	".npmrc",
+	".yarnrc",
+	".yarnrc.yml",
+	".env*",
+	"*.pem",
+	"*.key",
+	"id_rsa*",
+	"id_ed25519*",
+	".git/**",
+	".svn/**",
+	".hg/**",
+}
+
+type denylist struct {
+	patterns [][]string
+}
+
+func newDenylist(cfg Config) *denylist {
+	if cfg.DisableDenylist {
+		return &denylist{}
+	}
+
+	patterns := cfg.Denylist
+	if len(patterns) == 0 {
+		patterns = defaultDenylist
+	}
+
+	d := &denylist{}
+	for _, p := range patterns {
+		p = strings.Trim(p, "/")
+		if p == "" {
+			continue
+		}
+		d.patterns = append(d.patterns, strings.Split(p, "/"))
+	}
+	return d
+}
+
+// match reports the pattern that denies p, a slash separated path relative
+// to the package root. Patterns are unanchored: they can match starting at
+// any directory, and a denied directory denies everything below it.
+func (d *denylist) match(p string) (string, bool) {
+	if d == nil || len(d.patterns) == 0 {
+		return "", false
+	}
+
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+	for _, pat := range d.patterns {
+		for i := range segs {
+			if matchSegments(pat, segs[i:], true) {
+				return strings.Join(pat, "/"), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (d *denylist) denied(p string) bool {
+	_, ok := d.match(p)
+	return ok
+}
+
+// matchSegments reports whether pat matches all of segs or, with prefix,
+// a leading run of them. A "**" segment matches zero or more path
+// segments.
+func matchSegments(pat, segs []string, prefix bool) bool {
+	if len(pat) == 0 {
+		return prefix || len(segs) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pat[1:], segs[i:], prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], segs[0]); !ok {
+		return false
+	}
+	return matchSegments(pat[1:], segs[1:], prefix)
+}
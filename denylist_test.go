@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		// whole and prefix are whether pattern matches all of path, and
+		// a leading run of it.
+		whole, prefix bool
+	}{
+		{".npmrc", ".npmrc", true, true},
+		{".npmrc", ".npmrc/x", false, true},
+		{".npmrc", "a/.npmrc", false, false},
+		{".env*", ".env.local", true, true},
+		{"*.pem", "certs", false, false},
+		{"lib/*.js", "lib/index.js", true, true},
+		{"lib/*.js", "lib/util/index.js", false, false},
+		{"lib", "lib/index.js", false, true},
+		{".git/**", ".git", true, true},
+		{".git/**", ".git/objects/ab/cdef", true, true},
+		{"**/*.css", "a/b/c.css", true, true},
+		{"**/*.css", "c.css", true, true},
+		{"**/*.css", "c.css/x", false, true},
+		{"src/**/test", "src/a/b/test", true, true},
+		{"src/**/test", "src/test/x", false, true},
+		{"src/**/test", "lib/test", false, false},
+		{"**", "anything/at/all", true, true},
+	} {
+		pat, segs := strings.Split(tc.pattern, "/"), strings.Split(tc.path, "/")
+		if got := matchSegments(pat, segs, false); got != tc.whole {
+			t.Errorf("%s, %s: %v, want %v", tc.pattern, tc.path, got, tc.whole)
+		}
+		if got := matchSegments(pat, segs, true); got != tc.prefix {
+			t.Errorf("%s, %s as a prefix: %v, want %v", tc.pattern, tc.path, got, tc.prefix)
+		}
+	}
+}
+
+func TestDenylistMatch(t *testing.T) {
+	d := newDenylist(Config{Denylist: []string{".npmrc", "/secrets/", "*.pem", ".git/**"}})
+	for _, tc := range []struct{ path, pattern string }{
+		{".npmrc", ".npmrc"},
+		{"docs/.npmrc", ".npmrc"},
+		{"secrets/key.txt", "secrets"},
+		{"a/secrets/b/c", "secrets"},
+		{"certs/server.pem", "*.pem"},
+		{"vendor/.git/HEAD", ".git/**"},
+		{"index.js", ""},
+		{"npmrc", ""},
+		{"secret/key.txt", ""},
+	} {
+		pattern, ok := d.match(tc.path)
+		if pattern != tc.pattern || ok != (tc.pattern != "") {
+			t.Errorf("%s: matched %q, %v; want %q", tc.path, pattern, ok, tc.pattern)
+		}
+	}
+	if (&denylist{}).denied(".npmrc") || newDenylist(Config{DisableDenylist: true}).denied(".npmrc") {
+		t.Errorf("an empty denylist denied .npmrc")
+	}
+	if !newDenylist(Config{}).denied("a/.env.local") {
+		t.Errorf("the default denylist let .env.local through")
+	}
+}
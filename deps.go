@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+type resolvedPackage struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Ranges  []string `json:"ranges"`
+	Depth   int      `json:"depth"`
+
+	// Optional is set when only optionalDependencies lead to the package.
+	Optional bool `json:"optional,omitempty"`
+}
+
+type resolveProblem struct {
+	Name       string   `json:"name"`
+	Range      string   `json:"range,omitempty"`
+	RequiredBy string   `json:"requiredBy,omitempty"`
+	Cycle      []string `json:"cycle,omitempty"`
+	Optional   bool     `json:"optional,omitempty"`
+	Code       string   `json:"code"`
+	Error      string   `json:"error"`
+}
+
+type resolveResult struct {
+	Packages []resolvedPackage `json:"packages"`
+	Errors   []resolveProblem  `json:"errors"`
+	Warnings []resolveProblem  `json:"warnings"`
+}
+
+type depEdge struct {
+	name, rng, from string
+	depth           int
+	optional        bool
+}
+
+// depResolver flattens a dependency tree. Every range a package is required
+// with is collected first; a package then resolves to the highest version
+// satisfying all of them, or to one version per range when no single
+// version does.
+type depResolver struct {
+	tenant   *tenant
+	maxDepth int
+	platform platform
+
+	packuments map[string]*Packument
+	failed     map[string]error
+	ranges     map[string][]string
+	expanded   map[string]bool
+	reported   map[string]bool
+
+	result resolveResult
+}
+
+func newDepResolver(t *tenant, maxDepth int, target platform) *depResolver {
+	return &depResolver{
+		tenant:     t,
+		maxDepth:   maxDepth,
+		platform:   target,
+		packuments: map[string]*Packument{},
+		failed:     map[string]error{},
+		ranges:     map[string][]string{},
+		expanded:   map[string]bool{},
+		reported:   map[string]bool{},
+	}
+}
+
+// resolve flattens the dependencies of roots, of which those in optional
+// are optionalDependencies.
+func (r *depResolver) resolve(roots map[string]string, optional map[string]bool) resolveResult {
+	var frontier []depEdge
+	for _, name := range sortedKeys(roots) {
+		frontier = append(frontier, depEdge{name: name, rng: roots[name], optional: optional[name]})
+	}
+
+	for len(frontier) > 0 {
+		r.loadPackuments(frontier)
+
+		var next []depEdge
+		for _, e := range frontier {
+			if !r.addRange(e) {
+				continue
+			}
+			for _, pv := range r.pick(e.name) {
+				key := pv.Name + "@" + pv.Version
+				if r.expanded[key] {
+					continue
+				}
+				r.expanded[key] = true
+				deps := allDependencies(pv)
+				if e.depth >= r.maxDepth {
+					if len(deps) > 0 {
+						r.warn(resolveProblem{Name: pv.Name, Range: e.rng, Code: "depth_limit", Error: "dependencies of " + key + " not resolved: depth limit reached"})
+					}
+					continue
+				}
+				for _, dep := range sortedKeys(deps) {
+					_, optional := pv.OptionalDependencies[dep]
+					next = append(next, depEdge{name: dep, rng: deps[dep], from: key, depth: e.depth + 1, optional: optional})
+				}
+			}
+		}
+		frontier = next
+	}
+
+	r.collect(roots, optional)
+	return r.result
+}
+
+// allDependencies returns a version's dependencies and optionalDependencies
+// together. Registries usually list optional ones in both already.
+func allDependencies(pv *PackumentVersion) map[string]string {
+	if len(pv.OptionalDependencies) == 0 {
+		return pv.Dependencies
+	}
+	deps := map[string]string{}
+	for name, rng := range pv.Dependencies {
+		deps[name] = rng
+	}
+	for name, rng := range pv.OptionalDependencies {
+		deps[name] = rng
+	}
+	return deps
+}
+
+// addRange records the range an edge requires, reporting edges that can't
+// be resolved at all.
+func (r *depResolver) addRange(e depEdge) bool {
+	if err := unsupportedSpec(e.rng); err != nil {
+		r.fail(e, err)
+		return false
+	}
+	if err, ok := r.failed[e.name]; ok {
+		r.fail(e, err)
+		return false
+	}
+	pv, err := resolveVersion(r.packuments[e.name], e.rng, false)
+	if err != nil {
+		r.fail(e, err)
+		return false
+	}
+	if e.optional && !r.platform.matches(pv) {
+		r.warn(resolveProblem{Name: e.name, Range: e.rng, RequiredBy: e.from, Optional: true, Code: "platform_mismatch", Error: pv.Name + "@" + pv.Version + " is not for " + r.platform.String()})
+		return false
+	}
+
+	r.ranges[e.name] = appendUnique(r.ranges[e.name], e.rng)
+	return true
+}
+
+func (r *depResolver) loadPackuments(edges []depEdge) {
+	var names []string
+	seen := map[string]bool{}
+	for _, e := range edges {
+		_, loaded := r.packuments[e.name]
+		_, failed := r.failed[e.name]
+		if !loaded && !failed && !seen[e.name] && unsupportedSpec(e.rng) == nil {
+			seen[e.name] = true
+			names = append(names, e.name)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := checkAllowed(r.tenant, name)
+			var p *Packument
+			if err == nil {
+				p, err = getPackument(r.tenant, name, nil)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				r.failed[name] = err
+			} else {
+				r.packuments[name] = p
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+// pick returns the versions a package resolves to given every range seen
+// for it so far.
+func (r *depResolver) pick(name string) []*PackumentVersion {
+	p := r.packuments[name]
+	ranges := r.ranges[name]
+
+	if single := maxSatisfying(p, config.SkipDeprecated, func(v semver) bool {
+		for _, rng := range ranges {
+			if !satisfies(p, v, rng) {
+				return false
+			}
+		}
+		return true
+	}); single != nil {
+		return []*PackumentVersion{single}
+	}
+
+	var picked []*PackumentVersion
+	seen := map[string]bool{}
+	for _, rng := range ranges {
+		pv, err := resolveVersion(p, rng, false)
+		if err == nil && !seen[pv.Version] {
+			seen[pv.Version] = true
+			picked = append(picked, pv)
+		}
+	}
+	return picked
+}
+
+// satisfies reports whether v is acceptable for spec, which may be an exact
+// version, a tag or a range.
+func satisfies(p *Packument, v semver, spec string) bool {
+	if _, ok := p.Versions[spec]; ok {
+		return v.String() == spec
+	}
+	if tagged, ok := p.DistTags[spec]; ok {
+		return v.String() == tagged
+	}
+	if spec == "" {
+		return v.String() == p.DistTags["latest"]
+	}
+	rng, err := parseRange(spec)
+	return err == nil && rng.match(v)
+}
+
+// collect walks the final picks from the roots so versions that stopped
+// being picked, and their dependencies, are left out.
+func (r *depResolver) collect(roots map[string]string, optional map[string]bool) {
+	included := map[string]*resolvedPackage{}
+	onStack := map[string]bool{}
+	var stack []string
+
+	var visit func(name, rng string, depth int, optional bool)
+	visit = func(name, rng string, depth int, optional bool) {
+		if _, ok := r.packuments[name]; !ok || r.ranges[name] == nil {
+			return
+		}
+		pv := r.pickFor(name, rng)
+		if pv == nil {
+			return
+		}
+		key := pv.Name + "@" + pv.Version
+
+		if onStack[key] {
+			i := len(stack) - 1
+			for stack[i] != key {
+				i--
+			}
+			cycle := append(append([]string{}, stack[i:]...), key)
+			r.warn(resolveProblem{Name: name, Range: rng, Cycle: cycle, Code: "dependency_cycle", Error: "dependency cycle " + strings.Join(cycle, " -> ")})
+			return
+		}
+
+		if rp, ok := included[key]; ok {
+			rp.Ranges = appendUnique(rp.Ranges, rng)
+			rp.Depth = min(rp.Depth, depth)
+			rp.Optional = rp.Optional && optional
+			return
+		}
+		included[key] = &resolvedPackage{Name: pv.Name, Version: pv.Version, Ranges: []string{rng}, Depth: depth, Optional: optional}
+		if depth >= r.maxDepth {
+			return
+		}
+
+		onStack[key] = true
+		stack = append(stack, key)
+		deps := allDependencies(pv)
+		for _, dep := range sortedKeys(deps) {
+			_, optionalDep := pv.OptionalDependencies[dep]
+			visit(dep, deps[dep], depth+1, optional || optionalDep)
+		}
+		stack = stack[:len(stack)-1]
+		delete(onStack, key)
+	}
+
+	for _, name := range sortedKeys(roots) {
+		visit(name, roots[name], 0, optional[name])
+	}
+
+	r.result.Packages = []resolvedPackage{}
+	for _, key := range sortedKeys(included) {
+		r.result.Packages = append(r.result.Packages, *included[key])
+	}
+	if r.result.Errors == nil {
+		r.result.Errors = []resolveProblem{}
+	}
+	if r.result.Warnings == nil {
+		r.result.Warnings = []resolveProblem{}
+	}
+}
+
+// pickFor returns the highest picked version satisfying rng.
+func (r *depResolver) pickFor(name, rng string) *PackumentVersion {
+	p := r.packuments[name]
+	var best *PackumentVersion
+	var bestV semver
+	for _, pv := range r.pick(name) {
+		v, ok := parseSemver(pv.Version)
+		if !ok || !satisfies(p, v, rng) {
+			continue
+		}
+		if best == nil || v.compareBuild(bestV) > 0 {
+			best, bestV = pv, v
+		}
+	}
+	return best
+}
+
+// fail reports an edge that can't be resolved: as an error, or as a
+// warning for optionalDependencies, which are best-effort.
+func (r *depResolver) fail(e depEdge, err error) {
+	p := resolveProblem{
+		Name:       e.name,
+		Range:      e.rng,
+		RequiredBy: e.from,
+		Optional:   e.optional,
+		Code:       errorCode(err),
+		Error:      err.Error(),
+	}
+	if e.optional {
+		r.warn(p)
+		return
+	}
+	key := e.name + "@" + e.rng
+	if r.reported[key] {
+		return
+	}
+	r.reported[key] = true
+	r.result.Errors = append(r.result.Errors, p)
+}
+
+func (r *depResolver) warn(p resolveProblem) {
+	key := p.Code + " " + p.Name + "@" + p.Range
+	if r.reported[key] {
+		return
+	}
+	r.reported[key] = true
+	r.result.Warnings = append(r.result.Warnings, p)
+}
+
+// unsupportedSpec rejects dependency specifiers that don't refer to the
+// registry, such as git URLs, tarball URLs, local paths and aliases.
+func unsupportedSpec(spec string) error {
+	if strings.Contains(spec, ":") || strings.Contains(spec, "/") {
+		return newError(http.StatusBadRequest, codeUnsupportedSpec, "unsupported dependency specifier %q", spec)
+	}
+	return nil
+}
+
+// readDependencies accepts either a package.json document or a bare
+// name to range map, and reports which of the dependencies are
+// optionalDependencies.
+func readDependencies(body []byte, dev bool) (deps map[string]string, optional map[string]bool, err error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, nil, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid JSON body")
+	}
+
+	isPackageJSON := false
+	for _, key := range []string{"name", "version", "dependencies", "devDependencies", "optionalDependencies", "peerDependencies"} {
+		if _, ok := doc[key]; ok {
+			isPackageJSON = true
+		}
+	}
+
+	deps, optional = map[string]string{}, map[string]bool{}
+	if !isPackageJSON {
+		if err := json.Unmarshal(body, &deps); err != nil {
+			return nil, nil, wrapError(http.StatusBadRequest, codeBadRequest, err, "expected a package.json or a dependencies map")
+		}
+		return deps, optional, nil
+	}
+
+	fields := []string{"dependencies"}
+	if dev {
+		fields = append(fields, "devDependencies")
+	}
+	fields = append(fields, "optionalDependencies")
+	for _, field := range fields {
+		raw, ok := doc[field]
+		if !ok {
+			continue
+		}
+		var m map[string]string
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, nil, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid %s", field)
+		}
+		for name, rng := range m {
+			deps[name] = rng
+			optional[name] = field == "optionalDependencies"
+		}
+	}
+	return deps, optional, nil
+}
+
+// serveResolve handles POST /api/resolve.
+func serveResolve(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "reading body"))
+		return
+	}
+
+	deps, optional, err := readDependencies(body, c.Query("dev") == "true")
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	target, err := parsePlatform(c.Query("platform"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	depth := config.ResolveMaxDepth
+	if q := c.Query("depth"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 0 {
+			writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid depth %q", q))
+			return
+		}
+		depth = min(n, config.ResolveMaxDepth)
+	}
+
+	result := newDepResolver(tenantOf(c), depth, target).resolve(deps, optional)
+
+	if c.Query("prefetch") != "true" {
+		writeJSON(c, http.StatusOK, result)
+		return
+	}
+
+	items := make([]*prefetchItem, 0, len(result.Packages))
+	for _, p := range result.Packages {
+		items = append(items, &prefetchItem{Package: p.Name, Spec: p.Version, Optional: p.Optional})
+	}
+	job := enqueuePrefetch(items, fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), Timing: newFetchTiming(requestSpan(c)), FetchedBy: fetchedBy(c)})
+	writeJSON(c, http.StatusOK, gin.H{
+		"packages": result.Packages,
+		"errors":   result.Errors,
+		"warnings": result.Warnings,
+		"prefetch": job.snapshot(),
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, x := range list {
+		if x == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEsbuildRegistry publishes a package laid out like esbuild: its binary
+// comes from one of several optionalDependencies, each for one os and cpu,
+// and one of them is missing from the registry, as when a platform's
+// package is unpublished or private.
+func newEsbuildRegistry(t *testing.T) *fakeRegistry {
+	reg := newFakeRegistry(t)
+	platforms := map[string][2]string{
+		"@esbuild/linux-x64":    {"linux", "x64"},
+		"@esbuild/darwin-arm64": {"darwin", "arm64"},
+		"@esbuild/win32-x64":    {"win32", "x64"},
+	}
+	optional := map[string]string{"@esbuild/linux-arm64": "0.20.0"}
+	for name, p := range platforms {
+		reg.publish(name, "0.20.0", map[string]string{"bin/esbuild": name})
+		reg.setMeta(name, "0.20.0", "os", []string{p[0]})
+		reg.setMeta(name, "0.20.0", "cpu", []string{p[1]})
+		optional[name] = "0.20.0"
+	}
+	reg.publish("esbuild", "0.20.0", map[string]string{"lib/main.js": "esbuild"})
+	reg.setMeta("esbuild", "0.20.0", "optionalDependencies", optional)
+	return reg
+}
+
+func TestResolveOptionalPlatforms(t *testing.T) {
+	reg := newEsbuildRegistry(t)
+	s := newTestServer(t, reg, nil)
+	const missing = "not_found @esbuild/linux-arm64"
+
+	for _, tc := range []struct {
+		platform string
+		packages []string
+		warnings []string
+	}{
+		{"", []string{"esbuild"}, []string{
+			missing, "platform_mismatch @esbuild/darwin-arm64", "platform_mismatch @esbuild/linux-x64", "platform_mismatch @esbuild/win32-x64",
+		}},
+		{"linux-x64", []string{"@esbuild/linux-x64", "esbuild"}, []string{
+			missing, "platform_mismatch @esbuild/darwin-arm64", "platform_mismatch @esbuild/win32-x64",
+		}},
+		{"linux", []string{"@esbuild/linux-x64", "esbuild"}, []string{
+			missing, "platform_mismatch @esbuild/darwin-arm64", "platform_mismatch @esbuild/win32-x64",
+		}},
+		{"darwin-arm64", []string{"@esbuild/darwin-arm64", "esbuild"}, []string{
+			missing, "platform_mismatch @esbuild/linux-x64", "platform_mismatch @esbuild/win32-x64",
+		}},
+		{"any", []string{"@esbuild/darwin-arm64", "@esbuild/linux-x64", "@esbuild/win32-x64", "esbuild"}, []string{missing}},
+	} {
+		var result resolveResult
+		body := responseBody(t, s.request("POST", "/api/resolve?platform="+tc.platform, strings.NewReader(`{"dependencies": {"esbuild": "^0.20.0"}}`)), 200)
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+		var packages, warnings []string
+		for _, p := range result.Packages {
+			packages = append(packages, p.Name)
+			if p.Optional != (p.Name != "esbuild") {
+				t.Errorf("%s: %s is optional: %t", tc.platform, p.Name, p.Optional)
+			}
+		}
+		for _, w := range result.Warnings {
+			warnings = append(warnings, w.Code+" "+w.Name)
+			if !w.Optional || w.RequiredBy != "esbuild@0.20.0" {
+				t.Errorf("%s: warning %+v", tc.platform, w)
+			}
+		}
+		sort.Strings(packages)
+		sort.Strings(warnings)
+		if !slices.Equal(packages, tc.packages) || !slices.Equal(warnings, tc.warnings) || len(result.Errors) != 0 {
+			t.Errorf("platform %q: packages %q, warnings %q, errors %+v", tc.platform, packages, warnings, result.Errors)
+		}
+	}
+
+	responseBody(t, s.request("POST", "/api/resolve?platform=!linux", strings.NewReader(`{"esbuild": "^0.20.0"}`)), 400)
+}
+
+func TestPrefetchOptionalPlatforms(t *testing.T) {
+	reg := newEsbuildRegistry(t)
+	s := newTestServer(t, reg, nil)
+
+	var started struct{ Prefetch struct{ ID string } }
+	body := responseBody(t, s.request("POST", "/api/resolve?prefetch=true&platform=linux-x64", strings.NewReader(`{"esbuild": "^0.20.0"}`)), 200)
+	if err := json.Unmarshal([]byte(body), &started); err != nil {
+		t.Fatal(err)
+	}
+	var job struct {
+		Status              string
+		Total, Done, Failed int
+		Items               []prefetchItem
+	}
+	for deadline := time.Now().Add(10 * time.Second); job.Status != jobDone; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %+v", job)
+		}
+		if err := json.Unmarshal([]byte(responseBody(t, s.get("/api/prefetch/"+started.Prefetch.ID), 200)), &job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Total != 2 || job.Done != 2 || job.Failed != 0 {
+		t.Errorf("job %+v", job)
+	}
+	if body := responseBody(t, s.get("/packages/@esbuild/linux-x64@0.20.0/bin/esbuild"), 200); body != "@esbuild/linux-x64" {
+		t.Errorf("got %q", body)
+	}
+	for _, name := range []string{"@esbuild/darwin-arm64", "@esbuild/win32-x64"} {
+		if reg.hits(tarballPath(name, "0.20.0")) != 0 {
+			t.Errorf("%s was downloaded", name)
+		}
+	}
+}
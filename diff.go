@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds of a text diff, and lines of context around each hunk.
+const (
+	diffMaxFileSize = 1 << 20
+	diffMaxEdits    = 5000
+	diffContext     = 3
+)
+
+type diffedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type fileChange struct {
+	Path     string `json:"path"`
+	FromSize int64  `json:"fromSize"`
+	ToSize   int64  `json:"toSize"`
+	Delta    int64  `json:"delta"`
+}
+
+type versionDiff struct {
+	Package   string       `json:"package"`
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Added     []diffedFile `json:"added"`
+	Removed   []diffedFile `json:"removed"`
+	Modified  []fileChange `json:"modified"`
+	Unchanged int          `json:"unchanged"`
+	SizeDelta int64        `json:"sizeDelta"`
+}
+
+// Versions never change, so diffs are kept in memory once computed, up to
+// diffCacheEntries of them.
+const diffCacheEntries = 256
+
+var (
+	diffCacheMu sync.Mutex
+	diffCache   = map[string][]byte{}
+)
+
+func cachedDiff(key string, compute func() ([]byte, error)) ([]byte, error) {
+	diffCacheMu.Lock()
+	data, ok := diffCache[key]
+	diffCacheMu.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	data, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	diffCacheMu.Lock()
+	for k := range diffCache {
+		if len(diffCache) < diffCacheEntries {
+			break
+		}
+		delete(diffCache, k)
+	}
+	diffCache[key] = data
+	diffCacheMu.Unlock()
+	return data, nil
+}
+
+// serveDiff handles GET /api/diff/:scope/:name/:from/:to, summarizing what
+// changed between two cached versions from their manifests, or with
+// ?file=path returning a unified diff of one file. Versions that aren't
+// cached are a 404 unless ?fetch=true fetches them.
+func serveDiff(c *gin.Context) {
+	packageName, rest, err := parsePackageParams(c.Param("package"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if len(rest) != 2 {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "expected /api/diff/<name>/<from>/<to>"))
+		return
+	}
+
+	var versions [2]*Manifest
+	for i, spec := range rest {
+		if c.Query("fetch") == "true" {
+			var ep *ensuredPackage
+			if ep, err = ensurePackage(packageName, spec, fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), FetchedBy: fetchedBy(c)}); err == nil {
+				versions[i] = ep.Manifest
+			}
+		} else {
+			versions[i], err = cachedManifest(tenantOf(c), packageName, spec)
+		}
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+	}
+	from, to := versions[0], versions[1]
+
+	if file := c.Query("file"); file != "" {
+		file = normalizePath(strings.TrimPrefix(file, "/"))
+		t := tenantOf(c)
+		data, err := cachedDiff(t.qualify(packageName+"@"+from.Version+".."+to.Version+"\x00"+file), func() ([]byte, error) {
+			return diffFile(t, from, to, file)
+		})
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", data)
+		return
+	}
+
+	data, err := cachedDiff(packageName+"@"+from.Version+".."+to.Version, func() ([]byte, error) {
+		return json.Marshal(diffManifests(from, to))
+	})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// diffManifests compares two versions by the hashes in their manifests.
+func diffManifests(from, to *Manifest) *versionDiff {
+	d := &versionDiff{Package: from.Name, From: from.Version, To: to.Version, Added: []diffedFile{}, Removed: []diffedFile{}, Modified: []fileChange{}}
+	for _, f := range from.Files {
+		if deny.denied(f.Path) {
+			continue
+		}
+		g, ok := to.Lookup(f.Path)
+		switch {
+		case !ok:
+			d.Removed = append(d.Removed, diffedFile{Path: f.Path, Size: f.Size})
+			d.SizeDelta -= f.Size
+		case g.SHA256 != f.SHA256 || g.Size != f.Size:
+			d.Modified = append(d.Modified, fileChange{Path: f.Path, FromSize: f.Size, ToSize: g.Size, Delta: g.Size - f.Size})
+			d.SizeDelta += g.Size - f.Size
+		default:
+			d.Unchanged++
+		}
+	}
+	for _, g := range to.Files {
+		if _, ok := from.Lookup(g.Path); !ok && !deny.denied(g.Path) {
+			d.Added = append(d.Added, diffedFile{Path: g.Path, Size: g.Size})
+			d.SizeDelta += g.Size
+		}
+	}
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Path < d.Added[j].Path })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Path < d.Removed[j].Path })
+	sort.Slice(d.Modified, func(i, j int) bool { return d.Modified[i].Path < d.Modified[j].Path })
+	return d
+}
+
+// diffFile renders a unified diff of one file between two versions. A file
+// missing from one side diffs against nothing; binary files are only
+// reported as differing, like git does.
+func diffFile(t *tenant, from, to *Manifest, file string) ([]byte, error) {
+	var text [2][]byte
+	found := false
+	for i, m := range []*Manifest{from, to} {
+		f, ok := m.Lookup(file)
+		if !ok || deny.denied(file) {
+			continue
+		}
+		found = true
+		if f.Size > diffMaxFileSize {
+			return nil, newError(http.StatusUnprocessableEntity, codeDiffTooLarge, "%s is larger than %d bytes in %s@%s", file, diffMaxFileSize, m.Name, m.Version)
+		}
+		data, err := readStoredFile(versionDir(t, m.Name, m.Version), f)
+		if err != nil {
+			return nil, err
+		}
+		text[i] = data
+	}
+	if !found {
+		return nil, newError(http.StatusNotFound, codeNotFound, "neither %s@%s nor %s have a file %s", from.Name, from.Version, to.Version, file)
+	}
+
+	if string(text[0]) == string(text[1]) {
+		return []byte{}, nil
+	}
+	if !isText(text[0]) || !isText(text[1]) {
+		return []byte(fmt.Sprintf("Binary files a/%s and b/%s differ\n", file, file)), nil
+	}
+
+	a, b := splitLines(string(text[0])), splitLines(string(text[1]))
+	ops, ok := diffLines(a, b, diffMaxEdits)
+	if !ok {
+		return nil, newError(http.StatusUnprocessableEntity, codeDiffTooLarge, "%s changed in more than %d lines", file, diffMaxEdits)
+	}
+	return []byte(unifiedDiff(file, a, b, ops)), nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffOp is one line of an edit script: kept (' '), deleted from a ('-')
+// or inserted from b ('+'), at positions a and b of the two files.
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// diffLines computes a shortest edit script with Myers' algorithm. It gives
+// up when more than maxEdits lines change.
+func diffLines(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	var trace [][]int
+
+	for d := 0; d <= min(n+m, maxEdits); d++ {
+		// v as left by step d-1, for k in [-d, d].
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			x := v[off+k-1] + 1
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m, d), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func backtrack(trace [][]int, x, y, d int) []diffOp {
+	var ops []diffOp
+	for ; d > 0; d-- {
+		vd := trace[d]
+		at := func(k int) int { return vd[k+d] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			ops = append(ops, diffOp{' ', x, y})
+		}
+		if prevK == k+1 {
+			y--
+			ops = append(ops, diffOp{'+', x, y})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', x, y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		ops = append(ops, diffOp{' ', x, y})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff renders an edit script as hunks with diffContext lines of
+// context.
+func unifiedDiff(name string, a, b []string, ops []diffOp) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		// Changes less than two contexts apart share a hunk.
+		start, end := max(i-diffContext, 0), i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		stop := min(end+diffContext, len(ops))
+
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		aStart, bStart := ops[start].a+1, ops[start].b+1
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:stop] {
+			line := ""
+			if op.kind == '+' {
+				line = b[op.b]
+			} else {
+				line = a[op.a]
+			}
+			out.WriteByte(op.kind)
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+		i = stop
+	}
+	return out.String()
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// `repkg doctor` and GET /api/admin/doctor run the checks support always
+// starts with: the config, the data dir and its disk, the registry, its
+// credentials and the clock, a tarball downloaded and extracted into a
+// temporary directory, and a sample of the cache. Each check is bounded by
+// doctorCheckTimeout and only writes below the data dir's temporary
+// directory, so it is safe to run against a production instance.
+
+const (
+	doctorCheckTimeout = 15 * time.Second
+	// doctorProbe is a small package every npm registry has, asked for
+	// unless another is named.
+	doctorProbe = "is-number"
+	// doctorSample is how many cached versions are checked.
+	doctorSample = 20
+)
+
+var errDiskSpaceUnsupported = errors.New("free disk space isn't known on this platform")
+
+// Check outcomes, the worst of which is the report's status.
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+type doctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Hint says what to do about a warning or failure.
+	Hint string `json:"hint,omitempty"`
+	Ms   int64  `json:"ms"`
+}
+
+type doctorReport struct {
+	Status string        `json:"status"`
+	Probe  string        `json:"probe"`
+	At     time.Time     `json:"at"`
+	Checks []doctorCheck `json:"checks"`
+}
+
+// doctor runs the checks in order; later ones use what earlier ones found.
+type doctor struct {
+	t         *tenant
+	probe     string
+	configErr error
+	// server is set when the checks run in the serving process, whose
+	// index can be sampled.
+	server bool
+
+	pv *PackumentVersion
+}
+
+func (d *doctor) run() *doctorReport {
+	report := &doctorReport{Status: doctorPass, Probe: d.probe, At: time.Now().UTC()}
+	for _, c := range []struct {
+		name string
+		fn   func(ctx context.Context) doctorCheck
+	}{
+		{"config", d.checkConfig},
+		{"data-dir", d.checkDataDir},
+		{"disk", d.checkDisk},
+		{"registry", d.checkRegistry},
+		{"clock", d.checkClock},
+		{"tarball", d.checkTarball},
+		{"cache", d.checkCache},
+	} {
+		check := runDoctorCheck(c.fn)
+		check.Name = c.name
+		report.Checks = append(report.Checks, check)
+		switch {
+		case check.Status == doctorFail:
+			report.Status = doctorFail
+		case check.Status == doctorWarn && report.Status == doctorPass:
+			report.Status = doctorWarn
+		}
+	}
+	return report
+}
+
+// runDoctorCheck runs fn, failing it if it takes longer than
+// doctorCheckTimeout. A check that overruns is left to finish on its own;
+// its requests have timeouts of their own.
+func runDoctorCheck(fn func(ctx context.Context) doctorCheck) doctorCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan doctorCheck, 1)
+	go func() { done <- fn(ctx) }()
+	var check doctorCheck
+	select {
+	case check = <-done:
+	case <-ctx.Done():
+		check = doctorCheck{Status: doctorFail, Message: fmt.Sprintf("timed out after %s", doctorCheckTimeout),
+			Hint: "something is hanging: look for a slow disk or an unresponsive registry or proxy"}
+	}
+	check.Ms = time.Since(start).Milliseconds()
+	return check
+}
+
+func (d *doctor) checkConfig(ctx context.Context) doctorCheck {
+	if d.configErr != nil {
+		return doctorCheck{Status: doctorFail, Message: d.configErr.Error(), Hint: "fix " + configPath + " or the REPKG_ environment variables; repkg won't start with this config"}
+	}
+	if d.server {
+		// What a SIGHUP or a restart would read.
+		if _, err := readConfig(configPath, configExplicit); err != nil {
+			return doctorCheck{Status: doctorWarn, Message: "the running config is valid, but " + configPath + " no longer is: " + err.Error(),
+				Hint: "a restart would fail; fix the file before restarting or sending SIGHUP"}
+		}
+	}
+	if _, err := os.Stat(configPath); err != nil {
+		return doctorCheck{Status: doctorPass, Message: "no " + configPath + "; using the defaults and the environment"}
+	}
+	return doctorCheck{Status: doctorPass, Message: configPath + " is valid"}
+}
+
+func (d *doctor) checkDataDir(ctx context.Context) doctorCheck {
+	info, err := os.Stat(config.DataDir)
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "create " + config.DataDir + " or point dataDir at a mounted volume"}
+	}
+	if !info.IsDir() {
+		return doctorCheck{Status: doctorFail, Message: config.DataDir + " is not a directory", Hint: "point dataDir at a directory"}
+	}
+	if config.ReadOnly {
+		if _, err := os.ReadDir(config.DataDir); err != nil {
+			return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "give repkg read access to " + config.DataDir}
+		}
+		return doctorCheck{Status: doctorPass, Message: config.DataDir + " is readable (read-only replica, nothing written)"}
+	}
+
+	dir, err := newStagingDir()
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "give repkg write access to " + config.DataDir}
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "doctor")
+	want := []byte("repkg doctor " + time.Now().String())
+	if err := os.WriteFile(p, want, 0644); err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "give repkg write access to " + config.DataDir + " and check the disk isn't full"}
+	}
+	got, err := os.ReadFile(p)
+	if err != nil || string(got) != string(want) {
+		return doctorCheck{Status: doctorFail, Message: fmt.Sprintf("a file written to %s read back wrong: %v", dir, err), Hint: "the volume is misbehaving; check its health"}
+	}
+	if err := os.Remove(p); err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "give repkg permission to delete files in " + config.DataDir}
+	}
+	return doctorCheck{Status: doctorPass, Message: config.DataDir + " is writable"}
+}
+
+func (d *doctor) checkDisk(ctx context.Context) doctorCheck {
+	free, total, err := diskSpace(config.DataDir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return doctorCheck{Status: doctorSkip, Message: err.Error()}
+	}
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "check that " + config.DataDir + " is mounted"}
+	}
+	msg := fmt.Sprintf("%s free of %s", formatBytes(int64(free)), formatBytes(int64(total)))
+	hint := "free space, lower maxCacheSize or give the volume more room"
+	switch ratio := float64(free) / float64(max(total, 1)); {
+	case free < 64<<20 || ratio < 0.02:
+		return doctorCheck{Status: doctorFail, Message: msg, Hint: hint}
+	case ratio < 0.1:
+		return doctorCheck{Status: doctorWarn, Message: msg, Hint: hint}
+	}
+	return doctorCheck{Status: doctorPass, Message: msg}
+}
+
+func (d *doctor) checkRegistry(ctx context.Context) doctorCheck {
+	if config.ReadOnly {
+		return doctorCheck{Status: doctorSkip, Message: "a read-only replica never asks the registry"}
+	}
+	cp, err := fetchPackument(d.t, d.probe, nil, nil)
+	if err != nil {
+		check := doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "check " + d.t.registry() + " is reachable from here, and any proxy in between"}
+		switch errorCode(err) {
+		case codeUpstreamAuth, codeUpstreamForbidden:
+			check.Hint = "the registry refused the credentials: check registryToken or registryAuth"
+		case codeNotFound:
+			check.Status = doctorWarn
+			check.Hint = "the registry doesn't have " + d.probe + "; name a package it has to check downloads"
+		case codeUpstreamDNS:
+			check.Hint = "check the registry's host name and the DNS servers"
+		}
+		return check
+	}
+	p := cp.p
+	v := p.DistTags["latest"]
+	if d.pv = p.Versions[v]; d.pv == nil {
+		return doctorCheck{Status: doctorWarn, Message: d.probe + " has no latest version", Hint: "name another package to check downloads"}
+	}
+	return doctorCheck{Status: doctorPass, Message: fmt.Sprintf("fetched %s from %s (latest %s)", d.probe, d.t.registry(), v)}
+}
+
+// checkClock compares the clock with the registry's Date: TLS certificates
+// and signatures are checked against it.
+func (d *doctor) checkClock(ctx context.Context) doctorCheck {
+	if config.ReadOnly {
+		return doctorCheck{Status: doctorSkip, Message: "a read-only replica never asks the registry"}
+	}
+	req, err := newUpstreamRequest(d.t, http.MethodHead, d.t.registry()+"/")
+	if err != nil {
+		return doctorCheck{Status: doctorSkip, Message: err.Error()}
+	}
+	res, err := upstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return doctorCheck{Status: doctorSkip, Message: "couldn't ask the registry the time: " + err.Error()}
+	}
+	res.Body.Close()
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return doctorCheck{Status: doctorSkip, Message: "the registry sent no Date"}
+	}
+	skew := time.Since(date).Round(time.Second)
+	msg := fmt.Sprintf("%s off the registry's clock", skew.Abs())
+	hint := "keep the clock synchronized with NTP; TLS and signature checks depend on it"
+	switch {
+	case skew.Abs() > 5*time.Minute:
+		return doctorCheck{Status: doctorFail, Message: msg, Hint: hint}
+	case skew.Abs() > 30*time.Second:
+		return doctorCheck{Status: doctorWarn, Message: msg, Hint: hint}
+	}
+	return doctorCheck{Status: doctorPass, Message: msg}
+}
+
+// checkTarball downloads and extracts the probe's latest version into a
+// temporary directory, which is removed after; the cache is left alone.
+func (d *doctor) checkTarball(ctx context.Context) doctorCheck {
+	if config.ReadOnly || d.pv == nil {
+		return doctorCheck{Status: doctorSkip, Message: "no version of " + d.probe + " to download"}
+	}
+	URL, err := tarballURL(d.t, d.probe, d.pv)
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "allow the tarball host in upstreamHosts"}
+	}
+	dir, err := newStagingDir()
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "give repkg write access to " + config.DataDir}
+	}
+	defer os.RemoveAll(dir)
+
+	req, err := newUpstreamRequest(d.t, http.MethodGet, URL)
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error()}
+	}
+	res, err := tarballClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "check the tarball host is reachable from here"}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return doctorCheck{Status: doctorFail, Message: "the tarball host answered " + res.Status, Hint: "tarballs may need other credentials than packuments; check registryAuth and redirectAuth"}
+	}
+	fileName := filepath.Join(dir, "package.tgz")
+	f, err := os.Create(fileName)
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error()}
+	}
+	n, err := io.Copy(f, io.LimitReader(res.Body, 16<<20))
+	f.Close()
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "downloads are cut off; check any proxy in between"}
+	}
+	if err := checkTarball(d.t, res, fileName); err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "a proxy or login page answers instead of the registry"}
+	}
+	if _, err := verifyIntegrity(fileName, d.pv); err != nil {
+		return doctorCheck{Status: doctorFail, Message: err.Error(), Hint: "something between the registry and repkg alters tarballs"}
+	}
+	x := newExtraction(filepath.Join(dir, "aside"))
+	size, files, err := extractTarball(fileName, filepath.Join(dir, "contents"), deny, sizeLimits{}, x)
+	if err != nil {
+		return doctorCheck{Status: doctorFail, Message: "extracting: " + err.Error(), Hint: "check the staging directory's filesystem"}
+	}
+	return doctorCheck{Status: doctorPass, Message: fmt.Sprintf("downloaded %s@%s (%s) and extracted %d files (%s)", d.probe, d.pv.Version, formatBytes(n), files, formatBytes(size))}
+}
+
+// checkCache checks that a sample of cached versions still has the files
+// their manifests list, at their sizes: from the index in the serving
+// process, from a walk of the data dir otherwise.
+func (d *doctor) checkCache(ctx context.Context) doctorCheck {
+	var dirs []string
+	if d.server {
+		entries := index.entriesFor(d.t)
+		rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+		for _, e := range entries[:min(len(entries), doctorSample)] {
+			dirs = append(dirs, e.Dir)
+		}
+	} else {
+		dataDir := d.t.dataDir()
+		filepath.WalkDir(dataDir, func(p string, de os.DirEntry, err error) error {
+			if err != nil || len(dirs) >= doctorSample || ctx.Err() != nil {
+				return filepath.SkipAll
+			}
+			if de.IsDir() && de.Name() == internalDir {
+				return filepath.SkipDir
+			}
+			if !de.IsDir() && de.Name() == manifestFile {
+				dirs = append(dirs, filepath.Dir(p))
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+	if len(dirs) == 0 {
+		return doctorCheck{Status: doctorPass, Message: "nothing cached yet"}
+	}
+
+	var broken []string
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			break
+		}
+		if problem := checkCachedVersion(dir); problem != "" {
+			broken = append(broken, problem)
+		}
+	}
+	if len(broken) > 0 {
+		return doctorCheck{Status: doctorFail, Message: fmt.Sprintf("%d of %d versions sampled are damaged: %s", len(broken), len(dirs), strings.Join(broken, "; ")),
+			Hint: "run POST /api/admin/verify to find and repair every damaged version"}
+	}
+	return doctorCheck{Status: doctorPass, Message: fmt.Sprintf("%d versions sampled, all intact", len(dirs))}
+}
+
+// checkCachedVersion reports the first problem with the version in dir, ""
+// for none. Contents aren't hashed; that's for verification.
+func checkCachedVersion(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	m := &Manifest{}
+	if err == nil {
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return filepath.Base(dir) + ": " + err.Error()
+	}
+	for i := range m.Files {
+		f := &m.Files[i]
+		size := f.Size
+		if f.Stored == "br" {
+			size = f.StoredSize
+		}
+		p := f.diskPath(dir)
+		if f.Stored == "br" {
+			p += ".br"
+		}
+		info, err := os.Stat(p)
+		switch {
+		case err != nil:
+			return m.Name + "@" + m.Version + ": " + f.Path + " is missing"
+		case info.Size() != size:
+			return fmt.Sprintf("%s@%s: %s is %d bytes, not %d", m.Name, m.Version, f.Path, info.Size(), size)
+		}
+	}
+	return ""
+}
+
+// serveDoctor handles GET /api/admin/doctor, the checks as run by the
+// server, for the tenant's registry and data dir.
+func serveDoctor(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	probe := c.DefaultQuery("package", doctorProbe)
+	if !validPackageName(probe) {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid package %q", probe))
+		return
+	}
+	d := &doctor{t: tenantOf(c), probe: probe, server: true}
+	c.JSON(http.StatusOK, d.run())
+}
+
+// runDoctor is `repkg doctor [-config file] [package]`: it prints the
+// report and exits 1 when a check failed.
+func runDoctor() {
+	cfg, err := loadConfig()
+	config = cfg
+	deny = newDenylist(config)
+	tenants = setupTenants(config)
+	probe := doctorProbe
+	if flag.NArg() > 0 {
+		probe = flag.Arg(0)
+	}
+	d := &doctor{probe: probe, configErr: err}
+	report := d.run()
+	for _, c := range report.Checks {
+		fmt.Printf("%-4s  %-8s  %s (%dms)\n", strings.ToUpper(c.Status), c.Name, c.Message, c.Ms)
+		if c.Hint != "" && c.Status != doctorPass {
+			fmt.Printf("                %s\n", c.Hint)
+		}
+	}
+	fmt.Println(strings.ToUpper(report.Status))
+	if report.Status == doctorFail {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// randomText is n bytes of hex digits that gzip can't shrink much, so a
+// tarball holding it comes in many chunks.
+func randomText(n int) string {
+	const digits = "0123456789abcdef"
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = digits[r.Intn(len(digits))]
+	}
+	return string(b)
+}
+
+func TestChunkedTarball(t *testing.T) {
+	content := randomText(64 << 10)
+	reg := newFakeRegistry(t)
+	reg.chunked = true
+	reg.publish("big-pad", "1.0.0", map[string]string{"index.js": content})
+	s := newTestServer(t, reg, nil)
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	interval := downloadProgressInterval
+	downloadProgressInterval = 0
+	defer func() { downloadProgressInterval = interval }()
+
+	loc := s.follow(s.get("/npm/big-pad@1.0.0/index.js"), 302)
+	if body := responseBody(t, s.get(loc), 200); body != content {
+		t.Errorf("served %d bytes, want %d", len(body), len(content))
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.DataDir, partitionName(reg.URL), "big-pad", "1.0.0", manifestFile)); err != nil {
+		t.Errorf("not cached: %s", err)
+	}
+	if !strings.Contains(logs.String(), "of unknown size") {
+		t.Errorf("no progress in bytes was logged:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "%") {
+		t.Errorf("progress was logged as a percentage:\n%s", logs.String())
+	}
+}
+
+func TestChunkedTarballOverLimit(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.chunked = true
+	reg.publish("big-pad", "1.0.0", map[string]string{"index.js": randomText(64 << 10)})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.MaxPackageSize = 8 << 10
+	})
+
+	res := s.get("/npm/big-pad@1.0.0/index.js")
+	if res.StatusCode != 413 {
+		t.Fatalf("got %s, want 413", res.Status)
+	}
+	if code := responseCode(t, res); code != codeTooLarge {
+		t.Errorf("code %q", code)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.DataDir, partitionName(reg.URL), "big-pad", "1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("the version was cached: %v", err)
+	}
+}
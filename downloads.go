@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Downloads are the files served of each package, by UTC day, for authors
+// rather than for eviction: unlike usage they count neither listings nor
+// admin requests, and are kept for a year. Days are counted per version for
+// downloadVersionDays, then only per package.
+const (
+	downloadVersionDays = 31
+	downloadDays        = 366
+	dayLayout           = "2006-01-02"
+)
+
+type packageDownloads struct {
+	Days     map[string]int            `json:"days"`               // all versions, by day
+	Versions map[string]map[string]int `json:"versions,omitempty"` // by version, then day
+}
+
+// downloadStats is flushed with usage, by the maintenance loop.
+type downloadStats struct {
+	mu       sync.Mutex
+	packages map[string]*packageDownloads // by tenant-qualified name
+	dirty    bool
+}
+
+var downloads = &downloadStats{packages: map[string]*packageDownloads{}}
+
+func downloadsPath() string {
+	return filepath.Join(config.DataDir, internalDir, "downloads.json")
+}
+
+// countDownload counts a file of a version served for c, unless c is a
+// HEAD or admin request.
+func countDownload(c *gin.Context, name, version string) {
+	if c.Request.Method == http.MethodHead || isAdmin(c.Request) {
+		return
+	}
+	downloads.add(tenantOf(c), name, version, time.Now())
+}
+
+func (d *downloadStats) add(t *tenant, name, version string, at time.Time) {
+	day := at.UTC().Format(dayLayout)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.packages[t.qualify(name)]
+	if !ok {
+		p = &packageDownloads{Days: map[string]int{}, Versions: map[string]map[string]int{}}
+		d.packages[t.qualify(name)] = p
+	}
+	p.Days[day]++
+	if p.Versions[version] == nil {
+		p.Versions[version] = map[string]int{}
+	}
+	p.Versions[version][day]++
+	d.dirty = true
+}
+
+// days returns a package's downloads from start to end (inclusive), by day
+// and, when byVersion, by version.
+func (d *downloadStats) days(t *tenant, name, start, end string, byVersion bool) (days map[string]int, versions map[string]int, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.packages[t.qualify(name)]
+	if !ok {
+		return nil, nil, false
+	}
+	days = map[string]int{}
+	for day, n := range p.Days {
+		if day >= start && day <= end {
+			days[day] = n
+		}
+	}
+	if byVersion {
+		versions = map[string]int{}
+		for v, vdays := range p.Versions {
+			for day, n := range vdays {
+				if day >= start && day <= end {
+					versions[v] += n
+				}
+			}
+		}
+	}
+	return days, versions, true
+}
+
+// prune rolls days older than downloadVersionDays up, leaving them only in
+// the package's totals, which count every version already, and drops days
+// older than downloadDays.
+func (d *downloadStats) prune(now time.Time) {
+	versionsFrom := now.UTC().AddDate(0, 0, -downloadVersionDays+1).Format(dayLayout)
+	from := now.UTC().AddDate(0, 0, -downloadDays+1).Format(dayLayout)
+	for key, p := range d.packages {
+		for v, days := range p.Versions {
+			for day := range days {
+				if day < versionsFrom {
+					delete(days, day)
+					d.dirty = true
+				}
+			}
+			if len(days) == 0 {
+				delete(p.Versions, v)
+			}
+		}
+		for day := range p.Days {
+			if day < from {
+				delete(p.Days, day)
+				d.dirty = true
+			}
+		}
+		if len(p.Days) == 0 {
+			delete(d.packages, key)
+		}
+	}
+}
+
+func (d *downloadStats) load() error {
+	data, err := os.ReadFile(downloadsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	packages := map[string]*packageDownloads{}
+	if err := json.Unmarshal(data, &packages); err != nil {
+		log.Printf("downloads: ignoring %s: %s", downloadsPath(), err)
+		return nil
+	}
+	for _, p := range packages {
+		if p.Days == nil {
+			p.Days = map[string]int{}
+		}
+		if p.Versions == nil {
+			p.Versions = map[string]map[string]int{}
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.packages = packages
+	d.prune(time.Now())
+	return nil
+}
+
+// flush writes the counts to disk if they changed since the last flush.
+func (d *downloadStats) flush() error {
+	d.mu.Lock()
+	d.prune(time.Now())
+	if !d.dirty {
+		d.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(d.packages)
+	d.dirty = false
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	p := downloadsPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	index.setFileSize(p, int64(len(data)))
+	return nil
+}
+
+// downloadPeriod turns a period of npm's downloads API, last-day to
+// last-year or start:end dates, into its first and last day. The last days
+// end today, which is still being counted.
+func downloadPeriod(period string, now time.Time) (start, end string, err error) {
+	today := now.UTC()
+	end = today.Format(dayLayout)
+	days := map[string]int{"last-day": 1, "last-week": 7, "last-month": 30, "last-year": 365}
+	if n, ok := days[period]; ok {
+		return today.AddDate(0, 0, -n+1).Format(dayLayout), end, nil
+	}
+	from, to, ok := strings.Cut(period, ":")
+	s, serr := time.Parse(dayLayout, from)
+	e, eerr := time.Parse(dayLayout, to)
+	if !ok || serr != nil || eerr != nil || e.Before(s) {
+		return "", "", newError(http.StatusBadRequest, codeBadRequest, "period must be last-day, last-week, last-month, last-year or start:end dates, not %q", period)
+	}
+	if e.Sub(s) >= downloadDays*24*time.Hour {
+		return "", "", newError(http.StatusBadRequest, codeBadRequest, "periods can be at most %d days", downloadDays)
+	}
+	return s.Format(dayLayout), e.Format(dayLayout), nil
+}
+
+type downloadDay struct {
+	Day       string `json:"day"`
+	Downloads int    `json:"downloads"`
+}
+
+// serveDownloads handles /api/downloads/:scope/:name, with the downloads
+// of a package over ?period= (last-week by default) shaped as npm's point
+// API, or its range API with ?daily; ?by=version reports them per version
+// like npm's versions API does.
+func serveDownloads(c *gin.Context) {
+	packageName, rest, err := parsePackageParams(c.Param("package"))
+	if err == nil && len(rest) > 0 {
+		err = newError(http.StatusBadRequest, codeBadRequest, "downloads are counted per package; use ?by=version")
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	period := c.DefaultQuery("period", "last-week")
+	start, end, err := downloadPeriod(period, time.Now())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	_, daily := c.GetQuery("daily")
+	byVersion := c.Query("by") == "version"
+	if by := c.Query("by"); by != "" && !byVersion {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "by must be version, not %q", by))
+		return
+	}
+	oldest := time.Now().UTC().AddDate(0, 0, -downloadVersionDays+1).Format(dayLayout)
+	if byVersion && start < oldest {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "downloads per version are only kept for %d days", downloadVersionDays))
+		return
+	}
+
+	t := tenantOf(c)
+	days, versions, ok := downloads.days(t, packageName, start, end, byVersion)
+	if !ok && !cachedPackage(t, packageName) {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "package %s has no downloads and no cached versions", packageName))
+		return
+	}
+
+	body := gin.H{"package": packageName, "start": start, "end": end}
+	switch {
+	case byVersion:
+		if versions == nil {
+			versions = map[string]int{}
+		}
+		body["downloads"] = versions
+	case daily:
+		list := []downloadDay{}
+		s, _ := time.Parse(dayLayout, start)
+		e, _ := time.Parse(dayLayout, end)
+		for day := s; !day.After(e); day = day.AddDate(0, 0, 1) {
+			key := day.Format(dayLayout)
+			list = append(list, downloadDay{key, days[key]})
+		}
+		body["downloads"] = list
+	default:
+		total := 0
+		for _, n := range days {
+			total += n
+		}
+		body["downloads"] = total
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// cachedPackage reports whether any version of a package is cached.
+func cachedPackage(t *tenant, name string) bool {
+	entries := index.entriesFor(t)
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Name >= name })
+	return i < len(entries) && entries[i].Name == name
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Every top-level setting can also be set in the environment, named
+// REPKG_ and its JSON name in upper snake case: dataDir is REPKG_DATA_DIR
+// and maxURLLength REPKG_MAX_URL_LENGTH. Strings are taken as they are,
+// anything else as JSON, durations also as "5m". With _FILE appended, the
+// name is of a file holding the value, as orchestrators mount secrets.
+// The environment wins over the config file.
+const envPrefix = "REPKG_"
+
+// Names of the environment that aren't settings.
+var envOther = map[string]bool{envPrefix + "CONFIG": true}
+
+// envName turns a setting's JSON name into its environment variable, runs
+// of capitals being one word.
+func envName(jsonName string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	r := []rune(jsonName)
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && (unicode.IsLower(r[i-1]) || i+1 < len(r) && unicode.IsLower(r[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+// applyEnv sets the fields of cfg given in environ, a list of KEY=value
+// as os.Environ returns it.
+func applyEnv(cfg *Config, environ []string) error {
+	fields := map[string]reflect.Value{}
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[envName(name)] = v.Field(i)
+		}
+	}
+
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, envPrefix) || envOther[key] {
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			if field, ok = fields[strings.TrimSuffix(key, "_FILE")]; !ok {
+				log.Printf("config: ignoring %s, which is not a setting", key)
+				continue
+			}
+			data, err := os.ReadFile(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	data := []byte(value)
+	if !json.Valid(data) {
+		// Durations and the like, unquoted.
+		data, _ = json.Marshal(value)
+	}
+	return json.Unmarshal(data, field.Addr().Interface())
+}
+
+// inContainer reports whether repkg runs as a container's init process,
+// where the working directory is no place for data.
+func inContainer() bool {
+	if os.Getpid() != 1 {
+		return false
+	}
+	for _, f := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" || os.Getenv("container") != "" {
+		return true
+	}
+	cgroup, _ := os.ReadFile("/proc/self/cgroup")
+	for _, s := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(string(cgroup), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultDataDir is /data, where a volume is expected to be mounted, in a
+// container, and ./packages elsewhere.
+func defaultDataDir() string {
+	if inContainer() {
+		return "/data"
+	}
+	return "packages"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runAsRepkg, set to 1, has the test binary run main.
+const runAsRepkg = "RUN_AS_REPKG"
+
+// TestEnvOnlyConfig runs repkg as a process configured by its environment
+// alone, as in a container: no config file, no flags, a secret from a
+// file, and SIGTERM to stop it.
+func TestEnvOnlyConfig(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	base := "http://" + addr
+
+	data, work := t.TempDir(), t.TempDir()
+	token := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = work // where repkg.json and ./packages would be
+	cmd.Env = []string{
+		runAsRepkg + "=1",
+		"REPKG_ADDR=" + addr,
+		"REPKG_REGISTRY=" + reg.URL,
+		"REPKG_DATA_DIR=" + data,
+		"REPKG_ADMIN_TOKEN_FILE=" + token,
+		"REPKG_MAX_URL_LENGTH=200",
+		"REPKG_SHUTDOWN_TIMEOUT=5s",
+	}
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		if t.Failed() {
+			t.Logf("repkg's output:\n%s", output.String())
+		}
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	do := func(method, p, auth string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+p, strings.NewReader(`{"package": "left-pad"}`))
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body bytes.Buffer
+		body.ReadFrom(res.Body)
+		res.Body.Close()
+		return res.StatusCode, body.String()
+	}
+
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if res, err := client.Get(base + "/api/ready"); err == nil {
+			res.Body.Close()
+			if res.StatusCode == 200 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("repkg never got ready")
+		}
+	}
+
+	if status, body := do("GET", "/npm/left-pad@1.0.0/index.js", ""); status != 200 || body != "padded" {
+		t.Errorf("got %d: %q", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(data, partitionName(reg.URL), "left-pad", "1.0.0", "index.js")); err != nil {
+		t.Errorf("not in REPKG_DATA_DIR: %s", err)
+	}
+	if status, _ := do("GET", "/npm/left-pad@1.0.0/"+strings.Repeat("a", 200), ""); status != http.StatusRequestURITooLong {
+		t.Errorf("REPKG_MAX_URL_LENGTH: got %d", status)
+	}
+	if status, _ := do("POST", "/api/admin/purge", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("a wrong token: got %d", status)
+	}
+	// The file's trailing newline isn't part of the token.
+	if status, body := do("POST", "/api/admin/purge", "s3cret"); status != 200 {
+		t.Errorf("REPKG_ADMIN_TOKEN_FILE: got %d: %s", status, body)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("exited with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("still running 10s after SIGTERM")
+	}
+	if !strings.Contains(output.String(), "Server exiting") {
+		t.Errorf("didn't shut down gracefully")
+	}
+	if entries, _ := os.ReadDir(work); len(entries) != 0 {
+		t.Errorf("wrote to the working directory: %v", entries)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in JSON error responses.
+const (
+	codeNotFound            = "not_found"
+	codeBadRequest          = "bad_request"
+	codeUpstream            = "upstream_error"
+	codeInternal            = "internal_error"
+	codeVersionNotFound     = "version_not_found"
+	codeIntegrity           = "integrity_mismatch"
+	codeSignatureMissing    = "signature_missing"
+	codeSignatureInvalid    = "signature_invalid"
+	codeNotAllowed          = "package_not_allowed"
+	codeUnsupportedSpec     = "unsupported_specifier"
+	codeTooLarge            = "package_too_large"
+	codeBatchTooLarge       = "batch_too_large"
+	codeBuildFailed         = "build_failed"
+	codeWithdrawn           = "version_withdrawn"
+	codeUnauthorized        = "unauthorized"
+	codeDiffTooLarge        = "diff_too_large"
+	codeQuotaExceeded       = "quota_exceeded"
+	codeURITooLong          = "uri_too_long"
+	codeCorrupt             = "version_corrupt"
+	codeVerifyRunning       = "verification_running"
+	codeNotCached           = "not_cached"
+	codeReadOnly            = "read_only"
+	codeStarting            = "starting"
+	codeStopping            = "stopping"
+	codeExtractFailed       = "extraction_failed"
+	codeApprovalRequired    = "approval_required"
+	codeSecurityHolder      = "security_holder"
+	codeTransformsBusy      = "transforms_busy"
+	codeBodyTooLarge        = "body_too_large"
+	codeUnsupportedEncoding = "unsupported_encoding"
+	codeAddressNotAllowed   = "address_not_allowed"
+	codeTampered            = "version_tampered"
+
+	codeUpstreamForbidden   = "upstream_forbidden"
+	codeUpstreamAuth        = "upstream_auth_failed"
+	codeUpstreamDNS         = "upstream_dns_error"
+	codeUpstreamUnreachable = "upstream_unreachable"
+	codeUpstreamUnavailable = "upstream_unavailable"
+	codeUpstreamContent     = "upstream_wrong_content"
+)
+
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+
+	// Details are added to the JSON response next to code and error.
+	Details map[string]any
+	// Header is set on the response.
+	Header http.Header
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+func newError(status int, code string, format string, args ...any) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func wrapError(status int, code string, err error, format string, args ...any) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// errorCode returns the code an error is reported with.
+func errorCode(err error) string {
+	var e *apiError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return codeInternal
+}
+
+// writeError renders err as {"code": ..., "error": ...} plus its details,
+// or as an HTML page for clients that prefer HTML to JSON. Errors that are
+// not an *apiError are logged and reported as internal errors. A replica's
+// misses send the client to the writer instead, when it has one.
+func writeError(c *gin.Context, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		log.Printf("%s %s: %s", c.Request.Method, c.Request.URL.Path, err)
+		e = &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Message: "internal server error"}
+	}
+
+	if e.Code == codeNotCached && config.WriterURL != "" {
+		redirectToWriter(c)
+		return
+	}
+
+	copyHeaders(c.Writer.Header(), e.Header)
+	c.Writer.Header().Add("Vary", "Accept")
+	if prefersHTML(c.Request) {
+		writeErrorPage(c, e)
+		return
+	}
+
+	body := gin.H{}
+	for k, v := range e.Details {
+		body[k] = v
+	}
+	body["code"] = e.Code
+	body["error"] = e.Error()
+	c.AbortWithStatusJSON(e.Status, body)
+}
+
+// writeErrorPage renders an error for a browser, with the "did you mean"
+// suggestions of a missing file as links. Error pages are never cached.
+func writeErrorPage(c *gin.Context, e *apiError) {
+	var b strings.Builder
+	title := html.EscapeString(fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)))
+	fmt.Fprintf(&b, "<!doctype html>\n<title>%s</title>\n<h1>%s</h1>\n", title, title)
+	fmt.Fprintf(&b, "<p>%s</p>\n<p><code>%s</code></p>\n", html.EscapeString(e.Error()), html.EscapeString(e.Code))
+
+	name, _ := e.Details["package"].(string)
+	version, _ := e.Details["version"].(string)
+	if suggestions, ok := e.Details["suggestions"].([]string); ok && len(suggestions) > 0 {
+		b.WriteString("<p>Did you mean:</p>\n<ul>\n")
+		for _, s := range suggestions {
+			fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(withAccessKey(c, packageURL(tenantOf(c), name, version, s))), html.EscapeString(s))
+		}
+		b.WriteString("</ul>\n")
+	}
+	if name != "" && version != "" {
+		fmt.Fprintf(&b, "<p><a href=\"%s\">Browse %s</a></p>\n", html.EscapeString(withAccessKey(c, packageURL(tenantOf(c), name, version, ""))), html.EscapeString(name+"@"+version))
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(e.Status, "text/html; charset=utf-8", []byte(b.String()))
+	c.Abort()
+}
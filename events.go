@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/events streams what happens to the cache as server-sent events,
+// for indexers that would otherwise poll /api/packages. Event IDs only
+// grow, so a client reconnecting with the Last-Event-ID it last saw gets
+// what it missed first. The latest config.EventsRetained events are kept
+// for that, in memory and appended to events.jsonl in the data dir, which
+// is rewritten with just those once it holds twice as many; a client
+// further behind gets a resync-required event and should list the cache
+// again.
+
+// Event types.
+const (
+	eventVersionCached  = "version-cached"
+	eventVersionPurged  = "version-purged"
+	eventVersionEvicted = "version-evicted"
+	eventTagChanged     = "tag-resolution-changed"
+	eventWithdrawn      = "package-withdrawn"
+	eventResync         = "resync-required"
+)
+
+// eventHeartbeat is how often an idle stream gets a comment, so proxies
+// don't time it out.
+const eventHeartbeat = 30 * time.Second
+
+var (
+	eventsEmitted = newCounter("repkg_events_total", "Cache events emitted, by type.")
+
+	_ = newGaugeFunc("repkg_event_subscribers", "Clients streaming /api/events.", func() float64 {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		return float64(len(events.subscribers))
+	})
+
+	events = &eventLog{next: 1, subscribers: map[chan cacheEvent]bool{}}
+)
+
+type cacheEvent struct {
+	ID      uint64 `json:"id"`
+	Type    string `json:"type"`
+	Tenant  string `json:"tenant,omitempty"`
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Tag is the dist-tag of a tag-resolution-changed event and Previous
+	// the version it resolved to before, empty for a new tag. Reason is
+	// why a version was withdrawn.
+	Tag      string    `json:"tag,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+type eventLog struct {
+	mu sync.Mutex
+	// ring holds the latest events, oldest first, and next is the ID of
+	// the next one. written counts the lines of the file.
+	ring    []cacheEvent
+	next    uint64
+	written int
+
+	subscribers map[chan cacheEvent]bool
+	closed      bool
+}
+
+func eventsPath() string {
+	return filepath.Join(config.DataDir, internalDir, "events.jsonl")
+}
+
+// load reads the events a previous run kept, skipping lines cut short.
+func (l *eventLog) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ring, l.next, l.written = nil, 1, 0
+	l.subscribers, l.closed = map[chan cacheEvent]bool{}, false
+	data, err := os.ReadFile(eventsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e cacheEvent
+		if len(line) == 0 || json.Unmarshal(line, &e) != nil || e.ID < l.next {
+			continue
+		}
+		l.ring = append(l.ring, e)
+		l.next = e.ID + 1
+		l.written++
+	}
+	if n := len(l.ring) - config.EventsRetained; n > 0 {
+		l.ring = l.ring[n:]
+	}
+	return nil
+}
+
+// emit records an event and sends it to the streams. A stream too slow to
+// take it is closed; its client catches up when it reconnects.
+func (l *eventLog) emit(e cacheEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.ID, e.At = l.next, time.Now().UTC()
+	l.next++
+	l.ring = append(l.ring, e)
+	if n := len(l.ring) - config.EventsRetained; n > 0 {
+		l.ring = l.ring[n:]
+	}
+	if err := l.persist(e); err != nil {
+		log.Printf("events: %s", err)
+	}
+	eventsEmitted.Inc("type", e.Type)
+	for ch := range l.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// persist appends e to the file, or rewrites it with the ring once it
+// holds twice as many events. Callers hold l.mu.
+func (l *eventLog) persist(e cacheEvent) error {
+	if l.written+1 >= 2*config.EventsRetained {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		for _, e := range l.ring {
+			enc.Encode(e)
+		}
+		l.written = len(l.ring)
+		return writeDerived(eventsPath(), b.Bytes())
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	err = makeParents(eventsPath(), func() (err error) {
+		f, err = os.OpenFile(eventsPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l.written++
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// subscribe starts a stream of the events of tenant tn. With resume, it also
+// returns those after ID after, or resync when some of them are no longer
+// kept. ch is nil once the server is stopping.
+func (l *eventLog) subscribe(tn string, resume bool, after uint64) (backlog []cacheEvent, latest uint64, resync bool, ch chan cacheEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, 0, false, nil
+	}
+	latest = l.next - 1
+	if resume {
+		oldest := l.next
+		if len(l.ring) > 0 {
+			oldest = l.ring[0].ID
+		}
+		// An ID from the future is from a data dir since wiped.
+		resync = after+1 < oldest || after > latest
+		for _, e := range l.ring {
+			if !resync && e.ID > after && e.Tenant == tn {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	ch = make(chan cacheEvent, 256)
+	l.subscribers[ch] = true
+	return backlog, latest, resync, ch
+}
+
+func (l *eventLog) unsubscribe(ch chan cacheEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subscribers[ch] {
+		delete(l.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close ends every stream, so that shutting down doesn't wait on them.
+func (l *eventLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for ch := range l.subscribers {
+		delete(l.subscribers, ch)
+		close(ch)
+	}
+}
+
+// emitVersionEvent records an event about a version of t.
+func emitVersionEvent(t *tenant, kind, name, version string) {
+	events.emit(cacheEvent{Type: kind, Tenant: t.Name(), Package: name, Version: version})
+}
+
+// emitTagChanges records the dist-tags of a package that resolve to other
+// versions in fresh than they did in prev.
+func emitTagChanges(t *tenant, name string, prev, fresh *Packument) {
+	if prev == nil || fresh == nil {
+		return
+	}
+	for tag, v := range fresh.DistTags {
+		if old := prev.DistTags[tag]; old != v {
+			events.emit(cacheEvent{Type: eventTagChanged, Tenant: t.Name(), Package: name, Version: v, Tag: tag, Previous: old})
+		}
+	}
+}
+
+// serveEvents handles GET /api/events, the tenant's events as they happen,
+// after those since Last-Event-ID (or ?lastEventId=) when given.
+func serveEvents(c *gin.Context) {
+	last := c.GetHeader("Last-Event-ID")
+	if last == "" {
+		last = c.Query("lastEventId")
+	}
+	var after uint64
+	if last != "" {
+		var err error
+		if after, err = strconv.ParseUint(last, 10, 64); err != nil {
+			writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid event ID %q", last))
+			return
+		}
+	}
+	tn := tenantOf(c).Name()
+	backlog, latest, resync, ch := events.subscribe(tn, last != "", after)
+	if ch == nil {
+		writeError(c, newError(http.StatusServiceUnavailable, codeStopping, "repkg is stopping"))
+		return
+	}
+	defer events.unsubscribe(ch)
+
+	h := c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// For nginx, which buffers responses otherwise.
+	h.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if resync {
+		// Its ID is where to resume once the cache is listed again.
+		writeEvent(c, cacheEvent{ID: latest, Type: eventResync, Tenant: tn, At: time.Now().UTC()})
+	}
+	for _, e := range backlog {
+		writeEvent(c, e)
+	}
+	fmt.Fprint(c.Writer, ": connected\n\n")
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if e.Tenant == tn {
+				writeEvent(c, e)
+				c.Writer.Flush()
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": ping\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(c *gin.Context, e cacheEvent) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of config.EvictionPolicy.
+const (
+	evictLRU        = "lru"
+	evictPopularity = "popularity"
+)
+
+// Versions cached within evictGrace are never evicted, so a version isn't
+// removed between being fetched and being served.
+const evictGrace = 5 * time.Minute
+
+var (
+	versionsEvicted = newCounter("repkg_versions_evicted_total", "Package versions evicted to stay under maxCacheBytes.")
+
+	evictMu sync.Mutex
+)
+
+// runMaintenance persists request counts and evicts versions every
+// usageFlush, and saves the warm-start list every warmStartSaveInterval, for
+// as long as the process runs.
+func runMaintenance() {
+	saved := time.Now()
+	for range time.Tick(usageFlush) {
+		if err := usage.flush(); err != nil {
+			log.Printf("usage: %s", err)
+		}
+		if err := downloads.flush(); err != nil {
+			log.Printf("downloads: %s", err)
+		}
+		runEviction()
+		if time.Since(saved) >= warmStartSaveInterval {
+			if err := saveWarmStart(); err != nil {
+				log.Printf("warm start: %s", err)
+			}
+			saved = time.Now()
+		}
+	}
+}
+
+// evictionRun is what a run of evictVersions removed or, as a dry run,
+// would have.
+type evictionRun struct {
+	DryRun   bool           `json:"dryRun,omitempty"`
+	Total    int64          `json:"total"` // bytes on disk before the run
+	Limit    int64          `json:"limit"`
+	Versions []packageUsage `json:"versions"`
+	Bytes    int64          `json:"bytes"`
+}
+
+// runEviction is the scheduled eviction, which only logs what it would
+// remove with config.EvictionReportOnly. It skips a run when another is
+// under way.
+func runEviction() {
+	if config.MaxCacheBytes <= 0 || !evictMu.TryLock() {
+		return
+	}
+	defer evictMu.Unlock()
+	run := evictVersions(config.EvictionReportOnly)
+	if run.DryRun && len(run.Versions) > 0 {
+		log.Printf("evict: report only, would remove %d versions (%d bytes) of %d bytes cached", len(run.Versions), run.Bytes, run.Total)
+	}
+}
+
+// evictVersions removes versions until the ones on disk take at most
+// config.MaxCacheBytes, sparing pinned ones. With the lru policy the least
+// recently requested go first; with popularity the least requested over the
+// last week, so a steadily used old version outlives a new one requested
+// once. A dry run only lists them. The caller holds evictMu.
+func evictVersions(dryRun bool) *evictionRun {
+	_, total, _ := index.totals()
+	run := &evictionRun{DryRun: dryRun, Total: total, Limit: config.MaxCacheBytes, Versions: []packageUsage{}}
+	if config.MaxCacheBytes <= 0 || total <= config.MaxCacheBytes {
+		return run
+	}
+
+	candidates := withUsage(index.entries())
+	lastUsed := func(p packageUsage) time.Time {
+		if p.LastSeen != nil {
+			return *p.LastSeen
+		}
+		return p.CachedAt
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if config.EvictionPolicy == evictPopularity && a.Requests7d != b.Requests7d {
+			return a.Requests7d < b.Requests7d
+		}
+		return lastUsed(a).Before(lastUsed(b))
+	})
+
+	for _, c := range candidates {
+		if total <= config.MaxCacheBytes {
+			break
+		}
+		if c.Pinned || time.Since(c.CachedAt) < evictGrace {
+			continue
+		}
+		if dryRun {
+			log.Printf("evict: would remove %s@%s (%d bytes, %d requests in 7d)", c.Name, c.Version, c.Size, c.Requests7d)
+		} else if err := removeVersion(c.tenant, c.Name, c.Version); err != nil {
+			log.Printf("evict: %s@%s: %s", c.Name, c.Version, err)
+			continue
+		} else {
+			log.Printf("evict: removed %s@%s (%d bytes, %d requests in 7d)", c.Name, c.Version, c.Size, c.Requests7d)
+			versionsEvicted.Inc()
+			emitVersionEvent(c.tenant, eventVersionEvicted, c.Name, c.Version)
+		}
+		run.Versions = append(run.Versions, c)
+		run.Bytes += c.Size
+		total -= c.Size
+	}
+	return run
+}
+
+// serveEvict handles POST /api/admin/evict, running eviction now, or with
+// ?dry-run=true listing what it would remove.
+func serveEvict(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	evictMu.Lock()
+	run := evictVersions(c.Query("dry-run") == "true")
+	evictMu.Unlock()
+	writeJSON(c, http.StatusOK, run)
+}
+
+// removeVersion deletes a cached version along with what was derived from
+// it. The directory is first moved aside so it disappears at once.
+func removeVersion(t *tenant, name, version string) error {
+	dir := versionDir(t, name, version)
+	updateAliases(t, name, version)
+	staging, err := newStagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Rename(dir, filepath.Join(staging, "version")); err != nil {
+		return err
+	}
+	pruneEmptyParents(dir, t.dataDir())
+
+	manifests.Delete(dir)
+	hotCache.invalidateVersion(dir)
+	index.removeVersion(t, name, version)
+	usage.forget(t, name, version)
+
+	derived := derivedDir(t, name, version)
+	index.removeFiles(derived)
+	if err := os.RemoveAll(derived); err != nil {
+		return err
+	}
+	pruneEmptyParents(derived, filepath.Join(t.dataDir(), internalDir, "derived"))
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (s *testServer) purge(name, version string) {
+	s.t.Helper()
+	responseBody(s.t, s.purgeRequest(name, version), 200)
+}
+
+func (s *testServer) purgeRequest(name, version string) *http.Response {
+	body := `{"package": "` + name + `", "version": "` + version + `"}`
+	return s.request("POST", "/api/admin/purge", strings.NewReader(body), "Authorization", "Bearer admin", "Content-Type", "application/json")
+}
+
+// exists reports whether p, relative to the partition of s's registry, is
+// on disk.
+func (s *testServer) exists(p string) bool {
+	_, err := os.Stat(filepath.Join(s.cfg.DataDir, partitionName(s.registry.URL), filepath.FromSlash(p)))
+	return err == nil
+}
+
+func newEvictServer(t *testing.T) *testServer {
+	reg := newFakeRegistry(t)
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{"index.js": "1.0"})
+	reg.publish("@scope/pkg", "1.1.0", map[string]string{"index.js": "1.1"})
+	reg.publish("@scope/other", "1.0.0", map[string]string{"index.js": "other"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AdminToken = "admin"
+	})
+	for _, p := range []string{"@scope/pkg@1.0.0", "@scope/pkg@1.1.0", "@scope/other@1.0.0"} {
+		s.follow(s.get("/npm/"+p+"/index.js"), 302)
+	}
+	return s
+}
+
+func TestPurgeLastVersion(t *testing.T) {
+	s := newEvictServer(t)
+
+	s.purge("@scope/pkg", "1.0.0")
+	if s.exists("@scope/pkg/1.0.0") || !s.exists("@scope/pkg/1.1.0") {
+		t.Fatalf("purged the wrong version")
+	}
+	s.purge("@scope/pkg", "1.1.0")
+	if s.exists("@scope/pkg") {
+		t.Errorf("@scope/pkg is left without versions")
+	}
+	if !s.exists("@scope/other/1.0.0") {
+		t.Errorf("@scope went with its other package")
+	}
+	for _, e := range index.entriesFor(nil) {
+		if e.Name == "@scope/pkg" {
+			t.Errorf("%s@%s is still indexed", e.Name, e.Version)
+		}
+	}
+
+	s.purge("@scope/other", "")
+	if s.exists("@scope") {
+		t.Errorf("@scope is left empty")
+	}
+	if !s.exists("") || !s.exists(partitionFile) {
+		t.Errorf("the partition went with its last package")
+	}
+	if body := responseBody(t, s.get("/api/packages"), 200); !strings.Contains(body, `"packages":[]`) {
+		t.Errorf("still listed: %s", body)
+	}
+}
+
+func TestEvictLastVersion(t *testing.T) {
+	s := newEvictServer(t)
+	// Versions are only evicted once out of their grace period.
+	old := time.Now().Add(-2 * evictGrace)
+	for _, e := range index.entriesFor(nil) {
+		if _, err := updateManifest(nil, e.Dir, e.Name, e.Version, func(m *Manifest) { m.Extracted = old }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.cfg.MaxCacheBytes = 1
+	s = s.restart()
+	s.purge("@scope/other", "1.0.0")
+
+	var run evictionRun
+	body := responseBody(t, s.request("POST", "/api/admin/evict", nil, "Authorization", "Bearer admin"), 200)
+	if err := json.Unmarshal([]byte(body), &run); err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Versions) != 2 || run.Versions[0].Name != "@scope/pkg" || run.Versions[1].Name != "@scope/pkg" {
+		t.Errorf("evicted %s", body)
+	}
+	if s.exists("@scope") {
+		t.Errorf("@scope is left empty")
+	}
+	if len(index.entriesFor(nil)) != 0 {
+		t.Errorf("still indexed: %v", index.entriesFor(nil))
+	}
+	if res := s.get("/packages/@scope/pkg@1.1.0/index.js"); res.StatusCode != 404 {
+		t.Errorf("an evicted version was served: %s", res.Status)
+	}
+
+	// And it comes back, without starting an eviction that would outlive
+	// the test.
+	config.MaxCacheBytes = 0
+	loc := s.follow(s.get("/npm/@scope/pkg@1.1.0/index.js"), 302)
+	if body := responseBody(t, s.get(loc), 200); body != "1.1" {
+		t.Errorf("got %q", body)
+	}
+}
+
+// TestPurgeRacingServe purges the last version of a package while it is
+// served and while another version of it is fetched, which makes its
+// directories again as the purge prunes them.
+func TestPurgeRacingServe(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{"index.js": "1.0"})
+	reg.publish("@scope/pkg", "1.1.0", map[string]string{"index.js": "1.1"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AdminToken = "admin"
+	})
+
+	for i := 0; i < 20; i++ {
+		s.follow(s.get("/npm/@scope/pkg@1.0.0/index.js"), 302)
+
+		var wg sync.WaitGroup
+		statuses := make(chan string, 8)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if res := s.purgeRequest("@scope/pkg", "1.0.0"); res.StatusCode != 200 {
+				statuses <- "purging 1.0.0: " + res.Status
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				res := s.get("/packages/@scope/pkg@1.0.0/index.js")
+				body, err := io.ReadAll(res.Body)
+				if err != nil || res.StatusCode != 404 && (res.StatusCode != 200 || string(body) != "1.0") {
+					statuses <- fmt.Sprintf("serving 1.0.0: %s: %q, %v", res.Status, body, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			res := s.get("/npm/@scope/pkg@1.1.0/index.js")
+			if res.StatusCode != 302 {
+				statuses <- "fetching 1.1.0: " + res.Status
+			}
+		}()
+		wg.Wait()
+		close(statuses)
+		for status := range statuses {
+			t.Errorf("round %d: %s", i, status)
+		}
+
+		// The version fetched during the purge is whole.
+		if body := responseBody(t, s.get("/packages/@scope/pkg@1.1.0/index.js"), 200); body != "1.1" {
+			t.Fatalf("round %d: got %q", i, body)
+		}
+		if s.exists("@scope/pkg/1.0.0") {
+			t.Fatalf("round %d: 1.0.0 wasn't purged", i)
+		}
+		s.purge("@scope/pkg", "1.1.0")
+		if s.exists("@scope") {
+			t.Fatalf("round %d: @scope is left empty", i)
+		}
+	}
+}
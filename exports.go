@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Conditions honoured in package.json "exports", as a browser loading ESM
+// would, along with the env's: "production" or "development".
+var exportConditions = map[string]bool{"browser": true, "import": true, "module": true, "default": true}
+
+// Values of ?env=, which picks between a package's development and
+// production builds: the export condition that is honoured and, in
+// bundles, process.env.NODE_ENV. "" is production.
+const (
+	envProduction  = "production"
+	envDevelopment = "development"
+)
+
+// parseEnv reads the ?env= of a request.
+func parseEnv(c *gin.Context) (string, error) {
+	switch q := c.Query("env"); q {
+	case "", envProduction:
+		return envProduction, nil
+	case envDevelopment:
+		return envDevelopment, nil
+	default:
+		return "", newError(http.StatusBadRequest, codeBadRequest, "env must be %q or %q, not %q", envProduction, envDevelopment, q)
+	}
+}
+
+// Values of ManifestFile.ModuleType, for how Node would load a file.
+const (
+	moduleESM = "esm"
+	moduleCJS = "cjs"
+)
+
+// classifyModules sets the ModuleType of the JavaScript files of m, as
+// Node decides it: .mjs files are ESM and .cjs CommonJS, while .js files,
+// and JavaScript without an extension, follow the "type" of the nearest
+// package.json, nested ones included, and are CommonJS without one.
+func classifyModules(dir string, m *Manifest) {
+	types := map[string]string{}
+	for i := range m.Files {
+		f := &m.Files[i]
+		if path.Base(f.Path) != "package.json" {
+			continue
+		}
+		var pkg struct {
+			Type string `json:"type"`
+		}
+		if data, err := readStoredFile(dir, f); err == nil {
+			json.Unmarshal(data, &pkg)
+		}
+		types[path.Dir(f.Path)] = pkg.Type
+	}
+	for i := range m.Files {
+		f := &m.Files[i]
+		f.ModuleType = ""
+		switch ext := path.Ext(f.Path); {
+		case ext == ".mjs":
+			f.ModuleType = moduleESM
+		case ext == ".cjs":
+			f.ModuleType = moduleCJS
+		case ext == ".js" || ext == "" && strings.Contains(f.ContentType, "javascript"):
+			f.ModuleType = moduleCJS
+			if nearestType(types, f.Path) == "module" {
+				f.ModuleType = moduleESM
+			}
+		}
+	}
+}
+
+// nearestType is the "type" of the package.json nearest to p, from the
+// types of those in m by directory.
+func nearestType(types map[string]string, p string) string {
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if t, ok := types[dir]; ok || dir == "." {
+			return t
+		}
+	}
+}
+
+// setModuleTypeHeader tells the loader how Node would load f, for
+// JavaScript files.
+func setModuleTypeHeader(c *gin.Context, f *ManifestFile) {
+	if f != nil && f.ModuleType != "" {
+		c.Header("X-Module-Type", f.ModuleType)
+	}
+}
+
+// Extensions tried, in order, for imports that leave them out.
+var resolveExts = []string{".js", ".mjs", ".cjs", ".jsx", ".ts", ".tsx", ".json", ".css"}
+
+type packageJSON struct {
+	Name        string          `json:"name"`
+	Version     string          `json:"version"`
+	Description string          `json:"description"`
+	Module      string          `json:"module"`
+	Type        string          `json:"type"`
+	Main        string          `json:"main"`
+	Browser     json.RawMessage `json:"browser"`
+	Exports     json.RawMessage `json:"exports"`
+	Types       string          `json:"types"`
+	Typings     string          `json:"typings"`
+	// TypesVersions is kept raw, as the order of its ranges matters.
+	TypesVersions json.RawMessage `json:"typesVersions"`
+	License       json.RawMessage `json:"license"`
+	SideEffects   json.RawMessage `json:"sideEffects"`
+	Files         []string        `json:"files"`
+
+	Dependencies         map[string]string `json:"dependencies"`
+	PeerDependencies     map[string]string `json:"peerDependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+
+	PeerDependenciesMeta map[string]struct {
+		Optional bool `json:"optional"`
+	} `json:"peerDependenciesMeta"`
+}
+
+// readPackageJSON returns the version's package.json, or an empty one. It
+// is parsed once, when the manifest is loaded.
+func readPackageJSON(dir string, m *Manifest) *packageJSON {
+	if m.pkg != nil {
+		return m.pkg
+	}
+	return loadPackageJSON(dir, m)
+}
+
+func loadPackageJSON(dir string, m *Manifest) *packageJSON {
+	pkg := &packageJSON{}
+	if f, ok := m.Lookup("package.json"); ok {
+		if data, err := readStoredFile(dir, f); err == nil {
+			json.Unmarshal(data, pkg)
+		}
+	}
+	return pkg
+}
+
+// essentials is what the manifest keeps of pkg.
+func (pkg *packageJSON) essentials() *ManifestPackage {
+	e := &ManifestPackage{Main: pkg.Main, Module: pkg.Module, Type: pkg.Type, Types: pkg.Types}
+	if e.Types == "" {
+		e.Types = pkg.Typings
+	}
+	json.Unmarshal(pkg.Browser, &e.Browser)
+	e.Exports = len(pkg.Exports) > 0 && !bytes.Equal(bytes.TrimSpace(pkg.Exports), []byte("null"))
+	// Either "MIT" or, in older packages, {"type": "MIT"}.
+	if json.Unmarshal(pkg.License, &e.License) != nil {
+		var l struct{ Type string }
+		json.Unmarshal(pkg.License, &l)
+		e.License = l.Type
+	}
+	e.SideEffects = parseSideEffects(pkg.SideEffects)
+	e.Files = pkg.Files
+	if e.empty() {
+		return nil
+	}
+	return e
+}
+
+// sideEffects is package.json's "sideEffects": whether modules of the
+// package do something when imported, or the patterns of those that do.
+// Without one, they all might.
+type sideEffects struct {
+	all   bool
+	files []string
+}
+
+// parseSideEffects reads "sideEffects", true, false or a list of patterns;
+// nil when it is missing or neither.
+func parseSideEffects(data json.RawMessage) *sideEffects {
+	s := &sideEffects{}
+	if json.Unmarshal(data, &s.all) == nil {
+		return s
+	}
+	if json.Unmarshal(data, &s.files) == nil && s.files != nil {
+		return s
+	}
+	return nil
+}
+
+func (s *sideEffects) MarshalJSON() ([]byte, error) {
+	if s.files != nil {
+		return json.Marshal(s.files)
+	}
+	return json.Marshal(s.all)
+}
+
+func (s *sideEffects) UnmarshalJSON(data []byte) error {
+	if p := parseSideEffects(data); p != nil {
+		*s = *p
+	} else {
+		s.all = true
+	}
+	return nil
+}
+
+// has reports whether the module at p, relative to the package root, may
+// have side effects. As bundlers take them, patterns without a slash match
+// the file's name in any directory.
+func (s *sideEffects) has(p string) bool {
+	if s == nil || s.files == nil {
+		return s == nil || s.all
+	}
+	segs := strings.Split(p, "/")
+	for _, pattern := range s.files {
+		pattern = strings.TrimPrefix(pattern, "./")
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if matchSegments(strings.Split(pattern, "/"), segs, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencyRange returns the range a package declares for dep, or "".
+func (pkg *packageJSON) dependencyRange(dep string) string {
+	for _, deps := range []map[string]string{pkg.Dependencies, pkg.PeerDependencies, pkg.OptionalDependencies} {
+		if rng, ok := deps[dep]; ok {
+			return rng
+		}
+	}
+	return ""
+}
+
+// resolveSubpath maps an import of a package ("." or "./sub/path") to a
+// file of its manifest, following "exports" when present, with the
+// conditions of env, and "module", "browser" and "main" otherwise.
+func resolveSubpath(dir string, m *Manifest, subpath, env string) (string, error) {
+	pkg := readPackageJSON(dir, m)
+	notFound := newError(http.StatusNotFound, codeNotFound, "%s@%s has no entry for %q", m.Name, m.Version, subpath)
+
+	if len(pkg.Exports) > 0 && !bytes.Equal(bytes.TrimSpace(pkg.Exports), []byte("null")) {
+		exports, err := decodeOrdered(json.NewDecoder(bytes.NewReader(pkg.Exports)))
+		if err != nil {
+			return "", wrapError(http.StatusBadGateway, codeUpstream, err, "%s@%s has invalid exports", m.Name, m.Version)
+		}
+		if env == "" {
+			env = envProduction
+		}
+		target, ok := matchExports(exports, subpath, env)
+		if !ok {
+			return "", notFound
+		}
+		if _, ok := m.Lookup(path.Clean(target)); !ok {
+			return "", notFound
+		}
+		return path.Clean(target), nil
+	}
+
+	var candidates []string
+	if subpath == "." {
+		var browser string
+		json.Unmarshal(pkg.Browser, &browser)
+		candidates = []string{pkg.Module, browser, pkg.Main, "index"}
+	} else {
+		candidates = []string{subpath}
+	}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if p, ok := resolveFile(m, c); ok {
+			return p, nil
+		}
+	}
+	return "", notFound
+}
+
+// maxEntryListing is how many top-level files a package without an entry
+// point is listed with.
+const maxEntryListing = 50
+
+// resolveEntry resolves the root of a package as resolveSubpath does, then,
+// if that finds nothing, tries config.EntryFallbacks in order: paths that
+// must exist, or globs that must match exactly one file. fallback is the
+// pattern that matched. When nothing does, the 404 suggests the top-level
+// files.
+func resolveEntry(dir string, m *Manifest, env string) (entry, fallback string, err error) {
+	if err := securityHolderEntry(m); err != nil {
+		return "", "", err
+	}
+	entry, err = resolveSubpath(dir, m, ".", env)
+	var e *apiError
+	if err == nil || !errors.As(err, &e) || e.Status != http.StatusNotFound {
+		return entry, "", err
+	}
+	for _, pattern := range config.EntryFallbacks {
+		if p, ok := matchEntryFallback(m, pattern); ok && !deny.denied(p) {
+			return p, pattern, nil
+		}
+	}
+
+	top, _, _ := m.ListPage("", "", maxEntryListing, func(entry string) bool { return !deny.denied(entry) })
+	e = newError(http.StatusNotFound, codeNotFound, "%s@%s has no entry point; request one of its files", m.Name, m.Version)
+	e.Details = map[string]any{"package": m.Name, "version": m.Version, "suggestions": top}
+	return "", "", e
+}
+
+// setEntryHeaders tells which file the root of a package resolved to, and
+// its declarations, and warns when it was only a fallback.
+func setEntryHeaders(c *gin.Context, m *Manifest, entry, fallback string) {
+	c.Header("X-Resolved-Path", entry)
+	if f, ok := m.Lookup(entry); ok {
+		setModuleTypeHeader(c, f)
+	}
+	setTypesHeader(c, m, "")
+	if fallback != "" {
+		c.Header("Warning", `199 repkg "no entry point in package.json, fell back to `+entry+`"`)
+	}
+}
+
+func validEntryPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return pattern != "" && err == nil
+}
+
+func matchEntryFallback(m *Manifest, pattern string) (string, bool) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		f, ok := m.Lookup(pattern)
+		if !ok {
+			return "", false
+		}
+		return f.Path, true
+	}
+	match := ""
+	for _, f := range m.Files {
+		if ok, _ := path.Match(pattern, f.Path); ok {
+			if match != "" {
+				return "", false
+			}
+			match = f.Path
+		}
+	}
+	return match, match != ""
+}
+
+// resolveFile finds p in the manifest as is, with an extension added or as
+// a directory index.
+func resolveFile(m *Manifest, p string) (string, bool) {
+	p = path.Clean(strings.TrimPrefix(p, "/"))
+	if f, ok := m.Lookup(p); ok {
+		return f.Path, true
+	}
+	for _, ext := range resolveExts {
+		if f, ok := m.Lookup(p + ext); ok {
+			return f.Path, true
+		}
+	}
+	for _, ext := range resolveExts {
+		if f, ok := m.Lookup(path.Join(p, "index"+ext)); ok {
+			return f.Path, true
+		}
+	}
+	return "", false
+}
+
+// orderedObject is a JSON object with its key order kept, which matters
+// for export conditions.
+type orderedObject []orderedField
+
+type orderedField struct {
+	Key   string
+	Value any
+}
+
+func decodeOrdered(d *json.Decoder) (any, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+
+	switch delim {
+	case '{':
+		obj := orderedObject{}
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedField{Key: key.(string), Value: v})
+		}
+		_, err := d.Token()
+		return obj, err
+	default:
+		var list []any
+		for d.More() {
+			v, err := decodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := d.Token()
+		return list, err
+	}
+}
+
+// matchExports looks subpath up in an "exports" value, supporting the
+// sugar forms, conditions and "./*" patterns.
+func matchExports(exports any, subpath, env string) (string, bool) {
+	obj, isObj := exports.(orderedObject)
+	if !isObj || len(obj) == 0 || !strings.HasPrefix(obj[0].Key, ".") {
+		// "exports": "./index.js" or a conditions object for ".".
+		if subpath != "." {
+			return "", false
+		}
+		return exportTarget(exports, "", env)
+	}
+
+	for _, field := range obj {
+		if field.Key == subpath {
+			return exportTarget(field.Value, "", env)
+		}
+	}
+
+	bestKey, bestMatch := "", ""
+	var bestValue any
+	for _, field := range obj {
+		prefix, suffix, ok := strings.Cut(field.Key, "*")
+		if !ok || !strings.HasPrefix(subpath, prefix) || !strings.HasSuffix(subpath, suffix) || len(subpath) < len(prefix)+len(suffix) {
+			continue
+		}
+		if len(prefix) > len(strings.SplitN(bestKey, "*", 2)[0]) || bestKey == "" {
+			bestKey, bestValue = field.Key, field.Value
+			bestMatch = subpath[len(prefix) : len(subpath)-len(suffix)]
+		}
+	}
+	if bestKey == "" {
+		return "", false
+	}
+	return exportTarget(bestValue, bestMatch, env)
+}
+
+func exportTarget(v any, match, env string) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		if !strings.HasPrefix(t, "./") {
+			return "", false
+		}
+		return strings.ReplaceAll(t, "*", match), true
+	case []any:
+		for _, alt := range t {
+			if target, ok := exportTarget(alt, match, env); ok {
+				return target, true
+			}
+		}
+	case orderedObject:
+		for _, field := range t {
+			if exportConditions[field.Key] || field.Key == env {
+				if target, ok := exportTarget(field.Value, match, env); ok {
+					return target, true
+				}
+			}
+		}
+	}
+	return "", false
+}
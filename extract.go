@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// What to do with tarball entries that are neither files, directories nor
+// hard links.
+const (
+	specialSkip = "skip"
+	specialFail = "fail"
+)
+
+// extractTarball unpacks a gzipped npm tarball into outputDir. Entries that
+// match the denylist are skipped; the match is done on the path below the
+// package root, as packageRoot will pick it: the tarball's single top-level
+// directory (usually "package/", whatever its name) or, for flat tarballs,
+// the tarball itself. Extraction stops with errLimitExceeded once the files
+// written exceed limits.
+//
+// Files keep their mode masked by config.Umask, and their original mode is
+// recorded in x by entry name. Hard links are extracted as copies of their
+// target; other entry types are skipped or refused according to
+// config.SpecialEntries.
+//
+// The outcome doesn't depend on the filesystem: of entries with the same
+// path the last wins, and a file whose path only differs in case from an
+// earlier entry's is written to x.aside instead, so that it can't replace
+// that one on case-insensitive filesystems.
+func extractTarball(fileName, outputDir string, deny *denylist, limits sizeLimits, x *extraction) (size int64, files int, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return size, files, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return size, files, err
+	}
+	defer gz.Close()
+
+	// Until an entry outside the first top-level directory shows the
+	// tarball is flat, paths are matched below that directory. Files
+	// written until then are checked again by their full path.
+	top, flat := "", false
+	var written []extractedFile
+	sizes := map[string]int64{}
+	cased := map[string]string{}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, files, nil
+		}
+		if err != nil {
+			return size, files, err
+		}
+
+		name := normalizePath(path.Clean(strings.TrimPrefix(hdr.Name, "/")))
+		if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return size, files, fmt.Errorf("tarball entry %q escapes the output directory", hdr.Name)
+		}
+
+		first, below, nested := strings.Cut(name, "/")
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeLink:
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			kind := entryTypes[hdr.Typeflag]
+			if kind == "" {
+				kind = fmt.Sprintf("type %q entry", hdr.Typeflag)
+			}
+			if config.SpecialEntries == specialFail {
+				return size, files, newError(http.StatusBadGateway, codeUpstream, "tarball entry %s is a %s, which repkg does not extract", name, kind)
+			}
+			log.Printf("skipping %s: %s entries are not extracted", name, kind)
+			continue
+		}
+
+		if !flat {
+			if (!nested && hdr.Typeflag != tar.TypeDir) || (top != "" && first != top) {
+				flat = true
+				for _, w := range written {
+					if pattern, ok := deny.match(w.name); ok {
+						log.Printf("removing %s: matches denylist pattern %q in a flat tarball", w.name, pattern)
+						os.Remove(w.target)
+						for d := filepath.Dir(w.target); d != outputDir && os.Remove(d) == nil; d = filepath.Dir(d) {
+						}
+						if _, ok := sizes[w.name]; ok {
+							size -= sizes[w.name]
+							files--
+							delete(sizes, w.name)
+						}
+						delete(x.moved, w.name)
+					}
+				}
+				written = nil
+			} else {
+				top = first
+			}
+		}
+		rel := name
+		if !flat && nested {
+			rel = below
+		}
+		if pattern, ok := deny.match(rel); ok {
+			log.Printf("skipping %s: matches denylist pattern %q", name, pattern)
+			continue
+		}
+
+		target := filepath.Join(outputDir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if other := caseCollision(cased, name); other != "" {
+				// What goes in it is moved aside as it comes.
+				continue
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return size, files, err
+			}
+			addCased(cased, name)
+		case tar.TypeReg, tar.TypeLink:
+			var r io.Reader = tr
+			n := hdr.Size
+			if hdr.Typeflag == tar.TypeLink {
+				data, err := readLinkTarget(outputDir, hdr.Linkname, x)
+				if err != nil {
+					log.Printf("skipping %s: hard link to %s: %s", name, hdr.Linkname, err)
+					continue
+				}
+				r, n = bytes.NewReader(data), int64(len(data))
+			}
+
+			if prev, ok := sizes[name]; ok {
+				log.Printf("replacing %s: the tarball has it more than once, the last entry wins", name)
+				x.duplicates = append(x.duplicates, name)
+				size -= prev
+				files--
+			}
+			if aside, ok := x.moved[name]; ok {
+				target = aside
+			} else if other := caseCollision(cased, name); other != "" {
+				log.Printf("extracting %s aside: its path only differs in case from %s", name, other)
+				target = filepath.Join(x.aside, strconv.Itoa(len(x.moved)+1))
+				x.moved[name] = target
+				x.collisions = append(x.collisions, [2]string{other, name})
+			} else {
+				addCased(cased, name)
+			}
+
+			size += n
+			files++
+			sizes[name] = n
+			if (limits.Bytes > 0 && size > limits.Bytes) || (limits.Files > 0 && files > limits.Files) {
+				return size, files, errLimitExceeded
+			}
+			if err := writeFile(target, r, extractedMode(hdr.Mode)); err != nil {
+				return size, files, err
+			}
+			x.modes[name] = hdr.Mode & 07777
+			if !flat {
+				written = append(written, extractedFile{name, target})
+			}
+		}
+	}
+}
+
+type extractedFile struct {
+	name   string
+	target string
+}
+
+// extraction is what extractTarball records besides the files it writes,
+// all by entry name.
+type extraction struct {
+	modes map[string]int64
+
+	// Files colliding in case with an earlier entry are written to aside,
+	// under a number, and moved maps them to that file. Collisions pairs
+	// them with the entry they collide with.
+	aside      string
+	moved      map[string]string
+	collisions [][2]string
+	duplicates []string
+}
+
+func newExtraction(aside string) *extraction {
+	return &extraction{modes: map[string]int64{}, aside: aside, moved: map[string]string{}}
+}
+
+// place moves the files extracted aside into root's caseDir, root being
+// prefix in the tarball, and returns where each is stored by its path in
+// the package, with the warnings for the manifest.
+func (x *extraction) place(root, prefix string) (moved map[string]string, warnings []string, err error) {
+	rel := func(name string) string {
+		if prefix == "." {
+			return name
+		}
+		return strings.TrimPrefix(name, prefix+"/")
+	}
+	moved = make(map[string]string, len(x.moved))
+	if len(x.moved) > 0 {
+		if err := os.MkdirAll(filepath.Join(root, caseDir), 0755); err != nil {
+			return nil, nil, err
+		}
+	}
+	for name, aside := range x.moved {
+		disk := path.Join(caseDir, filepath.Base(aside))
+		if err := os.Rename(aside, filepath.Join(root, filepath.FromSlash(disk))); err != nil {
+			return nil, nil, err
+		}
+		moved[rel(name)] = disk
+	}
+	for _, c := range x.collisions {
+		warnings = append(warnings, fmt.Sprintf("%s and %s only differ in case; each is served at its own path", rel(c[0]), rel(c[1])))
+	}
+	for _, name := range x.duplicates {
+		warnings = append(warnings, fmt.Sprintf("%s appears more than once in the tarball; the last entry was kept", rel(name)))
+	}
+	return moved, warnings, nil
+}
+
+// caseCollision returns the path of an earlier entry that name, or one of
+// its directories, only differs from in case.
+func caseCollision(cased map[string]string, name string) string {
+	for p := name; p != "."; p = path.Dir(p) {
+		if other, ok := cased[strings.ToLower(p)]; ok && other != p {
+			return other
+		}
+	}
+	return ""
+}
+
+// addCased records name and its directories in cased, by their lower case
+// paths.
+func addCased(cased map[string]string, name string) {
+	for p := name; p != "."; p = path.Dir(p) {
+		if _, ok := cased[strings.ToLower(p)]; ok {
+			return
+		}
+		cased[strings.ToLower(p)] = p
+	}
+}
+
+var entryTypes = map[byte]string{
+	tar.TypeSymlink:   "symbolic link",
+	tar.TypeChar:      "character device",
+	tar.TypeBlock:     "block device",
+	tar.TypeFifo:      "FIFO",
+	tar.TypeCont:      "contiguous file",
+	tar.TypeGNUSparse: "sparse file",
+}
+
+// extractedMode is the mode a file is extracted with: its permission bits
+// in the tarball masked by config.Umask, always readable and writable by
+// its owner.
+func extractedMode(mode int64) os.FileMode {
+	umask, _ := strconv.ParseUint(config.Umask, 8, 32)
+	return os.FileMode(mode)&0777&^os.FileMode(umask) | 0600
+}
+
+// readLinkTarget reads the file a hard link entry points at, which must
+// have been extracted already.
+func readLinkTarget(outputDir, linkname string, x *extraction) ([]byte, error) {
+	name := normalizePath(path.Clean(strings.TrimPrefix(linkname, "/")))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return nil, fmt.Errorf("target escapes the output directory")
+	}
+	p := filepath.Join(outputDir, filepath.FromSlash(name))
+	if aside, ok := x.moved[name]; ok {
+		p = aside
+	}
+	if info, err := os.Lstat(p); err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("target is not a file")
+	}
+	return os.ReadFile(p)
+}
+
+func writeFile(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, r); err != nil {
+		return err
+	}
+	// Set explicitly rather than at creation, where the process umask
+	// would apply too.
+	return file.Chmod(mode)
+}
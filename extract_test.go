@@ -0,0 +1,401 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tree maps the paths of the files below dir to their content, leaving
+// out the manifest.
+func tree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == manifestFile {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestTarballRoots(t *testing.T) {
+	files := map[string]string{
+		"package.json":     `{"name": "left-pad", "version": "1.0.0", "main": "lib/index.js"}`,
+		"lib/index.js":     "padded",
+		"lib/util/pad.js":  "pad",
+		"README.md":        "# left-pad",
+		".npmrc":           "//registry.npmjs.org/:_authToken=secret",
+		"docs/.env.local":  "SECRET=1",
+		"types/index.d.ts": "export {}",
+	}
+	layouts := []struct{ version, prefix string }{
+		{"1.0.0", "package"},
+		{"1.0.1", "left-pad"},
+		{"1.0.2", ""}, // flat: the files at the top level
+	}
+	reg := newFakeRegistry(t)
+	for _, l := range layouts {
+		reg.publishTarball("left-pad", l.version, buildTarball(t, l.prefix, files))
+	}
+	s := newTestServer(t, reg, nil)
+
+	var want map[string]string
+	for _, l := range layouts {
+		loc := s.follow(s.get("/npm/left-pad@"+l.version), 302)
+		if loc != "/packages/left-pad@"+l.version+"/lib/index.js" {
+			t.Errorf("%s (%q): the entry redirects to %s", l.version, l.prefix, loc)
+		}
+		if body := responseBody(t, s.get(loc), 200); body != "padded" {
+			t.Errorf("%s (%q): got %q", l.version, l.prefix, body)
+		}
+
+		got := tree(t, filepath.Join(s.cfg.DataDir, partitionName(reg.URL), "left-pad", l.version))
+		for _, denied := range []string{".npmrc", "docs/.env.local"} {
+			if _, ok := got[denied]; ok {
+				t.Errorf("%s (%q): %s was extracted", l.version, l.prefix, denied)
+			}
+		}
+		if want == nil {
+			want = got
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s (%q): extracted\n%v\nwhere %s has\n%v", l.version, l.prefix, got, layouts[0].version, want)
+		}
+	}
+	if len(want) != len(files)-2 {
+		t.Errorf("extracted %v", want)
+	}
+}
+
+// tarEntry is an entry for writeTarball, body being the content of
+// regular files.
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+// writeTarball writes entries into a gzipped tarball in a temporary
+// directory and returns its path.
+func writeTarball(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "package.tgz")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// useConfig sets config to the defaults changed by change for the rest
+// of the test.
+func useConfig(t *testing.T, change func(cfg *Config)) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = defaultConfig()
+	change(&config)
+}
+
+func TestSpecialEntries(t *testing.T) {
+	files := []tarEntry{
+		{hdr: tar.Header{Name: "package/package.json", Typeflag: tar.TypeReg, Mode: 0664}, body: `{"name": "cli"}`},
+		{hdr: tar.Header{Name: "package/bin/cli.js", Typeflag: tar.TypeReg, Mode: 04775}, body: "#!/usr/bin/env node"},
+		{hdr: tar.Header{Name: "package/secret.js", Typeflag: tar.TypeReg, Mode: 0400}, body: "secret"},
+	}
+	for _, tc := range []struct {
+		name  string
+		entry tar.Header
+		kind  string
+	}{
+		{"symbolic link", tar.Header{Name: "package/link.js", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, "symbolic link"},
+		{"FIFO", tar.Header{Name: "package/fifo", Typeflag: tar.TypeFifo, Mode: 0644}, "FIFO"},
+		{"character device", tar.Header{Name: "package/tty", Typeflag: tar.TypeChar, Mode: 0644, Devmajor: 5}, "character device"},
+		{"block device", tar.Header{Name: "package/sda", Typeflag: tar.TypeBlock, Mode: 0644, Devmajor: 8}, "block device"},
+	} {
+		entries := append(append([]tarEntry{}, files...), tarEntry{hdr: tc.entry})
+		entries = append(entries, tarEntry{hdr: tar.Header{Name: "package/after.js", Typeflag: tar.TypeReg, Mode: 0644}, body: "after"})
+		tarball := writeTarball(t, entries)
+
+		t.Run(tc.name+", skip", func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.SpecialEntries = specialSkip })
+			out := t.TempDir()
+			_, n, err := extractTarball(tarball, out, &denylist{}, sizeLimits{}, newExtraction(t.TempDir()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 4 {
+				t.Errorf("extracted %d files", n)
+			}
+			if _, err := os.Lstat(filepath.Join(out, filepath.FromSlash(tc.entry.Name))); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("the %s was extracted: %v", tc.kind, err)
+			}
+			// Extraction went on past it.
+			if got := tree(t, out)["package/after.js"]; got != "after" {
+				t.Errorf("package/after.js is %q", got)
+			}
+		})
+
+		t.Run(tc.name+", fail", func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.SpecialEntries = specialFail })
+			_, _, err := extractTarball(tarball, t.TempDir(), &denylist{}, sizeLimits{}, newExtraction(t.TempDir()))
+			var e *apiError
+			if !errors.As(err, &e) || e.Status != http.StatusBadGateway || e.Code != codeUpstream {
+				t.Fatalf("got %v, want a 502 %s", err, codeUpstream)
+			}
+			if want := tc.entry.Name + " is a " + tc.kind; !strings.Contains(e.Message, want) {
+				t.Errorf("message %q doesn't say %q", e.Message, want)
+			}
+		})
+	}
+
+	// Hard links are copies of their target, whatever specialEntries is,
+	// and are skipped when their target isn't an earlier file.
+	links := append(append([]tarEntry{}, files...),
+		tarEntry{hdr: tar.Header{Name: "package/bin/repkg.js", Typeflag: tar.TypeLink, Linkname: "package/bin/cli.js", Mode: 0755}},
+		tarEntry{hdr: tar.Header{Name: "package/passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd", Mode: 0644}},
+		tarEntry{hdr: tar.Header{Name: "package/later.js", Typeflag: tar.TypeLink, Linkname: "package/after.js", Mode: 0644}},
+		tarEntry{hdr: tar.Header{Name: "package/bin", Typeflag: tar.TypeLink, Linkname: "package/bin", Mode: 0644}},
+		tarEntry{hdr: tar.Header{Name: "package/after.js", Typeflag: tar.TypeReg, Mode: 0644}, body: "after"},
+	)
+	tarball := writeTarball(t, links)
+	for _, special := range []string{specialSkip, specialFail} {
+		t.Run("hard links, "+special, func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.SpecialEntries = special })
+			out := t.TempDir()
+			if _, _, err := extractTarball(tarball, out, &denylist{}, sizeLimits{}, newExtraction(t.TempDir())); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"package/package.json": `{"name": "cli"}`,
+				"package/bin/cli.js":   "#!/usr/bin/env node",
+				"package/bin/repkg.js": "#!/usr/bin/env node",
+				"package/secret.js":    "secret",
+				"package/after.js":     "after",
+			}
+			if got := tree(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("extracted %v", got)
+			}
+			link, _ := os.Stat(filepath.Join(out, "package", "bin", "repkg.js"))
+			target, _ := os.Stat(filepath.Join(out, "package", "bin", "cli.js"))
+			if os.SameFile(link, target) {
+				t.Errorf("the hard link was extracted as a link")
+			}
+		})
+	}
+}
+
+func TestExtractedModes(t *testing.T) {
+	tarball := writeTarball(t, []tarEntry{
+		{hdr: tar.Header{Name: "package/package.json", Typeflag: tar.TypeReg, Mode: 0664}, body: "{}"},
+		{hdr: tar.Header{Name: "package/bin/cli.js", Typeflag: tar.TypeReg, Mode: 04775}, body: "cli"},
+		{hdr: tar.Header{Name: "package/secret.js", Typeflag: tar.TypeReg, Mode: 0400}, body: "secret"},
+		{hdr: tar.Header{Name: "package/none", Typeflag: tar.TypeReg, Mode: 0}, body: "none"},
+		{hdr: tar.Header{Name: "package/bin/repkg.js", Typeflag: tar.TypeLink, Linkname: "package/bin/cli.js", Mode: 0700}},
+	})
+	for _, tc := range []struct {
+		umask string
+		// want is the mode of each file on disk, in the order above.
+		want [5]os.FileMode
+	}{
+		{"022", [5]os.FileMode{0644, 0755, 0600, 0600, 0700}},
+		{"077", [5]os.FileMode{0600, 0700, 0600, 0600, 0700}},
+		{"0", [5]os.FileMode{0664, 0775, 0600, 0600, 0700}},
+		{"027", [5]os.FileMode{0640, 0750, 0600, 0600, 0700}},
+	} {
+		t.Run(tc.umask, func(t *testing.T) {
+			useConfig(t, func(cfg *Config) { cfg.Umask = tc.umask })
+			out := t.TempDir()
+			x := newExtraction(t.TempDir())
+			if _, _, err := extractTarball(tarball, out, &denylist{}, sizeLimits{}, x); err != nil {
+				t.Fatal(err)
+			}
+			names := []string{"package/package.json", "package/bin/cli.js", "package/secret.js", "package/none", "package/bin/repkg.js"}
+			for i, name := range names {
+				info, err := os.Stat(filepath.Join(out, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode() != tc.want[i] {
+					t.Errorf("%s: mode %v, want %v", name, info.Mode(), tc.want[i])
+				}
+			}
+			// The modes in the tarball are kept as they were, setuid
+			// included.
+			wantModes := map[string]int64{
+				"package/package.json": 0664,
+				"package/bin/cli.js":   04775,
+				"package/secret.js":    0400,
+				"package/none":         0,
+				"package/bin/repkg.js": 0700,
+			}
+			if !reflect.DeepEqual(x.modes, wantModes) {
+				t.Errorf("recorded modes %v", x.modes)
+			}
+		})
+	}
+}
+
+// caseEntries is a tarball with paths that only differ in case, of files
+// and of directories, and with paths given twice.
+var caseEntries = []tarEntry{
+	{hdr: tar.Header{Name: "package/package.json", Typeflag: tar.TypeReg, Mode: 0644}, body: `{"name": "cased", "version": "1.0.0"}`},
+	{hdr: tar.Header{Name: "package/README.md", Typeflag: tar.TypeReg, Mode: 0644}, body: "upper"},
+	{hdr: tar.Header{Name: "package/readme.md", Typeflag: tar.TypeReg, Mode: 0644}, body: "lower"},
+	{hdr: tar.Header{Name: "package/lib/index.js", Typeflag: tar.TypeReg, Mode: 0644}, body: "first"},
+	{hdr: tar.Header{Name: "package/Lib/extra.js", Typeflag: tar.TypeReg, Mode: 0644}, body: "extra"},
+	{hdr: tar.Header{Name: "package/Docs/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{hdr: tar.Header{Name: "package/docs/a.md", Typeflag: tar.TypeReg, Mode: 0644}, body: "a"},
+	{hdr: tar.Header{Name: "package/lib/index.js", Typeflag: tar.TypeReg, Mode: 0644}, body: "second"},
+	{hdr: tar.Header{Name: "package/readme.md", Typeflag: tar.TypeReg, Mode: 0644}, body: "lower again"},
+}
+
+// caseServed is what each path of caseEntries is served with.
+var caseServed = map[string]string{
+	"package.json": `{"name": "cased", "version": "1.0.0"}`,
+	"README.md":    "upper",
+	"readme.md":    "lower again",
+	"lib/index.js": "second",
+	"Lib/extra.js": "extra",
+	"docs/a.md":    "a",
+}
+
+// caseInsensitive is files as a case-insensitive filesystem would hold
+// them, by their lower case paths. Two paths that only differ in case
+// would be a single file there, so it fails on them.
+func caseInsensitive(t *testing.T, files map[string]string) map[string]string {
+	t.Helper()
+	folded := map[string]string{}
+	for p, data := range files {
+		if _, ok := folded[strings.ToLower(p)]; ok {
+			t.Fatalf("%s would replace a file that only differs from it in case", p)
+		}
+		folded[strings.ToLower(p)] = data
+	}
+	return folded
+}
+
+func TestCaseCollisions(t *testing.T) {
+	useConfig(t, func(cfg *Config) {})
+	tarball := writeTarball(t, caseEntries)
+	out, aside := t.TempDir(), t.TempDir()
+	x := newExtraction(aside)
+	if _, _, err := extractTarball(tarball, out, &denylist{}, sizeLimits{}, x); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(out, "package")
+	moved, warnings, err := x.place(root, "package")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whichever comes first in the tarball keeps its path, the others go
+	// in caseDir, numbered in the order they came.
+	wantMoved := map[string]string{
+		"readme.md":    caseDir + "/1",
+		"Lib/extra.js": caseDir + "/2",
+		"docs/a.md":    caseDir + "/3",
+	}
+	if !reflect.DeepEqual(moved, wantMoved) {
+		t.Errorf("moved %v", moved)
+	}
+	wantWarnings := []string{
+		"README.md and readme.md only differ in case; each is served at its own path",
+		"lib and Lib/extra.js only differ in case; each is served at its own path",
+		"Docs and docs/a.md only differ in case; each is served at its own path",
+		"lib/index.js appears more than once in the tarball; the last entry was kept",
+		"readme.md appears more than once in the tarball; the last entry was kept",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("warnings\n%q\nwant\n%q", warnings, wantWarnings)
+	}
+
+	// Each path is read from where it is kept, both as the files are on
+	// this filesystem and as they'd be on a case-insensitive one.
+	sensitive := tree(t, root)
+	insensitive := caseInsensitive(t, sensitive)
+	for p, want := range caseServed {
+		disk := p
+		if d, ok := moved[p]; ok {
+			disk = d
+		}
+		if got := sensitive[disk]; got != want {
+			t.Errorf("case-sensitive: %s is %q, want %q", p, got, want)
+		}
+		if got := insensitive[strings.ToLower(disk)]; got != want {
+			t.Errorf("case-insensitive: %s is %q, want %q", p, got, want)
+		}
+	}
+	if len(sensitive) != len(caseServed) {
+		t.Errorf("extracted %v", sensitive)
+	}
+	if entries, _ := os.ReadDir(aside); len(entries) != 0 {
+		t.Errorf("%d files were left aside", len(entries))
+	}
+}
+
+func TestServeCaseCollisions(t *testing.T) {
+	tarball, err := os.ReadFile(writeTarball(t, caseEntries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newFakeRegistry(t)
+	reg.publishTarball("cased", "1.0.0", tarball)
+	s := newTestServer(t, reg, nil)
+
+	var m Manifest
+	if err := json.Unmarshal([]byte(responseBody(t, s.get("/npm/cased@1.0.0?format=json"), 200)), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Warnings) != 5 {
+		t.Errorf("warnings %q", m.Warnings)
+	}
+	for p, want := range caseServed {
+		if body := responseBody(t, s.get("/packages/cased@1.0.0/"+p), 200); body != want {
+			t.Errorf("%s: got %q, want %q", p, body, want)
+		}
+	}
+	// What's aside is only served by its path.
+	if res := s.get("/packages/cased@1.0.0/" + caseDir + "/1"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("%s/1: %s", caseDir, res.Status)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Versions that fail to fetch config.FailureThreshold times in a row are
+// failed fast: requests get the last error straight away, with a
+// Retry-After, until the backoff is over or an admin clears it. Integrity,
+// signature, size and extraction failures happen again on every attempt,
+// so they back off for config.FailureBackoff; the registry being down or
+// unreachable only for config.TransientFailureBackoff.
+
+// failureForget is how long a version's failures are remembered without
+// another one.
+const failureForget = 24 * time.Hour
+
+var failuresShed = newCounter("repkg_fetch_failures_shed_total", "Fetches refused because the version kept failing, by failure class.")
+
+// Failure classes.
+const (
+	failureDeterministic = "deterministic"
+	failureTransient     = "transient"
+)
+
+// failureClass returns the class of a fetch error, or "" for errors that
+// don't count, such as a version not found or a quota being full.
+func failureClass(err error) string {
+	switch errorCode(err) {
+	case codeIntegrity, codeSignatureInvalid, codeSignatureMissing, codeTooLarge, codeExtractFailed:
+		return failureDeterministic
+	case codeUpstream, codeUpstreamUnreachable, codeUpstreamDNS, codeUpstreamContent:
+		return failureTransient
+	}
+	return ""
+}
+
+type fetchFailure struct {
+	Tenant   string    `json:"tenant,omitempty"`
+	Package  string    `json:"package"`
+	Version  string    `json:"version"`
+	Class    string    `json:"class"`
+	Code     string    `json:"code"`
+	Error    string    `json:"error"`
+	Failures int       `json:"failures"` // in a row
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	// Until is when requests are let through again, when backing off.
+	Until *time.Time `json:"until,omitempty"`
+
+	err *apiError
+}
+
+type failureTracker struct {
+	mu       sync.Mutex
+	versions map[string]*fetchFailure // by tenant-qualified name@version
+}
+
+var failures = &failureTracker{versions: map[string]*fetchFailure{}}
+
+// check returns the stored error of a version that is backing off.
+func (f *failureTracker) check(t *tenant, name, version string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.versions[t.qualify(name+"@"+version)]
+	if !ok || ff.Until == nil || !time.Now().Before(*ff.Until) {
+		return nil
+	}
+	failuresShed.Inc("class", ff.Class)
+	secs := max(1, int(time.Until(*ff.Until).Seconds()+0.5))
+	e := *ff.err
+	e.Message = fmt.Sprintf("%s@%s failed %d times in a row, not retrying for %ds: %s", name, version, ff.Failures, secs, ff.err.Message)
+	e.Header = http.Header{"Retry-After": {strconv.Itoa(secs)}}
+	e.Details = map[string]any{"package": name, "version": version, "failures": ff.Failures, "retryAfter": secs}
+	return &e
+}
+
+// record counts a failed fetch, backing off once there were enough of them.
+func (f *failureTracker) record(t *tenant, name, version string, err error) {
+	class := failureClass(err)
+	var e *apiError
+	if class == "" || config.FailureThreshold <= 0 || !errors.As(err, &e) {
+		return
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(now)
+
+	key := t.qualify(name + "@" + version)
+	ff, ok := f.versions[key]
+	if !ok {
+		ff = &fetchFailure{Package: name, Version: version, First: now}
+		if t != nil {
+			ff.Tenant = t.name
+		}
+		f.versions[key] = ff
+	}
+	ff.Failures++
+	ff.Class, ff.Code, ff.Error, ff.Last, ff.err = class, e.Code, e.Error(), now, e
+	if ff.Failures >= config.FailureThreshold {
+		backoff := config.FailureBackoff.Duration
+		if class == failureTransient {
+			backoff = config.TransientFailureBackoff.Duration
+		}
+		until := now.Add(backoff)
+		ff.Until = &until
+		log.Printf("failures: %s@%s failed %d times (%s), failing fast for %s", name, version, ff.Failures, class, backoff)
+	}
+}
+
+// succeeded forgets a version's failures.
+func (f *failureTracker) succeeded(t *tenant, name, version string) {
+	f.mu.Lock()
+	delete(f.versions, t.qualify(name+"@"+version))
+	f.mu.Unlock()
+}
+
+func (f *failureTracker) clear(t *tenant, name, version string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := t.qualify(name + "@" + version)
+	_, ok := f.versions[key]
+	delete(f.versions, key)
+	return ok
+}
+
+func (f *failureTracker) prune(now time.Time) {
+	for key, ff := range f.versions {
+		if now.Sub(ff.Last) > failureForget && (ff.Until == nil || now.After(*ff.Until)) {
+			delete(f.versions, key)
+		}
+	}
+}
+
+// list returns a tenant's failing versions, by name and version.
+func (f *failureTracker) list(t *tenant) []fetchFailure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now())
+	list := []fetchFailure{}
+	for _, ff := range f.versions {
+		if (t == nil && ff.Tenant == "") || (t != nil && ff.Tenant == t.name) {
+			list = append(list, *ff)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return versionLess(list[i].Package, list[i].Version, list[j].Package, list[j].Version)
+	})
+	return list
+}
+
+// serveFailures handles GET /api/admin/failures, listing the versions that
+// failed to fetch lately and whether they are backing off.
+func serveFailures(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"failures": failures.list(tenantOf(c))})
+}
+
+// serveClearFailure handles DELETE /api/admin/failures/:scope/:name/:version,
+// letting the next request for the version try to fetch it again.
+func serveClearFailure(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	name, rest, err := parsePackageParams(c.Param("package"))
+	if err == nil && (len(rest) != 1 || !validVersion(rest[0])) {
+		err = newError(http.StatusBadRequest, codeBadRequest, "expected /api/admin/failures/<name>/<version>")
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if !failures.clear(tenantOf(c), name, rest[0]) {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "%s@%s has no recorded failures", name, rest[0]))
+		return
+	}
+	log.Printf("failures: cleared %s@%s", name, rest[0])
+	c.JSON(http.StatusOK, gin.H{"cleared": name + "@" + rest[0]})
+}
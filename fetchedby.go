@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Each version's manifest records when it was first cached and what asked
+// for it, so that whatever turns up in the cache can be traced back long
+// after the logs are gone. Refreshes and repairs keep what was recorded; a
+// version purged and fetched again records anew. Clients' addresses and
+// user agents are only shown to admins.
+
+// Values of FetchedBy.Source, a prefix for prefetch jobs.
+const (
+	fetchedByRequest   = "request"
+	fetchedByWarmStart = "warm-start"
+	fetchedByJob       = "prefetch-job:"
+)
+
+// FetchedBy is what caused a version to be cached.
+type FetchedBy struct {
+	At time.Time `json:"at"`
+	// Source is "request", "prefetch-job:<id>" or "warm-start", empty
+	// for fetches nothing asked for, such as repairs. Jobs created by a
+	// request keep its client and ID.
+	Source    string `json:"source,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// requestIDs gives each request an ID in X-Request-Id: the one the client
+// or a proxy sent, if it looks like one, or a new one.
+func requestIDs(c *gin.Context) {
+	id := c.GetHeader("X-Request-Id")
+	if len(id) == 0 || len(id) > 128 || strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) >= 0 {
+		buf := make([]byte, 12)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+	c.Set("requestId", id)
+	c.Header("X-Request-Id", id)
+	c.Next()
+}
+
+func requestID(c *gin.Context) string {
+	return c.GetString("requestId")
+}
+
+// fetchedBy is what fetches made for c record.
+func fetchedBy(c *gin.Context) *FetchedBy {
+	return &FetchedBy{Source: fetchedByRequest, IP: c.ClientIP(), UserAgent: c.Request.UserAgent(), RequestID: requestID(c)}
+}
+
+// byJob is f for fetches of a prefetch job.
+func (f *FetchedBy) byJob(id string) *FetchedBy {
+	job := FetchedBy{Source: fetchedByJob + id}
+	if id == warmStartJobID {
+		job.Source = fetchedByWarmStart
+	}
+	if f != nil {
+		job.IP, job.UserAgent, job.RequestID = f.IP, f.UserAgent, f.RequestID
+	}
+	return &job
+}
+
+// public is f without the client, for requests that aren't an admin's.
+func (f *FetchedBy) public() *FetchedBy {
+	if f == nil {
+		return nil
+	}
+	return &FetchedBy{At: f.At, Source: f.Source, RequestID: f.RequestID}
+}
+
+// fetchedByFor leaves the clients out of list unless c is an admin's.
+func fetchedByFor(c *gin.Context, list []packageUsage) []packageUsage {
+	if !isAdmin(c.Request) {
+		for i := range list {
+			list[i].FetchedBy = list[i].FetchedBy.public()
+		}
+	}
+	return list
+}
@@ -3,9 +3,11 @@ module github.com/odoe/repkg-go
 go 1.21.0
 
 require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/evanw/esbuild v0.28.2
 	github.com/gin-contrib/cors v1.4.0
 	github.com/gin-gonic/gin v1.9.1
-	github.com/walle/targz v0.0.0-20140417120357-57fe4206da5a
+	golang.org/x/text v0.9.0
 )
 
 require (
@@ -30,7 +32,6 @@ require (
 	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenDeps are the dependencies of the golden fixture, enough of them
+// for every response to be over gzipMinSize.
+var goldenDeps = func() []string {
+	var deps []string
+	for c := 'a'; c <= 'p'; c++ {
+		deps = append(deps, "golden-dependency-"+string(c))
+	}
+	return deps
+}()
+
+// goldenPackageJSON is the fixture's package.json, posted as is to
+// /api/resolve and /api/normalize.
+func goldenPackageJSON() string {
+	var b strings.Builder
+	b.WriteString(`{"name": "golden", "version": "1.0.0", "main": "lib/file-00.js", "peerDependencies": {"react": "^18.0.0"}, "dependencies": {`)
+	for i, dep := range goldenDeps {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q: %q", dep, "^1.0.0")
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+// newGoldenServer serves the fixture and its dependencies, all cached. What
+// depends on when and where they were fetched, such as extraction times and
+// the registry's random port, is then set to fixed values in their
+// manifests, and the server restarted to index them from there.
+func newGoldenServer(t *testing.T) *testServer {
+	reg := newFakeRegistry(t)
+	files := map[string]string{"package.json": goldenPackageJSON()}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("lib/file-%02d.js", i)] = fmt.Sprintf("export default %d;\n", i)
+	}
+	reg.publish("golden", "1.0.0", files)
+	for _, dep := range goldenDeps {
+		reg.publish(dep, "1.0.0", map[string]string{"index.js": "old"})
+		reg.publish(dep, "1.2.0", map[string]string{"index.js": "new"})
+	}
+	s := newTestServer(t, reg, nil)
+	s.follow(s.get("/npm/golden@1.0.0/lib/file-00.js"), 302)
+	for _, dep := range goldenDeps {
+		s.follow(s.get("/npm/"+dep+"@^1.0.0/index.js"), 302)
+	}
+
+	fixed := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range index.entriesFor(nil) {
+		_, err := updateManifest(nil, e.Dir, e.Name, e.Version, func(m *Manifest) {
+			m.Extracted = fixed
+			m.Registry = "http://registry.test"
+			m.Upstream = "http://registry.test" + tarballPath(m.Name, m.Version)
+			if m.Origin != nil {
+				m.Origin.Date = fixed.Format(time.RFC1123)
+			}
+			m.FetchedBy = &FetchedBy{At: fixed, Source: fetchedByRequest}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s.restart()
+}
+
+func TestGoldenResponses(t *testing.T) {
+	endpoints := []struct {
+		name, method, target, body string
+	}{
+		{"metadata", "GET", "/api/meta/golden@1.0.0", ""},
+		{"versions-list", "GET", "/api/packages", ""},
+		{"import-map", "POST", "/api/resolve", goldenPackageJSON()},
+		{"normalize", "POST", "/api/normalize", goldenPackageJSON()},
+	}
+
+	// Each run starts from nothing, as CI would.
+	for run := 0; run < 2; run++ {
+		s := newGoldenServer(t)
+		for _, ep := range endpoints {
+			for _, encoding := range []string{"identity", "gzip"} {
+				res := s.request(ep.method, ep.target, strings.NewReader(ep.body), "Accept-Encoding", encoding)
+				body := responseBody(t, res, 200)
+				if v := res.Header.Get("X-Repkg-Schema-Version"); v != jsonSchemaVersion {
+					t.Errorf("%s: schema version %q", ep.name, v)
+				}
+				file := ep.name + ".json"
+				if encoding == "gzip" {
+					if res.Header.Get("Content-Encoding") != "gzip" {
+						t.Fatalf("%s: not gzipped", ep.name)
+					}
+					file += ".gz"
+					checkGunzips(t, ep.name, body, filepath.Join("testdata", "golden", ep.name+".json"))
+				}
+				checkGolden(t, run, filepath.Join("testdata", "golden", file), body)
+			}
+		}
+	}
+}
+
+// checkGolden compares got with the golden file at p, or, with -update,
+// rewrites it on the first run.
+func checkGolden(t *testing.T, run int, p, got string) {
+	t.Helper()
+	if *update && run == 0 {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("%s (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("run %d: %s differs:\n%q\nwant\n%q", run, p, got, want)
+	}
+}
+
+// checkGunzips checks that a gzipped response is the plain one, as in its
+// golden file, compressed.
+func checkGunzips(t *testing.T, name, body, plain string) {
+	t.Helper()
+	gz, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	want, err := os.ReadFile(plain)
+	if err != nil && !*update {
+		t.Fatal(err)
+	}
+	if err == nil && !bytes.Equal(data, want) {
+		t.Errorf("%s: the gzipped response isn't the plain one", name)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version directories are never written to once extracted, so a file that
+// changed since is one someone edited in place, and its ETag, integrity and
+// signature no longer describe it. With config.IntegrityGuard, manifests
+// record the size and mtime of each file as extracted, and serving a file
+// checks them first, hashing it in full one time in IntegrityGuardSample.
+// A file that changed quarantines its version until it is repaired.
+
+// corruptTampered is the Corruption.Reason of versions the guard
+// quarantined.
+const corruptTampered = "tampered"
+
+var tampered = newCounter("repkg_tampered_files_total", "Files found modified on disk since their version was extracted.")
+
+// recordModTimes notes the mtime of each file of a freshly extracted
+// version for the guard.
+func recordModTimes(dir string, m *Manifest) error {
+	if !config.IntegrityGuard {
+		return nil
+	}
+	for i := range m.Files {
+		f := &m.Files[i]
+		info, err := os.Stat(f.storedPath(dir))
+		if err != nil {
+			return err
+		}
+		f.ModTime = info.ModTime().UnixNano()
+	}
+	return nil
+}
+
+// guardFile checks f for changes before it is served, quarantining its
+// version and answering 500 when it has. It reports false when the
+// response was written. Manifests from before the guard was on have no
+// mtimes, and only the size and the sampled hashes are checked for them.
+func guardFile(c *gin.Context, m *Manifest, dir string, f *ManifestFile) bool {
+	if !config.IntegrityGuard || f.SHA256 == "" {
+		return true
+	}
+	size := f.Size
+	if f.Stored == "br" {
+		size = f.StoredSize
+	}
+	info, err := os.Stat(f.storedPath(dir))
+	ok := err == nil && info.Size() == size && (f.ModTime == 0 || info.ModTime().UnixNano() == f.ModTime)
+	if ok && rand.Float64() < config.IntegrityGuardSample {
+		n, sum, err := hashStored(dir, f, nil)
+		ok = err == nil && n == f.Size && sum == f.SHA256
+	}
+	if ok {
+		return true
+	}
+
+	log.Printf("integrity guard: %s@%s: %s changed on disk since it was extracted", m.Name, m.Version, f.Path)
+	tampered.Inc()
+	hotCache.invalidateVersion(dir)
+	updated, err := updateManifest(tenantOf(c), dir, m.Name, m.Version, func(m *Manifest) {
+		files := []string{f.Path}
+		if m.Corrupt != nil && m.Corrupt.Reason == corruptTampered {
+			if slices.Contains(m.Corrupt.Files, f.Path) {
+				files = m.Corrupt.Files
+			} else {
+				files = append(slices.Clone(m.Corrupt.Files), f.Path)
+			}
+		}
+		m.Corrupt = &Corruption{Files: files, At: time.Now(), Reason: corruptTampered}
+	})
+	if err != nil {
+		log.Printf("integrity guard: quarantining %s@%s: %s", m.Name, m.Version, err)
+		updated = &Manifest{Name: m.Name, Version: m.Version, Corrupt: &Corruption{Files: []string{f.Path}, At: time.Now()}}
+	}
+	writeError(c, tamperedError(updated))
+	return false
+}
+
+func tamperedError(m *Manifest) *apiError {
+	e := newError(http.StatusInternalServerError, codeTampered, "%s@%s was modified on disk since it was extracted and is quarantined until repaired", m.Name, m.Version)
+	if m.Corrupt != nil {
+		e.Details = map[string]any{"files": m.Corrupt.Files, "detectedAt": m.Corrupt.At}
+	}
+	return e
+}
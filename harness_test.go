@@ -0,0 +1,377 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The tests drive the real router with httptest against fakeRegistry, a
+// registry serving packuments and tarballs built in memory, so the whole
+// flow from resolution to serving runs without Verdaccio.
+
+func TestMain(m *testing.M) {
+	// TestEnvOnlyConfig runs the test binary as repkg itself.
+	if os.Getenv(runAsRepkg) == "1" {
+		main()
+		os.Exit(0)
+	}
+	flag.Parse()
+	gin.SetMode(gin.TestMode)
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		gin.DefaultWriter = io.Discard
+	}
+	os.Exit(m.Run())
+}
+
+// fakeRegistry serves the packuments of the packages published to it at
+// /<name> and their tarballs at /<name>/-/<base>-<version>.tgz, as npm does.
+type fakeRegistry struct {
+	*httptest.Server
+	t testing.TB
+
+	mu       sync.Mutex
+	packages map[string]*fakePackage
+	requests map[string]int // by path
+
+	// chunked streams tarballs without a Content-Length.
+	chunked bool
+}
+
+type fakePackage struct {
+	tags     map[string]string
+	versions map[string]*fakeVersion
+}
+
+type fakeVersion struct {
+	tarball   []byte
+	meta      map[string]any
+	published time.Time
+}
+
+func newFakeRegistry(t testing.TB) *fakeRegistry {
+	r := &fakeRegistry{t: t, packages: map[string]*fakePackage{}, requests: map[string]int{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// publish adds a version made of files, paths inside the package to their
+// content, below package/ in its tarball. A package.json naming the
+// version is added unless files has one. latest moves to the version when
+// it is a newer release.
+func (r *fakeRegistry) publish(name, version string, files map[string]string) {
+	r.t.Helper()
+	if _, ok := files["package.json"]; !ok {
+		files = withFile(files, "package.json", `{"name": "`+name+`", "version": "`+version+`"}`)
+	}
+	r.publishTarball(name, version, buildTarball(r.t, "package", files))
+}
+
+// publishTarball adds a version with a tarball of its own.
+func (r *fakeRegistry) publishTarball(name, version string, tarball []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.packages[name]
+	if !ok {
+		p = &fakePackage{tags: map[string]string{}, versions: map[string]*fakeVersion{}}
+		r.packages[name] = p
+	}
+	published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(len(p.versions)) * 24 * time.Hour)
+	p.versions[version] = &fakeVersion{tarball: tarball, meta: map[string]any{}, published: published}
+	v, ok := parseSemver(version)
+	if latest, lok := parseSemver(p.tags["latest"]); ok && len(v.Pre) == 0 && (!lok || v.compare(latest) > 0) {
+		p.tags["latest"] = version
+	}
+}
+
+// tag points a dist-tag of a published package at version.
+func (r *fakeRegistry) tag(name, tag, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packages[name].tags[tag] = version
+}
+
+// setMeta sets a field of a version in its packument, such as
+// "deprecated" or "dependencies".
+func (r *fakeRegistry) setMeta(name, version, field string, value any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packages[name].versions[version].meta[field] = value
+}
+
+// hits is how many requests were made for p, a packument's or a
+// tarball's path.
+func (r *fakeRegistry) hits(p string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests[p]
+}
+
+// tarballPath is where a version's tarball is served.
+func tarballPath(name, version string) string {
+	return "/" + name + "/-/" + path.Base(name) + "-" + version + ".tgz"
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[req.URL.Path]++
+
+	name, file, isTarball := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/-/")
+	p, ok := r.packages[name]
+	if !ok {
+		http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+		return
+	}
+	if !isTarball {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.packument(name, p))
+		return
+	}
+	for version, v := range p.versions {
+		if file != path.Base(name)+"-"+version+".tgz" {
+			continue
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if !r.chunked {
+			w.Write(v.tarball)
+			return
+		}
+		// Flushing before the end makes net/http send it chunked.
+		for data := v.tarball; len(data) > 0; {
+			n := min(len(data), 512)
+			w.Write(data[:n])
+			w.(http.Flusher).Flush()
+			data = data[n:]
+		}
+		return
+	}
+	http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+}
+
+// packument is what the registry publishes of a package. Callers hold
+// r.mu.
+func (r *fakeRegistry) packument(name string, p *fakePackage) map[string]any {
+	versions := map[string]any{}
+	times := map[string]string{}
+	for version, v := range p.versions {
+		sha := sha512.Sum512(v.tarball)
+		shasum := sha1.Sum(v.tarball)
+		doc := map[string]any{
+			"name":    name,
+			"version": version,
+			"dist": map[string]any{
+				"tarball":   r.URL + tarballPath(name, version),
+				"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sha[:]),
+				"shasum":    hex.EncodeToString(shasum[:]),
+			},
+		}
+		for k, value := range v.meta {
+			doc[k] = value
+		}
+		versions[version] = doc
+		times[version] = v.published.Format(time.RFC3339)
+	}
+	return map[string]any{"name": name, "dist-tags": p.tags, "versions": versions, "time": times}
+}
+
+// withFile returns a copy of files with one more.
+func withFile(files map[string]string, name, content string) map[string]string {
+	out := map[string]string{name: content}
+	for k, v := range files {
+		out[k] = v
+	}
+	return out
+}
+
+// buildTarball gzips a tar of files below prefix, or at the top level when
+// prefix is empty, in a stable order.
+func buildTarball(t testing.TB, prefix string, files map[string]string) []byte {
+	t.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     path.Join(prefix, name),
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Date(1985, 10, 26, 8, 15, 0, 0, time.UTC),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testServer is repkg set up by NewServer, serving over httptest.
+type testServer struct {
+	*httptest.Server
+	t        testing.TB
+	registry *fakeRegistry
+	cfg      Config
+}
+
+// newTestServer starts repkg against registry with a data dir of its own,
+// after configure, if not nil, changed the defaults.
+func newTestServer(t testing.TB, registry *fakeRegistry, configure func(cfg *Config)) *testServer {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.Registry = registry.URL
+	if configure != nil {
+		configure(&cfg)
+	}
+	return startTestServer(t, registry, cfg)
+}
+
+// startTestServer starts repkg with cfg as a new process would, with
+// nothing of an earlier server kept in memory.
+func startTestServer(t testing.TB, registry *fakeRegistry, cfg Config) *testServer {
+	t.Helper()
+	resetState()
+	handler, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{Server: httptest.NewServer(handler), t: t, registry: registry, cfg: cfg}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// restart stops s and starts a server with the same config and data dir.
+func (s *testServer) restart() *testServer {
+	s.t.Helper()
+	s.Close()
+	return startTestServer(s.t, s.registry, s.cfg)
+}
+
+// resetState forgets what the server before kept in memory.
+func resetState() {
+	index = newCacheIndex()
+	manifests.Range(func(k, _ any) bool {
+		manifests.Delete(k)
+		return true
+	})
+	packumentsMu.Lock()
+	packuments = map[string]*cachedPackument{}
+	packumentsMu.Unlock()
+	failures = &failureTracker{versions: map[string]*fetchFailure{}}
+	usage = &usageStats{versions: map[string]*versionUsage{}}
+	downloads = &downloadStats{packages: map[string]*packageDownloads{}}
+	approvals = &approvalQueue{}
+	hotCache = &lru{order: list.New(), entries: map[string]*list.Element{}}
+	refreshMu.Lock()
+	lastRefresh, recentRuns = map[string]time.Time{}, nil
+	refreshMu.Unlock()
+}
+
+// request makes a request to s without following redirects. Headers are
+// given as name, value pairs.
+func (s *testServer) request(method, target string, body io.Reader, headers ...string) *http.Response {
+	s.t.Helper()
+	req, err := http.NewRequest(method, s.URL+target, body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func (s *testServer) get(target string, headers ...string) *http.Response {
+	s.t.Helper()
+	return s.request(http.MethodGet, target, nil, headers...)
+}
+
+// follow returns where res redirects to, relative to s, checking that it
+// is a redirect with status.
+func (s *testServer) follow(res *http.Response, status int) string {
+	s.t.Helper()
+	if res.StatusCode != status {
+		s.t.Fatalf("%s %s: got %s, want %d", res.Request.Method, res.Request.URL, res.Status, status)
+	}
+	loc, err := res.Request.URL.Parse(res.Header.Get("Location"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return strings.TrimPrefix(loc.String(), s.URL)
+}
+
+// responseBody returns the body of res, checking its status.
+func responseBody(t testing.TB, res *http.Response, status int) string {
+	t.Helper()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: got %s, want %d: %s", res.Request.Method, res.Request.URL, res.Status, status, data)
+	}
+	return string(data)
+}
+
+// responseCode is the code of a JSON error response.
+func responseCode(t testing.TB, res *http.Response) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("%s %s: %s: %s", res.Request.Method, res.Request.URL, res.Status, err)
+	}
+	return body.Code
+}
+
+// escapeName writes a package name the way registries and URLs want it,
+// with the slash of a scope escaped.
+func escapeName(name string) string {
+	return url.PathEscape(name)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// hashedURL is where a file can be fetched by its content, for as long as
+// any cached version has it.
+func hashedURL(t *tenant, f *ManifestFile) string {
+	if f.SHA256 == "" {
+		return ""
+	}
+	return t.urlPrefix() + "/hash/" + f.SHA256 + "/" + url.PathEscape(path.Base(f.Path))
+}
+
+// serveHashed handles /hash/:sha256/:filename, serving a cached file with
+// that SHA-256 and base name. The content is hashed again before it is
+// sent, so the URL can only ever return those bytes, and caches may keep
+// it forever. Unknown hashes are a 404; the registry is never asked.
+func serveHashed(c *gin.Context) {
+	sum, filename := c.Param("sha256"), c.Param("filename")
+	if !sha256Hex.MatchString(sum) {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "not a SHA-256 hash: %q", sum))
+		return
+	}
+
+	t := tenantOf(c)
+	refs, entries := index.byHash(t, sum)
+	for i, ref := range refs {
+		e := entries[i]
+		if path.Base(ref.path) != filename || deny.denied(ref.path) {
+			continue
+		}
+		m, err := loadManifest(e.Dir, e.Name, e.Version)
+		if err != nil {
+			continue
+		}
+		f, ok := m.Lookup(ref.path)
+		if !ok || f.SHA256 != sum || m.Corrupt != nil {
+			continue
+		}
+
+		key := hotCacheKey(e.Dir, f.Path, "hash")
+		entry, ok := hotCache.get(key)
+		if !ok {
+			data, err := readStoredFile(e.Dir, f)
+			if err != nil {
+				log.Printf("hash: reading %s@%s/%s: %s", e.Name, e.Version, f.Path, err)
+				continue
+			}
+			if got := sha256.Sum256(data); hex.EncodeToString(got[:]) != sum {
+				log.Printf("hash: %s@%s/%s no longer matches its manifest", e.Name, e.Version, f.Path)
+				continue
+			}
+			h := http.Header{}
+			if t := f.fileType(); t != "" {
+				h.Set("Content-Type", t)
+			}
+			h.Set("ETag", `"`+sum+`"`)
+			entry = &hotEntry{key: key, data: data, header: h, modTime: m.Extracted}
+			hotCache.add(entry)
+		}
+
+		if !checkWithdrawn(c, m) {
+			return
+		}
+		applyHeaderRules(c, m.Name, f.Path)
+		if !applyHTMLPolicy(c, m.Name, f.Path, f.fileType()) {
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		c.Header("Content-Location", packageURL(t, m.Name, m.Version, f.Path))
+		applyHeaderOverrides(c, m.Name, f.Path)
+		usage.record(t, m.Name, m.Version)
+		countDownload(c, m.Name, m.Version)
+		serveEntry(c, filename, entry)
+		return
+	}
+	writeError(c, newError(http.StatusNotFound, codeNotFound, "no cached file %s has SHA-256 %s", filename, sum))
+}
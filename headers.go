@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHeaderRules lets pages that are cross-origin isolated load any
+// file; COOP and COEP are left for deployments to opt into.
+var defaultHeaderRules = []HeaderRule{
+	{Headers: map[string]string{"Cross-Origin-Resource-Policy": "cross-origin"}},
+}
+
+// fontTypes are the types of web fonts, whatever the system's mime.types
+// says. Browsers fetch fonts in CORS mode, even for a stylesheet of the
+// same origin once it is cached by a CDN, and a response cached without
+// Access-Control-Allow-Origin breaks every page after it; so fonts always
+// get config.FontAllowOrigin, not only when the request had an Origin.
+var fontTypes = map[string]string{
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+}
+
+func fontType(p string) string {
+	return fontTypes[strings.ToLower(path.Ext(p))]
+}
+
+// headerRuleSet holds the header rules in force, apart from config so that
+// a reload can replace them while requests are being served.
+type headerRuleSet struct {
+	mu        sync.RWMutex
+	rules     []HeaderRule
+	overrides []HeaderRule
+}
+
+var headerRules = &headerRuleSet{}
+
+// set takes the rules of a config, logging what looks mistaken in them.
+func (s *headerRuleSet) set(cfg Config) {
+	rules := cfg.Headers
+	if rules == nil {
+		rules = defaultHeaderRules
+	}
+	for _, w := range headerRuleWarnings("headers", cfg.Headers) {
+		log.Printf("WARNING: %s", w)
+	}
+	for _, w := range headerRuleWarnings("headerOverrides", cfg.HeaderOverrides) {
+		log.Printf("WARNING: %s", w)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules, s.overrides = rules, cfg.HeaderOverrides
+}
+
+func (s *headerRuleSet) get() (rules, overrides []HeaderRule) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rules, s.overrides
+}
+
+// setRuleHeaders sets the headers of every rule matching file p of
+// packageName, in order, so the last rule setting a header wins. It
+// reports whether one asked for the file to be served as it is.
+func setRuleHeaders(c *gin.Context, rules []HeaderRule, packageName, p string) (identity bool) {
+	for _, r := range rules {
+		if !r.matches(packageName, p) {
+			continue
+		}
+		for name, value := range r.Headers {
+			c.Writer.Header().Set(http.CanonicalHeaderKey(name), value)
+		}
+		identity = identity || r.Identity
+	}
+	return identity
+}
+
+// applyHeaderOverrides sets the headers of config.HeaderOverrides, over
+// whatever was set for the file before, but for the Content-Type,
+// Content-Encoding and ETag of package files.
+func applyHeaderOverrides(c *gin.Context, packageName, p string) {
+	_, overrides := headerRules.get()
+	setRuleHeaders(c, overrides, packageName, p)
+}
+
+// Directives of the headers whose values are lists of them, for warning of
+// typos that browsers would silently ignore.
+var knownDirectives = map[string][]string{
+	"Cache-Control": {"max-age", "s-maxage", "no-cache", "no-store", "no-transform", "must-revalidate",
+		"proxy-revalidate", "must-understand", "private", "public", "immutable", "stale-while-revalidate", "stale-if-error"},
+	"Content-Security-Policy": {"default-src", "script-src", "script-src-elem", "script-src-attr", "style-src",
+		"style-src-elem", "style-src-attr", "img-src", "font-src", "connect-src", "media-src", "object-src",
+		"frame-src", "child-src", "worker-src", "manifest-src", "fenced-frame-src", "base-uri", "form-action",
+		"frame-ancestors", "sandbox", "upgrade-insecure-requests", "block-all-mixed-content", "report-uri",
+		"report-to", "require-trusted-types-for", "trusted-types"},
+}
+
+// headerRuleWarnings lists the unknown directives and values of a list of
+// rules, which are only warned of: browsers move faster than repkg.
+func headerRuleWarnings(key string, rules []HeaderRule) []string {
+	var warnings []string
+	for i, r := range rules {
+		for name, value := range r.Headers {
+			name = http.CanonicalHeaderKey(name)
+			switch name {
+			case "Cache-Control":
+				for _, d := range strings.Split(value, ",") {
+					d, _, _ = strings.Cut(strings.TrimSpace(d), "=")
+					if d != "" && !slices.Contains(knownDirectives[name], strings.ToLower(d)) {
+						warnings = append(warnings, fmt.Sprintf("%s[%d]: unknown %s directive %q", key, i, name, d))
+					}
+				}
+			case "Content-Security-Policy", "Content-Security-Policy-Report-Only":
+				for _, d := range strings.Split(value, ";") {
+					d, _, _ = strings.Cut(strings.TrimSpace(d), " ")
+					if d != "" && !slices.Contains(knownDirectives["Content-Security-Policy"], strings.ToLower(d)) {
+						warnings = append(warnings, fmt.Sprintf("%s[%d]: unknown %s directive %q", key, i, name, d))
+					}
+				}
+			case "Cross-Origin-Resource-Policy":
+				if !slices.Contains([]string{"same-site", "same-origin", "cross-origin"}, value) {
+					warnings = append(warnings, fmt.Sprintf("%s[%d]: %s takes same-site, same-origin or cross-origin, not %q", key, i, name, value))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// matches reports whether the rule applies to file p of packageName.
+// Package patterns are matched like the allowlist, path patterns like the
+// denylist.
+func (r HeaderRule) matches(packageName, p string) bool {
+	if r.Package != "" && r.Package != "**" {
+		if ok, _ := path.Match(r.Package, packageName); !ok {
+			return false
+		}
+	}
+	if r.Path == "" {
+		return true
+	}
+	_, ok := (&denylist{patterns: [][]string{strings.Split(strings.Trim(r.Path, "/"), "/")}}).match(p)
+	return ok
+}
+
+// validateFontAllowOrigin accepts "*" and origins like
+// "https://app.example.com".
+func validateFontAllowOrigin(origin string) error {
+	if origin == "" || origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("fontAllowOrigin must be \"*\" or an origin like \"https://app.example.com\", not %q", origin)
+	}
+	return nil
+}
+
+func validateHeaderRule(r HeaderRule) error {
+	if _, err := path.Match(r.Package, ""); err != nil {
+		return fmt.Errorf("invalid package pattern %q", r.Package)
+	}
+	for _, seg := range strings.Split(r.Path, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q", r.Path)
+		}
+	}
+	for name := range r.Headers {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// applyHeaderRules sets the headers of every rule matching file p of
+// packageName, later rules taking precedence, and reports whether the file
+// must be served without a Content-Encoding. WebAssembly always is, so
+// that WebAssembly.instantiateStreaming gets the bytes it expects.
+func applyHeaderRules(c *gin.Context, packageName, p string) (identity bool) {
+	font := fontType(p) != ""
+	if font {
+		// The files of a version never change; rules may say otherwise.
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	rules, _ := headerRules.get()
+	identity = setRuleHeaders(c, rules, packageName, p)
+	if font && config.FontAllowOrigin != "" {
+		c.Header("Access-Control-Allow-Origin", config.FontAllowOrigin)
+		if config.FontAllowOrigin != "*" {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+	}
+	return identity || strings.EqualFold(path.Ext(p), ".wasm")
+}
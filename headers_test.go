@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var fontFiles = map[string]string{
+	"fonts/icons.woff":  "font/woff",
+	"fonts/icons.woff2": "font/woff2",
+	"fonts/icons.ttf":   "font/ttf",
+	"fonts/ICONS.OTF":   "font/otf",
+	"fonts/icons.eot":   "application/vnd.ms-fontobject",
+}
+
+func TestFontHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name, allowOrigin string
+	}{
+		{"any origin", "*"},
+		{"one origin", "https://app.example.com"},
+		{"left to CORS", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{"fonts/icons.css": "@font-face {}"}
+			for p := range fontFiles {
+				files[p] = "0123456789" + p
+			}
+			reg := newFakeRegistry(t)
+			reg.publish("icons", "1.0.0", files)
+			s := newTestServer(t, reg, func(cfg *Config) {
+				cfg.FontAllowOrigin = tc.allowOrigin
+			})
+			s.follow(s.get("/npm/icons@1.0.0/fonts/icons.css"), 302)
+
+			for p, typ := range fontFiles {
+				target := "/packages/icons@1.0.0/" + p
+				// Twice: from disk, then from the hot cache.
+				for i := 0; i < 2; i++ {
+					res := s.get(target)
+					if body := responseBody(t, res, 200); body != files[p] {
+						t.Errorf("%s: got %q", p, body)
+					}
+					if got := res.Header.Get("Content-Type"); got != typ {
+						t.Errorf("%s: Content-Type %q, want %q", p, got, typ)
+					}
+					if got := res.Header.Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+						t.Errorf("%s: Cache-Control %q", p, got)
+					}
+					if got := res.Header.Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+						t.Errorf("%s: Access-Control-Allow-Origin %q without an Origin", p, got)
+					}
+					varyOrigin := strings.Contains(strings.Join(res.Header.Values("Vary"), ","), "Origin")
+					if want := tc.allowOrigin != "" && tc.allowOrigin != "*"; varyOrigin != want {
+						t.Errorf("%s: Vary %q", p, res.Header.Values("Vary"))
+					}
+				}
+
+				// From another page, the configured origin still wins over
+				// the CORS middleware.
+				res := s.get(target, "Origin", "https://other.example.com")
+				responseBody(t, res, 200)
+				want := tc.allowOrigin
+				if want == "" {
+					want = "*"
+				}
+				if got := res.Header.Get("Access-Control-Allow-Origin"); got != want {
+					t.Errorf("%s: Access-Control-Allow-Origin %q with an Origin, want %q", p, got, want)
+				}
+
+				// Font loaders probe with HEAD and Range.
+				res = s.request("HEAD", target, nil)
+				if body := responseBody(t, res, 200); body != "" || res.Header.Get("Content-Type") != typ || res.ContentLength != int64(len(files[p])) {
+					t.Errorf("%s: HEAD gave %q, %q, %d bytes", p, body, res.Header.Get("Content-Type"), res.ContentLength)
+				}
+				if got := res.Header.Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+					t.Errorf("%s: HEAD Access-Control-Allow-Origin %q", p, got)
+				}
+				res = s.get(target, "Range", "bytes=2-5")
+				if body := responseBody(t, res, http.StatusPartialContent); body != "2345" {
+					t.Errorf("%s: range gave %q", p, body)
+				}
+				if got := res.Header.Get("Content-Range"); got != "bytes 2-5/"+strconv.Itoa(len(files[p])) {
+					t.Errorf("%s: Content-Range %q", p, got)
+				}
+				if res.Header.Get("Content-Type") != typ || res.Header.Get("Access-Control-Allow-Origin") != tc.allowOrigin {
+					t.Errorf("%s: range headers %v", p, res.Header)
+				}
+			}
+
+			// Other files are left to the CORS middleware and the rules.
+			res := s.get("/packages/icons@1.0.0/fonts/icons.css")
+			responseBody(t, res, 200)
+			if got := res.Header.Get("Access-Control-Allow-Origin"); got != "" {
+				t.Errorf("icons.css: Access-Control-Allow-Origin %q without an Origin", got)
+			}
+			if strings.Contains(res.Header.Get("Cache-Control"), "immutable") {
+				t.Errorf("icons.css: Cache-Control %q", res.Header.Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+// TestFontHeaderRules checks that header rules can still change the
+// caching of fonts.
+func TestFontHeaderRules(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("icons", "1.0.0", map[string]string{"icons.woff2": "font"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.Headers = []HeaderRule{{Path: "*.woff2", Headers: map[string]string{"Cache-Control": "no-cache"}}}
+	})
+	loc := s.follow(s.get("/npm/icons@1.0.0/icons.woff2"), 302)
+	res := s.get(loc)
+	responseBody(t, res, 200)
+	if got := res.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestValidateFontAllowOrigin(t *testing.T) {
+	for origin, ok := range map[string]bool{
+		"":                             true,
+		"*":                            true,
+		"https://app.example.com":      true,
+		"http://localhost:8080":        true,
+		"app.example.com":              false,
+		"https://app.example.com/":     false,
+		"https://app.example.com/path": false,
+		"ftp://app.example.com":        false,
+	} {
+		if err := validateFontAllowOrigin(origin); (err == nil) != ok {
+			t.Errorf("%q: %v", origin, err)
+		}
+	}
+}
+
+// TestOverlappingHeaderRules checks that every matching rule is applied in
+// order, headers before headerOverrides, so the last to set a header wins.
+func TestOverlappingHeaderRules(t *testing.T) {
+	reg := newFakeRegistry(t)
+	docs := map[string]string{
+		"index.html":        "<p>docs</p>",
+		"app.js":            "app",
+		"lib/util.js":       "util",
+		"fonts/icons.woff2": "font",
+	}
+	reg.publish("@docs/site", "1.0.0", docs)
+	reg.publish("other", "1.0.0", map[string]string{"app.js": "other"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.Headers = []HeaderRule{
+			{Headers: map[string]string{"Cross-Origin-Resource-Policy": "cross-origin", "X-Team": "all"}},
+			{Path: "**/*.js", Headers: map[string]string{"Cache-Control": "public, max-age=60", "X-Team": "js"}},
+			{Package: "@docs/*", Path: "lib/**", Headers: map[string]string{"X-Team": "docs-lib"}},
+			{Package: "@docs/site", Path: "**/*.js", Headers: map[string]string{"cache-control": "public, max-age=600"}},
+		}
+		cfg.HeaderOverrides = []HeaderRule{
+			{Path: "**/*.html", Headers: map[string]string{"Content-Security-Policy": "sandbox allow-scripts", "X-Robots-Tag": "noindex"}},
+			{Package: "@docs/*", Headers: map[string]string{"X-Robots-Tag": "none", "Cross-Origin-Resource-Policy": "same-site"}},
+			{Path: "fonts/*", Headers: map[string]string{"Cache-Control": "no-cache", "Content-Type": "text/plain"}},
+		}
+	})
+	s.follow(s.get("/npm/@docs/site@1.0.0/app.js"), 302)
+	s.follow(s.get("/npm/other@1.0.0/app.js"), 302)
+
+	want := map[string]map[string]string{
+		"@docs/site@1.0.0/index.html": {
+			"Cross-Origin-Resource-Policy": "same-site",
+			"X-Team":                       "all",
+			"Content-Security-Policy":      "sandbox allow-scripts",
+			"X-Robots-Tag":                 "none",
+			"Content-Type":                 "text/html; charset=utf-8",
+		},
+		"@docs/site@1.0.0/app.js": {
+			"Cross-Origin-Resource-Policy": "same-site",
+			"X-Team":                       "js",
+			"Cache-Control":                "public, max-age=600",
+			"X-Robots-Tag":                 "none",
+		},
+		"@docs/site@1.0.0/lib/util.js": {
+			"X-Team":        "docs-lib",
+			"Cache-Control": "public, max-age=600",
+		},
+		"@docs/site@1.0.0/fonts/icons.woff2": {
+			"X-Team":                      "all",
+			"Cache-Control":               "no-cache",
+			"Content-Type":                "font/woff2",
+			"Access-Control-Allow-Origin": "*",
+		},
+		"other@1.0.0/app.js": {
+			"Cross-Origin-Resource-Policy": "cross-origin",
+			"X-Team":                       "js",
+			"Cache-Control":                "public, max-age=60",
+			"X-Robots-Tag":                 "",
+		},
+	}
+	for file, headers := range want {
+		res := s.get("/packages/" + file)
+		responseBody(t, res, 200)
+		for name, value := range headers {
+			if got := res.Header.Get(name); got != value {
+				t.Errorf("%s: %s %q, want %q", file, name, got, value)
+			}
+		}
+	}
+
+	// /hash sets its own Cache-Control, which overrides still win over.
+	var meta struct{ Files []metaFile }
+	if err := json.Unmarshal([]byte(responseBody(t, s.get("/api/meta/@docs/site@1.0.0"), 200)), &meta); err != nil {
+		t.Fatal(err)
+	}
+	checked := 0
+	for _, f := range meta.Files {
+		content, ok := docs[f.Path]
+		if !ok {
+			continue
+		}
+		checked++
+		res := s.get(f.HashedURL)
+		if body := responseBody(t, res, 200); body != content {
+			t.Errorf("%s: got %q", f.HashedURL, body)
+		}
+		cacheControl := "public, max-age=31536000, immutable"
+		if f.Path == "fonts/icons.woff2" {
+			cacheControl = "no-cache"
+		}
+		if got := res.Header.Get("Cache-Control"); got != cacheControl {
+			t.Errorf("%s: Cache-Control %q, want %q", f.HashedURL, got, cacheControl)
+		}
+		if got := res.Header.Get("X-Robots-Tag"); got != "none" {
+			t.Errorf("%s: X-Robots-Tag %q", f.HashedURL, got)
+		}
+	}
+	if checked != len(docs) {
+		t.Errorf("%d of %d files in %+v", checked, len(docs), meta.Files)
+	}
+}
+
+// TestReloadHeaderRules checks that SIGHUP's reload replaces the rules in
+// force.
+func TestReloadHeaderRules(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("other", "1.0.0", map[string]string{"app.js": "other"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.HeaderOverrides = []HeaderRule{{Headers: map[string]string{"X-Version": "1"}}}
+	})
+	loc := s.follow(s.get("/npm/other@1.0.0/app.js"), 302)
+
+	path := filepath.Join(t.TempDir(), "repkg.json")
+	rules := `{"headers": [], "headerOverrides": [{"path": "*.js", "headers": {"X-Version": "2"}}, {"headers": {"X-Other": "yes"}}]}`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldExplicit := configPath, configExplicit
+	configPath, configExplicit = path, true
+	t.Cleanup(func() { configPath, configExplicit = oldPath, oldExplicit })
+	reloadConfig()
+
+	res := s.get(loc)
+	responseBody(t, res, 200)
+	if got := res.Header.Get("X-Version"); got != "2" {
+		t.Errorf("X-Version %q", got)
+	}
+	if got := res.Header.Get("X-Other"); got != "yes" {
+		t.Errorf("X-Other %q", got)
+	}
+	if got := res.Header.Get("Cross-Origin-Resource-Policy"); got != "" {
+		t.Errorf("Cross-Origin-Resource-Policy %q after reloading without headers", got)
+	}
+
+	// An invalid file leaves the rules as they were.
+	if err := os.WriteFile(path, []byte(`{"headerOverrides": [{"identity": true}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+	if res := s.get(loc); res.Header.Get("X-Version") != "2" {
+		t.Errorf("X-Version %q after an invalid reload", res.Header.Get("X-Version"))
+	}
+}
+
+func TestHeaderRuleWarnings(t *testing.T) {
+	rules := []HeaderRule{
+		{Headers: map[string]string{"Cache-Control": "public, max-age=60, imutable"}},
+		{Headers: map[string]string{"content-security-policy": "default-src 'self'; scirpt-src 'none'"}},
+		{Headers: map[string]string{"Cross-Origin-Resource-Policy": "cross-site"}},
+		{Headers: map[string]string{"Cache-Control": "no-cache", "X-Anything": "goes"}},
+	}
+	got := headerRuleWarnings("headerOverrides", rules)
+	want := []string{
+		`headerOverrides[0]: unknown Cache-Control directive "imutable"`,
+		`headerOverrides[1]: unknown Content-Security-Policy directive "scirpt-src"`,
+		`headerOverrides[2]: Cross-Origin-Resource-Policy takes same-site, same-origin or cross-origin, not "cross-site"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hotEntry is a small file held in memory along with the headers it is
+// served with.
+type hotEntry struct {
+	key     string
+	data    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+// lru keeps recently served small files in memory, bounded by total bytes.
+type lru struct {
+	mu      sync.Mutex
+	max     int64
+	maxFile int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var hotCache = &lru{order: list.New(), entries: map[string]*list.Element{}}
+
+var (
+	hotCacheHits   = newCounter("repkg_hot_cache_hits_total", "Files served from the in-memory cache.")
+	hotCacheMisses = newCounter("repkg_hot_cache_misses_total", "Files that were not in the in-memory cache.")
+
+	_ = newGaugeFunc("repkg_hot_cache_bytes", "Bytes held by the in-memory cache.", func() float64 {
+		hotCache.mu.Lock()
+		defer hotCache.mu.Unlock()
+		return float64(hotCache.size)
+	})
+	_ = newGaugeFunc("repkg_hot_cache_entries", "Files held by the in-memory cache.", func() float64 {
+		hotCache.mu.Lock()
+		defer hotCache.mu.Unlock()
+		return float64(len(hotCache.entries))
+	})
+	_ = newGaugeFunc("repkg_hot_cache_hit_ratio", "Share of in-memory cache lookups that were hits.", func() float64 {
+		hits, misses := hotCacheHits.Value(), hotCacheMisses.Value()
+		if hits+misses == 0 {
+			return 0
+		}
+		return hits / (hits + misses)
+	})
+)
+
+func (c *lru) configure(maxBytes, maxFile int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max, c.maxFile = maxBytes, maxFile
+	c.evict()
+}
+
+// fits reports whether a file of size n may be cached.
+func (c *lru) fits(n int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max > 0 && n <= c.maxFile && n <= c.max
+}
+
+func hotCacheKey(dir, file, encoding string) string {
+	return dir + "\x00" + file + "\x00" + encoding
+}
+
+func (c *lru) get(key string) (*hotEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max <= 0 {
+		return nil, false
+	}
+
+	el, ok := c.entries[key]
+	if !ok {
+		hotCacheMisses.Inc()
+		return nil, false
+	}
+	hotCacheHits.Inc()
+	c.order.MoveToFront(el)
+	return el.Value.(*hotEntry), true
+}
+
+func (c *lru) add(e *hotEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(e.data)) > c.maxFile || int64(len(e.data)) > c.max {
+		return
+	}
+
+	if el, ok := c.entries[e.key]; ok {
+		c.size -= int64(len(el.Value.(*hotEntry).data))
+		c.order.Remove(el)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	c.size += int64(len(e.data))
+	c.evict()
+}
+
+func (c *lru) evict() {
+	for c.size > c.max && c.order.Len() > 0 {
+		el := c.order.Back()
+		e := el.Value.(*hotEntry)
+		c.order.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.data))
+	}
+}
+
+// invalidateVersion drops every cached file of a version directory. It must
+// be called whenever a version is purged, evicted or replaced.
+func (c *lru) invalidateVersion(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := dir + "\x00"
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.size -= int64(len(el.Value.(*hotEntry).data))
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
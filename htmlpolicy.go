@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of config.HTMLPolicy, for the HTML and SVG files of packages.
+const (
+	htmlRender   = "render"
+	htmlDownload = "download"
+	htmlBlock    = "block"
+)
+
+const (
+	// Rendered pages run in an opaque origin, so their scripts can't
+	// reach this one's cookies or storage.
+	renderCSP = "sandbox allow-scripts allow-forms allow-popups allow-modals"
+	// SVGs loaded as images never run scripts anyway; this keeps them from
+	// doing so when opened directly too.
+	imageCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+)
+
+func validHTMLPolicy(p string) bool {
+	return p == htmlRender || p == htmlDownload || p == htmlBlock
+}
+
+// htmlPolicyFor returns the policy for a package: its scope's in
+// config.HTMLPolicyScopes, or config.HTMLPolicy.
+func htmlPolicyFor(packageName string) string {
+	if scope, _, ok := strings.Cut(packageName, "/"); ok {
+		if p, ok := config.HTMLPolicyScopes[scope]; ok {
+			return p
+		}
+	}
+	return config.HTMLPolicy
+}
+
+// activeContent reports whether browsers render files of contentType as
+// documents under the serving origin.
+func activeContent(contentType string) (html, svg bool) {
+	t, _, _ := mime.ParseMediaType(contentType)
+	return t == "text/html" || t == "application/xhtml+xml", t == "image/svg+xml"
+}
+
+// applyHTMLPolicy applies the package's HTML policy to file p of type
+// contentType, after the header rules so that they can't loosen it. SVGs
+// requested as images are always let through without scripts. It reports
+// false when the file was refused and the response is written.
+func applyHTMLPolicy(c *gin.Context, packageName, p, contentType string) bool {
+	html, svg := activeContent(contentType)
+	if !html && !svg {
+		return true
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	if svg {
+		c.Writer.Header().Add("Vary", "Sec-Fetch-Dest")
+		if c.GetHeader("Sec-Fetch-Dest") == "image" {
+			c.Header("Content-Security-Policy", imageCSP)
+			return true
+		}
+	}
+
+	switch htmlPolicyFor(packageName) {
+	case htmlBlock:
+		e := newError(http.StatusNotFound, codeNotFound, "%s files of %s are not served", path.Ext(p), packageName)
+		e.Details = map[string]any{"package": packageName, "path": p, "policy": htmlBlock}
+		writeError(c, e)
+		return false
+	case htmlDownload:
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(p)}))
+	}
+	if svg {
+		c.Header("Content-Security-Policy", imageCSP)
+	} else {
+		c.Header("Content-Security-Policy", renderCSP)
+	}
+	return true
+}
+
+func validateHTMLPolicies(cfg Config) error {
+	if !validHTMLPolicy(cfg.HTMLPolicy) {
+		return fmt.Errorf("htmlPolicy must be %q, %q or %q", htmlRender, htmlDownload, htmlBlock)
+	}
+	for scope, p := range cfg.HTMLPolicyScopes {
+		if !strings.HasPrefix(scope, "@") || !validPackageName(scope+"/x") {
+			return fmt.Errorf("htmlPolicyScopes: %q is not a scope like \"@org\"", scope)
+		}
+		if !validHTMLPolicy(p) {
+			return fmt.Errorf("htmlPolicyScopes[%q] must be %q, %q or %q", scope, htmlRender, htmlDownload, htmlBlock)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTMLPolicy(t *testing.T) {
+	files := map[string]string{
+		"index.html": "<script>alert(document.cookie)</script>",
+		"page.htm":   "<p>page</p>",
+		"logo.svg":   `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"index.js":   "export {};",
+	}
+	reg := newFakeRegistry(t)
+	reg.publish("site", "1.0.0", files)
+	reg.publish("@docs/site", "1.0.0", files)
+
+	for _, policy := range []string{htmlRender, htmlDownload, htmlBlock} {
+		// The scope's policy is the other way round from the default.
+		other := htmlBlock
+		if policy == htmlBlock {
+			other = htmlRender
+		}
+		s := newTestServer(t, reg, func(cfg *Config) {
+			cfg.HTMLPolicy = policy
+			cfg.HTMLPolicyScopes = map[string]string{"@docs": other}
+		})
+		for _, pkg := range []struct{ name, policy string }{{"site", policy}, {"@docs/site", other}} {
+			s.follow(s.get("/npm/"+pkg.name+"@1.0.0/index.js"), 302)
+			for _, tc := range []struct {
+				file, dest  string
+				contentType string
+				csp         string
+				// image is whether the policy is bypassed, as for SVGs
+				// loaded as images.
+				image bool
+			}{
+				{file: "index.html", contentType: "text/html; charset=utf-8", csp: renderCSP},
+				{file: "page.htm", contentType: "text/html; charset=utf-8", csp: renderCSP},
+				{file: "logo.svg", contentType: "image/svg+xml", csp: imageCSP},
+				{file: "logo.svg", dest: "image", contentType: "image/svg+xml", csp: imageCSP, image: true},
+				{file: "logo.svg", dest: "document", contentType: "image/svg+xml", csp: imageCSP},
+			} {
+				target := "/packages/" + pkg.name + "@1.0.0/" + tc.file
+				name := pkg.policy + " " + target + " " + tc.dest
+				res := s.get(target, "Sec-Fetch-Dest", tc.dest)
+				body := responseBody(t, res, res.StatusCode)
+
+				if pkg.policy == htmlBlock && !tc.image {
+					var e struct{ Code, Policy string }
+					if err := json.Unmarshal([]byte(body), &e); err != nil || res.StatusCode != http.StatusNotFound || e.Code != codeNotFound || e.Policy != htmlBlock {
+						t.Errorf("%s: got %s %s, want a 404 %s", name, res.Status, body, codeNotFound)
+					}
+					if csp := res.Header.Get("Content-Security-Policy"); csp != "" {
+						t.Errorf("%s: Content-Security-Policy %q", name, csp)
+					}
+					continue
+				}
+				if res.StatusCode != http.StatusOK || body != files[tc.file] {
+					t.Errorf("%s: got %s %q", name, res.Status, body)
+					continue
+				}
+				if ct := res.Header.Get("Content-Type"); ct != tc.contentType {
+					t.Errorf("%s: Content-Type %q, want %q", name, ct, tc.contentType)
+				}
+				if csp := res.Header.Get("Content-Security-Policy"); csp != tc.csp {
+					t.Errorf("%s: Content-Security-Policy %q, want %q", name, csp, tc.csp)
+				}
+				if nosniff := res.Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+					t.Errorf("%s: X-Content-Type-Options %q", name, nosniff)
+				}
+				disposition := res.Header.Get("Content-Disposition")
+				if want := "attachment; filename=" + tc.file; pkg.policy == htmlDownload && !tc.image {
+					if disposition != want {
+						t.Errorf("%s: Content-Disposition %q, want %q", name, disposition, want)
+					}
+				} else if strings.HasPrefix(disposition, "attachment") {
+					t.Errorf("%s: Content-Disposition %q", name, disposition)
+				}
+				if strings.HasSuffix(tc.file, ".svg") && !strings.Contains(strings.Join(res.Header.Values("Vary"), ","), "Sec-Fetch-Dest") {
+					t.Errorf("%s: Vary %q", name, res.Header.Values("Vary"))
+				}
+			}
+		}
+
+		// Other files are served as they are whatever the policy.
+		res := s.get("/packages/site@1.0.0/index.js")
+		if body := responseBody(t, res, 200); body != files["index.js"] || res.Header.Get("Content-Security-Policy") != "" || res.Header.Get("Content-Disposition") != "" {
+			t.Errorf("%s: index.js got %q, %v", policy, body, res.Header)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Internal state lives under this directory of config.DataDir. Package names
+// can't start with a dot, so it never collides with a package.
+const internalDir = ".cache"
+
+// indexEntry describes one cached version.
+type indexEntry struct {
+	Tenant       string    `json:"tenant,omitempty"`
+	Name         string    `json:"name"`
+	Version      string    `json:"version"`
+	Dir          string    `json:"-"`
+	Size         int64     `json:"size"`
+	TarballSize  int64     `json:"tarballSize,omitempty"`
+	UnpackedSize int64     `json:"unpackedSize"`
+	Files        int       `json:"files"`
+	CachedAt     time.Time `json:"cachedAt"`
+	Pinned       bool      `json:"pinned,omitempty"`
+	Withdrawn    bool      `json:"withdrawn,omitempty"`
+	// SecurityHolder is npm's placeholder for a removed package.
+	SecurityHolder bool `json:"securityHolder,omitempty"`
+	// Registry is the registryID of where the version was fetched from,
+	// "" for versions cached before manifests recorded it.
+	Registry  string     `json:"registry,omitempty"`
+	FetchedBy *FetchedBy `json:"fetchedBy,omitempty"`
+
+	tenant *tenant
+	hashes []string // tenant-qualified SHA-256 of each file
+}
+
+// hashRef is a file of a cached version with a given content hash.
+type hashRef struct {
+	key  string // tenant-qualified name@version
+	path string
+}
+
+// cacheIndex tracks what is stored under config.DataDir and how much space
+// it takes. It is filled by the startup sweep and kept up to date as
+// versions, packuments and derived files are written.
+type cacheIndex struct {
+	mu       sync.Mutex
+	versions map[string]*indexEntry // by tenant-qualified name@version
+	sizes    map[string]int64       // sizes of files under internalDir by path
+	hashes   map[string][]hashRef   // by tenant-qualified SHA-256
+}
+
+var index = newCacheIndex()
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{versions: map[string]*indexEntry{}, sizes: map[string]int64{}, hashes: map[string][]hashRef{}}
+}
+
+var (
+	_ = newGaugeFunc("repkg_cache_versions", "Package versions stored on disk.", func() float64 {
+		n, _, _ := index.totals()
+		return float64(n)
+	})
+	_ = newGaugeFunc("repkg_cache_bytes", "Bytes stored on disk, including cached packuments and derived files.", func() float64 {
+		_, versions, internal := index.totals()
+		return float64(versions + internal)
+	})
+)
+
+// manifestSize is the space a version takes on disk.
+func manifestSize(m *Manifest) int64 {
+	var n int64
+	for _, f := range m.Files {
+		if f.Stored != "" {
+			n += f.StoredSize
+		} else {
+			n += f.Size
+		}
+	}
+	return n
+}
+
+func (ix *cacheIndex) addVersion(t *tenant, dir string, m *Manifest, cachedAt time.Time) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	key := t.qualify(m.Name + "@" + m.Version)
+	ix.forgetHashes(key)
+	e := &indexEntry{
+		Tenant:         t.Name(),
+		Name:           m.Name,
+		Version:        m.Version,
+		Dir:            dir,
+		Size:           manifestSize(m),
+		TarballSize:    m.TarballSize,
+		UnpackedSize:   m.UnpackedSize,
+		Files:          len(m.Files),
+		CachedAt:       cachedAt,
+		Pinned:         m.Pinned,
+		Withdrawn:      m.Withdrawn != nil,
+		SecurityHolder: m.SecurityHolder,
+		Registry:       registryID(m.Registry),
+		FetchedBy:      m.FetchedBy,
+		tenant:         t,
+	}
+	for _, f := range m.Files {
+		if f.SHA256 != "" {
+			h := t.qualify(f.SHA256)
+			ix.hashes[h] = append(ix.hashes[h], hashRef{key: key, path: f.Path})
+			e.hashes = append(e.hashes, h)
+		}
+	}
+	ix.versions[key] = e
+}
+
+// forgetHashes drops the hash references of the version with key, called
+// with ix.mu held.
+func (ix *cacheIndex) forgetHashes(key string) {
+	e, ok := ix.versions[key]
+	if !ok {
+		return
+	}
+	for _, h := range e.hashes {
+		refs := slices.DeleteFunc(ix.hashes[h], func(r hashRef) bool { return r.key == key })
+		if len(refs) == 0 {
+			delete(ix.hashes, h)
+		} else {
+			ix.hashes[h] = refs
+		}
+	}
+}
+
+// byHash returns the cached files of t with the given SHA-256, with the
+// entries of their versions.
+func (ix *cacheIndex) byHash(t *tenant, sum string) ([]hashRef, []indexEntry) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	refs := slices.Clone(ix.hashes[t.qualify(sum)])
+	entries := make([]indexEntry, len(refs))
+	for i, r := range refs {
+		entries[i] = *ix.versions[r.key]
+	}
+	return refs, entries
+}
+
+// updateVersion refreshes what the index knows of a version from its
+// rewritten manifest.
+func (ix *cacheIndex) updateVersion(t *tenant, m *Manifest) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if e, ok := ix.versions[t.qualify(m.Name+"@"+m.Version)]; ok {
+		e.Pinned = m.Pinned
+		e.Withdrawn = m.Withdrawn != nil
+		e.SecurityHolder = m.SecurityHolder
+	}
+}
+
+// replace makes ix hold what n does, for a replica that read the data dir
+// again, and returns the versions that are gone.
+func (ix *cacheIndex) replace(n *cacheIndex) []indexEntry {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	var gone []indexEntry
+	for key, e := range ix.versions {
+		if _, ok := n.versions[key]; !ok {
+			gone = append(gone, *e)
+		}
+	}
+	ix.versions, ix.sizes, ix.hashes = n.versions, n.sizes, n.hashes
+	return gone
+}
+
+func (ix *cacheIndex) removeVersion(t *tenant, name, version string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	key := t.qualify(name + "@" + version)
+	ix.forgetHashes(key)
+	delete(ix.versions, key)
+}
+
+// removeFiles forgets the internal files below dir.
+func (ix *cacheIndex) removeFiles(dir string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for p := range ix.sizes {
+		if strings.HasPrefix(p, prefix) {
+			delete(ix.sizes, p)
+		}
+	}
+}
+
+func (ix *cacheIndex) removeFile(p string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	delete(ix.sizes, p)
+}
+
+func (ix *cacheIndex) setFileSize(p string, n int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.sizes[p] = n
+}
+
+func (ix *cacheIndex) totals() (versions int, versionBytes, internalBytes int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, e := range ix.versions {
+		versionBytes += e.Size
+	}
+	for _, n := range ix.sizes {
+		internalBytes += n
+	}
+	return len(ix.versions), versionBytes, internalBytes
+}
+
+// totalsFor is totals for a single tenant.
+func (ix *cacheIndex) totalsFor(t *tenant) (versions int, versionBytes, internalBytes int64) {
+	prefix := filepath.Join(t.dataDir(), internalDir) + string(filepath.Separator)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, e := range ix.versions {
+		if e.tenant == t {
+			versions++
+			versionBytes += e.Size
+		}
+	}
+	for p, n := range ix.sizes {
+		if strings.HasPrefix(p, prefix) {
+			internalBytes += n
+		}
+	}
+	return versions, versionBytes, internalBytes
+}
+
+// quotaBytes is the space t's versions counted under a quota key take.
+func (ix *cacheIndex) quotaBytes(t *tenant, key string) int64 {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	var n int64
+	for _, e := range ix.versions {
+		if inQuota(*e, t, key) {
+			n += e.Size
+		}
+	}
+	return n
+}
+
+// entries returns every cached version of every tenant, by tenant, name
+// and version.
+func (ix *cacheIndex) entries() []indexEntry {
+	ix.mu.Lock()
+	list := make([]indexEntry, 0, len(ix.versions))
+	for _, e := range ix.versions {
+		list = append(list, *e)
+	}
+	ix.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		return versionLess(list[i].Name, list[i].Version, list[j].Name, list[j].Version)
+	})
+	return list
+}
+
+// versionLess orders versions by name, then by semver precedence, then by
+// the version string for those that only differ in build metadata.
+func versionLess(name1, v1, name2, v2 string) bool {
+	if name1 != name2 {
+		return name1 < name2
+	}
+	a, _ := parseSemver(v1)
+	b, _ := parseSemver(v2)
+	if c := a.compare(b); c != 0 {
+		return c < 0
+	}
+	return v1 < v2
+}
+
+// page returns up to limit of t's versions that come after name@version
+// after ("" for the first page) in versionLess order, how many t has in all
+// and whether more follow. Only the page is copied out of the index.
+func (ix *cacheIndex) page(t *tenant, after string, limit int) (list []indexEntry, total int, more bool) {
+	afterName, afterVersion := "", ""
+	if i := strings.LastIndex(after, "@"); i > 0 {
+		afterName, afterVersion = after[:i], after[i+1:]
+	}
+	less := func(i, j int) bool {
+		return versionLess(list[i].Name, list[i].Version, list[j].Name, list[j].Version)
+	}
+
+	ix.mu.Lock()
+	for _, e := range ix.versions {
+		if e.tenant != t {
+			continue
+		}
+		total++
+		if after != "" && !versionLess(afterName, afterVersion, e.Name, e.Version) {
+			continue
+		}
+		more = more || len(list) >= limit
+		list = append(list, *e)
+		if len(list) >= 2*limit {
+			sort.Slice(list, less)
+			list = list[:limit]
+		}
+	}
+	ix.mu.Unlock()
+
+	sort.Slice(list, less)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, total, more
+}
+
+// entriesFor returns the cached versions of one tenant.
+func (ix *cacheIndex) entriesFor(t *tenant) []indexEntry {
+	list := []indexEntry{}
+	for _, e := range ix.entries() {
+		if e.tenant == t {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// largest returns the n versions of a tenant that unpack to the most bytes.
+func (ix *cacheIndex) largest(t *tenant, n int) []indexEntry {
+	return largestOf(ix.entriesFor(t), n)
+}
+
+func largestOf(list []indexEntry, n int) []indexEntry {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].UnpackedSize != list[j].UnpackedSize {
+			return list[i].UnpackedSize > list[j].UnpackedSize
+		}
+		return list[i].Name+"@"+list[i].Version < list[j].Name+"@"+list[j].Version
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// sweepDataDir runs at startup. It upgrades older layouts, removes what
+// interrupted fetches and writes left behind (staging directories, tarballs,
+// temporary files) and fills the index from the manifests and packument
+// cache found on disk, for every tenant. A replica only fills the index,
+// leaving the rest to the writer.
+func sweepDataDir() error {
+	if !config.ReadOnly {
+		if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := checkLayout(); err != nil {
+		return err
+	}
+	start := time.Now()
+
+	for _, t := range allTenants() {
+		if err := sweepTenant(t, index); err != nil {
+			return err
+		}
+	}
+	if config.ReadOnly {
+		replicaRefreshed(start, nil)
+	}
+
+	n, versionBytes, internalBytes := index.totals()
+	log.Printf("sweep: %d versions (%d bytes), %d bytes of internal files in %s", n, versionBytes, internalBytes, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func sweepTenant(t *tenant, ix *cacheIndex) error {
+	dataDir := t.dataDir()
+	if config.ReadOnly {
+		if _, err := os.Stat(dataDir); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	} else if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	routed := map[string]bool{partitionName(t.registry()): true}
+	if fallback := fallbackFor(t); fallback != "" {
+		routed[partitionName(fallback)] = true
+	}
+	// Directories above version directories, which may be left empty.
+	var parents []string
+	err := filepath.WalkDir(dataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dataDir, p)
+		rel = filepath.ToSlash(rel)
+
+		if !d.IsDir() {
+			// Anything outside a version directory is a leftover download.
+			if (strings.HasSuffix(p, ".tgz") || strings.HasSuffix(p, ".tmp")) && !config.ReadOnly {
+				log.Printf("sweep: removing %s", rel)
+				os.Remove(p)
+			}
+			return nil
+		}
+
+		if rel == internalDir {
+			return sweepInternal(p, ix)
+		}
+		if rel == tenantsDir {
+			return fs.SkipDir
+		}
+		if !strings.Contains(rel, "/") && rel != "." && !routed[rel] {
+			log.Printf("sweep: leaving %s alone, the partition of a registry no longer configured", p)
+			return fs.SkipDir
+		}
+		_, name, version, ok := parseVersionDir(rel)
+		if !ok {
+			if rel != "." {
+				parents = append(parents, p)
+			}
+			return nil
+		}
+		if !validVersion(version) {
+			// Older releases extracted to <name>/package before renaming.
+			if version == "package" && !config.ReadOnly {
+				log.Printf("sweep: removing %s", rel)
+				os.RemoveAll(p)
+			}
+			return fs.SkipDir
+		}
+
+		if config.ReadOnly {
+			checkManifest(p)
+		}
+		if versionDir(t, name, version) != p {
+			log.Printf("sweep: %s: also cached from %s, which is served instead", rel, t.registry())
+			return fs.SkipDir
+		}
+		m, err := loadManifest(p, name, version)
+		if err != nil {
+			log.Printf("sweep: %s: %s", rel, err)
+			return fs.SkipDir
+		}
+		ix.addVersion(t, p, m, m.Extracted)
+		return fs.SkipDir
+	})
+	if err != nil {
+		return err
+	}
+	if !config.ReadOnly {
+		pruneEmptyDirs(parents)
+	}
+	return nil
+}
+
+// pruneEmptyDirs removes those of dirs, found by a sweep in walk order,
+// that are empty: packages and scopes whose last version an older release
+// removed, or that an interrupted fetch created.
+func pruneEmptyDirs(dirs []string) {
+	// Children come after their parents in a walk.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if os.Remove(dirs[i]) == nil {
+			log.Printf("sweep: removed empty %s", dirs[i])
+		}
+	}
+}
+
+func sweepInternal(dir string, ix *cacheIndex) error {
+	// A replica leaves the writer's staging directories alone.
+	if !config.ReadOnly {
+		if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+			return err
+		}
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if config.ReadOnly && p == filepath.Join(dir, "tmp") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(p, ".tmp") {
+			if config.ReadOnly {
+				return nil
+			}
+			return os.Remove(p)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		ix.setFileSize(p, info.Size())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fs.SkipDir
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/gin-gonic/gin"
+)
+
+// ?inline-css answers for a stylesheet, the package's or the file named,
+// with the @imports of other stylesheets of the same package inlined in
+// place, for pages that want one request rather than a waterfall. Imports
+// of URLs and of anything outside the package are left as they are, and
+// url() references are rewritten to the /packages URLs of their files, as
+// the result is served from elsewhere.
+
+// derivedInlineCSS is the kind of the artifacts ?inline-css builds.
+const derivedInlineCSS = "inline-css"
+
+const (
+	inlineCSSMaxDepth = 16
+	inlineCSSMaxBytes = 4 << 20
+)
+
+// serveInlineCSS answers ?inline-css. Stylesheets that can't be inlined,
+// being invalid or too large, are redirected to as they are, with a
+// Warning.
+func serveInlineCSS(c *gin.Context, ep *ensuredPackage, file string, opts fetchOptions) {
+	m := ep.Manifest
+	t := opts.Tenant
+	if file == "" {
+		entry, _, err := resolveEntry(versionDir(t, m.Name, m.Version), m, opts.Env)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		file = entry
+	} else if p, ok := resolveFile(m, file); ok {
+		file = p
+	} else {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "%s@%s has no file %s", m.Name, m.Version, file))
+		return
+	}
+	if !strings.EqualFold(path.Ext(file), ".css") {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "inline-css takes a stylesheet, not %s", file))
+		return
+	}
+
+	sum := sha256.Sum256([]byte(m.Name + "\x00" + m.Version + "\x00" + file))
+	name := "css-" + hex.EncodeToString(sum[:8]) + ".css"
+	spec := &derivedSpec{TransformVersion: transformVersion, Kind: derivedInlineCSS, File: file}
+	err := buildDerived(m.Name, m.Version, name, spec, opts)
+	var e *apiError
+	if errors.As(err, &e) && e.Code == codeBuildFailed {
+		setResolveHeaders(c.Writer, ep)
+		c.Header("Warning", `199 repkg "not inlined: `+strings.ReplaceAll(e.Message, `"`, `'`)+`"`)
+		c.Redirect(http.StatusFound, withAccessKey(c, packageURL(t, m.Name, m.Version, file)))
+		return
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	setResolveHeaders(c.Writer, ep)
+	setServerTiming(c.Writer, opts.Timing)
+	c.Redirect(http.StatusFound, withAccessKey(c, derivedURL(t, m.Name, m.Version, name)))
+}
+
+// cssInliner resolves the imports and URLs of the stylesheets of one
+// version. The depth of each stylesheet is its plugin data.
+type cssInliner struct {
+	t      *tenant
+	m      *Manifest
+	name   string
+	ver    string
+	inputs *buildInputs
+}
+
+func buildInlineCSS(packageName, version, file string, opts fetchOptions) ([]byte, error) {
+	m, err := loadManifest(versionDir(opts.Tenant, packageName, version), packageName, version)
+	if err != nil {
+		return nil, err
+	}
+	in := &cssInliner{t: opts.Tenant, m: m, name: packageName, ver: version, inputs: opts.Inputs}
+	entry := packageName + "@" + version + "/" + file
+
+	options := api.BuildOptions{
+		EntryPoints: []string{entry},
+		Bundle:      true,
+		Write:       false,
+		Outfile:     "inline.css",
+		LogLevel:    api.LogLevelSilent,
+		Plugins: []api.Plugin{{
+			Name:  "repkg-css",
+			Setup: in.setup,
+		}},
+	}
+	opts.Inputs.build(options)
+	result := api.Build(options)
+	// esbuild recovers from syntax errors, which are only warnings to it,
+	// but what it recovers to isn't what browsers would make of the file.
+	problems := result.Errors
+	for _, w := range result.Warnings {
+		if w.ID == "css-syntax-error" || w.ID == "invalid-@import" {
+			problems = append(problems, w)
+		}
+	}
+	if len(problems) > 0 {
+		msg := problems[0]
+		log.Printf("inlining %s: %s", entry, msg.Text)
+		e := newError(http.StatusInternalServerError, codeBuildFailed, "inlining %s failed: %s", entry, msg.Text)
+		if msg.Location != nil {
+			e.Details = map[string]any{"file": msg.Location.File, "line": msg.Location.Line, "column": msg.Location.Column}
+		}
+		return nil, e
+	}
+	var code []byte
+	for _, f := range result.OutputFiles {
+		code = f.Contents
+	}
+	if len(code) > inlineCSSMaxBytes {
+		return nil, newError(http.StatusInternalServerError, codeBuildFailed, "inlining %s makes %d bytes, more than %d", entry, len(code), inlineCSSMaxBytes)
+	}
+	return code, nil
+}
+
+func (in *cssInliner) setup(build api.PluginBuild) {
+	build.OnResolve(api.OnResolveOptions{Filter: ".*"}, in.resolve)
+	build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: bundleNamespace}, in.load)
+}
+
+func (in *cssInliner) resolve(args api.OnResolveArgs) (api.OnResolveResult, error) {
+	spec := args.Path
+	if args.Kind == api.ResolveEntryPoint {
+		return api.OnResolveResult{Path: spec, Namespace: bundleNamespace, PluginData: 0}, nil
+	}
+	depth, _ := args.PluginData.(int)
+	untouched := api.OnResolveResult{Path: spec, External: true}
+	if spec == "" || strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, "#") || strings.HasPrefix(spec, "~") || strings.Contains(spec, ":") {
+		return untouched, nil
+	}
+
+	// Relative references, with or without "./", as CSS has them.
+	p, suffix := spec, ""
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p, suffix = p[:i], p[i:]
+	}
+	_, rel := splitPackagePath(args.Importer)
+	p = path.Join(path.Dir(rel), p)
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return untouched, nil
+	}
+
+	if args.Kind != api.ResolveCSSImportRule {
+		return api.OnResolveResult{Path: packageURL(in.t, in.name, in.ver, p) + suffix, External: true}, nil
+	}
+	f, ok := resolveFile(in.m, p)
+	if !ok || deny.denied(f) || suffix != "" {
+		return untouched, nil
+	}
+	if depth >= inlineCSSMaxDepth {
+		return api.OnResolveResult{}, fmt.Errorf("@imports nest deeper than %d", inlineCSSMaxDepth)
+	}
+	return api.OnResolveResult{Path: in.name + "@" + in.ver + "/" + f, Namespace: bundleNamespace, PluginData: depth + 1}, nil
+}
+
+func (in *cssInliner) load(args api.OnLoadArgs) (api.OnLoadResult, error) {
+	_, rel := splitPackagePath(args.Path)
+	f, ok := in.m.Lookup(rel)
+	if !ok || deny.denied(rel) {
+		return api.OnLoadResult{}, fmt.Errorf("%s@%s has no file %s", in.name, in.ver, rel)
+	}
+	data, err := readStoredFile(versionDir(in.t, in.name, in.ver), f)
+	if err != nil {
+		return api.OnLoadResult{}, err
+	}
+	in.inputs.read(in.m, f)
+	contents := string(data)
+	return api.OnLoadResult{Contents: &contents, Loader: api.LoaderCSS, PluginData: args.PluginData}, nil
+}
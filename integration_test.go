@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFetchExactVersion(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "module.exports = 1"})
+	reg.publish("left-pad", "1.1.0", map[string]string{"index.js": "module.exports = 2"})
+	s := newTestServer(t, reg, nil)
+
+	loc := s.follow(s.get("/npm/left-pad@1.0.0/index.js"), 302)
+	if want := "/packages/left-pad@1.0.0/index.js"; loc != want {
+		t.Errorf("redirected to %s, want %s", loc, want)
+	}
+	if body := responseBody(t, s.get(loc), 200); body != "module.exports = 1" {
+		t.Errorf("got %q", body)
+	}
+
+	dir := filepath.Join(s.cfg.DataDir, partitionName(reg.URL), "left-pad", "1.0.0")
+	if _, err := os.Stat(filepath.Join(dir, manifestFile)); err != nil {
+		t.Errorf("no manifest in the version directory: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.DataDir, partitionName(reg.URL), "left-pad", "1.1.0")); !os.IsNotExist(err) {
+		t.Errorf("1.1.0 was fetched too: %v", err)
+	}
+}
+
+func TestFetchTag(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "stable"})
+	reg.publish("left-pad", "2.0.0-beta.1", map[string]string{"index.js": "beta"})
+	reg.tag("left-pad", "next", "2.0.0-beta.1")
+	s := newTestServer(t, reg, nil)
+
+	for _, tc := range []struct{ path, want string }{
+		{"/npm/left-pad/next/index.js", "/packages/left-pad@2.0.0-beta.1/index.js"},
+		{"/npm/left-pad@latest/index.js", "/packages/left-pad@1.0.0/index.js"},
+		{"/npm/left-pad@next/index.js", "/packages/left-pad@2.0.0-beta.1/index.js"},
+		{"/npm/left-pad@^1/index.js", "/packages/left-pad@1.0.0/index.js"},
+	} {
+		if loc := s.follow(s.get(tc.path), 302); loc != tc.want {
+			t.Errorf("%s: redirected to %s, want %s", tc.path, loc, tc.want)
+		}
+	}
+	if body := responseBody(t, s.get("/packages/left-pad@2.0.0-beta.1/index.js"), 200); body != "beta" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestFetchScopedAndUnscoped(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{"lib/main.js": "scoped"})
+	reg.publish("pkg", "1.0.0", map[string]string{"lib/main.js": "unscoped"})
+	s := newTestServer(t, reg, nil)
+
+	for _, tc := range []struct{ name, want string }{
+		{"@scope/pkg", "scoped"},
+		{"pkg", "unscoped"},
+	} {
+		loc := s.follow(s.get("/npm/"+tc.name+"@1.0.0/lib/main.js"), 302)
+		if body := responseBody(t, s.get(loc), 200); body != tc.want {
+			t.Errorf("%s: got %q from %s, want %q", tc.name, body, loc, tc.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.DataDir, partitionName(reg.URL), "@scope", "pkg", "1.0.0", "lib", "main.js")); err != nil {
+		t.Errorf("scoped version not below its scope: %s", err)
+	}
+}
+
+func TestFetchNotFound(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": ""})
+	s := newTestServer(t, reg, nil)
+
+	for _, tc := range []struct{ path, code string }{
+		{"/npm/no-such-package@1.0.0/index.js", codeNotFound},
+		{"/npm/@scope/no-such-package/index.js", codeNotFound},
+		{"/npm/left-pad@2.0.0/index.js", codeVersionNotFound},
+		{"/npm/left-pad@no-such-tag/index.js", codeVersionNotFound},
+	} {
+		res := s.get(tc.path)
+		if res.StatusCode != 404 {
+			t.Errorf("%s: got %s, want 404", tc.path, res.Status)
+			continue
+		}
+		if code := responseCode(t, res); code != tc.code {
+			t.Errorf("%s: code %q, want %q", tc.path, code, tc.code)
+		}
+	}
+	if res := s.get("/packages/left-pad@1.0.0/index.js"); res.StatusCode != 404 {
+		t.Errorf("a version never fetched was served: %s", res.Status)
+	}
+}
+
+func TestConcurrentColdRequests(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, nil)
+
+	const n = 16
+	locs := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := s.get("/npm/left-pad@1.0.0/index.js")
+			if res.StatusCode == 302 {
+				locs[i] = res.Header.Get("Location")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, loc := range locs {
+		if loc != "/packages/left-pad@1.0.0/index.js" {
+			t.Fatalf("request %d: redirected to %q", i, loc)
+		}
+	}
+	if body := responseBody(t, s.get(locs[0]), 200); body != "padded" {
+		t.Errorf("got %q", body)
+	}
+	if entries := index.entriesFor(nil); len(entries) != 1 {
+		t.Errorf("index has %d versions, want 1", len(entries))
+	}
+	leftovers, _ := os.ReadDir(filepath.Join(s.cfg.DataDir, internalDir, "tmp"))
+	if len(leftovers) != 0 {
+		t.Errorf("%d staging directories left", len(leftovers))
+	}
+}
+
+func TestRestartWithExistingCache(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{"index.js": "cached"})
+	s := newTestServer(t, reg, nil)
+	s.follow(s.get("/npm/@scope/pkg@1.0.0/index.js"), 302)
+
+	s = s.restart()
+	tarball := tarballPath("@scope/pkg", "1.0.0")
+	before := reg.hits(tarball)
+	// The registry is gone: everything comes from the data dir.
+	reg.Close()
+
+	if body := responseBody(t, s.get("/packages/@scope/pkg@1.0.0/index.js"), 200); body != "cached" {
+		t.Errorf("got %q", body)
+	}
+	loc := s.follow(s.get("/npm/@scope/pkg@1.0.0/index.js"), 302)
+	if loc != "/packages/@scope/pkg@1.0.0/index.js" {
+		t.Errorf("redirected to %s", loc)
+	}
+	if reg.hits(tarball) != before {
+		t.Errorf("the tarball was downloaded again")
+	}
+
+	var page struct {
+		Packages []indexEntry `json:"packages"`
+	}
+	if err := json.Unmarshal([]byte(responseBody(t, s.get("/api/packages"), 200)), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Packages) != 1 || page.Packages[0].Name != "@scope/pkg" || page.Packages[0].Version != "1.0.0" {
+		t.Errorf("the sweep indexed %+v", page.Packages)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// verifyIntegrity checks a downloaded tarball against the dist.integrity
+// SRI string of its version, falling back to the legacy sha1 shasum.
+// Versions without either are accepted as is. It returns the algorithm the
+// tarball matched with, or "" for those.
+func verifyIntegrity(fileName string, pv *PackumentVersion) (string, error) {
+	expected := map[string]string{}
+	for _, sri := range strings.Fields(pv.Dist.Integrity) {
+		algo, digest, ok := strings.Cut(sri, "-")
+		if ok && newHash(algo) != nil {
+			expected[algo] = digest
+		}
+	}
+	if len(expected) == 0 && pv.Dist.Shasum != "" {
+		sum, err := hex.DecodeString(pv.Dist.Shasum)
+		if err == nil {
+			expected["sha1"] = base64.StdEncoding.EncodeToString(sum)
+		}
+	}
+	if len(expected) == 0 {
+		return "", nil
+	}
+
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for algo := range expected {
+		h := newHash(algo)
+		hashes[algo] = h
+		writers = append(writers, h)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return "", err
+	}
+
+	var want, got []string
+	for algo, h := range hashes {
+		sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if sum == expected[algo] {
+			return algo, nil
+		}
+		want = append(want, algo+"-"+expected[algo])
+		got = append(got, algo+"-"+sum)
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	e := newError(http.StatusBadGateway, codeIntegrity, "%s@%s does not match its published integrity", pv.Name, pv.Version)
+	e.Details = map[string]any{"expected": strings.Join(want, " "), "actual": strings.Join(got, " ")}
+	return "", e
+}
+
+// Values of config.IntegrityPolicy, for tarballs that don't match their
+// published integrity.
+const (
+	integrityReject = "reject"
+	integrityWarn   = "warn"
+	integrityIgnore = "ignore"
+)
+
+var integrityMismatches = newCounter("repkg_integrity_mismatches_total", "Tarballs that didn't match their published integrity, by the policy applied.")
+
+// IntegrityMismatch records that a version was cached although its tarball
+// didn't match its published integrity, under the warn policy.
+type IntegrityMismatch struct {
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Registry string    `json:"registry,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+func validIntegrityPolicy(p string) bool {
+	return p == integrityReject || p == integrityWarn || p == integrityIgnore
+}
+
+// integrityPolicyFor returns the policy for a package downloaded from
+// registry: its scope's in config.IntegrityPolicyScopes, the registry's in
+// config.IntegrityPolicyRegistries, or config.IntegrityPolicy.
+func integrityPolicyFor(packageName, registry string) string {
+	if scope, _, ok := strings.Cut(packageName, "/"); ok {
+		if p, ok := config.IntegrityPolicyScopes[scope]; ok {
+			return p
+		}
+	}
+	for r, p := range config.IntegrityPolicyRegistries {
+		if strings.TrimSuffix(r, "/") == strings.TrimSuffix(registry, "/") {
+			return p
+		}
+	}
+	return config.IntegrityPolicy
+}
+
+// checkIntegrity applies the integrity policy to the error of
+// verifyIntegrity: under warn and ignore, a mismatch is let through, and
+// under warn returned to be recorded.
+func checkIntegrity(pv *PackumentVersion, registry string, err error) (*IntegrityMismatch, error) {
+	var e *apiError
+	if !errors.As(err, &e) || e.Code != codeIntegrity {
+		return nil, err
+	}
+	policy := integrityPolicyFor(pv.Name, registry)
+	integrityMismatches.Inc("policy", policy)
+	if policy == integrityReject {
+		return nil, err
+	}
+	expected, _ := e.Details["expected"].(string)
+	actual, _ := e.Details["actual"].(string)
+	if policy == integrityIgnore {
+		debugf("integrity: %s@%s doesn't match (%s, got %s), ignored", pv.Name, pv.Version, expected, actual)
+		return nil, nil
+	}
+	log.Printf("integrity: %s@%s doesn't match its published integrity (%s, got %s), caching it anyway: integrity policy is warn", pv.Name, pv.Version, expected, actual)
+	mismatch := &IntegrityMismatch{Expected: expected, Actual: actual, At: time.Now().UTC()}
+	if u, err := url.Parse(registry); err == nil {
+		mismatch.Registry = redactURL(u)
+	}
+	return mismatch, nil
+}
+
+// setIntegrityHeader tells of a version cached despite an integrity
+// mismatch.
+func setIntegrityHeader(w http.ResponseWriter, m *Manifest) {
+	if m.IntegrityMismatch != nil {
+		w.Header().Set("X-Repkg-Integrity", "mismatch")
+		w.Header().Add("Warning", `199 repkg "does not match its published integrity"`)
+	}
+}
+
+// logIntegrityPolicies warns at startup of every policy that lets
+// mismatching tarballs through.
+func logIntegrityPolicies(cfg Config) {
+	if cfg.IntegrityPolicy != integrityReject {
+		log.Printf("WARNING: integrity: tarballs that don't match their published integrity are cached and served (integrityPolicy %q)", cfg.IntegrityPolicy)
+	}
+	for r, p := range cfg.IntegrityPolicyRegistries {
+		if p != integrityReject {
+			log.Printf("WARNING: integrity: tarballs from %s that don't match their published integrity are cached and served (%q)", r, p)
+		}
+	}
+	for scope, p := range cfg.IntegrityPolicyScopes {
+		if p != integrityReject {
+			log.Printf("WARNING: integrity: %s/* tarballs that don't match their published integrity are cached and served (%q)", scope, p)
+		}
+	}
+}
+
+func validateIntegrityPolicies(cfg Config) error {
+	if !validIntegrityPolicy(cfg.IntegrityPolicy) {
+		return fmt.Errorf("integrityPolicy must be %q, %q or %q", integrityReject, integrityWarn, integrityIgnore)
+	}
+	for r, p := range cfg.IntegrityPolicyRegistries {
+		if u, err := url.Parse(r); err != nil || u.Host == "" {
+			return fmt.Errorf("integrityPolicyRegistries: %q is not a registry URL", r)
+		}
+		if !validIntegrityPolicy(p) {
+			return fmt.Errorf("integrityPolicyRegistries[%q] must be %q, %q or %q", r, integrityReject, integrityWarn, integrityIgnore)
+		}
+	}
+	for scope, p := range cfg.IntegrityPolicyScopes {
+		if !strings.HasPrefix(scope, "@") || !validPackageName(scope+"/x") {
+			return fmt.Errorf("integrityPolicyScopes: %q is not a scope like \"@org\"", scope)
+		}
+		if !validIntegrityPolicy(p) {
+			return fmt.Errorf("integrityPolicyScopes[%q] must be %q, %q or %q", scope, integrityReject, integrityWarn, integrityIgnore)
+		}
+	}
+	return nil
+}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "sha512":
+		return sha512.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		return sha1.New()
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonSchemaVersion is sent as X-Repkg-Schema-Version with the metadata
+// responses, and goes up when any of them changes shape in a way that
+// consumers would notice: a field renamed, removed or of another type.
+const jsonSchemaVersion = "1"
+
+// gzipMinSize is the smallest JSON response worth compressing.
+const gzipMinSize = 1024
+
+// writeJSON writes v as canonical JSON: object keys sorted at every depth,
+// struct fields and embedded documents included, so that the same data is
+// always the same bytes and responses can be diffed between runs.
+func writeJSON(c *gin.Context, status int, v any) {
+	body, err := canonicalJSON(v)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	writeJSONBody(c, status, body)
+}
+
+func canonicalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Maps are marshaled with sorted keys, and numbers are kept as they
+	// were written.
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var doc any
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// writeJSONBody writes an encoded JSON response with the schema version,
+// gzipped when the client takes it and it is large enough to be worth it.
+func writeJSONBody(c *gin.Context, status int, body []byte) {
+	h := c.Writer.Header()
+	h.Set("X-Repkg-Schema-Version", jsonSchemaVersion)
+	h.Add("Vary", "Accept-Encoding")
+	if len(body) >= gzipMinSize && acceptsEncoding(c.Request, "gzip") {
+		var b bytes.Buffer
+		// Without a name or time in its header, the same body always
+		// compresses to the same bytes.
+		gz, _ := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+		gz.Write(body)
+		gz.Close()
+		body = b.Bytes()
+		h.Set("Content-Encoding", "gzip")
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+// writePureJSON is writeJSON for documents whose key order is part of
+// their meaning, such as package.json files: they are encoded as they come,
+// with characters like < and > left as they are.
+func writePureJSON(c *gin.Context, status int, v any) {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		writeError(c, err)
+		return
+	}
+	writeJSONBody(c, status, bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+}
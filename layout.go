@@ -0,0 +1,453 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Versions are stored as config.DataDir/<registry>/<name>/<version>, so
+// scoped packages live in config.DataDir/<registry>/@scope/name/<version>.
+// <registry> is the partition of the registry the version was downloaded
+// from, so versions another registry publishes under the same name never
+// mix; each holds a .registry file naming its registry. URLs keep the
+// usual /packages/@scope/name@version/ form. Tenants have the same layout
+// below their own data dir, and their URLs start with /t/<tenant>.
+
+const partitionFile = ".registry"
+
+// partitionNames caches partitionName, which versionDir needs for every
+// request.
+var partitionNames sync.Map
+
+// partitionName is the directory of a registry's partition: its
+// registryID, escaped to stay one path segment when it has a port or a
+// path.
+func partitionName(registry string) string {
+	if name, ok := partitionNames.Load(registry); ok {
+		return name.(string)
+	}
+	name := "unknown"
+	if id := registryID(registry); id != "" {
+		name = url.QueryEscape(id)
+	}
+	partitionNames.Store(registry, name)
+	return name
+}
+
+func partitionVersionDir(t *tenant, registry, packageName, version string) string {
+	return filepath.Join(t.dataDir(), partitionName(registry), filepath.FromSlash(packageName), version)
+}
+
+// versionDir is where a version of t's is cached: in the partition of its
+// registry or, for versions fetched while the registry was down, of
+// config.FallbackRegistry.
+func versionDir(t *tenant, packageName, version string) string {
+	dir := partitionVersionDir(t, t.registry(), packageName, version)
+	if fallback := fallbackFor(t); fallback != "" {
+		if _, err := os.Stat(dir); err != nil {
+			alt := partitionVersionDir(t, fallback, packageName, version)
+			if _, err := os.Stat(alt); err == nil {
+				return alt
+			}
+		}
+	}
+	return dir
+}
+
+// fallbackFor returns the registry fallbackURL turns to for t's registry,
+// or "".
+func fallbackFor(t *tenant) string {
+	if config.FallbackRegistry == "" {
+		return ""
+	}
+	u, uerr := url.Parse(t.registry())
+	registry, rerr := url.Parse(config.Registry)
+	if uerr != nil || rerr != nil || !strings.EqualFold(u.Host, registry.Host) {
+		return ""
+	}
+	return config.FallbackRegistry
+}
+
+// markPartition creates the partition of registry in a data dir, if it
+// doesn't exist yet, with the file naming the registry.
+func markPartition(dataDir, registry string) error {
+	dir := filepath.Join(dataDir, partitionName(registry))
+	p := filepath.Join(dir, partitionFile)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := registry
+	if u, err := url.Parse(registry); err == nil {
+		name = redactURL(u)
+	}
+	return os.WriteFile(p, []byte(name+"\n"), 0644)
+}
+
+// packageURL is the URL a file of a cached version is served at.
+func packageURL(t *tenant, packageName, version, file string) string {
+	return t.urlPrefix() + "/packages/" + escapePath(packageName) + "@" + url.PathEscape(version) + "/" + escapePath(file)
+}
+
+// validPackageName accepts "name" and "@scope/name" made of the characters
+// npm allows, which also keeps names from reaching outside config.DataDir.
+func validPackageName(packageName string) bool {
+	if len(packageName) == 0 || len(packageName) > 214 {
+		return false
+	}
+	parts := []string{packageName}
+	if strings.HasPrefix(packageName, "@") {
+		scope, name, ok := strings.Cut(packageName[1:], "/")
+		if !ok {
+			return false
+		}
+		parts = []string{scope, name}
+	}
+	for _, part := range parts {
+		if part == "" || part[0] == '.' || part[0] == '_' {
+			return false
+		}
+		for _, r := range part {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~!*'()", r)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validVersion(version string) bool {
+	_, ok := parseSemver(version)
+	return ok
+}
+
+// parseVersionDir turns a path relative to a data dir into the partition,
+// package and version it holds, if it is a version directory.
+func parseVersionDir(rel string) (partition, packageName, version string, ok bool) {
+	partition, rest, found := strings.Cut(rel, "/")
+	if !found {
+		return "", "", "", false
+	}
+	packageName, version, ok = splitVersionPath(rest)
+	return partition, packageName, version, ok
+}
+
+// splitVersionPath is parseVersionDir below a partition, or below the data
+// dir of layout 2.
+func splitVersionPath(rel string) (packageName, version string, ok bool) {
+	segs := strings.Split(rel, "/")
+	n := 2
+	if strings.HasPrefix(segs[0], "@") {
+		n = 3
+	}
+	if len(segs) != n {
+		return "", "", false
+	}
+	return strings.Join(segs[:n-1], "/"), segs[n-1], true
+}
+
+// pruneMu keeps pruneEmptyParents from removing a directory between a
+// writer creating it and moving something into it. Writers hold it for
+// reading with makeParents.
+var pruneMu sync.RWMutex
+
+// makeParents creates the parent directories of p and runs place, which
+// moves p into them, without them being pruned in between.
+func makeParents(p string, place func() error) error {
+	pruneMu.RLock()
+	defer pruneMu.RUnlock()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return place()
+}
+
+// pruneEmptyParents removes the parents of p that are left empty, up to
+// but not including root, so a package's or scope's directory goes with
+// its last version.
+func pruneEmptyParents(p, root string) {
+	pruneMu.Lock()
+	defer pruneMu.Unlock()
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// newStagingDir returns an empty directory on the same filesystem as the
+// cache, for downloads and extractions to be renamed into place from.
+func newStagingDir() (string, error) {
+	tmp := filepath.Join(config.DataDir, internalDir, "tmp")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(tmp, "fetch-")
+}
+
+// The data dir records the layout it was written with. Layout 1 is the
+// flat name@version layout of older releases, where versions may also lack
+// a manifest, and layout 2 has <name>/<version> without partitions.
+const (
+	layoutVersion = 3
+	layoutFile    = "LAYOUT_VERSION"
+)
+
+// migrations[i] upgrades layout i+1 to i+2 and returns a summary of what it
+// did. Each must be safe to run again after being interrupted.
+var migrations = []func() (string, error){
+	migrateNested,
+	migratePartitions,
+}
+
+// checkLayout brings the data dir up to layoutVersion. An empty data dir is
+// stamped with the current version; one without a LAYOUT_VERSION file is
+// assumed to be layout 1.
+func checkLayout() error {
+	current, err := readLayoutVersion()
+	if err != nil {
+		return err
+	}
+	if current > layoutVersion {
+		return fmt.Errorf("%s uses layout version %d but this release only knows up to %d; upgrade repkg or point dataDir elsewhere", config.DataDir, current, layoutVersion)
+	}
+	if current < layoutVersion && config.ReadOnly {
+		return fmt.Errorf("%s uses layout version %d; start the writer to migrate it to %d before the replicas", config.DataDir, current, layoutVersion)
+	}
+
+	for v := current; v < layoutVersion; v++ {
+		start := time.Now()
+		summary, err := migrations[v-1]()
+		if err != nil {
+			return fmt.Errorf("migrating layout %d to %d: %w", v, v+1, err)
+		}
+		// Only recorded once the step is complete, so an interrupted
+		// migration starts over on the next run.
+		if err := writeLayoutVersion(v + 1); err != nil {
+			return err
+		}
+		log.Printf("migrate: layout %d to %d: %s in %s", v, v+1, summary, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func readLayoutVersion() (int, error) {
+	data, err := os.ReadFile(filepath.Join(config.DataDir, layoutFile))
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err := os.ReadDir(config.DataDir)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			if e.Name() != internalDir && e.Name() != tenantsDir {
+				return 1, nil
+			}
+		}
+		if config.ReadOnly {
+			return layoutVersion, nil
+		}
+		return layoutVersion, writeLayoutVersion(layoutVersion)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("%s: invalid layout version %q", filepath.Join(config.DataDir, layoutFile), strings.TrimSpace(string(data)))
+	}
+	return v, nil
+}
+
+func writeLayoutVersion(v int) error {
+	p := filepath.Join(config.DataDir, layoutFile)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(v)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// migrateNested moves name@version and @scope/name@version directories to
+// <name>/<version> and writes manifests for versions cached before they
+// existed.
+func migrateNested() (string, error) {
+	entries, err := os.ReadDir(config.DataDir)
+	if err != nil {
+		return "", err
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == internalDir || e.Name() == tenantsDir {
+			continue
+		}
+		if !strings.HasPrefix(e.Name(), "@") {
+			dirs = append(dirs, e.Name())
+			continue
+		}
+		scoped, err := os.ReadDir(filepath.Join(config.DataDir, e.Name()))
+		if err != nil {
+			return "", err
+		}
+		for _, s := range scoped {
+			if s.IsDir() {
+				dirs = append(dirs, e.Name()+"/"+s.Name())
+			}
+		}
+	}
+
+	moved, skipped, generated := 0, 0, 0
+	for _, old := range dirs {
+		name, version := parsePkgDir(old)
+		if version == "" || !validPackageName(name) || !validVersion(version) {
+			continue
+		}
+
+		src := filepath.Join(config.DataDir, filepath.FromSlash(old))
+		dst := filepath.Join(config.DataDir, filepath.FromSlash(name), version)
+		if _, err := os.Stat(dst); err == nil {
+			log.Printf("migrate: %s already exists, leaving %s in place", dst, src)
+			skipped++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return "", err
+		}
+		moved++
+	}
+
+	err = filepath.WalkDir(config.DataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(config.DataDir, p)
+		rel = filepath.ToSlash(rel)
+		if rel == internalDir || rel == tenantsDir {
+			return fs.SkipDir
+		}
+		name, version, ok := splitVersionPath(rel)
+		if !ok {
+			return nil
+		}
+		if !validVersion(version) {
+			return fs.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(p, manifestFile)); errors.Is(err, os.ErrNotExist) {
+			if _, err := loadManifest(p, name, version); err != nil {
+				return err
+			}
+			generated++
+		}
+		return fs.SkipDir
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("moved %d versions (%d left in place), generated %d manifests", moved, skipped, generated), nil
+}
+
+// migratePartitions moves the packages and scopes of each data dir, the
+// default one and the tenants', into the partition of its registry. A
+// package with the partition's name is put aside as <name>% while the
+// partition is made, a name no package can have. The packuments cached
+// for each data dir are dropped, to be fetched again into their
+// registry's partition: they may hold another registry's validators.
+func migratePartitions() (string, error) {
+	dirs := map[string]string{config.DataDir: config.Registry}
+	entries, err := os.ReadDir(filepath.Join(config.DataDir, tenantsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			// Tenants no longer configured go to the default registry.
+			dirs[filepath.Join(config.DataDir, tenantsDir, e.Name())] = tenants[e.Name()].registry()
+		}
+	}
+
+	moved, dropped := 0, 0
+	for dataDir, registry := range dirs {
+		n, err := dropPackumentCache(dataDir)
+		if err != nil {
+			return "", err
+		}
+		dropped += n
+
+		name := partitionName(registry)
+		partition := filepath.Join(dataDir, name)
+		aside := partition + "%"
+		if _, err := os.Stat(filepath.Join(partition, partitionFile)); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Stat(partition); err == nil {
+				if err := os.Rename(partition, aside); err != nil {
+					return "", err
+				}
+			}
+			if err := markPartition(dataDir, registry); err != nil {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(aside); err == nil {
+			if err := os.Rename(aside, filepath.Join(partition, name)); err != nil {
+				return "", err
+			}
+			moved++
+		}
+
+		entries, err := os.ReadDir(dataDir)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range entries {
+			if !e.IsDir() || e.Name() == internalDir || e.Name() == tenantsDir || e.Name() == name {
+				continue
+			}
+			if err := os.Rename(filepath.Join(dataDir, e.Name()), filepath.Join(partition, e.Name())); err != nil {
+				return "", err
+			}
+			moved++
+		}
+	}
+	return fmt.Sprintf("moved %d packages and scopes into their registry's partition, dropped %d cached packuments", moved, dropped), nil
+}
+
+// dropPackumentCache removes the packuments cached below a data dir
+// outside of any partition.
+func dropPackumentCache(dataDir string) (int, error) {
+	dir := filepath.Join(dataDir, internalDir, "packuments")
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	reg := newFakeRegistry(t)
+	for _, name := range []string{"@scope/pkg", "pkg"} {
+		reg.publish(name, "1.0.0", map[string]string{"lib/main.js": name})
+	}
+	s := newTestServer(t, reg, nil)
+
+	for _, tc := range []struct{ path, want string }{
+		{"/npm/@scope/pkg@1.0.0/lib/main.js", "/packages/@scope/pkg@1.0.0/lib/main.js"},
+		{"/npm/@scope/pkg/1.0.0/lib/main.js", "/packages/@scope/pkg@1.0.0/lib/main.js"},
+		{"/npm/@scope/pkg@^1/lib/main.js", "/packages/@scope/pkg@1.0.0/lib/main.js"},
+		{"/npm/pkg@1.0.0/lib/main.js", "/packages/pkg@1.0.0/lib/main.js"},
+		{"/npm/pkg/1.0.0/lib/main.js", "/packages/pkg@1.0.0/lib/main.js"},
+		{"/npm/pkg@^1/lib/main.js", "/packages/pkg@1.0.0/lib/main.js"},
+	} {
+		res := s.get(tc.path)
+		if raw := res.Header.Get("Location"); raw != tc.want {
+			t.Errorf("%s: Location %q, want %q", tc.path, raw, tc.want)
+		}
+		loc := s.follow(res, 302)
+		name := strings.TrimSuffix(strings.TrimPrefix(tc.want, "/packages/"), "@1.0.0/lib/main.js")
+		if body := responseBody(t, s.get(loc), 200); body != name {
+			t.Errorf("%s: got %q from %s", tc.path, body, loc)
+		}
+	}
+
+	for _, name := range []string{"@scope/pkg", "pkg"} {
+		dir := filepath.Join(s.cfg.DataDir, partitionName(reg.URL), filepath.FromSlash(name), "1.0.0")
+		if _, err := os.Stat(filepath.Join(dir, "lib", "main.js")); err != nil {
+			t.Errorf("%s: not at %s: %s", name, dir, err)
+		}
+		if body := responseBody(t, s.get("/packages/"+name+"@1.0.0/lib/"), 200); !strings.Contains(body, "main.js") {
+			t.Errorf("%s: the listing has no main.js:\n%s", name, body)
+		}
+	}
+}
+
+func TestMigrateFlatLayout(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{"index.js": "from the registry"})
+	reg.publish("pkg", "1.0.0", map[string]string{"index.js": "from the registry"})
+	dataDir := t.TempDir()
+	// Layout 1: flat name@version directories without manifests.
+	legacy := map[string]string{"pkg@1.0.0": "pkg", "@scope/pkg@1.0.0": "@scope/pkg"}
+	for old, name := range legacy {
+		dir := filepath.Join(dataDir, filepath.FromSlash(old))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{
+			"package.json": `{"name": "` + name + `", "version": "1.0.0"}`,
+			"index.js":     name,
+		}
+		for file, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.DataDir = dataDir
+	cfg.Registry = reg.URL
+	s := startTestServer(t, reg, cfg)
+
+	for _, name := range []string{"@scope/pkg", "pkg"} {
+		loc := s.follow(s.get("/npm/"+name+"@1.0.0/index.js"), 302)
+		if body := responseBody(t, s.get(loc), 200); body != name {
+			t.Errorf("%s: got %q from %s", name, body, loc)
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, partitionName(reg.URL), filepath.FromSlash(name), "1.0.0", manifestFile)); err != nil {
+			t.Errorf("%s: not migrated: %s", name, err)
+		}
+	}
+	for old := range legacy {
+		if _, err := os.Stat(filepath.Join(dataDir, filepath.FromSlash(old))); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", old, err)
+		}
+	}
+	for _, name := range []string{"@scope/pkg", "pkg"} {
+		if reg.hits(tarballPath(name, "1.0.0")) != 0 {
+			t.Errorf("%s: downloaded again", name)
+		}
+	}
+}
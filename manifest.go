@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const manifestFile = ".repkg-manifest.json"
+
+// caseDir holds the files whose path only differs in case from another's
+// in the version, under a number; see extractTarball.
+const caseDir = ".repkg-case"
+
+// manifestSchema is bumped when manifests gain fields that older ones need
+// filled in; those are upgraded as they are loaded. Manifests from before
+// the field existed have schema 0.
+const manifestSchema = 4
+
+// Manifest describes the files extracted for one package version. Paths are
+// slash separated, relative to the version directory and NFC normalized.
+type Manifest struct {
+	Schema     int    `json:"schema"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Deprecated string `json:"deprecated,omitempty"`
+	Storage    string `json:"storage,omitempty"`
+
+	TarballSize  int64 `json:"tarballSize,omitempty"`
+	UnpackedSize int64 `json:"unpackedSize"`
+
+	// Upstream is where the tarball was downloaded from, after redirects
+	// and without its query.
+	Upstream string `json:"upstream,omitempty"`
+	// Origin is what the tarball came with, for audits; versions cached
+	// by older releases have none.
+	Origin *TarballOrigin `json:"origin,omitempty"`
+
+	// Registry is the registry the version was resolved from, and
+	// Verified the algorithm its tarball matched the published integrity
+	// with, empty when the registry published none.
+	Registry  string    `json:"registry,omitempty"`
+	Verified  string    `json:"verified,omitempty"`
+	Extracted time.Time `json:"extracted"`
+
+	// IntegrityMismatch is set when the tarball didn't match its
+	// published integrity and was cached under the warn policy.
+	IntegrityMismatch *IntegrityMismatch `json:"integrityMismatch,omitempty"`
+
+	// Publisher, Maintainers and Provenance are as the registry told of
+	// them, absent when it didn't.
+	Publisher   *npmUser    `json:"publisher,omitempty"`
+	Maintainers []npmUser   `json:"maintainers,omitempty"`
+	Provenance  *Provenance `json:"provenance,omitempty"`
+
+	Package *ManifestPackage `json:"package,omitempty"`
+
+	Files []ManifestFile `json:"files"`
+
+	// Warnings tell of what was odd about the tarball, such as paths that
+	// only differ in case.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Sizes is filled in by the first /api/size request.
+	Sizes *SizeStats `json:"sizes,omitempty"`
+
+	// Withdrawn is set once the registry no longer has the version.
+	// Pinned versions are served regardless and never evicted.
+	Withdrawn *Withdrawal `json:"withdrawn,omitempty"`
+	Pinned    bool        `json:"pinned,omitempty"`
+
+	// Corrupt is set when POST /api/admin/verify, or the integrity guard,
+	// finds files that no longer match, until the version is fetched
+	// again.
+	Corrupt *Corruption `json:"corrupt,omitempty"`
+
+	// SecurityHolder marks npm's placeholder for a package it removed.
+	SecurityHolder bool `json:"securityHolder,omitempty"`
+
+	// FetchedBy is when the version was first cached and what for; versions
+	// cached by older releases have none.
+	FetchedBy *FetchedBy `json:"fetchedBy,omitempty"`
+
+	byPath map[string]*ManifestFile
+	byFold map[string]string
+	pkg    *packageJSON
+}
+
+// ManifestPackage holds the essentials of the version's package.json.
+type ManifestPackage struct {
+	Main   string `json:"main,omitempty"`
+	Module string `json:"module,omitempty"`
+	// Type is package.json's "type", "module" or "commonjs", when it has
+	// one.
+	Type    string `json:"type,omitempty"`
+	Browser string `json:"browser,omitempty"`
+	Types   string `json:"types,omitempty"`
+	Exports bool   `json:"exports,omitempty"`
+	License string `json:"license,omitempty"`
+
+	// SideEffects and Files are package.json's, when it has them.
+	SideEffects *sideEffects `json:"sideEffects,omitempty"`
+	Files       []string     `json:"files,omitempty"`
+}
+
+func (p *ManifestPackage) empty() bool {
+	return p.Main == "" && p.Module == "" && p.Type == "" && p.Browser == "" && p.Types == "" && !p.Exports && p.License == "" &&
+		p.SideEffects == nil && p.Files == nil
+}
+
+// ManifestFile sizes and hashes always describe the original file, even when
+// it is stored compressed.
+type ManifestFile struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256,omitempty"`
+	Integrity string `json:"integrity,omitempty"`
+	// ContentType is detected from the extension, or the content when
+	// that says nothing.
+	ContentType string `json:"contentType,omitempty"`
+	// ModuleType is "esm" or "cjs" for JavaScript files; see
+	// classifyModules.
+	ModuleType string `json:"moduleType,omitempty"`
+	// Mode is the file's mode in the tarball, in octal.
+	Mode string `json:"mode,omitempty"`
+	// Disk is where the file is kept when not at Path, relative to the
+	// version directory.
+	Disk string `json:"disk,omitempty"`
+
+	// Stored is "br" for files kept only as a brotli blob next to the
+	// original path.
+	Stored     string `json:"stored,omitempty"`
+	StoredSize int64  `json:"storedSize,omitempty"`
+
+	// ModTime is the mtime, in Unix nanoseconds, of what is stored, as
+	// extracted, when config.IntegrityGuard is on.
+	ModTime int64 `json:"mtime,omitempty"`
+}
+
+var manifests sync.Map
+
+func normalizePath(p string) string {
+	return norm.NFC.String(p)
+}
+
+// buildManifest walks an extracted version directory. Moved maps the paths
+// of files kept elsewhere in it to where they are.
+func buildManifest(dir, name, version string, moved map[string]string) (*Manifest, error) {
+	m := &Manifest{Schema: manifestSchema, Name: name, Version: version, Extracted: time.Now().UTC()}
+	add := func(p, rel string) error {
+		f, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		f.Path = rel
+		if t := typeByExtension(rel); t != "" {
+			f.ContentType = t
+		}
+		m.Files = append(m.Files, f)
+		m.UnpackedSize += f.Size
+		return nil
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && p == filepath.Join(dir, caseDir) {
+			return fs.SkipDir
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = normalizePath(filepath.ToSlash(rel))
+		if rel == manifestFile {
+			return nil
+		}
+		return add(p, rel)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for rel, disk := range moved {
+		if err := add(filepath.Join(dir, filepath.FromSlash(disk)), rel); err != nil {
+			return nil, err
+		}
+		m.Files[len(m.Files)-1].Disk = disk
+	}
+
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	m.buildIndex()
+	m.Package = loadPackageJSON(dir, m).essentials()
+	classifyModules(dir, m)
+	return m, nil
+}
+
+func hashFile(p string) (ManifestFile, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+
+	h256, h512 := sha256.New(), sha512.New()
+	head := &prefixWriter{max: sniffLen}
+	n, err := io.Copy(io.MultiWriter(h256, h512, head), file)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+
+	return ManifestFile{
+		Size:        n,
+		SHA256:      hex.EncodeToString(h256.Sum(nil)),
+		Integrity:   "sha512-" + base64.StdEncoding.EncodeToString(h512.Sum(nil)),
+		ContentType: sniffType(head.data, n > int64(len(head.data))),
+	}, nil
+}
+
+// sniffFile returns the type sniffType finds for the file at p.
+func sniffFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, sniffLen+1)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return sniffType(head[:min(n, sniffLen)], n > sniffLen), nil
+}
+
+// prefixWriter keeps the first max bytes written to it.
+type prefixWriter struct {
+	data []byte
+	max  int
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if n := min(len(p), w.max-len(w.data)); n > 0 {
+		w.data = append(w.data, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// diskPath is where the file is in version directory dir, before any
+// ".br" it is stored with.
+func (f *ManifestFile) diskPath(dir string) string {
+	if f.Disk != "" {
+		return filepath.Join(dir, filepath.FromSlash(f.Disk))
+	}
+	return filepath.Join(dir, filepath.FromSlash(f.Path))
+}
+
+// storedPath is where the bytes of the file are, compressed or not.
+func (f *ManifestFile) storedPath(dir string) string {
+	if f.Stored == "br" {
+		return f.diskPath(dir) + ".br"
+	}
+	return f.diskPath(dir)
+}
+
+// fileType returns the file's content type, or "" when nothing is known.
+// config.ContentTypes comes first.
+func (f *ManifestFile) fileType() string {
+	if t, ok := config.ContentTypes[path.Base(f.Path)]; ok {
+		return t
+	}
+	if t := fontType(f.Path); t != "" {
+		// Over what older manifests recorded from mime.types.
+		return t
+	}
+	if t := moduleType(f.Path); t != "" {
+		return t
+	}
+	if f.ContentType != "" {
+		return f.ContentType
+	}
+	return typeByExtension(f.Path)
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	if err := writeManifestFile(dir, m); err != nil {
+		return err
+	}
+	cacheManifest(dir, m)
+	return nil
+}
+
+// cacheManifest makes m the manifest served for dir.
+func cacheManifest(dir string, m *Manifest) {
+	m.buildIndex()
+	m.pkg = loadPackageJSON(dir, m)
+	manifests.Store(dir, m)
+}
+
+func writeManifestFile(dir string, m *Manifest) error {
+	if config.ReadOnly {
+		// Kept in memory only; see replica.go.
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, manifestFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, manifestFile))
+}
+
+var manifestMu sync.Mutex
+
+// updateManifest applies change to a copy of a version's manifest and saves
+// it. Updates are serialized so concurrent ones don't undo each other.
+func updateManifest(t *tenant, dir, name, version string, change func(m *Manifest)) (*Manifest, error) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	m, err := loadManifest(dir, name, version)
+	if err != nil {
+		return nil, err
+	}
+	// m may be being read by other requests, so change gets files of its
+	// own.
+	updated := *m
+	updated.Files = slices.Clone(m.Files)
+	change(&updated)
+	if err := writeManifest(dir, &updated); err != nil {
+		return nil, err
+	}
+	index.updateVersion(t, &updated)
+	return &updated, nil
+}
+
+// loadManifest returns the manifest for a version directory, generating it
+// for directories that were extracted before manifests existed.
+func loadManifest(dir, name, version string) (*Manifest, error) {
+	if m, ok := manifests.Load(dir); ok {
+		return m.(*Manifest), nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		m, err := buildManifest(dir, name, version, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeManifest(dir, m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case err != nil:
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	m.buildIndex()
+	m.pkg = loadPackageJSON(dir, m)
+	if m.Schema < manifestSchema {
+		if err := upgradeManifest(dir, m); err != nil {
+			return nil, err
+		}
+	}
+	actual, _ := manifests.LoadOrStore(dir, m)
+	return actual.(*Manifest), nil
+}
+
+// upgradeManifest fills in what manifests of older schemas lack and saves
+// the result. Files stored compressed only get a type from their extension.
+func upgradeManifest(dir string, m *Manifest) error {
+	for i := range m.Files {
+		f := &m.Files[i]
+		p := f.diskPath(dir)
+		switch {
+		case f.SHA256 == "" && f.Stored == "":
+			hashed, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			f.SHA256, f.Integrity, f.ContentType = hashed.SHA256, hashed.Integrity, hashed.ContentType
+		case m.Schema < 2 && f.Stored == "":
+			// Schema 1 called any text without control characters UTF-8.
+			t, err := sniffFile(p)
+			if err != nil {
+				return err
+			}
+			f.ContentType = t
+		}
+		if t := typeByExtension(f.Path); t != "" {
+			f.ContentType = t
+		}
+	}
+	if m.Extracted.IsZero() {
+		if info, err := os.Stat(filepath.Join(dir, manifestFile)); err == nil {
+			m.Extracted = info.ModTime().UTC()
+		}
+	}
+	m.Package = m.pkg.essentials()
+	classifyModules(dir, m)
+	m.Schema = manifestSchema
+	return writeManifestFile(dir, m)
+}
+
+func (m *Manifest) buildIndex() {
+	m.byPath = make(map[string]*ManifestFile, len(m.Files))
+	m.byFold = make(map[string]string, len(m.Files))
+	for i := range m.Files {
+		f := &m.Files[i]
+		m.byPath[f.Path] = f
+		if _, ok := m.byFold[strings.ToLower(f.Path)]; !ok {
+			m.byFold[strings.ToLower(f.Path)] = f.Path
+		}
+	}
+}
+
+// Lookup finds a file by its exact (normalized) path.
+func (m *Manifest) Lookup(p string) (*ManifestFile, bool) {
+	f, ok := m.byPath[normalizePath(p)]
+	return f, ok
+}
+
+// LookupFold finds the canonical casing of a path, ignoring case.
+func (m *Manifest) LookupFold(p string) (string, bool) {
+	canonical, ok := m.byFold[strings.ToLower(normalizePath(p))]
+	return canonical, ok
+}
+
+// IsDir reports whether p is a directory containing at least one file.
+func (m *Manifest) IsDir(p string) bool {
+	p = normalizePath(strings.Trim(p, "/"))
+	if p == "" {
+		return true
+	}
+	prefix := p + "/"
+	i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Path >= prefix })
+	return i < len(m.Files) && strings.HasPrefix(m.Files[i].Path, prefix)
+}
+
+// List returns the direct children of directory p. Directory names end in a
+// slash.
+func (m *Manifest) List(p string) []string {
+	p = normalizePath(strings.Trim(p, "/"))
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+
+	var entries []string
+	seen := map[string]bool{}
+	for _, f := range m.Files {
+		if !strings.HasPrefix(f.Path, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(f.Path, prefix)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			entries = append(entries, name)
+		}
+	}
+	return entries
+}
+
+// ListPage is List one page at a time: up to limit of the entries after
+// the entry after ("" for the first page) that keep accepts, how many it
+// accepts in all and whether more follow. Entries come in the order of the
+// paths below them, so a directory sits where its files do.
+func (m *Manifest) ListPage(p, after string, limit int, keep func(entry string) bool) (entries []string, total int, more bool) {
+	p = normalizePath(strings.Trim(p, "/"))
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+
+	prev := ""
+	for i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Path >= prefix }); i < len(m.Files); i++ {
+		f := m.Files[i].Path
+		if !strings.HasPrefix(f, prefix) {
+			break
+		}
+		name := strings.TrimPrefix(f, prefix)
+		if j := strings.Index(name, "/"); j >= 0 {
+			name = name[:j+1]
+		}
+		if name == prev {
+			continue
+		}
+		prev = name
+		if !keep(name) {
+			continue
+		}
+		total++
+		// Past the cursor once past the cursor's own files.
+		if after != "" && (f <= prefix+after || strings.HasSuffix(after, "/") && strings.HasPrefix(f, prefix+after)) {
+			continue
+		}
+		if len(entries) == limit {
+			more = true
+			continue
+		}
+		entries = append(entries, name)
+	}
+	return entries, total, more
+}
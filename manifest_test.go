@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateManifest(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() { manifests.Delete(dir) })
+	for name, data := range map[string]string{"package.json": `{"name": "left-pad"}`, "index.js": "padded"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := loadManifest(dir, "left-pad", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := m.Files[0]
+
+	updated, err := updateManifest(nil, dir, "left-pad", "1.0.0", func(m *Manifest) {
+		m.Deprecated = "use right-pad"
+		m.Files[0].Size = 1 << 20
+		m.Files = append(m.Files, ManifestFile{Path: "added.js"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest loaded before, which requests may still be serving
+	// from, is left as it was.
+	if m.Deprecated != "" || m.Files[0] != before || len(m.Files) != 2 {
+		t.Errorf("the update changed the manifest it was applied to: %+v", m.Files)
+	}
+	if updated.Deprecated == "" || updated.Files[0].Size != 1<<20 || len(updated.Files) != 3 {
+		t.Errorf("updated to %+v", updated.Files)
+	}
+	if loaded, err := loadManifest(dir, "left-pad", "1.0.0"); err != nil || loaded != updated {
+		t.Errorf("loaded %p, %v; want the updated manifest", loaded, err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A minimal Prometheus text-format registry. Metrics are package level
+// variables registered at init time.
+type metric struct {
+	name string
+	help string
+	kind string
+
+	mu     sync.Mutex
+	values map[string]float64
+	fn     func() float64
+
+	label string
+	vecFn func() map[string]float64
+
+	bounds []float64
+	hists  map[string]*histogram
+}
+
+// histogram is one label set of a histogram metric.
+type histogram struct {
+	labels []string
+	counts []float64 // per bound, not cumulative
+	sum    float64
+	count  float64
+}
+
+var (
+	metricsMu  sync.Mutex
+	allMetrics []*metric
+)
+
+func register(m *metric) *metric {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+func newCounter(name, help string) *metric {
+	return register(&metric{name: name, help: help, kind: "counter", values: map[string]float64{}})
+}
+
+func newGauge(name, help string) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", values: map[string]float64{}})
+}
+
+// newGaugeFunc reports the value of fn at scrape time.
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// newGaugeVecFunc reports at scrape time one value per value of label,
+// as returned by fn.
+func newGaugeVecFunc(name, help, label string, fn func() map[string]float64) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", label: label, vecFn: fn})
+}
+
+// newHistogram counts observations into buckets with the given upper
+// bounds, in ascending order.
+func newHistogram(name, help string, bounds []float64) *metric {
+	return register(&metric{name: name, help: help, kind: "histogram", bounds: bounds, hists: map[string]*histogram{}})
+}
+
+// labelKey renders alternating label names and values as {a="b",...}.
+func labelKey(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (m *metric) Add(v float64, labels ...string) {
+	key := labelKey(labels)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+func (m *metric) Set(v float64, labels ...string) {
+	key := labelKey(labels)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func (m *metric) Observe(v float64, labels ...string) {
+	key := labelKey(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.hists[key]
+	if !ok {
+		h = &histogram{labels: labels, counts: make([]float64, len(m.bounds))}
+		m.hists[key] = h
+	}
+	for i, b := range m.bounds {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Value returns the current value for a label set.
+func (m *metric) Value(labels ...string) float64 {
+	if m.fn != nil {
+		return m.fn()
+	}
+	key := labelKey(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+// counterValues returns the value of every counter by name and labels, as
+// /metrics renders them.
+func counterValues() map[string]float64 {
+	metricsMu.Lock()
+	list := append([]*metric(nil), allMetrics...)
+	metricsMu.Unlock()
+	values := map[string]float64{}
+	for _, m := range list {
+		if m.kind != "counter" || m.values == nil {
+			continue
+		}
+		m.mu.Lock()
+		for k, v := range m.values {
+			values[m.name+k] = v
+		}
+		m.mu.Unlock()
+	}
+	return values
+}
+
+func (m *metric) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(b, "%s %s\n", m.name, formatFloat(m.fn()))
+		return
+	}
+	if m.vecFn != nil {
+		values := m.vecFn()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, labelKey([]string{m.label, k}), formatFloat(values[k]))
+		}
+		return
+	}
+
+	if m.hists != nil {
+		m.writeHistograms(b)
+		return
+	}
+
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s%s %s\n", m.name, k, formatFloat(m.values[k]))
+	}
+	m.mu.Unlock()
+}
+
+func (m *metric) writeHistograms(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.hists))
+	for k := range m.hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := m.hists[k]
+		var n float64
+		for i, bound := range m.bounds {
+			n += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %s\n", m.name, labelKey(append(h.labels[:len(h.labels):len(h.labels)], "le", formatFloat(bound))), formatFloat(n))
+		}
+		fmt.Fprintf(b, "%s_bucket%s %s\n", m.name, labelKey(append(h.labels[:len(h.labels):len(h.labels)], "le", "+Inf")), formatFloat(h.count))
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, k, formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count%s %s\n", m.name, k, formatFloat(h.count))
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsNaN(v) {
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func serveMetrics(c *gin.Context) {
+	metricsMu.Lock()
+	list := append([]*metric(nil), allMetrics...)
+	metricsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	var b strings.Builder
+	for _, m := range list {
+		m.write(&b)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Browsers import JSON and CSS files as modules with
+// `with { type: "json" }` and `with { type: "css" }`, and refuse them
+// unless served as exactly application/json and text/css; so those are
+// their types, whatever mime.types or older manifests say. For browsers
+// without import attributes, ?module answers for one with a JavaScript
+// module exporting the parsed value, or a CSSStyleSheet with the
+// stylesheet's own @imports inlined as ?inline-css does.
+
+// derivedModule is the kind of the artifacts ?module builds.
+const derivedModule = "module"
+
+var moduleTypes = map[string]string{
+	".json": "application/json",
+	".css":  "text/css",
+}
+
+func moduleType(p string) string {
+	return moduleTypes[strings.ToLower(path.Ext(p))]
+}
+
+// cssModuleScript is a module exporting css as a CSSStyleSheet, as a CSS
+// module script would.
+func cssModuleScript(css string) string {
+	text, _ := json.Marshal(css)
+	return "const sheet = new CSSStyleSheet();\n" +
+		"sheet.replaceSync(" + string(text) + ");\n" +
+		"export default sheet;\n"
+}
+
+// serveModule answers ?module for a JSON file or stylesheet, the package's
+// entry point or the file named.
+func serveModule(c *gin.Context, ep *ensuredPackage, file string, opts fetchOptions) {
+	m := ep.Manifest
+	t := opts.Tenant
+	if file == "" {
+		entry, _, err := resolveEntry(versionDir(t, m.Name, m.Version), m, opts.Env)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		file = entry
+	} else if p, ok := resolveFile(m, file); ok {
+		file = p
+	} else {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "%s@%s has no file %s", m.Name, m.Version, file))
+		return
+	}
+	if moduleType(file) == "" {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "module takes a JSON file or a stylesheet, not %s", file))
+		return
+	}
+
+	sum := sha256.Sum256([]byte(m.Name + "\x00" + m.Version + "\x00" + file))
+	name := "module-" + hex.EncodeToString(sum[:8]) + ".js"
+	spec := &derivedSpec{TransformVersion: transformVersion, Kind: derivedModule, File: file}
+	if err := buildDerived(m.Name, m.Version, name, spec, opts); err != nil {
+		writeError(c, err)
+		return
+	}
+
+	setResolveHeaders(c.Writer, ep)
+	setServerTiming(c.Writer, opts.Timing)
+	c.Redirect(http.StatusFound, withAccessKey(c, derivedURL(t, m.Name, m.Version, name)))
+}
+
+func buildModule(packageName, version, file string, opts fetchOptions) ([]byte, error) {
+	if strings.EqualFold(path.Ext(file), ".css") {
+		css, err := buildInlineCSS(packageName, version, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(cssModuleScript(string(css))), nil
+	}
+
+	dir := versionDir(opts.Tenant, packageName, version)
+	m, err := loadManifest(dir, packageName, version)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := m.Lookup(file)
+	if !ok || deny.denied(file) {
+		return nil, newError(http.StatusNotFound, codeNotFound, "%s@%s has no file %s", packageName, version, file)
+	}
+	data, err := readStoredFile(dir, f)
+	if err != nil {
+		return nil, err
+	}
+	opts.Inputs.read(m, f)
+	var b bytes.Buffer
+	b.WriteString("export default ")
+	if err := json.Compact(&b, bytes.TrimPrefix(data, []byte("\ufeff"))); err != nil {
+		return nil, wrapError(http.StatusInternalServerError, codeBuildFailed, err, "%s@%s/%s is not valid JSON", packageName, version, file)
+	}
+	b.WriteString(";\n")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestModules(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("theme", "1.0.0", map[string]string{
+		"package.json":      `{"name": "theme", "version": "1.0.0", "main": "tokens.json"}`,
+		"tokens.json":       "\ufeff{\n  \"color\": \"rebeccapurple\",\n  \"sizes\": [1, 2]\n}\n",
+		"styles/main.css":   "@import \"./reset.css\";\nbody { color: rebeccapurple; }\n",
+		"styles/reset.css":  "* { margin: 0; }\n",
+		"STYLES/UPPER.CSS":  "a { color: red; }\n",
+		"broken.json":       `{"color": `,
+		"index.js":          "export {};",
+		"data/config.jsonc": `{}`,
+	})
+	s := newTestServer(t, reg, nil)
+	s.follow(s.get("/npm/theme@1.0.0/index.js"), 302)
+
+	// As they are, with the types browsers require of JSON and CSS
+	// modules.
+	for _, tc := range []struct{ file, contentType string }{
+		{"tokens.json", "application/json"},
+		{"styles/main.css", "text/css"},
+		{"STYLES/UPPER.CSS", "text/css"},
+	} {
+		res := s.get("/packages/theme@1.0.0/" + tc.file)
+		responseBody(t, res, 200)
+		if ct := res.Header.Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", tc.file, ct, tc.contentType)
+		}
+	}
+
+	// Wrapped in a JavaScript module.
+	for _, tc := range []struct {
+		target string
+		// want is the module, or what it should have in it for
+		// stylesheets.
+		want []string
+	}{
+		{"/npm/theme@1.0.0/tokens.json?module", []string{"export default {\"color\":\"rebeccapurple\",\"sizes\":[1,2]};\n"}},
+		{"/npm/theme@1.0.0?module", []string{"export default {\"color\":\"rebeccapurple\",\"sizes\":[1,2]};\n"}},
+		{"/npm/theme@1.0.0/styles/main.css?module", []string{
+			"const sheet = new CSSStyleSheet();\n",
+			"margin: 0",
+			"color: rebeccapurple",
+			"export default sheet;\n",
+		}},
+		{"/npm/theme@1.0.0/STYLES/UPPER.CSS?module", []string{"sheet.replaceSync(", "color: red"}},
+	} {
+		loc := s.follow(s.get(tc.target), 302)
+		res := s.get(loc)
+		body := responseBody(t, res, 200)
+		if ct := res.Header.Get("Content-Type"); ct != "text/javascript; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q", tc.target, ct)
+		}
+		if len(tc.want) == 1 && body != tc.want[0] {
+			t.Errorf("%s: got %q, want %q", tc.target, body, tc.want[0])
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: %q has no %q", tc.target, body, want)
+			}
+		}
+		// The stylesheet's imports are inlined, not left to the
+		// browser.
+		if strings.Contains(body, "@import") {
+			t.Errorf("%s: %q kept its @import", tc.target, body)
+		}
+	}
+
+	for _, tc := range []struct {
+		target string
+		status int
+		code   string
+	}{
+		{"/npm/theme@1.0.0/index.js?module", http.StatusBadRequest, codeBadRequest},
+		{"/npm/theme@1.0.0/data/config.jsonc?module", http.StatusBadRequest, codeBadRequest},
+		{"/npm/theme@1.0.0/missing.json?module", http.StatusNotFound, codeNotFound},
+		{"/npm/theme@1.0.0/broken.json?module", http.StatusInternalServerError, codeBuildFailed},
+	} {
+		var e struct{ Code string }
+		if err := json.Unmarshal([]byte(responseBody(t, s.get(tc.target), tc.status)), &e); err != nil || e.Code != tc.code {
+			t.Errorf("%s: code %q, %v; want %s", tc.target, e.Code, err, tc.code)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Representations of a package root, in order of preference when the
+// client accepts several equally.
+const (
+	formatJS   = "js"
+	formatJSON = "json"
+	formatHTML = "html"
+)
+
+var formatTypes = []struct {
+	format string
+	types  []string
+}{
+	{formatJS, []string{"text/javascript", "application/javascript"}},
+	{formatJSON, []string{"application/json"}},
+	{formatHTML, []string{"text/html"}},
+}
+
+// negotiateFormat picks the representation for an Accept header. A missing
+// header accepts anything.
+func negotiateFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return formatJS
+	}
+
+	best, bestQ := "", 0.0
+	for _, ft := range formatTypes {
+		q := 0.0
+		for _, t := range ft.types {
+			q = max(q, acceptQuality(accept, t))
+		}
+		if q > bestQ {
+			best, bestQ = ft.format, q
+		}
+	}
+	return best
+}
+
+// prefersHTML reports whether a client would rather have HTML than JSON,
+// as browsers do when opening a URL.
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return !config.DisableHTML && acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality returns the q value the most specific matching media range
+// of accept gives mediaType.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		r := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		s := -1
+		switch {
+		case r == mediaType:
+			s = 2
+		case r == typ+"/*":
+			s = 1
+		case r == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		rq := 1.0
+		for _, param := range fields[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					rq = f
+				}
+			}
+		}
+		q, specificity = rq, s
+	}
+	return q
+}
+
+// servePackageRoot answers a request for a version without a file path,
+// depending on ?format= or the Accept header: the entry module, for env,
+// the manifest, or a page listing the files and showing the README.
+func servePackageRoot(c *gin.Context, ep *ensuredPackage, env string) {
+	m := ep.Manifest
+	c.Header("Vary", "Accept")
+	setResolveHeaders(c.Writer, ep)
+
+	format := c.Query("format")
+	if format == "" {
+		format = negotiateFormat(c.GetHeader("Accept"))
+	}
+
+	switch format {
+	case formatJS:
+		t := tenantOf(c)
+		dir := versionDir(t, m.Name, m.Version)
+		c.Header("X-Repkg-Env", env)
+		entry, fallback, err := resolveEntry(dir, m, env)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		setEntryHeaders(c, m, entry, fallback)
+		setPeerHeader(c.Writer, readPackageJSON(dir, m).peers(), false)
+		c.Redirect(http.StatusFound, withAccessKey(c, packageURL(t, m.Name, m.Version, entry)))
+	case formatJSON:
+		writeJSON(c, http.StatusOK, m)
+	case formatHTML:
+		if config.DisableHTML {
+			writeJSON(c, http.StatusOK, m)
+			return
+		}
+		servePackagePage(c, m)
+	case "":
+		writeError(c, newError(http.StatusNotAcceptable, codeBadRequest, "no acceptable representation; offered text/javascript, application/json and text/html"))
+	default:
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "unknown format %q", format))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiatePackageRoot(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{
+		"package.json": `{"name": "left-pad", "version": "1.0.0", "main": "lib/index.js"}`,
+		"lib/index.js": "padded",
+		"README.md":    "# Padding strings",
+	})
+	s := newTestServer(t, reg, nil)
+	const browser = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	for _, tc := range []struct {
+		accept, query string
+		format        string
+	}{
+		{"", "", formatJS},
+		{"*/*", "", formatJS},
+		{"text/javascript", "", formatJS},
+		{"application/javascript, */*;q=0.1", "", formatJS},
+		{"application/json", "", formatJSON},
+		{"application/json, text/html;q=0.5", "", formatJSON},
+		{browser, "", formatHTML},
+		{"text/html", "", formatHTML},
+		// ?format= wins over the header.
+		{browser, "?format=js", formatJS},
+		{browser, "?format=json", formatJSON},
+		{"application/json", "?format=html", formatHTML},
+		{"image/png", "", ""},
+	} {
+		res := s.get("/npm/left-pad@1.0.0"+tc.query, "Accept", tc.accept)
+		what := tc.accept + " " + tc.query
+		if !strings.Contains(res.Header.Get("Vary"), "Accept") {
+			t.Errorf("%s: Vary %q", what, res.Header.Get("Vary"))
+		}
+		ct := res.Header.Get("Content-Type")
+		switch tc.format {
+		case formatJS:
+			if loc := s.follow(res, 302); loc != "/packages/left-pad@1.0.0/lib/index.js" {
+				t.Errorf("%s: redirects to %s", what, loc)
+			}
+		case formatJSON:
+			var m Manifest
+			if err := json.Unmarshal([]byte(responseBody(t, res, 200)), &m); err != nil || m.Name != "left-pad" || m.Version != "1.0.0" {
+				t.Errorf("%s: manifest %+v, %v", what, m, err)
+			}
+			if !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("%s: Content-Type %q", what, ct)
+			}
+		case formatHTML:
+			body := responseBody(t, res, 200)
+			if !strings.HasPrefix(ct, "text/html") || !strings.Contains(body, "Padding strings") || !strings.Contains(body, "lib/index.js") {
+				t.Errorf("%s: %s page:\n%s", what, ct, body)
+			}
+		default:
+			if body := responseBody(t, res, http.StatusNotAcceptable); !strings.Contains(body, codeBadRequest) {
+				t.Errorf("%s: %s", what, body)
+			}
+		}
+	}
+
+	responseBody(t, s.get("/npm/left-pad@1.0.0?format=xml"), 400)
+}
+
+func TestNegotiateWithoutHTML(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.DisableHTML = true
+	})
+
+	for _, p := range []string{"/npm/left-pad@1.0.0", "/npm/left-pad@1.0.0?format=html"} {
+		res := s.get(p, "Accept", "text/html")
+		if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type %q", p, ct)
+		}
+		responseBody(t, res, 200)
+	}
+}
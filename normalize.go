@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dependency fields of a package.json that normalization pins.
+var normalizeFields = []string{"dependencies", "devDependencies", "optionalDependencies"}
+
+type normalizedDep struct {
+	Field   string `json:"field"`
+	Name    string `json:"name"`
+	Range   string `json:"range"`
+	Version string `json:"version,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// serveNormalize handles POST /api/normalize: the package.json in the body
+// comes back with every dependency range replaced by the version /npm would
+// serve for it right now, along with the entries that couldn't be resolved,
+// which are left as they were. Key order is kept.
+func serveNormalize(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "reading body"))
+		return
+	}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	v, err := decodeOrdered(d)
+	doc, ok := v.(orderedObject)
+	if err != nil || !ok {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "expected a package.json object"))
+		return
+	}
+
+	var deps []*normalizedDep
+	for _, field := range doc {
+		if !slices.Contains(normalizeFields, field.Key) {
+			continue
+		}
+		obj, ok := field.Value.(orderedObject)
+		if !ok {
+			writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid %s", field.Key))
+			return
+		}
+		for _, dep := range obj {
+			rng, ok := dep.Value.(string)
+			if !ok {
+				writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid range for %s in %s", dep.Key, field.Key))
+				return
+			}
+			deps = append(deps, &normalizedDep{Field: field.Key, Name: dep.Key, Range: rng})
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, dep := range deps {
+		wg.Add(1)
+		go func(dep *normalizedDep) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := unsupportedSpec(dep.Range)
+			var pv *PackumentVersion
+			if err == nil {
+				pv, _, err = resolvePackage(tenantOf(c), dep.Name, dep.Range, requestSpan(c))
+			}
+			if err != nil {
+				dep.Code, dep.Error = errorCode(err), err.Error()
+				return
+			}
+			dep.Version = pv.Version
+		}(dep)
+	}
+	wg.Wait()
+
+	resolved, unresolved := []*normalizedDep{}, []*normalizedDep{}
+	i := 0
+	for _, field := range doc {
+		if !slices.Contains(normalizeFields, field.Key) {
+			continue
+		}
+		for j := range field.Value.(orderedObject) {
+			dep := deps[i]
+			i++
+			if dep.Error != "" {
+				unresolved = append(unresolved, dep)
+				continue
+			}
+			field.Value.(orderedObject)[j].Value = dep.Version
+			resolved = append(resolved, dep)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := writeOrdered(&b, doc); err != nil {
+		writeError(c, err)
+		return
+	}
+	writePureJSON(c, http.StatusOK, gin.H{
+		"packageJson": json.RawMessage(b.Bytes()),
+		"resolved":    resolved,
+		"unresolved":  unresolved,
+	})
+}
+
+// writeOrdered encodes a value decoded by decodeOrdered, keeping key order
+// and leaving characters like < and > unescaped.
+func writeOrdered(b *bytes.Buffer, v any) error {
+	switch t := v.(type) {
+	case orderedObject:
+		b.WriteByte('{')
+		for i, field := range t {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeOrdered(b, field.Key); err != nil {
+				return err
+			}
+			b.WriteByte(':')
+			if err := writeOrdered(b, field.Value); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case []any:
+		b.WriteByte('[')
+		for i, item := range t {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeOrdered(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	default:
+		enc := json.NewEncoder(b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+		b.Truncate(b.Len() - 1) // Encode's newline
+	}
+	return nil
+}
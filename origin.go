@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TarballOrigin is what a tarball was downloaded with, to show where a
+// cached version came from: the validators and Date of the registry's
+// response, as it sent them (empty when it sent none), the integrity the
+// packument published and the sha512 of what was downloaded.
+type TarballOrigin struct {
+	ETag              string `json:"etag,omitempty"`
+	LastModified      string `json:"lastModified,omitempty"`
+	Date              string `json:"date,omitempty"`
+	ExpectedIntegrity string `json:"expectedIntegrity,omitempty"`
+	Integrity         string `json:"integrity,omitempty"`
+}
+
+func tarballOrigin(res *http.Response) *TarballOrigin {
+	return &TarballOrigin{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Date:         res.Header.Get("Date"),
+	}
+}
+
+// hash records the integrity of the downloaded tarball and the one pv
+// published.
+func (o *TarballOrigin) hash(fileName string, pv *PackumentVersion) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	o.Integrity = "sha512-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	o.ExpectedIntegrity = pv.Dist.Integrity
+	if o.ExpectedIntegrity == "" && pv.Dist.Shasum != "" {
+		o.ExpectedIntegrity = "sha1:" + pv.Dist.Shasum
+	}
+	return nil
+}
+
+// describe is the validators, for the download's log line.
+func (o *TarballOrigin) describe() string {
+	if o == nil {
+		return ""
+	}
+	var b strings.Builder
+	if o.ETag != "" {
+		fmt.Fprintf(&b, ", etag %s", o.ETag)
+	}
+	if o.LastModified != "" {
+		fmt.Fprintf(&b, ", last modified %s", o.LastModified)
+	}
+	return b.String()
+}
+
+// upstreamChange is a version whose tarball the registry no longer serves
+// as it was downloaded, or couldn't be asked about.
+type upstreamChange struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	// Status is "changed", with the registry's new ETag if it sent one,
+	// or "error".
+	Status string `json:"status"`
+	ETag   string `json:"etag,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkUpstream asks the registry with a conditional GET whether a cached
+// version's tarball is still the one downloaded, without downloading it
+// again. It reports false for versions cached without validators.
+func checkUpstream(t *tenant, name, version string) (*upstreamChange, bool, error) {
+	m, err := loadManifest(versionDir(t, name, version), name, version)
+	if err != nil {
+		return nil, false, err
+	}
+	o := m.Origin
+	if o == nil || m.Upstream == "" || (o.ETag == "" && o.LastModified == "") {
+		return nil, false, nil
+	}
+	change := &upstreamChange{Package: name, Version: version, Status: "error"}
+	req, err := newUpstreamRequest(t, http.MethodGet, m.Upstream)
+	if err != nil {
+		change.Error = err.Error()
+		return change, true, nil
+	}
+	if o.ETag != "" {
+		req.Header.Set("If-None-Match", o.ETag)
+	} else {
+		req.Header.Set("If-Modified-Since", o.LastModified)
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		change.Error = err.Error()
+		return change, true, nil
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		return nil, true, nil
+	case res.StatusCode == http.StatusOK && o.ETag != "" && res.Header.Get("ETag") == o.ETag:
+		// A registry that ignores If-None-Match.
+		return nil, true, nil
+	case res.StatusCode == http.StatusOK && o.ETag == "" && res.Header.Get("Last-Modified") == o.LastModified:
+		return nil, true, nil
+	case res.StatusCode == http.StatusOK:
+		change.Status, change.ETag = "changed", res.Header.Get("ETag")
+		return change, true, nil
+	}
+	change.Error = "the registry answered " + res.Status
+	return change, true, nil
+}
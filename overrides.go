@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ?override=name@version, repeated, pins packages to published versions for
+// one /npm response: the package asked for, and what a bundle imports,
+// whatever range the importer declares. Nothing else resolves any
+// differently, and the responses are kept out of shared caches.
+
+// parseOverrides reads the ?override= of a request, checking each version
+// against the registry's.
+func parseOverrides(c *gin.Context) (map[string]string, error) {
+	list := c.QueryArray("override")
+	if len(list) == 0 {
+		return nil, nil
+	}
+	overrides := map[string]string{}
+	for _, o := range list {
+		i := strings.LastIndex(o, "@")
+		if i <= 0 || !validPackageName(o[:i]) || !validVersion(o[i+1:]) {
+			return nil, newError(http.StatusBadRequest, codeBadRequest, "override must be name@version, not %q", o)
+		}
+		name, version := o[:i], o[i+1:]
+		if v, ok := overrides[name]; ok && v != version {
+			return nil, newError(http.StatusBadRequest, codeBadRequest, "%s is overridden with both %s and %s", name, v, version)
+		}
+		if err := checkAllowed(tenantOf(c), name); err != nil {
+			return nil, err
+		}
+		pv, _, err := resolvePackage(tenantOf(c), name, version, requestSpan(c))
+		if err != nil {
+			return nil, err
+		}
+		overrides[name] = pv.Version
+	}
+	return overrides, nil
+}
+
+// setOverrideHeaders lists the overrides a response was built with, and
+// keeps it out of shared caches.
+func setOverrideHeaders(c *gin.Context, overrides map[string]string) {
+	if len(overrides) == 0 {
+		return
+	}
+	list := make([]string, 0, len(overrides))
+	for name, version := range overrides {
+		list = append(list, name+"@"+version)
+	}
+	sort.Strings(list)
+	c.Header("X-Repkg-Overrides", strings.Join(list, ", "))
+	c.Header("Cache-Control", "private, no-store")
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Packument is the registry's document describing all versions of a package.
+type Packument struct {
+	Name     string                       `json:"name"`
+	DistTags map[string]string            `json:"dist-tags"`
+	Versions map[string]*PackumentVersion `json:"versions"`
+	Time     map[string]string            `json:"time"`
+
+	// Stale is set when the registry could not be reached or sent garbage
+	// and a previously cached copy is used instead.
+	Stale bool `json:"-"`
+}
+
+type PackumentVersion struct {
+	Name       string      `json:"name"`
+	Version    string      `json:"version"`
+	Deprecated deprecation `json:"deprecated"`
+
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+
+	// OS and CPU restrict the platforms the version installs on, as in
+	// package.json.
+	OS  []string `json:"os"`
+	CPU []string `json:"cpu"`
+
+	NPMUser     *npmUser  `json:"_npmUser"`
+	Maintainers []npmUser `json:"maintainers"`
+
+	Dist struct {
+		Tarball   string `json:"tarball"`
+		Shasum    string `json:"shasum"`
+		Integrity string `json:"integrity"`
+
+		// Not every registry reports these.
+		UnpackedSize int64 `json:"unpackedSize"`
+		FileCount    int   `json:"fileCount"`
+
+		Signatures []struct {
+			KeyID string `json:"keyid"`
+			Sig   string `json:"sig"`
+		} `json:"signatures"`
+
+		// Attestations are npm's, for versions published with provenance.
+		Attestations *struct {
+			URL        string `json:"url"`
+			Provenance struct {
+				PredicateType string `json:"predicateType"`
+			} `json:"provenance"`
+		} `json:"attestations"`
+	} `json:"dist"`
+
+	// Published is taken from the packument's time map.
+	Published time.Time `json:"-"`
+}
+
+// deprecation is the "deprecated" field of a version. Some registries write
+// false instead of omitting it.
+type deprecation string
+
+func (d *deprecation) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*d = deprecation(s)
+		return nil
+	}
+	var b bool
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	if b {
+		*d = "deprecated"
+	} else {
+		*d = ""
+	}
+	return nil
+}
+
+// cachedPackument is kept in memory and on disk under
+// <data dir>/.cache/packuments/<registry> so the registry can be asked
+// whether it changed instead of sending it again. Registry is the
+// registryID of where it came from: its validators are only sent there.
+type cachedPackument struct {
+	Registry     string          `json:"registry,omitempty"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"lastModified,omitempty"`
+	FetchedAt    time.Time       `json:"fetchedAt"`
+	Body         json.RawMessage `json:"packument"`
+
+	p *Packument
+}
+
+var (
+	packumentsMu sync.Mutex
+	packuments   = map[string]*cachedPackument{} // by tenant-qualified name
+)
+
+var staleServes = newCounter("repkg_stale_serves_total", "Requests served from the cache because the registry failed, by what was served.")
+
+// getPackument returns the packument for a package, reusing a copy fetched
+// within the last config.PackumentTTL and revalidating older ones. When
+// revalidation fails and useStale allows it, the stale copy is returned
+// with Stale set.
+func getPackument(t *tenant, packageName string, s *span) (*Packument, error) {
+	packumentsMu.Lock()
+	cached, ok := packuments[t.qualify(packageName)]
+	packumentsMu.Unlock()
+	if !ok {
+		cached, ok = readPackumentCache(t, packageName)
+	}
+	if ok && time.Since(cached.FetchedAt) < config.PackumentTTL.Duration {
+		return cached.p, nil
+	}
+	if config.ReadOnly {
+		// Replicas take the writer's copy, however old.
+		if !ok {
+			return nil, notCached(packageName)
+		}
+		return cached.p, nil
+	}
+
+	fresh, err := fetchPackument(t, packageName, cached, s)
+	if err != nil {
+		if !ok || !useStale(cached, err) {
+			return nil, err
+		}
+		log.Printf("serving stale packument for %s: %s", packageName, err)
+		staleServes.Inc("kind", "packument")
+		stale := *cached.p
+		stale.Stale = true
+		return &stale, nil
+	}
+
+	storePackument(t, packageName, fresh)
+	return fresh.p, nil
+}
+
+// useStale reports whether a cached packument may stand in for one the
+// registry failed to send with err: within config.StaleIfError of expiring,
+// and, unless config.StaleIfNotFound, not because the package is gone.
+func useStale(cached *cachedPackument, err error) bool {
+	var e *apiError
+	if errors.As(err, &e) && e.Status == http.StatusNotFound && !config.StaleIfNotFound {
+		return false
+	}
+	return time.Since(cached.FetchedAt) < config.PackumentTTL.Duration+config.StaleIfError.Duration
+}
+
+// localPackument returns the cached packument for a package, whatever its
+// age, without asking the registry.
+func localPackument(t *tenant, packageName string) (*Packument, bool) {
+	packumentsMu.Lock()
+	cached, ok := packuments[t.qualify(packageName)]
+	packumentsMu.Unlock()
+	if !ok {
+		cached, ok = readPackumentCache(t, packageName)
+	}
+	if !ok {
+		return nil, false
+	}
+	return cached.p, true
+}
+
+// refreshPackument fetches a packument whatever the age of the cached copy,
+// which it replaces. Unlike getPackument it never falls back to that copy.
+func refreshPackument(t *tenant, packageName string, s *span) (*Packument, error) {
+	packumentsMu.Lock()
+	cached := packuments[t.qualify(packageName)]
+	packumentsMu.Unlock()
+	if cached == nil {
+		cached, _ = readPackumentCache(t, packageName)
+	}
+
+	fresh, err := fetchPackument(t, packageName, cached, s)
+	if err != nil {
+		return nil, err
+	}
+	storePackument(t, packageName, fresh)
+	return fresh.p, nil
+}
+
+func storePackument(t *tenant, packageName string, fresh *cachedPackument) {
+	packumentsMu.Lock()
+	prev := packuments[t.qualify(packageName)]
+	packuments[t.qualify(packageName)] = fresh
+	packumentsMu.Unlock()
+	if prev != nil {
+		emitTagChanges(t, packageName, prev.p, fresh.p)
+	}
+	if err := writePackumentCache(t, packageName, fresh); err != nil {
+		log.Printf("caching packument for %s: %s", packageName, err)
+	}
+	updateAliases(t, packageName, "")
+}
+
+// packumentCachePath is in the partition of t's registry, like versionDir,
+// so a packument is never taken for another registry's.
+func packumentCachePath(t *tenant, packageName string) string {
+	return filepath.Join(t.dataDir(), internalDir, "packuments", partitionName(t.registry()), url.PathEscape(packageName)+".json")
+}
+
+func readPackumentCache(t *tenant, packageName string) (*cachedPackument, bool) {
+	data, err := os.ReadFile(packumentCachePath(t, packageName))
+	if err != nil {
+		return nil, false
+	}
+	cached := &cachedPackument{}
+	if err := json.Unmarshal(data, cached); err != nil {
+		return nil, false
+	}
+	if cached.p, err = parsePackument(packageName, cached.Body); err != nil {
+		return nil, false
+	}
+
+	packumentsMu.Lock()
+	packuments[t.qualify(packageName)] = cached
+	packumentsMu.Unlock()
+	return cached, true
+}
+
+func writePackumentCache(t *tenant, packageName string, cached *cachedPackument) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	p := packumentCachePath(t, packageName)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	index.setFileSize(p, int64(len(data)))
+	return nil
+}
+
+// fetchPackument asks the tenant's registry for a packument, conditionally
+// when a previous copy exists. A 304 returns that copy with a new fetch time.
+// The request is traced below parent.
+func fetchPackument(t *tenant, packageName string, prev *cachedPackument, parent *span) (*cachedPackument, error) {
+	URL := t.registry() + "/" + url.PathEscape(packageName)
+
+	registry := t.registry()
+	req, err := newPackumentRequest(t, URL, prev, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	s := traceUpstream(parent, req)
+	res, err := upstreamClient.Do(req)
+	s.done(res, err)
+	if fallback, ok := fallbackURL(URL, err); ok {
+		log.Printf("fetching %s from the fallback registry: %s", packageName, err)
+		registry = config.FallbackRegistry
+		if req, err = newPackumentRequest(t, fallback, prev, registry); err != nil {
+			return nil, err
+		}
+		s = traceUpstream(parent, req)
+		res, err = upstreamClient.Do(req)
+		s.done(res, err)
+	}
+	if err != nil {
+		return nil, wrapUpstream(err, "fetching %s", packageName)
+	}
+	defer res.Body.Close()
+
+	conditional := req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+	if res.StatusCode == http.StatusNotModified && conditional {
+		revalidated := *prev
+		revalidated.FetchedAt = time.Now()
+		if etag := res.Header.Get("ETag"); etag != "" {
+			revalidated.ETag = etag
+		}
+		return &revalidated, nil
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, newError(http.StatusNotFound, codeNotFound, "package %s not found", packageName)
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, wrapUpstream(errUpstreamAuth, "fetching %s: registry responded %s", packageName, res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, newError(http.StatusBadGateway, codeUpstream, "fetching %s: registry responded %s", packageName, res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, wrapError(http.StatusBadGateway, codeUpstream, err, "reading %s", packageName)
+	}
+
+	if err := checkJSONResponse(t, res, body); err != nil {
+		return nil, wrapUpstream(err, "fetching %s", packageName)
+	}
+	p, err := parsePackument(packageName, body)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedPackument{
+		Registry:     registryID(registry),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+		Body:         body,
+		p:            p,
+	}, nil
+}
+
+// newPackumentRequest asks registry for a packument at URL, conditionally
+// when prev came from that registry.
+func newPackumentRequest(t *tenant, URL string, prev *cachedPackument, registry string) (*http.Request, error) {
+	req, err := newUpstreamRequest(t, http.MethodGet, URL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if prev != nil && prev.Registry == registryID(registry) {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+	return req, nil
+}
+
+func parsePackument(packageName string, body []byte) (*Packument, error) {
+	p := &Packument{}
+	if err := json.Unmarshal(body, p); err != nil {
+		return nil, wrapError(http.StatusBadGateway, codeUpstream, err, "parsing %s", packageName)
+	}
+	if p.Versions == nil {
+		return nil, newError(http.StatusBadGateway, codeUpstream, "packument for %s has no versions", packageName)
+	}
+	for v, pv := range p.Versions {
+		if t, err := time.Parse(time.RFC3339, p.Time[v]); err == nil {
+			pv.Published = t
+		}
+	}
+	return p, nil
+}
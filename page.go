@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The package page is self-contained: styles are inline and every link
+// points back into repkg.
+const pageStyle = `body{font:14px/1.5 system-ui,sans-serif;margin:2em auto;max-width:60em;padding:0 1em}` +
+	`ul{list-style:none;padding-left:1.2em}summary{cursor:pointer}.size{color:#888;margin-left:.5em}` +
+	`pre{background:#f6f6f6;padding:1em;overflow:auto;white-space:pre-wrap}`
+
+// servePackagePage renders the HTML index of a version: its name,
+// description, entry points, file tree and README.
+func servePackagePage(c *gin.Context, m *Manifest) {
+	t := tenantOf(c)
+	dir := versionDir(t, m.Name, m.Version)
+	pkg := readPackageJSON(dir, m)
+
+	var b strings.Builder
+	title := html.EscapeString(m.Name + "@" + m.Version)
+	fmt.Fprintf(&b, "<!doctype html>\n<meta charset=utf-8>\n<title>%s</title>\n<style>%s</style>\n<h1>%s</h1>\n", title, pageStyle, title)
+	if pkg.Description != "" {
+		fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(pkg.Description))
+	}
+	if m.Deprecated != "" {
+		fmt.Fprintf(&b, "<p><strong>Deprecated:</strong> %s</p>\n", html.EscapeString(m.Deprecated))
+	}
+	if m.SecurityHolder {
+		b.WriteString("<p><strong>Security holding package:</strong> npm removed this package from the registry for security reasons; this version is its placeholder and has no code.</p>\n")
+	}
+
+	if entries := entryPoints(dir, m, pkg); len(entries) > 0 {
+		b.WriteString("<h2>Entry points</h2>\n<ul>\n")
+		for _, e := range entries {
+			fmt.Fprintf(&b, "<li><code>%s</code> &rarr; <a href=\"%s\">%s</a></li>\n", html.EscapeString(e[0]), html.EscapeString(withAccessKey(c, packageURL(t, m.Name, m.Version, e[1]))), html.EscapeString(e[1]))
+		}
+		b.WriteString("</ul>\n")
+	}
+
+	if f := m.FetchedBy; f != nil {
+		fmt.Fprintf(&b, "<p>First cached %s", f.At.UTC().Format(time.RFC3339))
+		if f.Source != "" {
+			fmt.Fprintf(&b, " by %s", html.EscapeString(f.Source))
+		}
+		if isAdmin(c.Request) && f.IP != "" {
+			fmt.Fprintf(&b, " from %s", html.EscapeString(f.IP))
+			if f.UserAgent != "" {
+				fmt.Fprintf(&b, " (%s)", html.EscapeString(f.UserAgent))
+			}
+		}
+		if f.RequestID != "" {
+			fmt.Fprintf(&b, ", request <code>%s</code>", html.EscapeString(f.RequestID))
+		}
+		b.WriteString("</p>\n")
+	}
+
+	fmt.Fprintf(&b, "<h2>Files</h2>\n<p>%d files, %s unpacked</p>\n", len(m.Files), formatBytes(m.UnpackedSize))
+	writeFileTree(&b, c, t, m, "")
+
+	for _, name := range []string{"README.md", "README", "readme.md", "README.markdown", "README.txt"} {
+		f, ok := m.Lookup(name)
+		if !ok || deny.denied(name) {
+			continue
+		}
+		if data, err := readStoredFile(dir, f); err == nil {
+			fmt.Fprintf(&b, "<h2>%s</h2>\n<pre>%s</pre>\n", html.EscapeString(name), html.EscapeString(string(data)))
+		}
+		break
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(b.String()))
+}
+
+// entryPoints lists the subpaths a version exports, or just its main
+// entry, with the files they resolve to.
+func entryPoints(dir string, m *Manifest, pkg *packageJSON) [][2]string {
+	subpaths := []string{"."}
+	if len(pkg.Exports) > 0 {
+		if obj, ok := decodeExports(pkg.Exports).(orderedObject); ok && len(obj) > 0 && strings.HasPrefix(obj[0].Key, ".") {
+			subpaths = subpaths[:0]
+			for _, field := range obj {
+				if !strings.Contains(field.Key, "*") {
+					subpaths = append(subpaths, field.Key)
+				}
+			}
+		}
+	}
+
+	var entries [][2]string
+	for _, sp := range subpaths {
+		if p, err := resolveSubpath(dir, m, sp, envProduction); err == nil && !deny.denied(p) {
+			entries = append(entries, [2]string{sp, p})
+		}
+	}
+	return entries
+}
+
+func decodeExports(raw json.RawMessage) any {
+	v, err := decodeOrdered(json.NewDecoder(bytes.NewReader(raw)))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// writeFileTree renders directory p of the manifest as nested lists.
+func writeFileTree(b *strings.Builder, c *gin.Context, t *tenant, m *Manifest, p string) {
+	b.WriteString("<ul>\n")
+	for _, entry := range m.List(p) {
+		full := path.Join(p, entry)
+		if deny.denied(full) {
+			continue
+		}
+		if strings.HasSuffix(entry, "/") {
+			fmt.Fprintf(b, "<li><details open><summary>%s</summary>\n", html.EscapeString(entry))
+			writeFileTree(b, c, t, m, full)
+			b.WriteString("</details></li>\n")
+			continue
+		}
+		size := ""
+		if f, ok := m.Lookup(full); ok {
+			size = formatBytes(f.Size)
+		}
+		fmt.Fprintf(b, "<li><a href=\"%s\">%s</a><span class=size>%s</span></li>\n", html.EscapeString(withAccessKey(c, packageURL(t, m.Name, m.Version, full))), html.EscapeString(entry), size)
+	}
+	b.WriteString("</ul>\n")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Listings return at most this many entries per page, and this many unless
+// ?limit= asks for fewer.
+const maxPageLimit = 1000
+
+// pageParams reads ?cursor= and ?limit=. Cursors are opaque to clients but
+// hold the last entry of the previous page, so they keep working as entries
+// before or after them come and go.
+func pageParams(c *gin.Context) (after string, limit int, err error) {
+	limit = maxPageLimit
+	if q := c.Query("limit"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return "", 0, newError(http.StatusBadRequest, codeBadRequest, "limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	if q := c.Query("cursor"); q != "" {
+		data, err := base64.RawURLEncoding.DecodeString(q)
+		if err != nil || len(data) == 0 {
+			return "", 0, newError(http.StatusBadRequest, codeBadRequest, "invalid cursor %q", q)
+		}
+		after = string(data)
+	}
+	return after, limit, nil
+}
+
+func encodeCursor(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
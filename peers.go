@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// peerDependency is a package a version expects the page to provide.
+type peerDependency struct {
+	Name     string `json:"name"`
+	Range    string `json:"range"`
+	Optional bool   `json:"optional,omitempty"`
+
+	// Bundled is set when the package also depends on the peer itself,
+	// so it gets installed with it anyway.
+	Bundled bool `json:"bundled,omitempty"`
+}
+
+// peers lists the package's peerDependencies by name, with
+// peerDependenciesMeta's optional flags.
+func (pkg *packageJSON) peers() []peerDependency {
+	list := []peerDependency{}
+	for name, rng := range pkg.PeerDependencies {
+		_, bundled := pkg.Dependencies[name]
+		list = append(list, peerDependency{Name: name, Range: rng, Optional: pkg.PeerDependenciesMeta[name].Optional, Bundled: bundled})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// setPeerHeader lists peers in X-Peer-Dependencies as
+// "react@^18.0.0, react-dom@^18.0.0;optional". Bundled ones are left out
+// unless all is set.
+func setPeerHeader(w http.ResponseWriter, peers []peerDependency, all bool) {
+	var list []string
+	for _, p := range peers {
+		if p.Bundled && !all {
+			continue
+		}
+		s := p.Name + "@" + p.Range
+		if p.Optional {
+			s += ";optional"
+		}
+		list = append(list, s)
+	}
+	if len(list) > 0 {
+		w.Header().Set("X-Peer-Dependencies", strings.Join(list, ", "))
+	}
+}
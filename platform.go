@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// platform is what dependencies are resolved for, from ?platform=:
+// "browser" (the default), "any", or an npm os and cpu such as
+// "linux-x64" or just "darwin".
+type platform struct {
+	name    string
+	os, cpu string
+}
+
+func parsePlatform(s string) (platform, error) {
+	switch s {
+	case "", "browser":
+		return platform{name: "browser"}, nil
+	case "any":
+		return platform{name: "any"}, nil
+	}
+	os, cpu, _ := strings.Cut(s, "-")
+	if os == "" || strings.ContainsAny(os+cpu, "!-, ") {
+		return platform{}, newError(http.StatusBadRequest, codeBadRequest, "invalid platform %q; expected browser, any or <os>[-<cpu>]", s)
+	}
+	return platform{name: s, os: os, cpu: cpu}, nil
+}
+
+func (p platform) String() string {
+	return p.name
+}
+
+// matches reports whether a version can be installed on p. Browsers run
+// nothing built for an os or cpu.
+func (p platform) matches(pv *PackumentVersion) bool {
+	switch p.name {
+	case "any":
+		return true
+	case "browser":
+		return len(pv.OS) == 0 && len(pv.CPU) == 0
+	}
+	return allowedBy(pv.OS, p.os) && allowedBy(pv.CPU, p.cpu)
+}
+
+// allowedBy applies an npm os or cpu list, such as ["linux", "darwin"] or
+// ["!win32"], to value. An empty value (any cpu) is always allowed.
+func allowedBy(list []string, value string) bool {
+	if len(list) == 0 || value == "" {
+		return true
+	}
+	if slices.Contains(list, "!"+value) {
+		return false
+	}
+	allowed := slices.ContainsFunc(list, func(s string) bool { return !strings.HasPrefix(s, "!") })
+	return !allowed || slices.Contains(list, value)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// checkAllowed rejects packages that don't match the tenant's allowlist.
+// "*" in a pattern does not cross the scope separator; "**" matches any
+// name.
+func checkAllowed(t *tenant, packageName string) error {
+	allowlist := t.allowlist()
+	if len(allowlist) == 0 {
+		return nil
+	}
+	for _, pattern := range allowlist {
+		if pattern == "**" {
+			return nil
+		}
+		if ok, _ := path.Match(pattern, packageName); ok {
+			return nil
+		}
+	}
+	return newError(http.StatusForbidden, codeNotAllowed, "package %s is not on the allowlist", packageName)
+}
+
+var errLimitExceeded = errors.New("package size limit exceeded")
+
+// errStreamLimitExceeded is errLimitExceeded for a tarball sent without a
+// Content-Length, whose size is only known to be over the limit.
+var errStreamLimitExceeded = fmt.Errorf("%w while streaming", errLimitExceeded)
+
+// sizeLimits bounds what a single package version may unpack to. Zero
+// fields are unlimited.
+type sizeLimits struct {
+	Bytes int64
+	Files int
+}
+
+// limitsFor returns the configured limits, or none for admin requests.
+func limitsFor(opts fetchOptions) sizeLimits {
+	if opts.Admin {
+		return sizeLimits{}
+	}
+	return sizeLimits{Bytes: config.MaxPackageSize, Files: config.MaxPackageFiles}
+}
+
+// check rejects a package of the given unpacked size and file count. Unknown
+// values are passed as zero.
+func (l sizeLimits) check(packageName, version string, size int64, files int) error {
+	if l.Bytes > 0 && size > l.Bytes {
+		err := newError(http.StatusRequestEntityTooLarge, codeTooLarge, "%s@%s unpacks to %s, over the %s limit", packageName, version, formatBytes(size), formatBytes(l.Bytes))
+		err.Details = map[string]any{"size": size, "limit": l.Bytes}
+		return err
+	}
+	if l.Files > 0 && files > l.Files {
+		err := newError(http.StatusRequestEntityTooLarge, codeTooLarge, "%s@%s has %d files, over the %d file limit", packageName, version, files, l.Files)
+		err.Details = map[string]any{"files": files, "limit": l.Files}
+		return err
+	}
+	return nil
+}
+
+// checkStreamed reports a tarball of unannounced size that was cut off
+// after read bytes, over the byte limit.
+func (l sizeLimits) checkStreamed(packageName, version string, read int64) error {
+	err := newError(http.StatusRequestEntityTooLarge, codeTooLarge, "%s@%s is over the %s limit: its tarball, sent without a size, was cut off after %s", packageName, version, formatBytes(l.Bytes), formatBytes(read))
+	err.Details = map[string]any{"read": read, "limit": l.Bytes}
+	return err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
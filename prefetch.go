@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+)
+
+// Finished jobs are kept around this long for status polling.
+const prefetchJobRetention = time.Hour
+
+type prefetchItem struct {
+	Package string `json:"package"`
+	Spec    string `json:"spec,omitempty"`
+	Version string `json:"version,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// Optional items are optionalDependencies; their failures are only
+	// warnings.
+	Optional bool `json:"optional,omitempty"`
+}
+
+type prefetchJob struct {
+	mu sync.Mutex
+
+	ID       string
+	Status   string
+	Created  time.Time
+	Finished time.Time
+	Total    int
+	Done     int
+	Failed   int
+	Warnings int
+	Items    []*prefetchItem
+
+	opts     fetchOptions
+	interval time.Duration
+}
+
+type prefetchTask struct {
+	job    *prefetchJob
+	item   *prefetchItem
+	queued time.Time
+}
+
+var (
+	prefetchJobsMu sync.Mutex
+	prefetchJobs   = map[string]*prefetchJob{}
+
+	prefetchQueue   = make(chan prefetchTask, 256)
+	prefetchStarted sync.Once
+)
+
+// parseSpec splits "name@spec" (including "@scope/name@spec").
+func parseSpec(s string) (packageName, spec string) {
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// enqueuePrefetch creates a job fetching every item through the normal
+// pipeline in the background.
+func enqueuePrefetch(items []*prefetchItem, opts fetchOptions) *prefetchJob {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return enqueuePaced(hex.EncodeToString(buf), items, opts, 0)
+}
+
+// enqueuePaced is enqueuePrefetch with a job ID and at most one item handed
+// to the workers per interval, so that large jobs leave room for others.
+func enqueuePaced(id string, items []*prefetchItem, opts fetchOptions, interval time.Duration) *prefetchJob {
+	prefetchStarted.Do(func() {
+		for i := 0; i < max(config.PrefetchWorkers, 1); i++ {
+			go prefetchWorker()
+		}
+	})
+
+	job := &prefetchJob{
+		ID:       id,
+		Status:   jobQueued,
+		Created:  time.Now(),
+		Total:    len(items),
+		Items:    items,
+		opts:     opts,
+		interval: interval,
+	}
+	if job.Total == 0 {
+		job.Status = jobDone
+		job.Finished = job.Created
+	}
+
+	prefetchJobsMu.Lock()
+	for id, j := range prefetchJobs {
+		j.mu.Lock()
+		expired := j.Status == jobDone && time.Since(j.Finished) > prefetchJobRetention
+		j.mu.Unlock()
+		if expired {
+			delete(prefetchJobs, id)
+		}
+	}
+	prefetchJobs[job.ID] = job
+	prefetchJobsMu.Unlock()
+
+	go func() {
+		for i, item := range items {
+			if i > 0 && interval > 0 {
+				time.Sleep(interval)
+			}
+			prefetchQueue <- prefetchTask{job: job, item: item, queued: time.Now()}
+		}
+	}()
+	return job
+}
+
+func prefetchWorker() {
+	for task := range prefetchQueue {
+		task.job.mu.Lock()
+		task.job.Status = jobRunning
+		task.job.mu.Unlock()
+
+		opts := task.job.opts
+		// Each item is timed on its own, traced below the request that
+		// created the job.
+		opts.Timing = newFetchTiming(opts.Timing.parent())
+		opts.FetchedBy = opts.FetchedBy.byJob(task.job.ID)
+		qs := opts.Timing.begin("queue")
+		qs.start = task.queued
+		qs.finish()
+		ep, err := ensurePackage(task.item.Package, task.item.Spec, opts)
+
+		task.job.mu.Lock()
+		if err != nil {
+			log.Printf("prefetch %s %s@%s: %s", task.job.ID, task.item.Package, task.item.Spec, err)
+			task.item.Code, task.item.Error = errorCode(err), err.Error()
+			if task.item.Optional {
+				task.job.Warnings++
+			} else {
+				task.job.Failed++
+			}
+		} else {
+			task.item.Version = ep.Manifest.Version
+		}
+		task.job.Done++
+		if task.job.Done == task.job.Total {
+			task.job.Status = jobDone
+			task.job.Finished = time.Now()
+			if task.job.interval > 0 {
+				log.Printf("prefetch %s: done, %d of %d failed in %s", task.job.ID, task.job.Failed, task.job.Total, task.job.Finished.Sub(task.job.Created).Round(time.Second))
+			}
+		} else if task.job.interval > 0 && task.job.Done%50 == 0 {
+			log.Printf("prefetch %s: %d of %d done", task.job.ID, task.job.Done, task.job.Total)
+		}
+		task.job.mu.Unlock()
+	}
+}
+
+func servePrefetch(c *gin.Context) {
+	var body struct {
+		Packages []string `json:"packages"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request body"))
+		return
+	}
+
+	items := make([]*prefetchItem, 0, len(body.Packages))
+	for _, s := range body.Packages {
+		name, spec := parseSpec(s)
+		items = append(items, &prefetchItem{Package: name, Spec: spec})
+	}
+
+	job := enqueuePrefetch(items, fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), Timing: newFetchTiming(requestSpan(c)), FetchedBy: fetchedBy(c)})
+	c.JSON(http.StatusAccepted, job.snapshot())
+}
+
+func servePrefetchStatus(c *gin.Context) {
+	prefetchJobsMu.Lock()
+	job, ok := prefetchJobs[c.Param("id")]
+	prefetchJobsMu.Unlock()
+	if !ok {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "no prefetch job %s", c.Param("id")))
+		return
+	}
+	c.JSON(http.StatusOK, job.snapshot())
+}
+
+// snapshot copies the job so it can be rendered without holding its lock.
+func (j *prefetchJob) snapshot() gin.H {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	items := make([]prefetchItem, len(j.Items))
+	for i, item := range j.Items {
+		items[i] = *item
+	}
+
+	h := gin.H{
+		"id":       j.ID,
+		"status":   j.Status,
+		"created":  j.Created,
+		"total":    j.Total,
+		"done":     j.Done,
+		"failed":   j.Failed,
+		"warnings": j.Warnings,
+		"items":    items,
+	}
+	if !j.Finished.IsZero() {
+		h["finished"] = j.Finished
+	}
+	return h
+}
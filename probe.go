@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveProbe answers HEAD on /npm (p is the part after /npm): whether a version (or a file of it) is
+// cached, without ever fetching it. Tags and ranges are resolved against the
+// cached packument unless ?resolve=remote asks the registry. Hits get a
+// 200 with X-Cache: HIT, misses a 404 with X-Cache: MISS.
+func serveProbe(c *gin.Context, p string) {
+	packageName, rest, err := parsePackageParams(p)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	spec, file := "", ""
+	if len(rest) > 0 {
+		spec, file = rest[0], strings.Join(rest[1:], "/")
+	}
+
+	env, err := parseEnv(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	t := tenantOf(c)
+	var pv *PackumentVersion
+	stale := false
+	if c.Query("resolve") == "remote" {
+		pv, stale, err = resolvePackage(t, packageName, spec, requestSpan(c))
+	} else {
+		pv, err = resolveLocal(t, packageName, spec)
+	}
+	var e *apiError
+	if errors.As(err, &e) && (e.Status == http.StatusNotFound || e.Code == codeVersionNotFound) {
+		c.Header("X-Cache", "MISS")
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Header("X-Resolved-Version", pv.Version)
+
+	dir := versionDir(t, packageName, pv.Version)
+	m, err := loadManifest(dir, packageName, pv.Version)
+	if errors.Is(err, os.ErrNotExist) {
+		c.Header("X-Cache", "MISS")
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "%s@%s is not cached", packageName, pv.Version))
+		return
+	}
+	if err != nil {
+		log.Printf("loading manifest for %s@%s: %s", packageName, pv.Version, err)
+		writeError(c, wrapError(http.StatusInternalServerError, codeInternal, err, "loading %s@%s", packageName, pv.Version))
+		return
+	}
+
+	c.Header("X-Cache", "HIT")
+	setResolveHeaders(c.Writer, &ensuredPackage{Manifest: m, Stale: stale})
+	if !checkWithdrawn(c, m) || !checkCorrupt(c, m) {
+		return
+	}
+	if file != "" {
+		f, ok := m.Lookup(normalizePath(file))
+		if !ok || deny.denied(file) {
+			writeError(c, newError(http.StatusNotFound, codeNotFound, "%s@%s has no file %s", packageName, pv.Version, file))
+			return
+		}
+		setModuleTypeHeader(c, f)
+	} else if format := c.Query("format"); format == formatJS || format == "" && negotiateFormat(c.GetHeader("Accept")) == formatJS {
+		// Where GET would redirect to.
+		c.Header("X-Repkg-Env", env)
+		if entry, fallback, err := resolveEntry(dir, m, env); err == nil {
+			file = entry
+			setEntryHeaders(c, m, entry, fallback)
+			setPeerHeader(c.Writer, readPackageJSON(dir, m).peers(), false)
+		}
+	}
+	c.Header("Content-Location", packageURL(t, packageName, pv.Version, file))
+	c.Status(http.StatusOK)
+}
+
+// resolveLocal resolves spec from what is cached: the packument if there is
+// one, else an exact version.
+func resolveLocal(t *tenant, packageName, spec string) (*PackumentVersion, error) {
+	if err := checkAllowed(t, packageName); err != nil {
+		return nil, err
+	}
+	if p, ok := localPackument(t, packageName); ok {
+		return resolveVersion(p, spec, false)
+	}
+	if spec = normalizeVersion(spec); validVersion(spec) {
+		return &PackumentVersion{Name: packageName, Version: spec}, nil
+	}
+	return nil, newError(http.StatusNotFound, codeNotFound, "%s has no cached packument to resolve %q", packageName, spec)
+}
+
+// cachedManifest returns the manifest of a cached version, resolving spec
+// locally. Versions that aren't cached are a 404; nothing is fetched.
+func cachedManifest(t *tenant, packageName, spec string) (*Manifest, error) {
+	pv, err := resolveLocal(t, packageName, spec)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadManifest(versionDir(t, packageName, pv.Version), packageName, pv.Version)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, newError(http.StatusNotFound, codeNotFound, "%s@%s is not cached", packageName, pv.Version)
+	}
+	return m, err
+}
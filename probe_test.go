@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProbeMiss(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, nil)
+
+	for _, p := range []string{"/npm/left-pad@1.0.0", "/npm/left-pad@1.0.0/index.js", "/npm/left-pad@latest"} {
+		res := s.request(http.MethodHead, p, nil)
+		if res.StatusCode != 404 || res.Header.Get("X-Cache") != "MISS" {
+			t.Errorf("%s: got %s, X-Cache %q", p, res.Status, res.Header.Get("X-Cache"))
+		}
+	}
+	if reg.hits("/left-pad") != 0 || reg.hits(tarballPath("left-pad", "1.0.0")) != 0 {
+		t.Errorf("a probe reached the registry")
+	}
+	if res := s.request(http.MethodHead, "/packages/left-pad@1.0.0/index.js", nil); res.StatusCode != 404 {
+		t.Errorf("probing fetched the version: %s", res.Status)
+	}
+}
+
+func TestProbeHit(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	s := newTestServer(t, reg, nil)
+	s.follow(s.get("/npm/left-pad@1.0.0/index.js"), 302)
+	packuments := reg.hits("/left-pad")
+
+	res := s.request(http.MethodHead, "/npm/left-pad@1.0.0/index.js", nil)
+	if res.StatusCode != 200 || res.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("got %s, X-Cache %q", res.Status, res.Header.Get("X-Cache"))
+	}
+	if v := res.Header.Get("X-Resolved-Version"); v != "1.0.0" {
+		t.Errorf("X-Resolved-Version %q", v)
+	}
+	if loc := res.Header.Get("Content-Location"); loc != "/packages/left-pad@1.0.0/index.js" {
+		t.Errorf("Content-Location %q", loc)
+	}
+	if body := responseBody(t, res, 200); body != "" {
+		t.Errorf("HEAD had a body: %q", body)
+	}
+
+	res = s.request(http.MethodHead, "/npm/left-pad@1.0.0/no-such-file.js", nil)
+	if res.StatusCode != 404 || res.Header.Get("X-Cache") != "HIT" {
+		t.Errorf("missing file: got %s, X-Cache %q", res.Status, res.Header.Get("X-Cache"))
+	}
+	if reg.hits("/left-pad") != packuments {
+		t.Errorf("a probe asked the registry")
+	}
+}
+
+func TestProbeTags(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "1"})
+	reg.publish("left-pad", "1.1.0", map[string]string{"index.js": "1.1"})
+	reg.tag("left-pad", "stable", "1.0.0")
+	reg.publish("right-pad", "2.0.0", map[string]string{"index.js": "2"})
+	s := newTestServer(t, reg, nil)
+	s.follow(s.get("/npm/left-pad@1.0.0/index.js"), 302)
+
+	for _, tc := range []struct {
+		path    string
+		status  int
+		cache   string
+		version string
+	}{
+		// Resolved with the packument cached by the GET.
+		{"/npm/left-pad@stable", 200, "HIT", "1.0.0"},
+		{"/npm/left-pad@~1.0.0", 200, "HIT", "1.0.0"},
+		{"/npm/left-pad/stable/index.js", 200, "HIT", "1.0.0"},
+		{"/npm/left-pad@latest", 404, "MISS", "1.1.0"},
+		{"/npm/left-pad@^1", 404, "MISS", "1.1.0"},
+		{"/npm/left-pad@no-such-tag", 404, "MISS", ""},
+		// Nothing cached of right-pad: only the registry knows its tags.
+		{"/npm/right-pad@latest", 404, "MISS", ""},
+		{"/npm/right-pad@latest?resolve=remote", 404, "MISS", "2.0.0"},
+	} {
+		res := s.request(http.MethodHead, tc.path, nil)
+		if res.StatusCode != tc.status || res.Header.Get("X-Cache") != tc.cache || res.Header.Get("X-Resolved-Version") != tc.version {
+			t.Errorf("%s: got %s, X-Cache %q, X-Resolved-Version %q; want %d, %q, %q", tc.path,
+				res.Status, res.Header.Get("X-Cache"), res.Header.Get("X-Resolved-Version"), tc.status, tc.cache, tc.version)
+		}
+	}
+	if reg.hits("/right-pad") != 1 {
+		t.Errorf("right-pad's packument was fetched %d times, want once, for ?resolve=remote", reg.hits("/right-pad"))
+	}
+	for _, tarball := range []string{tarballPath("left-pad", "1.1.0"), tarballPath("right-pad", "2.0.0")} {
+		if reg.hits(tarball) != 0 {
+			t.Errorf("%s was downloaded", tarball)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// npmUser is a publisher or maintainer, as packuments list them.
+type npmUser struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// Provenance is where a version's attestations are, and, with
+// config.VerifyProvenance, how checking its SLSA provenance went.
+type Provenance struct {
+	URL           string           `json:"url"`
+	PredicateType string           `json:"predicateType,omitempty"`
+	Check         *ProvenanceCheck `json:"check,omitempty"`
+}
+
+// ProvenanceCheck is the outcome of checking a provenance bundle: "verified"
+// when its statement names the tarball, its signature is valid and its
+// certificate chains to config.ProvenanceRoots, "signed" for the same
+// without roots to chain to, and "failed" or "error" (the attestations
+// couldn't be had) otherwise. The transparency log isn't checked.
+type ProvenanceCheck struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Identity  string    `json:"identity,omitempty"` // the certificate's, such as a workflow URL
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// The predicate type of SLSA provenance, among the attestations npm keeps.
+const slsaPredicatePrefix = "https://slsa.dev/provenance/"
+
+var provenanceChecks = newCounter("repkg_provenance_checks_total", "Provenance bundles checked, by status.")
+
+// ownership returns what the packument tells of who published a version and
+// where its provenance is; nil for registries that tell nothing.
+func (pv *PackumentVersion) ownership() (publisher *npmUser, maintainers []npmUser, provenance *Provenance) {
+	if pv.NPMUser != nil && pv.NPMUser.Name != "" {
+		publisher = pv.NPMUser
+	}
+	if a := pv.Dist.Attestations; a != nil && a.URL != "" {
+		provenance = &Provenance{URL: a.URL, PredicateType: a.Provenance.PredicateType}
+	}
+	if len(pv.Maintainers) > 0 {
+		maintainers = pv.Maintainers
+	}
+	return publisher, maintainers, provenance
+}
+
+// recordOwnership fills in the publisher, maintainers and provenance of a
+// manifest that has none from its packument version, checking the
+// provenance with config.VerifyProvenance. It reports whether it did.
+func recordOwnership(t *tenant, m *Manifest, pv *PackumentVersion) bool {
+	if m.Publisher != nil || m.Maintainers != nil || m.Provenance != nil {
+		return false
+	}
+	publisher, maintainers, provenance := pv.ownership()
+	if publisher == nil && maintainers == nil && provenance == nil {
+		return false
+	}
+	if provenance != nil && config.VerifyProvenance {
+		provenance.Check = checkProvenance(t, pv, provenance)
+	}
+	m.Publisher, m.Maintainers, m.Provenance = publisher, maintainers, provenance
+	return true
+}
+
+// dsseEnvelope is a signed in-toto statement.
+type dsseEnvelope struct {
+	Payload     string `json:"payload"`
+	PayloadType string `json:"payloadType"`
+	Signatures  []struct {
+		Sig string `json:"sig"`
+	} `json:"signatures"`
+}
+
+type sigstoreBundle struct {
+	VerificationMaterial struct {
+		Certificate *struct {
+			RawBytes string `json:"rawBytes"`
+		} `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []struct {
+				RawBytes string `json:"rawBytes"`
+			} `json:"certificates"`
+		} `json:"x509CertificateChain"`
+		TlogEntries []struct {
+			IntegratedTime string `json:"integratedTime"`
+		} `json:"tlogEntries"`
+	} `json:"verificationMaterial"`
+	DSSEEnvelope dsseEnvelope `json:"dsseEnvelope"`
+}
+
+// checkProvenance fetches a version's attestations and checks its SLSA
+// provenance against the tarball's integrity. It never fails the fetch.
+func checkProvenance(t *tenant, pv *PackumentVersion, p *Provenance) *ProvenanceCheck {
+	check := &ProvenanceCheck{CheckedAt: time.Now().UTC()}
+	bundle, err := fetchProvenance(t, p.URL)
+	if err == nil {
+		check.Identity, err = verifyProvenance(pv, bundle)
+		check.Status = "signed"
+		if err == nil && provenanceRoots() != nil {
+			check.Status = "verified"
+		}
+		if err != nil {
+			check.Status, check.Error = "failed", err.Error()
+		}
+	} else {
+		check.Status, check.Error = "error", err.Error()
+	}
+	if check.Error != "" {
+		log.Printf("provenance of %s@%s: %s: %s", pv.Name, pv.Version, check.Status, check.Error)
+	}
+	provenanceChecks.Inc("status", check.Status)
+	return check
+}
+
+func fetchProvenance(t *tenant, URL string) (*sigstoreBundle, error) {
+	u, err := url.Parse(URL)
+	if err != nil || !allowedUpstream(u) {
+		return nil, errUpstreamForbidden
+	}
+	req, err := newUpstreamRequest(t, http.MethodGet, URL)
+	if err != nil {
+		return nil, err
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("attestations: registry responded %s", res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Attestations []struct {
+			PredicateType string         `json:"predicateType"`
+			Bundle        sigstoreBundle `json:"bundle"`
+		} `json:"attestations"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("parsing attestations: %w", err)
+	}
+	for _, a := range doc.Attestations {
+		if strings.HasPrefix(a.PredicateType, slsaPredicatePrefix) {
+			return &a.Bundle, nil
+		}
+	}
+	return nil, errors.New("no SLSA provenance among the attestations")
+}
+
+// verifyProvenance checks that a bundle's statement is about pv's tarball
+// and that it is signed by the bundle's certificate, valid when the log
+// recorded it. It returns the certificate's identity.
+func verifyProvenance(pv *PackumentVersion, b *sigstoreBundle) (string, error) {
+	env := b.DSSEEnvelope
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return "", fmt.Errorf("decoding the statement: %w", err)
+	}
+	var statement struct {
+		Subject []struct {
+			Name   string            `json:"name"`
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+	}
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return "", fmt.Errorf("parsing the statement: %w", err)
+	}
+	algo, want, ok := strings.Cut(pv.Dist.Integrity, "-")
+	sum, derr := base64.StdEncoding.DecodeString(want)
+	if !ok || algo != "sha512" || derr != nil {
+		return "", errors.New("the version has no sha512 integrity to check the statement against")
+	}
+	purl := "pkg:npm/" + strings.Replace(pv.Name, "@", "%40", 1) + "@" + pv.Version
+	subject := false
+	for _, s := range statement.Subject {
+		if s.Name == purl && s.Digest["sha512"] == hex.EncodeToString(sum) {
+			subject = true
+		}
+	}
+	if !subject {
+		return "", fmt.Errorf("the statement isn't about %s with this tarball", purl)
+	}
+
+	cert, intermediates, err := b.certificates()
+	if err != nil {
+		return "", err
+	}
+	identity := ""
+	if len(cert.URIs) > 0 {
+		identity = cert.URIs[0].String()
+	}
+	if len(b.VerificationMaterial.TlogEntries) == 0 {
+		return identity, errors.New("no transparency log entry to date the signature")
+	}
+	secs, err := strconv.ParseInt(b.VerificationMaterial.TlogEntries[0].IntegratedTime, 10, 64)
+	if err != nil {
+		return identity, fmt.Errorf("invalid integrated time: %w", err)
+	}
+	signedAt := time.Unix(secs, 0)
+	if signedAt.Before(cert.NotBefore) || signedAt.After(cert.NotAfter) {
+		return identity, fmt.Errorf("the certificate wasn't valid at %s", signedAt.UTC().Format(time.RFC3339))
+	}
+	if roots := provenanceRoots(); roots != nil {
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: signedAt, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}}
+		if _, err := cert.Verify(opts); err != nil {
+			return identity, fmt.Errorf("the certificate doesn't chain to provenanceRoots: %w", err)
+		}
+	}
+
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return identity, errors.New("the certificate's key isn't ECDSA")
+	}
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(env.PayloadType), env.PayloadType, len(payload)))
+	pae = append(pae, payload...)
+	var digest []byte
+	if key.Curve == elliptic.P384() {
+		d := sha512.Sum384(pae)
+		digest = d[:]
+	} else {
+		d := sha256.Sum256(pae)
+		digest = d[:]
+	}
+	for _, sig := range env.Signatures {
+		raw, err := base64.StdEncoding.DecodeString(sig.Sig)
+		if err == nil && ecdsa.VerifyASN1(key, digest, raw) {
+			return identity, nil
+		}
+	}
+	return identity, errors.New("no valid signature on the statement")
+}
+
+// certificates returns the signing certificate of a bundle and the ones
+// that came with it.
+func (b *sigstoreBundle) certificates() (*x509.Certificate, *x509.CertPool, error) {
+	var raws []string
+	if c := b.VerificationMaterial.Certificate; c != nil {
+		raws = append(raws, c.RawBytes)
+	}
+	if chain := b.VerificationMaterial.X509CertificateChain; chain != nil {
+		for _, c := range chain.Certificates {
+			raws = append(raws, c.RawBytes)
+		}
+	}
+	if len(raws) == 0 {
+		return nil, nil, errors.New("the bundle has no certificate")
+	}
+	pool := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, raw := range raws {
+		der, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding a certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing a certificate: %w", err)
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			pool.AddCert(cert)
+		}
+	}
+	return leaf, pool, nil
+}
+
+var (
+	provenanceRootsOnce sync.Once
+	provenanceRootPool  *x509.CertPool
+)
+
+// provenanceRoots returns the certificates of config.ProvenanceRoots, nil
+// when there are none.
+func provenanceRoots() *x509.CertPool {
+	provenanceRootsOnce.Do(func() {
+		if config.ProvenanceRoots == "" {
+			return
+		}
+		data, err := os.ReadFile(config.ProvenanceRoots)
+		if err != nil {
+			log.Printf("provenance: %s", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bytes.TrimSpace(data)) {
+			log.Printf("provenance: no certificates in %s", config.ProvenanceRoots)
+			return
+		}
+		provenanceRootPool = pool
+	})
+	return provenanceRootPool
+}
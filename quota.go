@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of config.QuotaPolicy.
+const (
+	quotaFail  = "fail"
+	quotaEvict = "evict"
+)
+
+// Quota keys name either a scope ("@web"), counted separately in each
+// tenant, or a whole tenant ("tenant:web", "tenant:default").
+const tenantQuotaPrefix = "tenant:"
+
+// quotaSet holds the quotas in force. It is kept apart from config so that
+// a reload can replace it while requests are being served.
+type quotaSet struct {
+	mu     sync.RWMutex
+	limits map[string]int64
+	policy string
+}
+
+var (
+	quotas = &quotaSet{}
+
+	// quotaMu makes checking a quota and committing the version it was
+	// checked for one step, so concurrent fetches can't both fit.
+	quotaMu sync.Mutex
+
+	quotaRejections = newCounter("repkg_quota_rejections_total", "Versions refused for going over a quota.")
+	quotaEvictions  = newCounter("repkg_quota_evictions_total", "Versions evicted to make room within a quota.")
+)
+
+func (q *quotaSet) set(limits map[string]int64, policy string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits, q.policy = limits, policy
+}
+
+func (q *quotaSet) get() (map[string]int64, string) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.limits, q.policy
+}
+
+// validQuotaKey accepts "@scope" and "tenant:<name>" for a configured
+// tenant or "default".
+func validQuotaKey(key string, cfg Config) bool {
+	if name, ok := strings.CutPrefix(key, tenantQuotaPrefix); ok {
+		_, configured := cfg.Tenants[name]
+		return configured || name == "default"
+	}
+	return strings.HasPrefix(key, "@") && !strings.Contains(key, "/") && validPackageName(key+"/x")
+}
+
+// quotaKeys returns the keys a version of packageName in t is counted
+// under.
+func quotaKeys(t *tenant, packageName string) []string {
+	keys := []string{tenantQuotaPrefix + t.label()}
+	if scope, _, ok := strings.Cut(packageName, "/"); ok && strings.HasPrefix(scope, "@") {
+		keys = append(keys, scope)
+	}
+	return keys
+}
+
+// inQuota reports whether a cached version counts against a quota key
+// within t.
+func inQuota(e indexEntry, t *tenant, key string) bool {
+	if e.tenant != t {
+		return false
+	}
+	if strings.HasPrefix(key, tenantQuotaPrefix) {
+		return true
+	}
+	return strings.HasPrefix(e.Name, key+"/")
+}
+
+// quotaUsage is what t has stored under each quota that applies to it.
+type quotaUsage struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+	Limit int64  `json:"limit"`
+}
+
+// quotaUsageFor reports the usage of every configured quota within t.
+func quotaUsageFor(t *tenant) []quotaUsage {
+	limits, _ := quotas.get()
+	list := []quotaUsage{}
+	for key, limit := range limits {
+		if name, ok := strings.CutPrefix(key, tenantQuotaPrefix); ok && name != t.label() {
+			continue
+		}
+		list = append(list, quotaUsage{Key: key, Bytes: index.quotaBytes(t, key), Limit: limit})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// checkQuota makes room for a version of size bytes within every quota it
+// falls under, evicting the quota's own least recently requested versions
+// with the evict policy, or refuses it with a 507. It must be called with
+// quotaMu held until the version is in the index.
+func checkQuota(t *tenant, packageName, version string, size int64) error {
+	limits, policy := quotas.get()
+	for _, key := range quotaKeys(t, packageName) {
+		limit, ok := limits[key]
+		if !ok {
+			continue
+		}
+		used := index.quotaBytes(t, key)
+		if used+size > limit && policy == quotaEvict && size <= limit {
+			used -= evictWithin(t, key, used+size-limit)
+		}
+		if used+size > limit {
+			quotaRejections.Inc()
+			err := newError(http.StatusInsufficientStorage, codeQuotaExceeded, "%s@%s (%s) doesn't fit in the %s quota of %s, %s of which is used", packageName, version, formatBytes(size), key, formatBytes(limit), formatBytes(used))
+			err.Details = map[string]any{"quota": key, "size": size, "used": used, "limit": limit}
+			return err
+		}
+	}
+	return nil
+}
+
+// evictWithin removes t's versions counted under key, least recently
+// requested first, until at least need bytes are freed, and returns how
+// many were.
+func evictWithin(t *tenant, key string, need int64) int64 {
+	evictMu.Lock()
+	defer evictMu.Unlock()
+
+	var candidates []packageUsage
+	for _, p := range withUsage(index.entriesFor(t)) {
+		if inQuota(p.indexEntry, t, key) {
+			candidates = append(candidates, p)
+		}
+	}
+	lastUsed := func(p packageUsage) time.Time {
+		if p.LastSeen != nil {
+			return *p.LastSeen
+		}
+		return p.CachedAt
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return lastUsed(candidates[i]).Before(lastUsed(candidates[j])) })
+
+	var freed int64
+	for _, c := range candidates {
+		if freed >= need {
+			break
+		}
+		if c.Pinned || time.Since(c.CachedAt) < evictGrace {
+			continue
+		}
+		if err := removeVersion(c.tenant, c.Name, c.Version); err != nil {
+			log.Printf("quota: evicting %s@%s: %s", c.Name, c.Version, err)
+			continue
+		}
+		log.Printf("quota: evicted %s@%s from %s (%d bytes)", c.Name, c.Version, key, c.Size)
+		quotaEvictions.Inc()
+		emitVersionEvent(c.tenant, eventVersionEvicted, c.Name, c.Version)
+		freed += c.Size
+	}
+	return freed
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Readiness states, as /api/ready reports them.
+const (
+	stateStarting = "starting"
+	stateReady    = "ready"
+	stateStopping = "stopping"
+)
+
+var readiness atomic.Value
+
+func init() {
+	readiness.Store(stateStarting)
+}
+
+// serveReady handles /api/ready, which only succeeds between the data dir
+// sweep and the start of a shutdown, for orchestrators to route requests
+// by. /api/health is the liveness check.
+func serveReady(c *gin.Context) {
+	state := readiness.Load().(string)
+	status := http.StatusOK
+	if state != stateReady {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"status": state})
+}
+
+// startupHandler answers while NewServer sweeps the data dir, which can
+// take a while on a large one, so that the process is seen to be alive.
+// Everything but /api/health is a 503 until it is given the server.
+type startupHandler struct {
+	next atomic.Pointer[http.Handler]
+}
+
+func (s *startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if next := s.next.Load(); next != nil {
+		(*next).ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	switch r.URL.Path {
+	case "/api/health":
+		json.NewEncoder(w).Encode(map[string]string{"status": stateStarting})
+	case "/api/ready":
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": stateStarting})
+	default:
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"code": codeStarting, "error": "repkg is starting: the data dir is being read"})
+	}
+}
+
+func (s *startupHandler) serve(h http.Handler) {
+	s.next.Store(&h)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of config.Refresh.
+const (
+	refreshOff   = "off"
+	refreshAdmin = "admin"
+	refreshOn    = "on"
+)
+
+// At most this many forced refreshes are let through per minute, whatever
+// the packages.
+const maxRefreshesPerMinute = 30
+
+var (
+	refreshMu   sync.Mutex
+	lastRefresh = map[string]time.Time{} // by tenant-qualified package name
+	recentRuns  []time.Time
+
+	// swapping holds the version directories being replaced by a
+	// refresh, each with a channel closed once the new one is in place.
+	swapping sync.Map
+
+	refreshes = newCounter("repkg_refreshes_total", "Forced refreshes of cached versions, by result.")
+)
+
+// wantsRefresh reports whether a request asks for the cached version to be
+// fetched again, with "Cache-Control: no-cache" or "X-Repkg-Refresh: 1".
+func wantsRefresh(r *http.Request) bool {
+	if r.Header.Get("X-Repkg-Refresh") == "1" {
+		return true
+	}
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshAllowed applies config.Refresh and config.RefreshOrigins to a
+// request asking for a refresh. The admin token is always enough.
+func refreshAllowed(r *http.Request) bool {
+	switch {
+	case config.Refresh == refreshOff:
+		return false
+	case isAdmin(r):
+		return true
+	case config.Refresh == refreshAdmin:
+		return false
+	}
+	if len(config.RefreshOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if u, err := url.Parse(r.Referer()); err == nil && u.Host != "" {
+			origin = u.Scheme + "://" + u.Host
+		}
+	}
+	return slices.Contains(config.RefreshOrigins, origin)
+}
+
+// takeRefresh reports whether a package of t may be refreshed now: once
+// per config.RefreshInterval per package, and maxRefreshesPerMinute in
+// all, so refreshes can't be used to hammer the registry.
+func takeRefresh(t *tenant, packageName string) bool {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	now := time.Now()
+	key := t.qualify(packageName)
+	if last, ok := lastRefresh[key]; ok && now.Sub(last) < config.RefreshInterval.Duration {
+		return false
+	}
+	recentRuns = slices.DeleteFunc(recentRuns, func(at time.Time) bool { return now.Sub(at) >= time.Minute })
+	if len(recentRuns) >= maxRefreshesPerMinute {
+		return false
+	}
+	for k, last := range lastRefresh {
+		if now.Sub(last) >= config.RefreshInterval.Duration {
+			delete(lastRefresh, k)
+		}
+	}
+	lastRefresh[key] = now
+	recentRuns = append(recentRuns, now)
+	return true
+}
+
+// checkRefresh decides whether an /npm request refreshes the package,
+// reporting the outcome in X-Repkg-Refresh. Refused or throttled
+// refreshes are served from the cache as usual.
+func checkRefresh(c *gin.Context, t *tenant, packageName string) bool {
+	if !wantsRefresh(c.Request) {
+		return false
+	}
+	result := "refreshed"
+	switch {
+	case config.ReadOnly || !refreshAllowed(c.Request):
+		result = "denied"
+	case !takeRefresh(t, packageName):
+		result = "throttled"
+	}
+	refreshes.Inc("result", result)
+	if result != "denied" {
+		c.Header("X-Repkg-Refresh", result)
+	}
+	return result == "refreshed"
+}
+
+// swapVersion replaces the cached version in old with the one staged in
+// src, placed at dir: old itself, or the directory in another registry's
+// partition when the version now comes from there. Requests that miss the
+// directory while it is swapped wait for waitForSwap; files already being
+// served keep their old content.
+func swapVersion(t *tenant, name, version, src, old, dir string) error {
+	done := make(chan struct{})
+	swapping.Store(old, done)
+	swapping.Store(dir, done)
+	defer func() {
+		swapping.Delete(old)
+		swapping.Delete(dir)
+		close(done)
+	}()
+
+	staging, err := newStagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Rename(old, filepath.Join(staging, "version")); err != nil {
+		return err
+	}
+	if err := makeParents(dir, func() error { return os.Rename(src, dir) }); err != nil {
+		os.Rename(filepath.Join(staging, "version"), old)
+		return err
+	}
+	if old != dir {
+		pruneEmptyParents(old, t.dataDir())
+	}
+
+	manifests.Delete(old)
+	hotCache.invalidateVersion(old)
+	derived := derivedDir(t, name, version)
+	index.removeFiles(derived)
+	return os.RemoveAll(derived)
+}
+
+// waitForSwap waits for a refresh replacing dir, if one is under way, and
+// reports whether there was one.
+func waitForSwap(dir string) bool {
+	done, ok := swapping.Load(dir)
+	if !ok {
+		return false
+	}
+	<-done.(chan struct{})
+	return true
+}
@@ -6,18 +6,26 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/walle/targz"
 )
 
+// PackageInfo is Verdaccio's sidebar for a package. Releases disagree on
+// where the latest version is: in "dist-tags", in a top-level "latest"
+// version, or only in the list of "versions".
 type PackageInfo struct {
 	ID          string `json:"_id"`
 	Name        string `json:"name"`
@@ -25,46 +33,89 @@ type PackageInfo struct {
 	DistTags    struct {
 		Latest string `json:"latest"`
 	} `json:"dist-tags"`
+	Latest   json.RawMessage `json:"latest"`
+	Versions json.RawMessage `json:"versions"`
 }
 
-func main() {
-	r := gin.Default()
-	r.Use(cors.New(cors.Config{
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-		AllowHeaders:     []string{"Authorization", "Origin", "Content-Length", "Content-Type"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-		AllowAllOrigins:  true,
-	}))
-
-	r.StaticFS("/packages", http.Dir("./packages"))
+// latest returns the latest version the sidebar names, and which of its
+// shapes it came from.
+func (p *PackageInfo) latest() (version, format string) {
+	if p.DistTags.Latest != "" {
+		return p.DistTags.Latest, "dist-tags"
+	}
+	if v := sidebarVersion(p.Latest); v != "" {
+		return v, "latest"
+	}
 
-	r.GET("/npm/:scope/:name/*version", func(c *gin.Context) {
-		scope := c.Param("scope")
-		name := c.Param("name")
-		version := c.Param("version")
-		packageName := scope + "/" + name
+	var versions []string
+	var list []json.RawMessage
+	var byVersion map[string]json.RawMessage
+	if json.Unmarshal(p.Versions, &list) == nil {
+		for _, raw := range list {
+			versions = append(versions, sidebarVersion(raw))
+		}
+	} else if json.Unmarshal(p.Versions, &byVersion) == nil {
+		for v := range byVersion {
+			versions = append(versions, v)
+		}
+	}
 
-		if len(version) < 2 {
-			version, _ = findPackageInfo(scope, name)
+	// The highest release listed, or the highest prerelease if that's all
+	// there is.
+	var best semver
+	found := false
+	for _, s := range versions {
+		v, ok := parseSemver(s)
+		if !ok {
+			continue
+		}
+		if release, bestRelease := len(v.Pre) == 0, len(best.Pre) == 0; !found || release && !bestRelease || release == bestRelease && v.compareBuild(best) > 0 {
+			best, found = v, true
 		}
+	}
+	if !found {
+		return "", ""
+	}
+	return best.String(), "versions"
+}
 
-		fetchPackage(packageName, version)
-		fmt.Println("Package downloaded and extracted")
+// sidebarVersion reads a version given as a string or as an object with a
+// "version".
+func sidebarVersion(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var v struct {
+		Version string `json:"version"`
+	}
+	json.Unmarshal(raw, &v)
+	return v.Version
+}
 
-		// graceful restart or stop
-		// https://gin-gonic.com/docs/examples/graceful-restart-or-stop/
+var deny *denylist
 
-		if _, err := os.Stat("packages/" + packageName); os.IsNotExist(err) {
-			c.Redirect(http.StatusFound, "/packages/"+packageName+"@"+version)
-		} else {
-			c.String(http.StatusOK, "Hello %s", name)
-		}
-	})
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		runDoctor()
+		return
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+
+	// Kubernetes only sends SIGTERM, and as PID 1 nothing is done about
+	// signals that aren't handled.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
+	// The port is open while the data dir is swept, for liveness checks.
+	startup := &startupHandler{}
 	srv := &http.Server{
-		Addr:    ":8001",
-		Handler: r,
+		Addr:    cfg.Addr,
+		Handler: startup,
 	}
 
 	go func() {
@@ -74,36 +125,441 @@ func main() {
 		}
 	}()
 
+	handler, err := NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	startup.serve(handler)
+	if info, err := json.Marshal(currentBuildInfo()); err == nil {
+		log.Printf("starting repkg: %s", info)
+	}
+	if config.ReadOnly {
+		if config.ReplicaRefresh.Duration > 0 {
+			go runReplicaRefresh(config.ReplicaRefresh.Duration)
+		}
+	} else {
+		go runMaintenance()
+		go updateAllAliases()
+		go warmStart()
+		go resumeVerification()
+		if config.WithdrawalCheckInterval.Duration > 0 {
+			go runWithdrawalChecks(config.WithdrawalCheckInterval.Duration)
+		}
+		if config.StatsSnapshotInterval.Duration > 0 {
+			go runStatsSnapshots(config.StatsSnapshotInterval.Duration)
+		}
+	}
+	if config.OTLPEndpoint != "" {
+		go traces.run()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
-	// kill (no param) default send syscanll.SIGTERM
-	// kill -2 is syscall.SIGINT
-	// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	// a timeout of config.ShutdownTimeout.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
 	<-quit
 	log.Println("Shutdown Server ...")
+	readiness.Store(stateStopping)
+	events.close()
+	if d := config.ShutdownDelay.Duration; d > 0 {
+		log.Printf("waiting %s for load balancers to stop sending requests", d)
+		time.Sleep(d)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+		// What was counted is saved all the same.
+		log.Printf("Server Shutdown: %s", err)
 	}
-	select {
-	case <-ctx.Done():
-		log.Println("timeout of 5 seconds.")
+	traces.flush()
+	if !config.ReadOnly {
+		if err := usage.flush(); err != nil {
+			log.Printf("usage: %s", err)
+		}
+		if err := downloads.flush(); err != nil {
+			log.Printf("downloads: %s", err)
+		}
+		if err := saveWarmStart(); err != nil {
+			log.Printf("warm start: %s", err)
+		}
 	}
 	log.Println("Server exiting")
 }
 
-func findPackageInfo(scope string, name string) (version string, err error) {
-	npmApi := "http://localhost:4873/-/verdaccio/data/sidebar/" + scope + "/" + name
+// NewServer sets repkg up to run with cfg, sweeping its data dir and
+// loading the saved request counts, and returns the router. The periodic
+// maintenance, warm start and withdrawal checks are left to the caller,
+// so that tests can drive a server with httptest alone.
+func NewServer(cfg Config) (http.Handler, error) {
+	config = cfg
+	deny = newDenylist(config)
+	tenants = setupTenants(config)
+	logIntegrityPolicies(config)
+	quotas.set(config.Quotas, config.QuotaPolicy)
+	headerRules.set(config)
+	hotCache.configure(config.HotCacheMaxBytes, config.HotCacheMaxFileSize)
+	if config.OTLPEndpoint != "" {
+		traces.exporter = newOTLPExporter(config.OTLPEndpoint)
+	}
+	var err error
+	// Checked here too, for configs that didn't come from readConfig: a
+	// bad entry must not leave the allowlist empty, and so open.
+	if allowedNets, err = parseAllowedIPs(config.AllowedIPs); err != nil {
+		return nil, fmt.Errorf("allowedIPs: %w", err)
+	}
+	if _, err := parseAllowedIPs(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trustedProxies: %w", err)
+	}
+	if v := environmentProxy(); v != "" && config.BlockPrivateNetworks {
+		return nil, fmt.Errorf("blockPrivateNetworks can't be enforced through the proxy of %s; unset one of them", v)
+	}
+	if signer, err = loadSigningKeys(config); err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	if err := sweepDataDir(); err != nil {
+		return nil, fmt.Errorf("data dir: %w", err)
+	}
+	if err := usage.load(); err != nil {
+		return nil, fmt.Errorf("usage: %w", err)
+	}
+	if err := downloads.load(); err != nil {
+		return nil, fmt.Errorf("downloads: %w", err)
+	}
+	if err := approvals.load(); err != nil {
+		return nil, fmt.Errorf("approvals: %w", err)
+	}
+	if err := events.load(); err != nil {
+		return nil, fmt.Errorf("events: %w", err)
+	}
+	readiness.Store(stateReady)
+	return limitRequests(setupRouter()), nil
+}
+
+// Values of config.PathStyles.
+const (
+	pathStyleJSDelivr = "jsdelivr"
+	pathStyleUnpkg    = "unpkg"
+)
+
+func pathStyle(style string) bool {
+	return slices.Contains(config.PathStyles, style)
+}
+
+// First path segments of the routes below, which unpkg-style paths never
+// shadow.
+var reservedPrefixes = map[string]bool{"packages": true, "npm": true, "hash": true, "api": true, "metrics": true}
+
+func setupRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(accessLog), gin.Recovery())
+	if len(config.TrustedProxies) > 0 {
+		// Checked by NewServer.
+		r.SetTrustedProxies(config.TrustedProxies)
+	}
+	r.Use(allowIPs)
+	r.Use(cors.New(cors.Config{
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowHeaders:     []string{"Authorization", "Origin", "Content-Length", "Content-Type", "Content-Encoding", "X-Api-Key", "X-Repkg-Key", "X-Request-Id", "traceparent"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+		AllowAllOrigins:  true,
+	}))
+	r.Use(requestIDs)
+	r.Use(traceRequests)
+	r.Use(selectTenant)
+	r.Use(requireAccessKey)
+
+	globalRoutes, tenantRoutes = nil, nil
+	root := router{r, &globalRoutes}
+	root.handle("GET", "/metrics", routeDoc{Description: "Prometheus metrics"}, serveMetrics)
+	root.handle("GET", "/api/health", routeDoc{Description: "ok, or degraded while an upstream circuit is open, with each upstream host's state"}, serveHealth)
+	root.handle("GET", "/api/ready", routeDoc{Description: "200 once serving, 503 while starting or stopping"}, serveReady)
+	root.handle("GET", "/api/version", routeDoc{Description: "the build and the features its config turns on"}, serveVersion)
+	root.handle("GET", "/api/stats/history", routeDoc{
+		Description: "the stats snapshots written every statsSnapshotInterval, oldest first",
+		Params:      []routeParam{inQuery("hours", "how far back, 24 by default")},
+		Auth:        "admin",
+	}, serveStatsHistory)
+	root.handle("POST", "/api/admin/evict", routeDoc{
+		Description: "evicts versions until the cache is within maxCacheBytes",
+		Params:      []routeParam{inQuery("dry-run", "true to only list what would be removed")},
+		Auth:        "admin", Writes: true,
+	}, serveEvict)
+	addRoutes(router{r, &tenantRoutes})
+	if len(tenants) > 0 {
+		addRoutes(router{r.Group("/t/:tenant", requireTenant), nil})
+	}
+	if pathStyle(pathStyleUnpkg) {
+		globalRoutes = append(globalRoutes, routeInfo{"GET", "/*package", unpkgRoute}, routeInfo{"HEAD", "/*package", unpkgRoute})
+	}
+
+	// unpkg-style /<name>@<version>/<file> URLs can't be routed next to
+	// the other routes, so they are whatever else is left, except below
+	// the prefixes of those routes.
+	r.NoRoute(func(c *gin.Context) {
+		first, _, _ := strings.Cut(strings.TrimPrefix(c.Request.URL.Path, "/"), "/")
+		if !pathStyle(pathStyleUnpkg) || reservedPrefixes[first] {
+			return
+		}
+		if _, _, err := parsePackageParams(c.Request.URL.Path); err != nil {
+			return
+		}
+		switch c.Request.Method {
+		case http.MethodGet:
+			serveNpm(c, c.Request.URL.Path)
+		case http.MethodHead:
+			serveProbe(c, c.Request.URL.Path)
+		}
+	})
+
+	return r
+}
+
+// addRoutes registers the routes a tenant has, at the root for the default
+// tenant and below /t/:tenant for the others.
+func addRoutes(r router) {
+	version := inPath("package", "name, then a version, tag or range")
+	file := inPath("package", "name, then a version, tag or range, then the file")
+	cursor := []routeParam{inQuery("cursor", "the nextCursor of the previous page"), inQuery("limit", "entries per page, at most 1000")}
+
+	r.handle("GET", "/api", routeDoc{Description: "this catalogue; paths are relative to basePath"}, serveRoutes)
+	r.handle("GET", "/api/signing-key", routeDoc{Description: "the public keys that X-Repkg-Signature headers are checked with, when signingKey is set"}, serveSigningKey)
+
+	files := routeDoc{
+		Description: "a file of a cached version, or a directory listing",
+		Params:      append([]routeParam{inPath("filepath", "name@version/file")}, cursor...),
+	}
+	r.handle("GET", "/packages/*filepath", files, servePackageFile)
+	r.handle("HEAD", "/packages/*filepath", files, servePackageFile)
+	hashed := routeDoc{
+		Description: "a file by content, from whichever cached version has it",
+		Params:      []routeParam{inPath("sha256", "the file's SHA-256, in hex"), inPath("filename", "its base name")},
+	}
+	r.handle("GET", "/hash/:sha256/:filename", hashed, serveHashed)
+	r.handle("HEAD", "/hash/:sha256/:filename", hashed, serveHashed)
+
+	r.handle("GET", "/npm/*package", routeDoc{
+		Description: "fetches a version and redirects to the file, or to the package entry, manifest or page by Accept",
+		Params: []routeParam{file,
+			inQuery("format", "js, json or html, instead of Accept"),
+			inQuery("bundle", "a single ESM file with the dependencies inlined"),
+			inQuery("external", "with bundle, comma-separated packages left as imports"),
+			inQuery("inline-css", "a stylesheet with the package's own @imports inlined"),
+			inQuery("module", "a JSON file or stylesheet as a JavaScript module, for browsers without import attributes"),
+			inQuery("override", "name@version to pin a package to, repeatable"),
+			inQuery("before", "a date or time to resolve tags and ranges as of"),
+			inQuery("include-prerelease", "true to let ranges take prereleases"),
+			inQuery("env", "production (the default) or development, for export conditions and NODE_ENV in bundles"),
+			inQuery("dts", "redirects to the type declarations instead"),
+			inQuery("ts", "the TypeScript version to apply typesVersions for, the latest by default")},
+	}, func(c *gin.Context) {
+		if p, ok := npmPath(c); ok {
+			serveNpm(c, p)
+		}
+	})
+	r.handle("HEAD", "/npm/*package", routeDoc{
+		Description: "where GET would redirect, without fetching",
+		Params:      []routeParam{file, inQuery("format", "as for GET"), inQuery("env", "as for GET"), inQuery("ts", "as for GET"), inQuery("resolve", "remote to resolve against the registry")},
+	}, func(c *gin.Context) {
+		if p, ok := npmPath(c); ok {
+			serveProbe(c, p)
+		}
+	})
+
+	r.handle("GET", "/api/meta/*package", routeDoc{
+		Description: "a version's manifest, with hashed URLs and peer dependencies",
+		Params: []routeParam{version, inQuery("before", "resolve as of this date or time, and list the versions published by then"),
+			inQuery("include-prerelease", "true to let ranges take prereleases")},
+	}, serveMeta)
+	r.handle("GET", "/api/stats", routeDoc{
+		Description: "disk usage, the largest and most requested versions, and quotas",
+		Params:      []routeParam{inQuery("top", "how many versions to list, 20 by default"), inQuery("registry", "only versions fetched from this registry")},
+	}, serveStats)
+	r.handle("GET", "/api/packages", routeDoc{
+		Description: "the cached versions, with sizes and request counts",
+		Params:      append(cursor, inQuery("top", "the most requested versions instead")),
+	}, servePackages)
+	r.handle("GET", "/api/events", routeDoc{
+		Description: "server-sent events as versions are cached, purged, evicted or withdrawn and tags move, each with package, version and timestamp",
+		Params:      []routeParam{inQuery("lastEventId", "resume after this event, instead of Last-Event-ID")},
+	}, serveEvents)
+	r.handle("GET", "/api/size/*package", routeDoc{Description: "unpacked, gzip and brotli sizes of a version and its entry", Params: []routeParam{version}}, serveSize)
+	r.handle("GET", "/api/downloads/*package", routeDoc{
+		Description: "files of a package served, as npm's downloads API",
+		Params: []routeParam{inPath("package", "name"),
+			inQuery("period", "last-day, last-week (the default), last-month, last-year or start:end"),
+			inQuery("daily", "by day"), inQuery("by", "version, by version")},
+	}, serveDownloads)
+	r.handle("GET", "/api/search/*package", routeDoc{
+		Description: "paths or lines of a cached version that match",
+		Params: []routeParam{version, inQuery("q", "a glob, substring, literal or regular expression"),
+			inQuery("type", "name (the default) or content"), inQuery("regex", "true for a regular expression"), inQuery("limit", "at most 200 results")},
+	}, serveSearch)
+	r.handle("GET", "/api/diff/*package", routeDoc{
+		Description: "files added, removed and modified between two versions",
+		Params: []routeParam{inPath("package", "name, then the two versions"),
+			inQuery("file", "a unified diff of this file instead"), inQuery("fetch", "true to fetch versions that aren't cached")},
+	}, serveDiff)
+	batch := routeDoc{
+		Description: "NDJSON, one line per package@range/file with its metadata and content",
+		Params:      []routeParam{inQuery("paths", "comma-separated, for GET"), inBody(`{"paths": [...]}`)},
+	}
+	r.handle("GET", "/api/batch", batch, serveBatch)
+	r.handle("POST", "/api/batch", batch, serveBatch)
+	r.handle("POST", "/api/resolve", routeDoc{
+		Description: "every package@version a package.json needs",
+		Params: []routeParam{inBody("a package.json or a dependencies map"), inQuery("depth", "how deep to resolve"),
+			inQuery("dev", "true to include devDependencies"), inQuery("prefetch", "true to queue the result"),
+			inQuery("platform", "browser (the default), any or os-cpu")},
+		BulkBody: true,
+	}, serveResolve)
+	r.handle("POST", "/api/normalize", routeDoc{Description: "a package.json with every range pinned to the version served", Params: []routeParam{inBody("a package.json")}, BulkBody: true}, serveNormalize)
+	r.handle("POST", "/api/prefetch", routeDoc{Description: "queues a prefetch job", Params: []routeParam{inBody(`{"packages": ["name@version", ...]}`)}, Writes: true, BulkBody: true}, servePrefetch)
+	r.handle("GET", "/api/prefetch/:id", routeDoc{Description: "a prefetch job's progress", Params: []routeParam{inPath("id", "the job, or warm-start")}}, servePrefetchStatus)
+	r.handle("POST", "/api/hooks/registry", routeDoc{
+		Description: "rechecks a package for withdrawn versions, from a registry webhook",
+		Params:      []routeParam{inBody(`{"name": "..."}`), {"X-Npm-Signature", "header", "sha256=<HMAC of the body>"}},
+		Auth:        "signature", Writes: true,
+	}, serveRegistryHook)
+	pin := inBody(`{"package": "...", "version": "..."}, all versions without one`)
+	r.handle("POST", "/api/admin/pin", routeDoc{Description: "pins or unpins cached versions", Params: []routeParam{pin}, Auth: "admin", Writes: true}, servePin)
+	r.handle("POST", "/api/admin/purge", routeDoc{
+		Description: "removes cached versions",
+		Params: []routeParam{pin, inQuery("dry-run", "true to only list what would be removed"),
+			inQuery("registry", "only versions fetched from this registry, of every package without one")},
+		Auth: "admin", Writes: true,
+	}, servePurge)
+	r.handle("GET", "/api/admin/verify", routeDoc{Description: "the current or last verification run", Auth: "admin"}, serveVerify)
+	r.handle("POST", "/api/admin/verify", routeDoc{
+		Description: "hashes cached files again in the background",
+		Params: []routeParam{pin, inQuery("repair", "true to fetch mismatching versions again"),
+			inQuery("upstream", "true to ask the registry whether tarballs changed, by their ETag")},
+		Auth: "admin", Writes: true,
+	}, serveVerify)
+	r.handle("GET", "/api/admin/doctor", routeDoc{
+		Description: "checks the registry, its credentials and clock, a tarball download, the data dir, its disk and a sample of the cache, with hints for what fails",
+		Params:      []routeParam{inQuery("package", "the package to fetch, is-number by default")},
+		Auth:        "admin",
+	}, serveDoctor)
+	r.handle("POST", "/api/admin/rebuild", routeDoc{
+		Description: "builds a derived artifact again, with the versions its record resolved to, and tells whether the bytes match",
+		Params:      []routeParam{inBody(`{"package", "version", "artifact"}, the artifact named as below /-/`)},
+		Auth:        "admin", Writes: true,
+	}, serveRebuild)
+	r.handle("GET", "/api/admin/failures", routeDoc{Description: "versions that failed to fetch lately", Auth: "admin"}, serveFailures)
+	r.handle("DELETE", "/api/admin/failures/*package", routeDoc{Description: "lets a failing version be fetched again", Params: []routeParam{inPath("package", "name, then version")}, Auth: "admin"}, serveClearFailure)
+	r.handle("GET", "/api/admin/approvals", routeDoc{Description: "packages waiting for approval, and those approved", Auth: "admin"}, serveApprovals)
+	decision := inBody(`{"decision": "approve" or "deny", "range": "...", "fetch": true}`)
+	r.handle("POST", "/api/admin/approvals", routeDoc{
+		Description: "approves a package before it is asked for",
+		Params:      []routeParam{inBody(`{"package": "...", "range": "..."}, every version without one`)},
+		Auth:        "admin", Writes: true,
+	}, serveApprove)
+	r.handle("POST", "/api/admin/approvals/:id", routeDoc{Description: "approves or denies a request", Params: []routeParam{inPath("id", "the request"), decision}, Auth: "admin", Writes: true}, serveApprove)
+}
+
+// npmPath returns the package path of an /npm request. Without the
+// jsdelivr path style, name@version paths are answered with a 404.
+func npmPath(c *gin.Context) (string, bool) {
+	p := c.Param("package")
+	if !pathStyle(pathStyleJSDelivr) && versionInName(p) {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "/npm/<name>@<version> paths are not enabled; use /npm/<name>/<version>"))
+		return "", false
+	}
+	return p, true
+}
+
+// serveNpm answers GET /npm/<name>/<version>[/<file>] (p is the part after
+// /npm), fetching the version if needed.
+func serveNpm(c *gin.Context, p string) {
+	packageName, rest, err := parsePackageParams(p)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	version, file := "", ""
+	if len(rest) > 0 {
+		version, file = rest[0], strings.Join(rest[1:], "/")
+	}
+
+	opts := fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), Timing: newFetchTiming(requestSpan(c)), FetchedBy: fetchedBy(c)}
+	if opts.Overrides, err = parseOverrides(c); err != nil {
+		writeError(c, err)
+		return
+	}
+	if opts.Before, err = parseBefore(c); err != nil {
+		writeError(c, err)
+		return
+	}
+	opts.IncludePrerelease = c.Query("include-prerelease") == "true"
+	if opts.Env, err = parseEnv(c); err != nil {
+		writeError(c, err)
+		return
+	}
+	ts, err := parseTSVersion(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	setOverrideHeaders(c, opts.Overrides)
+	opts.Refresh = checkRefresh(c, opts.Tenant, packageName)
+	ep, err := ensurePackage(packageName, version, opts)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	// Only the requested package is refreshed, and resolved as of
+	// ?before= or with prereleases, not what a bundle pulls in.
+	opts.Refresh, opts.Before, opts.IncludePrerelease = false, time.Time{}, false
+
+	if _, ok := c.GetQuery("dts"); ok {
+		serveTypes(c, ep, file, ts)
+		return
+	}
+	if _, ok := c.GetQuery("inline-css"); ok {
+		serveInlineCSS(c, ep, file, opts)
+		return
+	}
+	if _, ok := c.GetQuery("bundle"); ok {
+		serveBundle(c, ep, file, opts)
+		return
+	}
+	if _, ok := c.GetQuery("module"); ok {
+		serveModule(c, ep, file, opts)
+		return
+	}
+	setServerTiming(c.Writer, opts.Timing)
+	if file == "" {
+		servePackageRoot(c, ep, opts.Env)
+		return
+	}
+
+	// graceful restart or stop
+	// https://gin-gonic.com/docs/examples/graceful-restart-or-stop/
+
+	setResolveHeaders(c.Writer, ep)
+	if !isTypesFile(file) {
+		setTypesHeader(c, ep.Manifest, file)
+	}
+	c.Redirect(http.StatusFound, withAccessKey(c, packageURL(opts.Tenant, packageName, ep.Manifest.Version, file)))
+}
+
+func findPackageInfo(t *tenant, packageName string) (version string, err error) {
+	npmApi := t.registry() + "/-/verdaccio/data/sidebar/" + packageName
 
 	client := http.Client{
-		Timeout: time.Second * 2,
+		Transport:     upstreamRoundTripper,
+		CheckRedirect: checkUpstreamRedirect,
+		Timeout:       time.Second * 2,
 	}
 
-	req, err := http.NewRequest(http.MethodGet, npmApi, nil)
+	req, err := newUpstreamRequest(t, http.MethodGet, npmApi)
 	if err != nil {
 		return "", err
 	}
@@ -116,12 +572,22 @@ func findPackageInfo(scope string, name string) (version string, err error) {
 	if res.Body != nil {
 		defer res.Body.Close()
 	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return "", errUpstreamAuth
+	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return "", err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return "", newError(http.StatusBadGateway, codeUpstream, "the registry's sidebar for %s answered %s", packageName, res.Status)
+	}
+
+	if err := checkJSONResponse(t, res, body); err != nil {
+		return "", wrapUpstream(err, "the registry's sidebar for %s", packageName)
+	}
 	pkgInfo := PackageInfo{}
 	err = json.Unmarshal(body, &pkgInfo)
 
@@ -129,82 +595,347 @@ func findPackageInfo(scope string, name string) (version string, err error) {
 		return "", err
 	}
 
-	fmt.Println(pkgInfo.DistTags.Latest)
+	version, format := pkgInfo.latest()
+	if !validVersion(version) {
+		return "", newError(http.StatusBadGateway, codeUpstream, "the registry's sidebar for %s names no latest version", packageName)
+	}
+	log.Printf("sidebar: %s: latest is %s, from %q", packageName, version, format)
 
-	return pkgInfo.DistTags.Latest, nil
+	return version, nil
 }
 
-func fetchPackage(packageName string, packageVersion string) {
-	registryHost := "http://localhost:4873"
-	URL := registryHost + "/" + packageName + "/-/" + packageName + "-" + packageVersion + ".tgz"
-	fileName := "packages/" + packageName + "/" + packageVersion + ".tgz"
-	outputDir := "packages/" + packageName
+func fetchPackage(packageName string, pv *PackumentVersion, opts fetchOptions) error {
+	packageVersion := pv.Version
+	versionDir := versionDir(opts.Tenant, packageName, packageVersion)
 
-	if _, err := os.Stat(outputDir + "@" + packageVersion); os.IsNotExist(err) {
-		fmt.Println("Output directory does not exist, creating...")
-		err := os.MkdirAll(outputDir, 0755)
-		if err != nil {
-			log.Fatal(err)
+	var cached *Manifest
+	if _, err := os.Stat(versionDir); err == nil && opts.Refresh {
+		cached, _ = loadManifest(versionDir, packageName, packageVersion)
+	} else if err == nil {
+		return nil
+	}
+	if config.ReadOnly {
+		return notCached(packageName + "@" + packageVersion)
+	}
+	if cached == nil && !opts.Admin {
+		if err := approvals.check(opts.Tenant, packageName, packageVersion); err != nil {
+			return err
 		}
-	} else {
-		// Early return if package contents already exist
-		fmt.Println("Package and version already exist, nothing to do...")
-		return
 	}
 
-	err := downloadPackage(URL, fileName)
+	// Everything happens in a staging directory that is renamed into place
+	// once complete, so a version directory is never seen half written.
+	staging, err := newStagingDir()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer os.RemoveAll(staging)
+	fileName := filepath.Join(staging, "package.tgz")
+	outputDir := filepath.Join(staging, "contents")
 
-	err = targz.Extract(fileName, outputDir)
+	URL, err := tarballURL(opts.Tenant, packageName, pv)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	limits := limitsFor(opts)
+	if err := limits.check(packageName, packageVersion, pv.Dist.UnpackedSize, pv.Dist.FileCount); err != nil {
+		return err
 	}
 
-	if _, err := os.Stat(outputDir + "/package"); !os.IsNotExist(err) {
-		fmt.Println("Renaming package directory to version...")
-		err := os.Rename(outputDir+"/package", outputDir+"@"+packageVersion)
-		if err != nil {
-			log.Fatal(err)
+	// The tarball can't be larger than what it unpacks to, so its size is
+	// a fallback when the registry doesn't report unpackedSize.
+	ds := opts.Timing.begin("download")
+	ds.set("repkg.package", packageName)
+	ds.set("repkg.version", packageVersion)
+	registry := opts.Tenant.registry()
+	tarballSize, source, origin, err := downloadPackage(opts.Tenant, URL, fileName, limits.Bytes, ds)
+	if fallback, ok := fallbackURL(URL, err); ok {
+		log.Printf("downloading %s@%s from the fallback registry: %s", packageName, packageVersion, err)
+		registry = config.FallbackRegistry
+		tarballSize, source, origin, err = downloadPackage(opts.Tenant, fallback, fileName, limits.Bytes, ds)
+	}
+	registryURL := ""
+	if u, err := url.Parse(registry); err == nil {
+		registryURL = redactURL(u)
+	}
+	ds.set("repkg.bytes", tarballSize)
+	ds.set("repkg.registry", registryURL)
+	ds.fail(err)
+	ds.finish()
+	if errors.Is(err, errStreamLimitExceeded) {
+		return limits.checkStreamed(packageName, packageVersion, tarballSize)
+	}
+	if errors.Is(err, errLimitExceeded) {
+		return limits.check(packageName, packageVersion, tarballSize, 0)
+	}
+	if err != nil {
+		return wrapUpstream(err, "downloading %s@%s", packageName, packageVersion)
+	}
+	log.Printf("downloaded %s@%s from %s (%d bytes%s)", packageName, packageVersion, source, tarballSize, origin.describe())
+
+	vs := opts.Timing.begin("verify")
+	verified, err := verifyIntegrity(fileName, pv)
+	mismatch, err := checkIntegrity(pv, registry, err)
+	if err == nil {
+		if err = verifySignatures(opts.Tenant, pv, pv.Published); err != nil {
+			log.Printf("rejecting %s@%s: %s", packageName, packageVersion, err)
 		}
 	}
+	vs.set("repkg.verified", verified)
+	vs.fail(err)
+	vs.finish()
+	if err != nil {
+		return err
+	}
+	if err := origin.hash(fileName, pv); err != nil {
+		return err
+	}
 
-	// Do not remove downloaded tgz files? I don't know, maybe
+	xs := opts.Timing.begin("extract")
+	defer xs.finish()
+	x := newExtraction(filepath.Join(staging, "aside"))
+	size, files, err := extractTarball(fileName, outputDir, deny, limits, x)
+	if errors.Is(err, errLimitExceeded) {
+		return limits.check(packageName, packageVersion, size, files)
+	}
+	var pathErr *fs.PathError
+	var apiErr *apiError
+	if err != nil && !errors.As(err, &pathErr) && !errors.As(err, &apiErr) {
+		// Not the disk but the tarball, which won't extract any better
+		// next time.
+		return wrapError(http.StatusBadGateway, codeExtractFailed, err, "extracting %s@%s", packageName, packageVersion)
+	}
+	if err != nil {
+		return err
+	}
 
-	err = os.Remove(fileName)
+	root, err := packageRoot(outputDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	err = os.Remove(outputDir)
+
+	prefix, _ := filepath.Rel(outputDir, root)
+	moved, warnings, err := x.place(root, filepath.ToSlash(prefix))
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	m, err := buildManifest(root, packageName, packageVersion, moved)
+	if err != nil {
+		return err
+	}
+	m.Warnings = warnings
+	m.TarballSize = tarballSize
+	m.Upstream = source
+	m.Origin = origin
+	m.Verified = verified
+	m.IntegrityMismatch = mismatch
+	m.Registry = registryURL
+	recordOwnership(opts.Tenant, m, pv)
+	for i, f := range m.Files {
+		if mode, ok := x.modes[path.Join(filepath.ToSlash(prefix), f.Path)]; ok {
+			m.Files[i].Mode = fmt.Sprintf("%04o", mode)
+		}
+	}
+	if err := compressVersion(root, m); err != nil {
+		return err
 	}
+	if err := recordModTimes(root, m); err != nil {
+		return err
+	}
+	if m.SecurityHolder = isSecurityHolder(root, m); m.SecurityHolder {
+		log.Printf("%s@%s is a security holding package", packageName, packageVersion)
+	}
+	if opts.FetchedBy != nil {
+		fb := *opts.FetchedBy
+		fb.At = m.Extracted
+		m.FetchedBy = &fb
+	} else {
+		m.FetchedBy = &FetchedBy{At: m.Extracted}
+	}
+	size = manifestSize(m)
+	if cached != nil {
+		// A refreshed version keeps its pin and where it first came from,
+		// and only grows its quotas by the difference.
+		m.Pinned, m.FetchedBy = cached.Pinned, cached.FetchedBy
+		size -= manifestSize(cached)
+	}
+	if err := writeManifestFile(root, m); err != nil {
+		return err
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if err := checkQuota(opts.Tenant, packageName, packageVersion, size); err != nil {
+		return err
+	}
+	// The version goes in the partition of the registry it came from,
+	// which on a refresh may not be the one it was in.
+	dest := partitionVersionDir(opts.Tenant, registry, packageName, packageVersion)
+	if err := markPartition(opts.Tenant.dataDir(), registry); err != nil {
+		return err
+	}
+	if cached != nil {
+		if err := swapVersion(opts.Tenant, packageName, packageVersion, root, versionDir, dest); err != nil {
+			return err
+		}
+		log.Printf("refreshed %s@%s", packageName, packageVersion)
+	} else if err := makeParents(dest, func() error { return os.Rename(root, dest) }); err != nil {
+		if _, serr := os.Stat(dest); serr == nil {
+			// A concurrent request extracted the same version first.
+			return nil
+		}
+		return err
+	}
+	versionDir = dest
+	xs.set("repkg.files", len(m.Files))
+	xs.set("repkg.warnings", len(warnings))
+	xs.finish()
+	log.Printf("fetched %s@%s: %s", packageName, packageVersion, opts.Timing)
+
+	cacheManifest(versionDir, m)
+	index.addVersion(opts.Tenant, versionDir, m, time.Now())
+	updateAliases(opts.Tenant, packageName, "")
+	if cached == nil {
+		emitVersionEvent(opts.Tenant, eventVersionCached, packageName, packageVersion)
+	}
+	if config.MaxCacheBytes > 0 {
+		go runEviction()
+	}
+	return nil
 }
 
-func downloadPackage(URL, fileName string) error {
-	response, err := http.Get(URL)
+// packageRoot returns the directory holding the package files of an
+// extracted tarball: its single top-level directory (usually "package"),
+// or dir itself for tarballs without one.
+func packageRoot(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return dir, os.MkdirAll(dir, 0755)
+	}
 	if err != nil {
-		return err
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
 	}
+	return dir, nil
+}
 
+// downloadPackage saves a tarball and returns its size, the URL it came
+// from after redirects and the validators it was sent with. It gives up
+// with errLimitExceeded as soon as the tarball is known to exceed
+// maxBytes, when that is not zero. Registries that stream tarballs
+// chunked, without a Content-Length, are held to the limit by the bytes
+// actually read (errStreamLimitExceeded), and their progress is logged in
+// bytes; integrity is checked afterwards either way. Large tarballs from
+// servers that take byte ranges are fetched in parallel segments, or in one
+// stream again if that fails.
+func downloadPackage(t *tenant, URL, fileName string, maxBytes int64, s *span) (int64, string, *TarballOrigin, error) {
+	response, err := getTarball(t, URL, s)
+	if err != nil {
+		return 0, "", nil, err
+	}
 	defer response.Body.Close()
+	source, origin := redactURL(response.Request.URL), tarballOrigin(response)
 
-	if response.StatusCode != 200 {
-		return errors.New("received a non 200 response code")
+	if err := tarballStatus(response); err != nil {
+		return 0, source, origin, err
+	}
+	if maxBytes > 0 && response.ContentLength > maxBytes {
+		return response.ContentLength, source, origin, errLimitExceeded
+	}
+
+	if wantSegments(response) {
+		response.Body.Close()
+		n, err := downloadSegments(t, response.Request.URL, fileName, response.ContentLength, s)
+		if err == nil {
+			segmentedDownloads.Inc("result", "ok")
+			return n, source, origin, checkTarball(t, response, fileName)
+		}
+		segmentedDownloads.Inc("result", "fallback")
+		log.Printf("download: %s: segmented download failed, using one stream: %s", source, err)
+		if response, err = getTarball(t, URL, s); err != nil {
+			return 0, source, origin, err
+		}
+		defer response.Body.Close()
+		source, origin = redactURL(response.Request.URL), tarballOrigin(response)
+		if err := tarballStatus(response); err != nil {
+			return 0, source, origin, err
+		}
 	}
 
 	file, err := os.Create(fileName)
 	if err != nil {
-		return err
+		return 0, source, origin, err
 	}
 
 	defer file.Close()
 
-	_, err = io.Copy(file, response.Body)
+	progress := &progressReader{r: response.Body, source: source, size: response.ContentLength, began: time.Now()}
+	progress.logged = progress.began
+	body := throttleDownload(progress)
+	if maxBytes > 0 {
+		body = io.LimitReader(body, maxBytes+1)
+	}
+	n, err := io.Copy(file, body)
 	if err != nil {
-		return err
+		return n, source, origin, err
+	}
+	if maxBytes > 0 && n > maxBytes {
+		if response.ContentLength < 0 {
+			return n, source, origin, errStreamLimitExceeded
+		}
+		return n, source, origin, errLimitExceeded
 	}
 
+	return n, source, origin, checkTarball(t, response, fileName)
+}
+
+// progressReader logs how far a single-stream download got every
+// downloadProgressInterval, in bytes read, and against the size when the
+// registry sent a Content-Length. Chunked tarballs have none (size is -1).
+type progressReader struct {
+	r      io.Reader
+	source string
+	size   int64
+	read   int64
+
+	began, logged time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if time.Since(p.logged) >= downloadProgressInterval {
+		p.logged = time.Now()
+		rate := formatBytes(int64(float64(p.read) / time.Since(p.began).Seconds()))
+		if p.size < 0 {
+			log.Printf("download: %s: %s of unknown size, %s/s", p.source, formatBytes(p.read), rate)
+		} else {
+			log.Printf("download: %s: %s of %s, %s/s", p.source, formatBytes(p.read), formatBytes(p.size), rate)
+		}
+	}
+	return n, err
+}
+
+func getTarball(t *tenant, URL string, parent *span) (*http.Response, error) {
+	req, err := newUpstreamRequest(t, http.MethodGet, URL)
+	if err != nil {
+		return nil, err
+	}
+	s := traceUpstream(parent, req)
+	res, err := tarballClient.Do(req)
+	s.done(res, err)
+	return res, err
+}
+
+func tarballStatus(response *http.Response) error {
+	if response.StatusCode == http.StatusUnauthorized {
+		return errUpstreamAuth
+	}
+	if response.StatusCode != 200 {
+		return errors.New("received a non 200 response code")
+	}
 	return nil
 }
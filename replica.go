@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A replica (config.ReadOnly) serves a data dir on shared storage that a
+// writer instance fills. It never writes to it: what it would save, such
+// as sizes, is only kept in memory. Everything the writer writes is
+// renamed into place, so the replica sees whole versions or none.
+
+var (
+	replicaMu         sync.Mutex
+	indexRefreshTried time.Time
+	indexRefreshed    time.Time
+	indexRefreshErr   error
+
+	// manifestStats are the sizes and times of the manifests read, by
+	// version dir, to tell which ones the writer has rewritten since.
+	manifestStats = map[string]os.FileInfo{}
+)
+
+// notCached is the error for what a replica doesn't have and won't fetch.
+func notCached(what string) *apiError {
+	return newError(http.StatusNotFound, codeNotCached, "%s is not cached, and this replica doesn't fetch", what)
+}
+
+// writable refuses requests that would change the cache on a replica.
+func writable(c *gin.Context) {
+	if config.ReadOnly {
+		writeError(c, newError(http.StatusForbidden, codeReadOnly, "this replica is read-only; send %s %s to the writer", c.Request.Method, c.Request.URL.Path))
+	}
+}
+
+// redirectToWriter sends a replica's miss to config.WriterURL, keeping the
+// method of requests other than GET and HEAD.
+func redirectToWriter(c *gin.Context) {
+	status := http.StatusFound
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		status = http.StatusTemporaryRedirect
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(status, strings.TrimSuffix(config.WriterURL, "/")+c.Request.URL.RequestURI())
+	c.Abort()
+}
+
+// checkManifest drops what is cached of the version in dir when its
+// manifest changed since it was last read: pinned, withdrawn or refreshed
+// by the writer.
+func checkManifest(dir string) {
+	info, err := os.Stat(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return
+	}
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	if prev, ok := manifestStats[dir]; ok && (!prev.ModTime().Equal(info.ModTime()) || prev.Size() != info.Size()) {
+		manifests.Delete(dir)
+		hotCache.invalidateVersion(dir)
+	}
+	manifestStats[dir] = info
+}
+
+// runReplicaRefresh reads the data dir again every interval, for as long
+// as the process runs.
+func runReplicaRefresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		refreshReplica()
+	}
+}
+
+// refreshReplica rebuilds the index from the data dir, picking up the
+// versions the writer has cached, changed or removed since the last time.
+func refreshReplica() {
+	start := time.Now()
+	ix := newCacheIndex()
+	for _, t := range allTenants() {
+		if err := sweepTenant(t, ix); err != nil {
+			log.Printf("replica: refreshing the index: %s", err)
+			replicaRefreshed(start, err)
+			return
+		}
+	}
+
+	gone := index.replace(ix)
+	for _, e := range gone {
+		manifests.Delete(e.Dir)
+		hotCache.invalidateVersion(e.Dir)
+		usage.forget(e.tenant, e.Name, e.Version)
+	}
+	replicaMu.Lock()
+	for _, e := range gone {
+		delete(manifestStats, e.Dir)
+	}
+	replicaMu.Unlock()
+	// Packuments are read again as they are needed.
+	packumentsMu.Lock()
+	clear(packuments)
+	packumentsMu.Unlock()
+
+	replicaRefreshed(start, nil)
+	if len(gone) > 0 {
+		log.Printf("replica: %d versions are gone from the data dir", len(gone))
+	}
+}
+
+func replicaRefreshed(at time.Time, err error) {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	indexRefreshTried, indexRefreshErr = at, err
+	if err == nil {
+		indexRefreshed = at
+	}
+}
+
+// replicaHealth reports on the index refreshes for /api/health, and
+// whether the index is more than three refreshes behind.
+func replicaHealth() (gin.H, bool) {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	age := time.Since(indexRefreshed)
+	h := gin.H{"refreshed": indexRefreshed, "ageSeconds": int(age.Seconds())}
+	if indexRefreshErr != nil {
+		h["error"] = indexRefreshErr.Error()
+		h["attempted"] = indexRefreshTried
+	}
+	interval := config.ReplicaRefresh.Duration
+	return h, indexRefreshErr == nil && (interval == 0 || age <= 3*interval)
+}
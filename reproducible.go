@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/gin-gonic/gin"
+)
+
+// Derived artifacts are reproducible: built from the same inputs by the
+// same transform version, they come out the same to the byte. Next to each
+// one, <artifact>.meta.json records what it was built from: its spec, the
+// esbuild version and settings, the hash of every file read, the versions
+// the ranges of its imports resolved to and the hashes of the output. POST
+// /api/admin/rebuild builds an artifact again from its record, with the
+// same versions, and tells whether the bytes match.
+
+// buildInputs collects what one build reads. Its methods do nothing on a
+// nil one, so fetches outside of builds don't record anything.
+type buildInputs struct {
+	mu sync.Mutex
+	// files are the hashes of the files read, by name@version/path, and
+	// resolved the versions resolved, by name@spec.
+	files    map[string]string
+	resolved map[string]string
+	settings *buildSettings
+	// pins are the resolutions of an earlier build, to rebuild it with.
+	pins map[string]string
+}
+
+func newBuildInputs(pins map[string]string) *buildInputs {
+	return &buildInputs{files: map[string]string{}, resolved: map[string]string{}, pins: pins}
+}
+
+// pinned is the version name@spec resolved to when the artifact was first
+// built, if it is being rebuilt.
+func (in *buildInputs) pinned(name, spec string) (string, bool) {
+	if in == nil {
+		return "", false
+	}
+	v, ok := in.pins[name+"@"+spec]
+	return v, ok
+}
+
+func (in *buildInputs) resolve(name, spec, version string) {
+	if in == nil {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.resolved[name+"@"+spec] = version
+}
+
+func (in *buildInputs) read(m *Manifest, f *ManifestFile) {
+	if in == nil {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.files[m.Name+"@"+m.Version+"/"+f.Path] = f.SHA256
+}
+
+// build records the settings o builds with.
+func (in *buildInputs) build(o api.BuildOptions) {
+	if in == nil {
+		return
+	}
+	s := settingsOf(o)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.settings = s
+}
+
+// buildSettings are the esbuild options that decide the output bytes.
+type buildSettings struct {
+	Esbuild     string            `json:"esbuild"`
+	Format      string            `json:"format,omitempty"`
+	Platform    string            `json:"platform,omitempty"`
+	Target      string            `json:"target,omitempty"`
+	Minify      bool              `json:"minify"`
+	TreeShaking bool              `json:"treeShaking"`
+	Sourcemap   bool              `json:"sourcemap"`
+	Define      map[string]string `json:"define,omitempty"`
+	Supported   map[string]bool   `json:"supported,omitempty"`
+}
+
+func settingsOf(o api.BuildOptions) *buildSettings {
+	s := &buildSettings{
+		Esbuild:     esbuildVersion(),
+		Format:      []string{"", "iife", "cjs", "esm"}[o.Format],
+		Platform:    []string{"", "browser", "node", "neutral"}[o.Platform],
+		Minify:      o.MinifyWhitespace || o.MinifyIdentifiers || o.MinifySyntax,
+		TreeShaking: o.TreeShaking == api.TreeShakingTrue,
+		Sourcemap:   o.Sourcemap != api.SourceMapNone,
+		Define:      o.Define,
+		Supported:   o.Supported,
+	}
+	switch {
+	case o.Target == api.ESNext:
+		s.Target = "esnext"
+	case o.Target == api.ES5:
+		s.Target = "es5"
+	case o.Target >= api.ES2015:
+		s.Target = "es" + strconv.Itoa(2015+int(o.Target-api.ES2015))
+	}
+	return s
+}
+
+var esbuildVersion = sync.OnceValue(func() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/evanw/esbuild" {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+})
+
+// derivedMeta is the record of how an artifact was built.
+type derivedMeta struct {
+	Spec     *derivedSpec   `json:"spec"`
+	Settings *buildSettings `json:"settings,omitempty"`
+	// Inputs are the files read, in order of path; Resolved the version
+	// each range imported resolved to, by name@range.
+	Inputs   []derivedInput    `json:"inputs"`
+	Resolved map[string]string `json:"resolved,omitempty"`
+	// Outputs are the hashes of the artifact and its source map, by
+	// file name.
+	Outputs map[string]string `json:"outputs"`
+}
+
+type derivedInput struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+func derivedMetaName(name string) string {
+	return name + ".meta.json"
+}
+
+// writeDerivedMeta hashes the artifact at out and its map, and records it
+// with what in collected.
+func writeDerivedMeta(out string, spec *derivedSpec, in *buildInputs) error {
+	meta := &derivedMeta{Spec: spec, Settings: in.settings, Inputs: []derivedInput{}, Outputs: map[string]string{}}
+	for p, sum := range in.files {
+		meta.Inputs = append(meta.Inputs, derivedInput{p, sum})
+	}
+	sort.Slice(meta.Inputs, func(i, j int) bool { return meta.Inputs[i].Path < meta.Inputs[j].Path })
+	if len(in.resolved) > 0 {
+		meta.Resolved = in.resolved
+	}
+	for _, p := range []string{out, out + ".map"} {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) && p != out {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		meta.Outputs[filepath.Base(p)] = hex.EncodeToString(sum[:])
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeDerived(filepath.Join(filepath.Dir(out), derivedMetaName(filepath.Base(out))), data)
+}
+
+// rebuildResult is what POST /api/admin/rebuild reports for an artifact.
+type rebuildResult struct {
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Artifact string `json:"artifact"`
+	// Matched is whether every output came out as the stored one; Outputs
+	// has the hashes of the rebuilt ones. Pinned tells whether imports
+	// resolved to the versions of the record, which artifacts built before
+	// records existed, or importing no ranges, don't have.
+	Matched    bool              `json:"matched"`
+	Pinned     bool              `json:"pinned"`
+	Outputs    map[string]string `json:"outputs"`
+	Mismatches []string          `json:"mismatches,omitempty"`
+}
+
+// serveRebuild handles POST /api/admin/rebuild, building an artifact again
+// in a staging directory, from its spec and with the versions its record
+// resolved to, and comparing the bytes with the stored ones. The stored
+// artifact is left as it was.
+func serveRebuild(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req struct {
+		Package  string `json:"package"`
+		Version  string `json:"version"`
+		Artifact string `json:"artifact"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request"))
+		return
+	}
+	req.Artifact = strings.TrimPrefix(req.Artifact, derivedPrefix)
+	if !validPackageName(req.Package) || !validVersion(req.Version) || req.Artifact == "" ||
+		strings.ContainsAny(req.Artifact, `/\`) || strings.HasPrefix(req.Artifact, ".") {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "package, version and artifact are required"))
+		return
+	}
+	result, err := rebuildArtifact(tenantOf(c), req.Package, req.Version, req.Artifact)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	writeJSON(c, http.StatusOK, result)
+}
+
+func rebuildArtifact(t *tenant, packageName, version, name string) (*rebuildResult, error) {
+	out := derivedPath(t, packageName, version, name)
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(out), derivedSpecName(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, newError(http.StatusNotFound, codeNotFound, "%s@%s has no artifact %s built by transform version %d", packageName, version, name, transformVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	spec := &derivedSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, wrapError(http.StatusInternalServerError, codeInternal, err, "reading the spec of %s", name)
+	}
+	var meta derivedMeta
+	if data, err := os.ReadFile(filepath.Join(filepath.Dir(out), derivedMetaName(name))); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+
+	staging, err := newStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		os.RemoveAll(staging)
+		index.removeFiles(staging)
+	}()
+	rebuilt := filepath.Join(staging, name)
+	opts := fetchOptions{Tenant: t, Admin: true, Timing: newFetchTiming(nil), Inputs: newBuildInputs(meta.Resolved)}
+	err = runTransform(rebuilt, "rebuild", opts.Timing, func() error {
+		return buildDerivedNow(packageName, version, name, rebuilt, spec, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &rebuildResult{Package: packageName, Version: version, Artifact: name, Matched: true, Pinned: meta.Resolved != nil, Outputs: map[string]string{}}
+	for _, f := range []string{name, name + ".map"} {
+		now, err := os.ReadFile(filepath.Join(staging, f))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(now)
+		result.Outputs[f] = hex.EncodeToString(sum[:])
+		if before, err := os.ReadFile(filepath.Join(filepath.Dir(out), f)); err != nil || !bytes.Equal(before, now) {
+			result.Matched = false
+			result.Mismatches = append(result.Mismatches, f)
+		}
+	}
+	return result, nil
+}
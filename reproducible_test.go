@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRebuildTwice(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("app", "1.0.0", map[string]string{
+		"package.json": `{"name": "app", "version": "1.0.0", "main": "index.js", "dependencies": {"pad": "^1.0.0"}}`,
+		"index.js":     `import pad from "pad"; export default function app() { return pad("app"); }`,
+	})
+	reg.publish("pad", "1.0.0", map[string]string{
+		"package.json": `{"name": "pad", "version": "1.0.0", "main": "index.js"}`,
+		"index.js":     `export default function pad(s) { return " " + s; }`,
+	})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.AdminToken = "admin"
+	})
+
+	loc := s.follow(s.get("/npm/app@1.0.0?bundle"), 302)
+	u, _ := strings.CutSuffix(loc, "?tv=3")
+	name := path.Base(u)
+	stored := responseBody(t, s.get(loc), 200)
+	var meta derivedMeta
+	if err := json.Unmarshal([]byte(responseBody(t, s.get(u+".meta.json"), 200)), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Resolved["pad@^1.0.0"] != "1.0.0" {
+		t.Fatalf("resolved %v", meta.Resolved)
+	}
+
+	// A newer pad, which the rebuilds see, doesn't change what the artifact
+	// is rebuilt from.
+	reg.publish("pad", "1.1.0", map[string]string{
+		"package.json": `{"name": "pad", "version": "1.1.0", "main": "index.js"}`,
+		"index.js":     `export default function pad(s) { return "  " + s; }`,
+	})
+	s.cfg.PackumentTTL = duration{}
+	s = s.restart()
+
+	var outputs []map[string]string
+	for i := 0; i < 2; i++ {
+		body := `{"package": "app", "version": "1.0.0", "artifact": "` + name + `"}`
+		var result rebuildResult
+		res := s.request("POST", "/api/admin/rebuild", strings.NewReader(body), "Authorization", "Bearer admin", "Content-Type", "application/json")
+		if err := json.Unmarshal([]byte(responseBody(t, res, 200)), &result); err != nil {
+			t.Fatal(err)
+		}
+		if !result.Matched || !result.Pinned || len(result.Mismatches) != 0 {
+			t.Errorf("rebuild %d: %+v", i+1, result)
+		}
+		if result.Outputs[name] != meta.Outputs[name] || result.Outputs[name+".map"] != meta.Outputs[name+".map"] {
+			t.Errorf("rebuild %d: outputs %v, recorded %v", i+1, result.Outputs, meta.Outputs)
+		}
+		outputs = append(outputs, result.Outputs)
+	}
+	if len(outputs[0]) == 0 || !maps.Equal(outputs[0], outputs[1]) {
+		t.Errorf("rebuilt %v, then %v", outputs[0], outputs[1])
+	}
+
+	// The stored artifact is left as it was.
+	if body := responseBody(t, s.get(loc), 200); body != stored {
+		t.Errorf("the artifact changed:\n%s\nwas\n%s", body, stored)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(s.cfg.DataDir, internalDir, "tmp", "*")); len(staged) != 0 {
+		t.Errorf("left behind: %v", staged)
+	}
+}
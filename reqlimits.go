@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var requestsRejected = newCounter("repkg_requests_rejected_total", "Requests refused before routing for their URL, by reason.")
+
+// limitRequests refuses requests whose URL is over the limits in config
+// before the router, or anything else, looks at them. The error is always
+// JSON, as nothing about the request is trusted enough to render a page.
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason, e := checkRequestURL(r)
+		if e == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		requestsRejected.Inc("reason", reason)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(map[string]string{"code": e.Code, "error": e.Error()})
+	})
+}
+
+// checkRequestURL refuses URLs longer than config.MaxURLLength or with more
+// than MaxPathSegments path segments (414), more than MaxQueryParams query
+// parameters, or control characters in the path or query, percent-encoded
+// or not (400). Zero disables a limit. The cheap checks come first, so
+// nothing is decoded for an oversized URL.
+func checkRequestURL(r *http.Request) (reason string, err *apiError) {
+	if n := len(r.RequestURI); config.MaxURLLength > 0 && n > config.MaxURLLength {
+		return "url_length", newError(http.StatusRequestURITooLong, codeURITooLong, "the URL is %d bytes, over the limit of %d", n, config.MaxURLLength)
+	}
+	if n := strings.Count(r.URL.Path, "/"); config.MaxPathSegments > 0 && n > config.MaxPathSegments {
+		return "path_segments", newError(http.StatusRequestURITooLong, codeURITooLong, "the path has %d segments, over the limit of %d", n, config.MaxPathSegments)
+	}
+	if q := r.URL.RawQuery; q != "" && config.MaxQueryParams > 0 {
+		if n := strings.Count(q, "&") + 1; n > config.MaxQueryParams {
+			return "query_params", newError(http.StatusBadRequest, codeBadRequest, "the query has %d parameters, over the limit of %d", n, config.MaxQueryParams)
+		}
+	}
+	// r.URL.Path is already decoded.
+	query, _ := url.QueryUnescape(r.URL.RawQuery)
+	if hasControl(r.URL.Path) || hasControl(r.URL.RawQuery) || hasControl(query) {
+		return "control_characters", newError(http.StatusBadRequest, codeBadRequest, "the URL contains control characters")
+	}
+	return "", nil
+}
+
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, func(c rune) bool { return c < 0x20 || c == 0x7f }) >= 0
+}
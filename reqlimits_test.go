@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rejections(reason string) float64 {
+	requestsRejected.mu.Lock()
+	defer requestsRejected.mu.Unlock()
+	return requestsRejected.values[labelKey([]string{"reason", reason})]
+}
+
+func TestOversizedURLs(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		target    string
+		configure func(cfg *Config)
+		reason    string
+	}{
+		{"1 MB URL", "/npm/left-pad@1.0.0/" + strings.Repeat("a", 1<<20), nil, "url_length"},
+		{"10,000 segments", "/npm/left-pad@1.0.0" + strings.Repeat("/a", 10000), nil, "url_length"},
+		{"10,000 segments, no length limit", "/npm/left-pad@1.0.0" + strings.Repeat("/a", 10000), func(cfg *Config) {
+			cfg.MaxURLLength = 0
+		}, "path_segments"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := newFakeRegistry(t)
+			reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+			s := newTestServer(t, reg, tc.configure)
+			rejected := rejections(tc.reason)
+
+			res := s.get(tc.target)
+			var e struct{ Code string }
+			if err := json.Unmarshal([]byte(responseBody(t, res, http.StatusRequestURITooLong)), &e); err != nil || e.Code != codeURITooLong {
+				t.Errorf("code %q, %v", e.Code, err)
+			}
+			if n := rejections(tc.reason) - rejected; n != 1 {
+				t.Errorf("%g rejections for %s", n, tc.reason)
+			}
+
+			// Straight to the handler, to see what the rejection costs.
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			w := httptest.NewRecorder()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			began := time.Now()
+			s.Config.Handler.ServeHTTP(w, req)
+			took := time.Since(began)
+			runtime.ReadMemStats(&after)
+			if w.Code != http.StatusRequestURITooLong {
+				t.Errorf("got %d", w.Code)
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 64<<10 {
+				t.Errorf("allocated %d bytes for a %d byte URL", n, len(tc.target))
+			}
+			if took > 100*time.Millisecond {
+				t.Errorf("took %s", took)
+			}
+
+			if reg.hits("/left-pad") != 0 {
+				t.Errorf("the registry was asked for left-pad")
+			}
+			s.follow(s.get("/npm/left-pad@1.0.0/index.js"), 302)
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolveVersion picks the version a spec refers to: an exact version, a
+// dist-tag or a semver range. An empty spec means "latest". Ranges only
+// take prereleases as npm does, unless includePrerelease.
+func resolveVersion(p *Packument, spec string, includePrerelease bool) (*PackumentVersion, error) {
+	if spec == "" {
+		spec = "latest"
+	}
+	spec = normalizeVersion(spec)
+
+	if pv, ok := p.Versions[spec]; ok {
+		return pv, nil
+	}
+
+	if tagged, ok := p.DistTags[spec]; ok {
+		pv, ok := p.Versions[tagged]
+		if !ok {
+			return nil, newError(http.StatusBadGateway, codeUpstream, "tag %s of %s points at missing version %s", spec, p.Name, tagged)
+		}
+		tv, ok := parseSemver(tagged)
+		if config.SkipDeprecated && pv.Deprecated != "" && ok {
+			// Fall back to the newest older version on the same release
+			// line as the tag.
+			alt := maxSatisfying(p, true, func(v semver) bool {
+				if v.compare(tv) > 0 {
+					return false
+				}
+				return len(v.Pre) == 0 || (len(tv.Pre) > 0 && v.sameTuple(tv))
+			})
+			if alt != nil {
+				log.Printf("%s@%s is deprecated, resolving %s to %s", p.Name, pv.Version, spec, alt.Version)
+				return alt, nil
+			}
+		}
+		return pv, nil
+	}
+
+	r, err := parseRange(spec)
+	if err != nil {
+		return nil, newError(http.StatusNotFound, codeVersionNotFound, "%s has no version or tag %q", p.Name, spec)
+	}
+
+	match := func(v semver) bool { return r.test(v, includePrerelease) }
+	best := maxSatisfying(p, false, match)
+	if best == nil {
+		return nil, newError(http.StatusNotFound, codeVersionNotFound, "no version of %s satisfies %q", p.Name, spec)
+	}
+	if config.SkipDeprecated && best.Deprecated != "" {
+		if alt := maxSatisfying(p, true, match); alt != nil {
+			log.Printf("%s@%s is deprecated, resolving %s to %s", p.Name, best.Version, spec, alt.Version)
+			return alt, nil
+		}
+	}
+	return best, nil
+}
+
+// maxSatisfying returns the highest version accepted by match, optionally
+// ignoring deprecated versions. Of versions differing only in their build
+// metadata, it takes the last in compareBuild order.
+func maxSatisfying(p *Packument, skipDeprecated bool, match func(semver) bool) *PackumentVersion {
+	var best *PackumentVersion
+	var bestV semver
+	for raw, pv := range p.Versions {
+		if skipDeprecated && pv.Deprecated != "" {
+			continue
+		}
+		v, ok := parseSemver(raw)
+		if !ok || !match(v) {
+			continue
+		}
+		if best == nil || v.compareBuild(bestV) > 0 {
+			best, bestV = pv, v
+		}
+	}
+	return best
+}
+
+// packumentBefore returns p as it was at before: without the versions
+// published after it, and with latest the highest stable version left when
+// it was one of them, as npm's --before does. Other tags of later versions
+// are dropped.
+func packumentBefore(p *Packument, before time.Time) (*Packument, error) {
+	old := *p
+	old.Versions = map[string]*PackumentVersion{}
+	var first time.Time
+	for v, pv := range p.Versions {
+		if pv.Published.IsZero() {
+			continue
+		}
+		if first.IsZero() || pv.Published.Before(first) {
+			first = pv.Published
+		}
+		if !pv.Published.After(before) {
+			old.Versions[v] = pv
+		}
+	}
+	if len(old.Versions) == 0 {
+		if first.IsZero() {
+			return nil, newError(http.StatusNotFound, codeVersionNotFound, "the registry has no publish times for %s", p.Name)
+		}
+		e := newError(http.StatusNotFound, codeVersionNotFound, "%s was first published on %s, after %s", p.Name, first.UTC().Format(time.RFC3339), before.UTC().Format(time.RFC3339))
+		e.Details = map[string]any{"firstPublished": first.UTC()}
+		return nil, e
+	}
+
+	old.DistTags = map[string]string{}
+	for tag, v := range p.DistTags {
+		if _, ok := old.Versions[v]; ok {
+			old.DistTags[tag] = v
+		}
+	}
+	if _, ok := old.DistTags["latest"]; !ok {
+		if pv := maxSatisfying(&old, false, func(v semver) bool { return len(v.Pre) == 0 }); pv != nil {
+			old.DistTags["latest"] = pv.Version
+		}
+	}
+	return &old, nil
+}
+
+// parseBefore reads the ?before= of a request, a date or an RFC 3339 time;
+// zero without one.
+func parseBefore(c *gin.Context) (time.Time, error) {
+	q := c.Query("before")
+	if q == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, q); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, q)
+	if err != nil {
+		return time.Time{}, newError(http.StatusBadRequest, codeBadRequest, "before must be a date like 2023-06-01 or an RFC 3339 time, not %q", q)
+	}
+	return t, nil
+}
+
+// resolvePackage checks the package against the tenant's allowlist and
+// resolves spec against its packument. stale reports that the packument is a
+// cached copy the registry could not revalidate.
+func resolvePackage(t *tenant, packageName, spec string, s *span) (pv *PackumentVersion, stale bool, err error) {
+	return resolvePackageFor(packageName, spec, fetchOptions{Tenant: t}, s)
+}
+
+// resolvePackageFor is resolvePackage for opts.Tenant, against the
+// packument as it was at opts.Before, unless that is zero, and with
+// opts.IncludePrerelease. It always needs the packument.
+func resolvePackageFor(packageName, spec string, opts fetchOptions, s *span) (pv *PackumentVersion, stale bool, err error) {
+	t, before := opts.Tenant, opts.Before
+	if err := checkAllowed(t, packageName); err != nil {
+		return nil, false, err
+	}
+	if config.ReadOnly && before.IsZero() {
+		// A replica may have the version without its packument.
+		if pv, ok := cachedVersion(t, packageName, spec); ok {
+			return pv, false, nil
+		}
+	}
+
+	p, err := getPackument(t, packageName, s)
+	if err != nil {
+		var e *apiError
+		notFound := errors.As(err, &e) && e.Status == http.StatusNotFound
+		if pv, ok := cachedVersion(t, packageName, spec); ok && !notFound && before.IsZero() {
+			// Cached versions don't change, so they are served whatever
+			// the registry's state.
+			staleServes.Inc("kind", "version")
+			return pv, false, nil
+		}
+		if (spec != "" && spec != "latest") || notFound {
+			return nil, false, err
+		}
+		// Older registries may not serve packuments, ask for latest the
+		// old way.
+		latest, ferr := findPackageInfo(t, packageName)
+		if ferr != nil || latest == "" {
+			return nil, false, err
+		}
+		return &PackumentVersion{Name: packageName, Version: latest}, false, nil
+	}
+
+	if !before.IsZero() {
+		if p, err = packumentBefore(p, before); err != nil {
+			return nil, false, err
+		}
+	}
+	// An exact version is the same whether or not the packument is stale.
+	pv, err = resolveVersion(p, spec, opts.IncludePrerelease)
+	return pv, p.Stale && !validVersion(normalizeVersion(spec)), err
+}
+
+// cachedVersion returns what the manifest of an exact version tells of it,
+// if the version is cached.
+func cachedVersion(t *tenant, packageName, spec string) (*PackumentVersion, bool) {
+	version := normalizeVersion(spec)
+	if !validVersion(version) {
+		return nil, false
+	}
+	m, err := loadManifest(versionDir(t, packageName, version), packageName, version)
+	if err != nil {
+		return nil, false
+	}
+	return &PackumentVersion{Name: packageName, Version: version, Deprecated: deprecation(m.Deprecated)}, true
+}
+
+// fetchOptions carry per-request choices through the fetch pipeline.
+type fetchOptions struct {
+	// Tenant is who the package is fetched for, nil for the default tenant.
+	Tenant *tenant
+	// Admin requests bypass the package size limits.
+	Admin bool
+	// Refresh fetches the packument and the version again even when they
+	// are cached, replacing the cached copies.
+	Refresh bool
+	// Timing collects the duration of each phase; ensurePackage starts one
+	// when the caller doesn't.
+	Timing *fetchTiming
+	// Overrides are the exact versions ?override= resolves packages to,
+	// by name, whatever spec they are asked for with.
+	Overrides map[string]string
+	// Before resolves against the versions published by then, when set.
+	Before time.Time
+	// IncludePrerelease lets ranges take prereleases, as npm's
+	// --include-prerelease does.
+	IncludePrerelease bool
+	// Env is the ?env= packages are resolved and bundled for, "" for
+	// production.
+	Env string
+	// FetchedBy is recorded in the manifests of versions fetched.
+	FetchedBy *FetchedBy
+	// Inputs records what a derived artifact is built from, and pins
+	// what a rebuild resolves to; nil outside of builds.
+	Inputs *buildInputs
+}
+
+// ensuredPackage is a version that is extracted and ready to serve.
+type ensuredPackage struct {
+	Manifest *Manifest
+	Stale    bool
+}
+
+// ensurePackage resolves spec against the registry, makes sure the version
+// is extracted and returns its manifest.
+func ensurePackage(packageName, spec string, opts fetchOptions) (*ensuredPackage, error) {
+	if opts.Timing == nil {
+		opts.Timing = newFetchTiming(nil)
+	}
+	if v, ok := opts.Overrides[packageName]; ok {
+		spec = v
+	}
+	asked := spec
+	if v, ok := opts.Inputs.pinned(packageName, spec); ok {
+		spec = v
+	}
+	rs := opts.Timing.begin("resolve")
+	rs.set("repkg.package", packageName)
+	rs.set("repkg.spec", spec)
+	if opts.Refresh && checkAllowed(opts.Tenant, packageName) == nil {
+		if _, err := refreshPackument(opts.Tenant, packageName, rs); err != nil {
+			log.Printf("refreshing packument for %s: %s", packageName, err)
+		}
+	}
+	pv, stale, err := resolvePackageFor(packageName, spec, opts, rs)
+	if err != nil {
+		rs.fail(err)
+		rs.finish()
+		return nil, err
+	}
+	rs.set("repkg.version", pv.Version)
+	rs.set("repkg.stale", stale)
+	rs.finish()
+	opts.Inputs.resolve(packageName, asked, pv.Version)
+
+	if err := failures.check(opts.Tenant, packageName, pv.Version); err != nil {
+		return nil, err
+	}
+	if err := fetchPackage(packageName, pv, opts); err != nil {
+		failures.record(opts.Tenant, packageName, pv.Version, err)
+		return nil, err
+	}
+	failures.succeeded(opts.Tenant, packageName, pv.Version)
+
+	dir := versionDir(opts.Tenant, packageName, pv.Version)
+	m, err := loadManifest(dir, packageName, pv.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions fetched before manifests kept their publisher get it from
+	// the packument. The manifest is only saved when something changed,
+	// through updateManifest so pins and quarantines made meanwhile stay.
+	if manifestOutdated(m, pv) || !m.SecurityHolder && isSecurityHolder(dir, m) {
+		updated, err := updateManifest(opts.Tenant, dir, packageName, pv.Version, func(m *Manifest) {
+			recordOwnership(opts.Tenant, m, pv)
+			m.Deprecated = string(pv.Deprecated)
+			if !m.SecurityHolder {
+				m.SecurityHolder = isSecurityHolder(dir, m)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		m = updated
+	}
+	return &ensuredPackage{Manifest: m, Stale: stale}, nil
+}
+
+// manifestOutdated reports whether the packument tells more of a version
+// than its manifest recorded: a change of deprecation, or ownership the
+// manifest has none of.
+func manifestOutdated(m *Manifest, pv *PackumentVersion) bool {
+	if m.Deprecated != string(pv.Deprecated) {
+		return true
+	}
+	if m.Publisher != nil || m.Maintainers != nil || m.Provenance != nil {
+		return false
+	}
+	publisher, maintainers, provenance := pv.ownership()
+	return publisher != nil || maintainers != nil || provenance != nil
+}
+
+// setResolveHeaders reports how a request was resolved.
+func setResolveHeaders(w http.ResponseWriter, ep *ensuredPackage) {
+	setDeprecationHeader(w, ep.Manifest)
+	setSecurityHolderHeader(w, ep.Manifest)
+	if ep.Manifest.Upstream != "" {
+		w.Header().Set("X-Upstream", ep.Manifest.Upstream)
+	}
+	if ep.Stale {
+		w.Header().Set("Warning", `111 repkg "Revalidation Failed"`)
+		w.Header().Set("X-Repkg-Stale", "true")
+	}
+	setIntegrityHeader(w, ep.Manifest)
+}
+
+// sanitizeHeader makes free-form registry text safe to use as a header
+// value: printable ASCII only, whitespace collapsed, bounded length.
+func sanitizeHeader(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		}
+	}
+
+	out := strings.Join(strings.Fields(b.String()), " ")
+	if len(out) > 256 {
+		out = out[:253] + "..."
+	}
+	return out
+}
+
+func setDeprecationHeader(w http.ResponseWriter, m *Manifest) {
+	if m.Deprecated != "" {
+		w.Header().Set("X-Npm-Deprecated", sanitizeHeader(m.Deprecated))
+	}
+}
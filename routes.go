@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api lists the routes with what they take and need. The catalogue is
+// filled in as the routes are registered, from the docs they are
+// registered with, so that it can't fall behind.
+
+type routeParam struct {
+	Name        string `json:"name"`
+	In          string `json:"in"` // path, query, header or body
+	Description string `json:"description"`
+}
+
+func inPath(name, description string) routeParam {
+	return routeParam{name, "path", description}
+}
+
+func inQuery(name, description string) routeParam {
+	return routeParam{name, "query", description}
+}
+
+func inBody(description string) routeParam {
+	return routeParam{"body", "body", description}
+}
+
+type routeDoc struct {
+	Description string       `json:"description"`
+	Params      []routeParam `json:"params,omitempty"`
+	// Auth is "admin" for routes that take the admin token only, and
+	// "signature" for webhooks signed with hookSecret.
+	Auth string `json:"auth,omitempty"`
+	// Writes marks the routes that change the cache and are refused on a
+	// read-only replica.
+	Writes bool `json:"writes,omitempty"`
+	// BulkBody marks the routes that take bodies up to bulkBodyMaxBytes,
+	// gzipped or not, rather than maxBodyBytes.
+	BulkBody bool `json:"bulkBody,omitempty"`
+}
+
+type routeInfo struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	routeDoc
+}
+
+// The routes at the root only, and those every tenant has.
+var globalRoutes, tenantRoutes []routeInfo
+
+// router registers routes with their docs, adding them to docs unless it
+// is nil: the tenant routes are registered twice but catalogued once.
+type router struct {
+	gin.IRoutes
+	docs *[]routeInfo
+}
+
+func (r router) handle(method, p string, doc routeDoc, handlers ...gin.HandlerFunc) {
+	if method != http.MethodGet && method != http.MethodHead {
+		handlers = append([]gin.HandlerFunc{readBodies(doc.BulkBody)}, handlers...)
+	}
+	if doc.Writes {
+		handlers = append([]gin.HandlerFunc{writable}, handlers...)
+	}
+	r.Handle(method, p, handlers...)
+	if r.docs != nil {
+		*r.docs = append(*r.docs, routeInfo{method, p, doc})
+	}
+}
+
+// serveRoutes handles GET /api. Paths are relative to basePath: the prefix
+// a proxy sent in X-Forwarded-Prefix, then the tenant's.
+func serveRoutes(c *gin.Context) {
+	t := tenantOf(c)
+	routes := tenantRoutes
+	if t == nil {
+		routes = append(append([]routeInfo{}, globalRoutes...), tenantRoutes...)
+	}
+	writeJSON(c, http.StatusOK, gin.H{"basePath": forwardedPrefix(c.Request) + t.urlPrefix(), "routes": routes})
+}
+
+// forwardedPrefix returns the X-Forwarded-Prefix of a request, "" unless it
+// is a clean absolute path.
+func forwardedPrefix(r *http.Request) string {
+	p := strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")
+	if p == "" || !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+		return ""
+	}
+	return p
+}
+
+// unpkgRoute documents what the NoRoute handler serves, which gin knows
+// nothing of.
+var unpkgRoute = routeDoc{
+	Description: "unpkg-style URLs, as /npm (HEAD as its HEAD), when pathStyles has unpkg",
+	Params:      []routeParam{inPath("package", "name@version, then the file")},
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds of a search, so that one request can't scan a huge package for
+// long.
+const (
+	searchMaxResults  = 200
+	searchMaxFileSize = 1 << 20
+	searchMaxBytes    = 64 << 20
+	searchTimeout     = 5 * time.Second
+	searchMaxLineLen  = 200
+)
+
+type searchResult struct {
+	Path string `json:"path"`
+	Line int    `json:"line,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+// serveSearch handles GET /api/search/:scope/:name/:version?q=, searching a
+// cached version's file names (type=name, the default: a glob when q has
+// glob characters, a substring otherwise) or the contents of its text files
+// (type=content: a literal, or a regular expression with regex=true).
+func serveSearch(c *gin.Context) {
+	packageName, rest, err := parsePackageParams(c.Param("package"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	spec := ""
+	if len(rest) > 0 {
+		spec = rest[0]
+	}
+
+	q := c.Query("q")
+	if q == "" {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "missing q"))
+		return
+	}
+	limit := searchMaxResults
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid limit %q", s))
+			return
+		}
+		limit = min(n, searchMaxResults)
+	}
+
+	var match func(string) bool
+	kind := c.DefaultQuery("type", "name")
+	switch kind {
+	case "name":
+		match = nameMatcher(q)
+	case "content":
+		if c.Query("regex") == "true" {
+			// RE2 runs in time linear in the input, so the scan limits
+			// bound regular expressions too.
+			re, err := regexp.Compile(q)
+			if err != nil {
+				writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid regular expression"))
+				return
+			}
+			match = re.MatchString
+		} else {
+			match = func(s string) bool { return strings.Contains(s, q) }
+		}
+	default:
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid type %q, expected name or content", kind))
+		return
+	}
+
+	t := tenantOf(c)
+	m, err := cachedManifest(t, packageName, spec)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	dir := versionDir(t, m.Name, m.Version)
+	results := []searchResult{}
+	truncated := false
+	var scanned int64
+	deadline := time.Now().Add(searchTimeout)
+
+files:
+	for i := range m.Files {
+		f := &m.Files[i]
+		if deny.denied(f.Path) {
+			continue
+		}
+		if kind == "name" {
+			if match(f.Path) {
+				if len(results) == limit {
+					truncated = true
+					break
+				}
+				results = append(results, searchResult{Path: f.Path})
+			}
+			continue
+		}
+
+		if f.Size > searchMaxFileSize {
+			continue
+		}
+		if scanned+f.Size > searchMaxBytes || time.Now().After(deadline) {
+			truncated = true
+			break
+		}
+		data, err := readStoredFile(dir, f)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		scanned += int64(len(data))
+		if !isText(data) {
+			continue
+		}
+
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		sc.Buffer(nil, searchMaxFileSize+1)
+		for line := 1; sc.Scan(); line++ {
+			text := sc.Text()
+			if !match(text) {
+				continue
+			}
+			if len(results) == limit {
+				truncated = true
+				break files
+			}
+			if len(text) > searchMaxLineLen {
+				text = strings.ToValidUTF8(text[:searchMaxLineLen], "") + "…"
+			}
+			results = append(results, searchResult{Path: f.Path, Line: line, Text: text})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"package":      m.Name,
+		"version":      m.Version,
+		"type":         kind,
+		"q":            q,
+		"results":      results,
+		"truncated":    truncated,
+		"scannedBytes": scanned,
+	})
+}
+
+// nameMatcher matches file paths against a glob, on the whole path or its
+// base name, or a case-insensitive substring.
+func nameMatcher(q string) func(string) bool {
+	if strings.ContainsAny(q, "*?[") {
+		return func(p string) bool {
+			ok, _ := path.Match(q, p)
+			if !ok && !strings.Contains(q, "/") {
+				ok, _ = path.Match(q, path.Base(p))
+			}
+			return ok
+		}
+	}
+	lower := strings.ToLower(q)
+	return func(p string) bool { return strings.Contains(strings.ToLower(p), lower) }
+}
+
+// isText reports whether data looks like text: valid UTF-8 without NUL
+// bytes in its first few kilobytes.
+func isText(data []byte) bool {
+	head := data[:min(len(data), 8192)]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	for len(head) > 0 {
+		r, n := utf8.DecodeRune(head)
+		if r == utf8.RuneError && n == 1 && len(head) >= utf8.UTFMax {
+			return false
+		}
+		head = head[n:]
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// When npm takes a package down for being malicious, it publishes a
+// placeholder in its place, 0.0.1-security, whose package.json reads
+// "security holding package" and that holds nothing but a README. Resolving
+// the package's latest then gets the placeholder, which is cached like any
+// version but marked securityHolder in its manifest and served with
+// X-Security-Holder: true. With config.SecurityHolders "block", the
+// default, requests for its entry point are a 404 saying why rather than
+// a redirect to a README; its files, /api/meta and its page still answer.
+
+// Values of config.SecurityHolders.
+const (
+	securityHolderBlock = "block"
+	securityHolderServe = "serve"
+)
+
+// isSecurityHolder reports whether a version looks like npm's placeholder:
+// a -security version whose package.json says so, or that has no files
+// but package.json and a README.
+func isSecurityHolder(dir string, m *Manifest) bool {
+	if !strings.HasSuffix(m.Version, "-security") {
+		return false
+	}
+	if strings.Contains(strings.ToLower(loadPackageJSON(dir, m).Description), "security holding package") {
+		return true
+	}
+	for _, f := range m.Files {
+		name := strings.ToLower(f.Path)
+		if name != "package.json" && strings.TrimSuffix(name, path.Ext(name)) != "readme" {
+			return false
+		}
+	}
+	return true
+}
+
+func setSecurityHolderHeader(w http.ResponseWriter, m *Manifest) {
+	if m.SecurityHolder {
+		w.Header().Set("X-Security-Holder", "true")
+	}
+}
+
+// securityHolderEntry is the error entry point requests for a placeholder
+// get, nil unless they are blocked.
+func securityHolderEntry(m *Manifest) error {
+	if !m.SecurityHolder || config.SecurityHolders != securityHolderBlock {
+		return nil
+	}
+	e := newError(http.StatusNotFound, codeSecurityHolder, "%s@%s is npm's security holding package: the package was removed from the registry for security reasons and has no code to serve", m.Name, m.Version)
+	e.Details = map[string]any{"package": m.Name, "version": m.Version}
+	return e
+}
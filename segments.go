@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Downloads, segmented or not, log their progress this often.
+var downloadProgressInterval = 5 * time.Second
+
+// errNoRanges is returned by a segment when the server doesn't answer a
+// range request with that range, which retrying won't change.
+var errNoRanges = errors.New("range request not honoured")
+
+var segmentedDownloads = newCounter("repkg_segmented_downloads_total", "Tarballs downloaded in parallel segments, by result.")
+
+// wantSegments reports whether the response to a tarball request, still
+// unread, is worth dropping for a segmented download: the tarball is over
+// config.SegmentedDownloadThreshold and the server takes byte ranges.
+func wantSegments(response *http.Response) bool {
+	return config.SegmentedDownloadThreshold > 0 && config.DownloadSegments > 1 &&
+		response.ContentLength > config.SegmentedDownloadThreshold &&
+		strings.EqualFold(response.Header.Get("Accept-Ranges"), "bytes")
+}
+
+// downloadSegments saves the size bytes at u to fileName in
+// config.DownloadSegments ranges fetched in parallel, each retried up to
+// config.DownloadSegmentRetries times from where it stopped. The segments
+// share the download's bandwidth limits, and are traced below parent.
+func downloadSegments(t *tenant, u *url.URL, fileName string, size int64, parent *span) (int64, error) {
+	URL, source := u.String(), redactURL(u)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(contextWithSpan(context.Background(), parent))
+	defer cancel()
+
+	n := int64(config.DownloadSegments)
+	segment := (size + n - 1) / n
+	buckets := downloadBuckets()
+	var (
+		read     atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for start := int64(0); start < size; start += segment {
+		end := min(start+segment, size) - 1
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := fetchSegment(ctx, t, URL, source, file, start, end, buckets, &read); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(start, end)
+	}
+
+	began := time.Now()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(downloadProgressInterval)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-ticker.C:
+			log.Printf("download: %s: %s of %s in %d segments, %s/s", source, formatBytes(read.Load()), formatBytes(size), n, formatBytes(int64(float64(read.Load())/time.Since(began).Seconds())))
+		}
+	}
+	if firstErr != nil {
+		return read.Load(), firstErr
+	}
+	log.Printf("download: %s: %s in %d segments, %s/s", source, formatBytes(size), n, formatBytes(int64(float64(size)/time.Since(began).Seconds())))
+	return size, nil
+}
+
+// fetchSegment writes bytes start to end (inclusive) of URL to file at
+// the same offsets, counting them in read.
+func fetchSegment(ctx context.Context, t *tenant, URL, source string, file *os.File, start, end int64, buckets []*tokenBucket, read *atomic.Int64) error {
+	for attempt := 0; ; attempt++ {
+		n, err := fetchRange(ctx, t, URL, file, start, end, buckets)
+		read.Add(n)
+		start += n
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || errors.Is(err, errNoRanges) || errors.Is(err, errUpstreamAuth) || attempt >= config.DownloadSegmentRetries {
+			return err
+		}
+		log.Printf("download: %s: retrying bytes %d-%d: %s", source, start, end, err)
+		select {
+		case <-time.After(time.Duration(attempt+1) * 500 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func fetchRange(ctx context.Context, t *tenant, URL string, file *os.File, start, end int64, buckets []*tokenBucket) (int64, error) {
+	req, err := newUpstreamRequest(t, http.MethodGet, URL)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	s := traceUpstream(spanFromContext(ctx), req)
+	s.set("repkg.range", fmt.Sprintf("%d-%d", start, end))
+	response, err := tarballClient.Do(req)
+	s.done(response, err)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		return 0, errUpstreamAuth
+	case response.StatusCode != http.StatusPartialContent:
+		return 0, fmt.Errorf("%w: registry responded %s", errNoRanges, response.Status)
+	case !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)):
+		return 0, fmt.Errorf("%w: got %q", errNoRanges, response.Header.Get("Content-Range"))
+	}
+
+	want := end - start + 1
+	body := &throttledReader{r: io.LimitReader(response.Body, want), buckets: buckets}
+	n, err := io.Copy(io.NewOffsetWriter(file, start), body)
+	if err == nil && n < want {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
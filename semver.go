@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type semver struct {
+	Major, Minor, Patch uint64
+	Pre                 []string
+	Build               string
+}
+
+// normalizeVersion drops the "v" or "V" of versions written like Git tags,
+// such as "v4.29.0". Anything else, including tags like "v-next", is left
+// as it is.
+func normalizeVersion(s string) string {
+	if len(s) > 1 && (s[0] == 'v' || s[0] == 'V') {
+		if _, ok := parseSemver(s[1:]); ok {
+			return s[1:]
+		}
+	}
+	return s
+}
+
+// parseSemver parses a strict semver string such as "1.2.3-beta.1+sha".
+func parseSemver(s string) (semver, bool) {
+	var v semver
+
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+		if v.Build == "" {
+			return v, false
+		}
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		pre := s[i+1:]
+		s = s[:i]
+		if pre == "" {
+			return v, false
+		}
+		v.Pre = strings.Split(pre, ".")
+		for _, p := range v.Pre {
+			if p == "" {
+				return v, false
+			}
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	nums := make([]uint64, 3)
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil || (len(p) > 1 && p[0] == '0') {
+			return v, false
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Pre) > 0 {
+		s += "-" + strings.Join(v.Pre, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// compare orders versions by semver precedence; build metadata is ignored.
+func (v semver) compare(o semver) int {
+	if c := cmpUint(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := cmpUint(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := cmpUint(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	switch {
+	case len(v.Pre) == 0 && len(o.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+
+	return compareIdentifiers(v.Pre, o.Pre)
+}
+
+// compareIdentifiers orders dot-separated identifiers: numeric ones
+// numerically and before the others, which compare as strings, and a
+// shorter list before a longer one it starts.
+func compareIdentifiers(x, y []string) int {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		a, aErr := strconv.ParseUint(x[i], 10, 64)
+		b, bErr := strconv.ParseUint(y[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := cmpUint(a, b); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmpUint(uint64(len(x)), uint64(len(y)))
+}
+
+// compareBuild is compare, then build metadata as node-semver's
+// compareBuild orders it: without any first, then identifier by
+// identifier. Picking between 1.0.0+a and 1.0.0+b doesn't hang on map
+// order that way.
+func (v semver) compareBuild(o semver) int {
+	if c := v.compare(o); c != 0 {
+		return c
+	}
+	switch {
+	case v.Build == o.Build:
+		return 0
+	case v.Build == "":
+		return -1
+	case o.Build == "":
+		return 1
+	}
+	return compareIdentifiers(strings.Split(v.Build, "."), strings.Split(o.Build, "."))
+}
+
+func (v semver) sameTuple(o semver) bool {
+	return v.Major == o.Major && v.Minor == o.Minor && v.Patch == o.Patch
+}
+
+func cmpUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type comparator struct {
+	op string // one of "<", "<=", ">", ">=", "="
+	v  semver
+	// partial marks the ">=" of a version missing components, such as
+	// ">=1.2" or the floor of "1.x", which with includePrerelease also
+	// takes the prereleases of its floor.
+	partial bool
+}
+
+// atLeast is the lower bound of a partial.
+func atLeast(p partial) comparator {
+	return comparator{op: ">=", v: p.floor(), partial: p.n < 3}
+}
+
+// anyVersion is the comparator of "*".
+var anyVersion = comparator{op: ">=", partial: true}
+
+func (c comparator) match(v semver, includePrerelease bool) bool {
+	floor := c.v
+	if includePrerelease && c.partial {
+		floor.Pre = []string{"0"}
+	}
+	n := v.compare(floor)
+	switch c.op {
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	}
+	return n == 0
+}
+
+// semverRange is a set of comparator sets joined by "||".
+type semverRange [][]comparator
+
+// match follows npm: a prerelease version only satisfies a comparator set
+// when one of its comparators carries a prerelease on the same
+// major.minor.patch tuple.
+func (r semverRange) match(v semver) bool {
+	return r.test(v, false)
+}
+
+// test is match with npm's includePrerelease, when set: prereleases
+// satisfy the sets their version falls in, "1.x" taking 1.0.0-beta too,
+// but "^1.2.3" still doesn't take 2.0.0-beta.1.
+func (r semverRange) test(v semver, includePrerelease bool) bool {
+	for _, set := range r {
+		if matchSet(set, v, includePrerelease) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSet(set []comparator, v semver, includePrerelease bool) bool {
+	for _, c := range set {
+		if !c.match(v, includePrerelease) {
+			return false
+		}
+	}
+	if len(v.Pre) == 0 || includePrerelease {
+		return true
+	}
+	for _, c := range set {
+		if len(c.v.Pre) > 0 && c.v.sameTuple(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses npm's range grammar: "||", hyphen ranges, x-ranges,
+// tilde and caret ranges, and primitive comparators.
+func parseRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, part := range strings.Split(s, "||") {
+		set, err := parseComparatorSet(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+func parseComparatorSet(s string) ([]comparator, error) {
+	fields := strings.Fields(s)
+
+	if len(fields) == 3 && fields[1] == "-" {
+		from, err := parsePartial(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePartial(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		set := []comparator{atLeast(from)}
+		if to.n == 3 {
+			set = append(set, comparator{op: "<=", v: to.floor()})
+		} else if to.n > 0 {
+			set = append(set, comparator{op: "<", v: to.ceil()})
+		}
+		return set, nil
+	}
+
+	// Join operators separated from their version by whitespace.
+	var tokens []string
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if strings.Trim(f, "<>=~^") == "" && i+1 < len(fields) {
+			f += fields[i+1]
+			i++
+		}
+		tokens = append(tokens, f)
+	}
+
+	var set []comparator
+	for _, t := range tokens {
+		cs, err := parseComparator(t)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, cs...)
+	}
+	if len(set) == 0 {
+		set = []comparator{anyVersion}
+	}
+	return set, nil
+}
+
+// partial is a possibly incomplete version such as "1", "1.2" or "1.x".
+type partial struct {
+	v semver
+	n int // number of specified numeric components
+}
+
+func parsePartial(s string) (partial, error) {
+	var p partial
+	s = strings.TrimPrefix(s, "=")
+	// As npm does, "v1.2" is "1.2".
+	if len(s) > 1 && (s[0] == 'v' || s[0] == 'V') && '0' <= s[1] && s[1] <= '9' {
+		s = s[1:]
+	}
+
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		p.v.Build = s[i+1:]
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		p.v.Pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+
+	if s == "" {
+		return p, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return p, fmt.Errorf("bad version %q", s)
+	}
+	nums := []*uint64{&p.v.Major, &p.v.Minor, &p.v.Patch}
+	wild := false
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			wild = true
+			continue
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("bad version %q", s)
+		}
+		// What follows a wildcard is ignored, as in "1.x.2", but must be
+		// there to be valid.
+		if !wild {
+			*nums[i] = n
+			p.n = i + 1
+		}
+	}
+	if p.n < 3 {
+		p.v.Pre = nil
+	}
+	return p, nil
+}
+
+// floor is the lowest version matched by the partial.
+func (p partial) floor() semver {
+	v := p.v
+	v.Build = ""
+	return v
+}
+
+// ceil is the exclusive upper bound of the partial, e.g. "1.2" -> "1.3.0-0".
+func (p partial) ceil() semver {
+	switch p.n {
+	case 1:
+		return semver{Major: p.v.Major + 1, Pre: []string{"0"}}
+	case 2:
+		return semver{Major: p.v.Major, Minor: p.v.Minor + 1, Pre: []string{"0"}}
+	}
+	return p.floor()
+}
+
+func parseComparator(t string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", ">", "<", "=", "~>", "~", "^"} {
+		if strings.HasPrefix(t, candidate) {
+			op = candidate
+			break
+		}
+	}
+	p, err := parsePartial(t[len(op):])
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "~", "~>":
+		if p.n == 3 {
+			return []comparator{atLeast(p), {op: "<", v: partial{v: p.v, n: 2}.ceil()}}, nil
+		}
+		return xRange(p), nil
+	case "^":
+		switch {
+		case p.n == 0:
+			return xRange(p), nil
+		case p.v.Major > 0 || p.n == 1:
+			return []comparator{atLeast(p), {op: "<", v: partial{v: p.v, n: 1}.ceil()}}, nil
+		case p.v.Minor > 0 || p.n == 2:
+			return []comparator{atLeast(p), {op: "<", v: partial{v: p.v, n: 2}.ceil()}}, nil
+		}
+		upper := semver{Patch: p.v.Patch + 1, Pre: []string{"0"}}
+		return []comparator{atLeast(p), {op: "<", v: upper}}, nil
+	case ">":
+		if p.n == 0 {
+			return []comparator{{op: "<", v: semver{Pre: []string{"0"}}}}, nil
+		}
+		if p.n < 3 {
+			ceil := p.ceil()
+			ceil.Pre = nil
+			return []comparator{{op: ">=", v: ceil, partial: true}}, nil
+		}
+		return []comparator{{op: ">", v: p.floor()}}, nil
+	case ">=":
+		return []comparator{atLeast(p)}, nil
+	case "<":
+		if p.n < 3 {
+			v := p.floor()
+			v.Pre = []string{"0"}
+			return []comparator{{op: "<", v: v}}, nil
+		}
+		return []comparator{{op: "<", v: p.floor()}}, nil
+	case "<=":
+		if p.n == 0 {
+			return []comparator{anyVersion}, nil
+		}
+		if p.n < 3 {
+			return []comparator{{op: "<", v: p.ceil()}}, nil
+		}
+		return []comparator{{op: "<=", v: p.floor()}}, nil
+	}
+
+	if p.n == 3 {
+		return []comparator{{op: "=", v: p.floor()}}, nil
+	}
+	return xRange(p), nil
+}
+
+func xRange(p partial) []comparator {
+	if p.n == 0 {
+		return []comparator{anyVersion}
+	}
+	return []comparator{atLeast(p), {op: "<", v: p.ceil()}}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// splitPackagePath splits a path below /packages into the version directory
+// ("@scope/name@version" or "name@version") and the file path inside it.
+func splitPackagePath(p string) (pkgDir, rel string) {
+	p = strings.TrimPrefix(p, "/")
+	n := 1
+	if strings.HasPrefix(p, "@") {
+		n = 2
+	}
+	parts := strings.SplitN(p, "/", n+1)
+	if len(parts) < n {
+		return "", ""
+	}
+	pkgDir = strings.Join(parts[:n], "/")
+	if len(parts) > n {
+		rel = parts[n]
+	}
+	return pkgDir, rel
+}
+
+// parsePkgDir turns "@scope/name@version" into its name and version.
+func parsePkgDir(pkgDir string) (name, version string) {
+	i := strings.LastIndex(pkgDir, "@")
+	if i <= 0 {
+		return pkgDir, ""
+	}
+	return pkgDir[:i], pkgDir[i+1:]
+}
+
+// escapePath percent-encodes each segment of a manifest path for use in a
+// URL. Manifest paths are stored unencoded and request paths are decoded
+// once by net/http, so this is the only place they are encoded.
+func escapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+// servePackageFile serves files from extracted packages. Lookups go through
+// the version manifest so that matching is exact and identical on every
+// filesystem, whatever its case sensitivity or Unicode normalization.
+func servePackageFile(c *gin.Context) {
+	pkgDir, rel := splitPackagePath(c.Param("filepath"))
+	name, version := parsePkgDir(pkgDir)
+	if v := normalizeVersion(version); v != version && validPackageName(name) {
+		u := packageURL(tenantOf(c), name, v, rel)
+		if c.Request.URL.RawQuery != "" {
+			u += "?" + c.Request.URL.RawQuery
+		}
+		c.Redirect(http.StatusMovedPermanently, u)
+		return
+	}
+	if !validPackageName(name) || !validVersion(version) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	rel = normalizePath(rel)
+
+	if pattern, ok := deny.match(rel); ok {
+		log.Printf("refusing to serve %s/%s: matches denylist pattern %q", pkgDir, rel, pattern)
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	t := tenantOf(c)
+	dir := versionDir(t, name, version)
+	m, err := loadManifest(dir, name, version)
+	if errors.Is(err, os.ErrNotExist) && waitForSwap(dir) {
+		m, err = loadManifest(dir, name, version)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("loading manifest for %s: %s", pkgDir, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	setDeprecationHeader(c.Writer, m)
+	setSecurityHolderHeader(c.Writer, m)
+	setIntegrityHeader(c.Writer, m)
+	if !checkWithdrawn(c, m) || !checkCorrupt(c, m) {
+		return
+	}
+	usage.record(t, name, version)
+
+	if f, ok := m.Lookup(rel); ok {
+		c.Header("Content-Location", packageURL(t, name, version, f.Path))
+		serveManifestFile(c, m, dir, f)
+		return
+	}
+
+	if artifact, ok := strings.CutPrefix(rel, derivedPrefix); ok && serveDerived(c, name, version, artifact) {
+		return
+	}
+
+	if m.IsDir(rel) {
+		if !strings.HasSuffix(c.Request.URL.Path, "/") {
+			// Built from rel rather than the request path, which
+			// http.Redirect would join to the decoded path.
+			c.Redirect(http.StatusMovedPermanently, withAccessKey(c, strings.TrimSuffix(packageURL(t, name, version, rel), "/")+"/"))
+			return
+		}
+		if f, ok := m.Lookup(path.Join(rel, "index.html")); ok {
+			c.Header("Content-Location", packageURL(t, name, version, f.Path))
+			serveManifestFile(c, m, dir, f)
+			return
+		}
+		if rel == "" {
+			c.Header("Vary", "Accept")
+		}
+		if rel == "" && prefersHTML(c.Request) {
+			servePackagePage(c, m)
+			return
+		}
+		if rel == "" && config.DisableHTML {
+			writeJSON(c, http.StatusOK, m)
+			return
+		}
+		serveListing(c, m, rel)
+		return
+	}
+
+	if config.CaseInsensitiveFallback {
+		if canonical, ok := m.LookupFold(rel); ok && !deny.denied(canonical) {
+			c.Redirect(http.StatusMovedPermanently, withAccessKey(c, packageURL(t, name, version, canonical)))
+			return
+		}
+	}
+
+	e := newError(http.StatusNotFound, codeNotFound, "%s@%s has no file %s", name, version, rel)
+	e.Details = map[string]any{"package": name, "version": version, "path": rel, "suggestions": suggestFiles(m, rel, maxSuggestions)}
+	writeError(c, e)
+}
+
+const maxSuggestions = 5
+
+// suggestFiles returns up to n files of m whose path is close to rel, for
+// "did you mean" hints on 404s.
+func suggestFiles(m *Manifest, rel string, n int) []string {
+	type candidate struct {
+		path  string
+		score int
+	}
+
+	want := strings.ToLower(rel)
+	limit := max(2, len(want)/3)
+	var candidates []candidate
+	for _, f := range m.Files {
+		if deny.denied(f.Path) {
+			continue
+		}
+		p := strings.ToLower(f.Path)
+		score := -1
+		if path.Base(p) == path.Base(want) {
+			// Same file name in another directory.
+			score = 1
+		}
+		if d := len(p) - len(want); d <= limit && d >= -limit {
+			if dist := editDistance(want, p); dist <= limit && (score < 0 || dist < score) {
+				score = dist
+			}
+		}
+		if score >= 0 {
+			candidates = append(candidates, candidate{f.Path, score})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score < candidates[j].score
+		}
+		return candidates[i].path < candidates[j].path
+	})
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < n; i++ {
+		suggestions = append(suggestions, candidates[i].path)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between a and b, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func serveManifestFile(c *gin.Context, m *Manifest, dir string, f *ManifestFile) {
+	s := childSpan(requestSpan(c), "serve", spanInternal)
+	s.set("repkg.package", m.Name)
+	s.set("repkg.version", m.Version)
+	s.set("repkg.file", f.Path)
+	s.set("repkg.bytes", f.Size)
+	defer s.finish()
+
+	p := f.diskPath(dir)
+	name := path.Base(f.Path)
+	identity := applyHeaderRules(c, m.Name, f.Path)
+	if !applyHTMLPolicy(c, m.Name, f.Path, f.fileType()) {
+		return
+	}
+	if !guardFile(c, m, dir, f) {
+		return
+	}
+	setModuleTypeHeader(c, f)
+	applyHeaderOverrides(c, m.Name, f.Path)
+	countDownload(c, m.Name, m.Version)
+
+	encoding := ""
+	if f.Stored == "br" && !identity && acceptsEncoding(c.Request, "br") && c.GetHeader("Range") == "" {
+		encoding = "br"
+	}
+
+	key := hotCacheKey(dir, f.Path, encoding)
+	if e, ok := hotCache.get(key); ok {
+		s.set("repkg.hot_cache", true)
+		serveEntry(c, name, e)
+		return
+	}
+
+	etag := ""
+	if f.SHA256 != "" {
+		etag = `"` + f.SHA256[:32] + `"`
+	}
+
+	h := http.Header{}
+	fileType := f.fileType()
+	if fileType != "" {
+		h.Set("Content-Type", fileType)
+	}
+	src, size := p, f.Size
+	if f.Stored == "br" {
+		src, size = p+".br", f.StoredSize
+		h.Set("Vary", "Accept-Encoding")
+	}
+	if encoding == "br" {
+		h.Set("Content-Encoding", "br")
+		if fileType == "" {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+		if etag != "" {
+			etag = strings.TrimSuffix(etag, `"`) + `-br"`
+		}
+	}
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if sig := signFile(m, f); sig != "" {
+		h.Set("X-Repkg-Signature", sig)
+	}
+
+	// Compressed blobs are decoded in memory for clients without br when
+	// the hot cache takes them, and streamed otherwise.
+	decode := f.Stored == "br" && encoding == ""
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case decode:
+		if hotCache.fits(f.Size) {
+			data, err = readBrotli(src)
+		}
+	case hotCache.fits(size):
+		data, err = os.ReadFile(src)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("reading %s: %s", src, err)
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("reading %s: %s", src, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if data != nil {
+		e := &hotEntry{key: key, data: data, header: h, modTime: m.Extracted}
+		hotCache.add(e)
+		serveEntry(c, name, e)
+		return
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		log.Printf("opening %s: %s", src, err)
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	copyHeaders(c.Writer.Header(), h)
+	if decode {
+		streamBrotli(c, m.Extracted, f.Size, file)
+		return
+	}
+	if encoding != "" {
+		c.Header("Content-Length", strconv.FormatInt(size, 10))
+	}
+	http.ServeContent(c.Writer, c.Request, name, m.Extracted, file)
+}
+
+// streamBrotli writes the file of size bytes decoded from blob. What's
+// decoded can't be seeked, so Range is ignored and only If-None-Match and
+// If-Modified-Since are answered.
+func streamBrotli(c *gin.Context, modTime time.Time, size int64, blob io.Reader) {
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(c.Request, c.Writer.Header().Get("ETag"), modTime) {
+		c.Writer.Header().Del("Content-Type")
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(c.Writer, brotli.NewReader(blob)); err != nil {
+		log.Printf("decoding %s: %s", c.Request.URL.Path, err)
+	}
+}
+
+// notModified reports whether r's conditions show the client has the
+// file of etag, last modified at modTime, already. If-Modified-Since only
+// counts without If-None-Match.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || etag != "" && tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.IsZero() && !modTime.Truncate(time.Second).After(since)
+}
+
+func serveEntry(c *gin.Context, name string, e *hotEntry) {
+	copyHeaders(c.Writer.Header(), e.header)
+	if e.header.Get("Content-Encoding") != "" {
+		c.Header("Content-Length", strconv.Itoa(len(e.data)))
+	}
+	http.ServeContent(c.Writer, c.Request, name, e.modTime, bytes.NewReader(e.data))
+}
+
+// copyHeaders sets the headers of src on dst, adding to its Vary.
+func copyHeaders(dst, src http.Header) {
+	for k, v := range src {
+		if k == "Vary" {
+			dst[k] = append(dst[k], v...)
+			continue
+		}
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+// serveListing lists a directory as links, or as JSON with
+// config.DisableHTML, a page (?cursor=, ?limit=) at a time.
+func serveListing(c *gin.Context, m *Manifest, rel string) {
+	after, limit, err := pageParams(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	entries, total, more := m.ListPage(rel, after, limit, func(entry string) bool {
+		return !deny.denied(path.Join(rel, entry))
+	})
+	next := ""
+	if more {
+		next = encodeCursor(entries[len(entries)-1])
+	}
+	if config.DisableHTML {
+		h := gin.H{"path": strings.Trim(rel, "/"), "entries": append([]string{}, entries...), "total": total}
+		if next != "" {
+			h["nextCursor"] = next
+		}
+		writeJSON(c, http.StatusOK, h)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("<pre>\n")
+	for _, entry := range entries {
+		// "./" keeps a name such as "a:b.js" from being read as a scheme.
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(withAccessKey(c, "./"+escapePath(entry))), html.EscapeString(entry))
+	}
+	b.WriteString("</pre>\n")
+	if next != "" {
+		q := url.Values{"cursor": {next}}
+		if c.Query("limit") != "" {
+			q.Set("limit", c.Query("limit"))
+		}
+		fmt.Fprintf(&b, "<p>%d entries. <a href=\"%s\">Next page</a></p>\n", total, html.EscapeString(withAccessKey(c, "?"+q.Encode())))
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+var hrefPattern = regexp.MustCompile(`href="([^"]*)"`)
+
+// links returns the targets of the links in an HTML page served at base,
+// resolved against it.
+func links(t *testing.T, base, page string) map[string]string {
+	t.Helper()
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, m := range hrefPattern.FindAllStringSubmatch(page, -1) {
+		ref, err := url.Parse(html.UnescapeString(m[1]))
+		if err != nil {
+			t.Fatalf("%s: %s", m[1], err)
+		}
+		target := u.ResolveReference(ref)
+		found[target.Path] = target.EscapedPath()
+	}
+	return found
+}
+
+func TestSpecialFileNames(t *testing.T) {
+	files := map[string]string{
+		"fonts/a b.js":       "a space",
+		"fonts/c+d.js":       "a plus",
+		"fonts/100%.png":     "\x89PNG\r\n\x1a\n\x00\xff",
+		"fonts/e#f.js":       "a hash",
+		"fonts/plain.woff2":  "plain",
+		"fonts/x y+z%#w.css": "all of them",
+	}
+	reg := newFakeRegistry(t)
+	reg.publish("fonts", "1.0.0", files)
+	s := newTestServer(t, reg, nil)
+	s.follow(s.get("/npm/fonts@1.0.0/fonts/plain.woff2"), 302)
+
+	// The directory listing, and the package page's file tree.
+	for _, listing := range []string{"/packages/fonts@1.0.0/fonts/", "/packages/fonts@1.0.0/"} {
+		res := s.get(listing, "Accept", "text/html")
+		targets := links(t, listing, responseBody(t, res, 200))
+		for file, content := range files {
+			target, ok := targets["/packages/fonts@1.0.0/"+file]
+			if !ok {
+				t.Errorf("%s: no link to %s in %v", listing, file, targets)
+				continue
+			}
+			if body := responseBody(t, s.get(target), 200); body != content {
+				t.Errorf("%s: got %q from %s, want %q", file, body, target, content)
+			}
+		}
+	}
+
+	// Requested directly, escaped as any client would.
+	for file, content := range files {
+		target := (&url.URL{Path: "/packages/fonts@1.0.0/" + file}).EscapedPath()
+		if body := responseBody(t, s.get(target), 200); body != content {
+			t.Errorf("%s: got %q from %s", file, body, target)
+		}
+	}
+}
+
+func TestBrotliStorage(t *testing.T) {
+	var large strings.Builder
+	for i := 0; large.Len() < 64<<10; i++ {
+		fmt.Fprintf(&large, "export const line%d = %d;\n", i, i*i)
+	}
+	files := map[string]string{
+		// Big enough to be stored compressed, small enough for the hot
+		// cache.
+		"small.js": "export const small = true;\n" + strings.Repeat("// padding\n", 60),
+		"large.js": large.String(),
+	}
+	reg := newFakeRegistry(t)
+	reg.publish("big", "1.0.0", files)
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.Storage = storageBrotli
+		cfg.HotCacheMaxFileSize = 1024
+	})
+	s.follow(s.get("/npm/big@1.0.0/small.js"), 302)
+	dir := versionDir(nil, "big", "1.0.0")
+
+	for name, want := range files {
+		target := "/packages/big@1.0.0/" + name
+
+		// As stored, to clients taking br.
+		res := s.get(target, "Accept-Encoding", "br")
+		if res.Header.Get("Content-Encoding") != "br" {
+			t.Fatalf("%s: Content-Encoding %q", name, res.Header.Get("Content-Encoding"))
+		}
+		if body, err := io.ReadAll(brotli.NewReader(res.Body)); err != nil || string(body) != want {
+			t.Errorf("%s: decoded %d bytes, %v", name, len(body), err)
+		}
+
+		// Decoded, to others.
+		res = s.get(target)
+		etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+		if body := responseBody(t, res, 200); body != want {
+			t.Errorf("%s: got %d bytes, want %d", name, len(body), len(want))
+		}
+		if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("%s: Content-Encoding %q, Content-Length %q", name, res.Header.Get("Content-Encoding"), res.Header.Get("Content-Length"))
+		}
+		if res.Header.Get("Content-Type") != "text/javascript; charset=utf-8" || res.Header.Get("Vary") != "Accept-Encoding" || etag == "" || modified == "" {
+			t.Errorf("%s: headers %v", name, res.Header)
+		}
+
+		// Only small files are kept decoded in the hot cache; the others
+		// are streamed.
+		_, cached := hotCache.get(hotCacheKey(dir, name, ""))
+		if cached != (name == "small.js") {
+			t.Errorf("%s: in the hot cache: %v", name, cached)
+		}
+
+		for _, conditional := range [][]string{
+			{"If-None-Match", etag},
+			{"If-None-Match", `"other", ` + etag},
+			{"If-None-Match", "*"},
+			{"If-Modified-Since", modified},
+		} {
+			res := s.get(target, conditional...)
+			responseBody(t, res, http.StatusNotModified)
+			if res.Header.Get("ETag") != etag {
+				t.Errorf("%s, %s: ETag %q", name, conditional[0], res.Header.Get("ETag"))
+			}
+		}
+		res = s.get(target, "If-None-Match", `"other"`, "If-Modified-Since", modified)
+		if body := responseBody(t, res, 200); body != want {
+			t.Errorf("%s: If-None-Match not matching got %d bytes", name, len(body))
+		}
+
+		res = s.request(http.MethodHead, target, nil)
+		if body := responseBody(t, res, 200); body != "" || res.Header.Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("%s: HEAD got %q, Content-Length %q", name, body, res.Header.Get("Content-Length"))
+		}
+	}
+
+	// What's streamed can't be seeked, so a range gets the whole file.
+	res := s.get("/packages/big@1.0.0/large.js", "Range", "bytes=0-9")
+	if body := responseBody(t, res, 200); body != files["large.js"] {
+		t.Errorf("Range: got %d bytes", len(body))
+	}
+	res = s.get("/packages/big@1.0.0/small.js", "Range", "bytes=0-5")
+	if body := responseBody(t, res, http.StatusPartialContent); body != "export" {
+		t.Errorf("Range: got %q", body)
+	}
+}
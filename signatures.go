@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	signaturesOff     = "off"
+	signaturesWarn    = "warn"
+	signaturesRequire = "require"
+)
+
+type registryKey struct {
+	KeyID   string     `json:"keyid"`
+	KeyType string     `json:"keytype"`
+	Scheme  string     `json:"scheme"`
+	Key     string     `json:"key"`
+	Expires *time.Time `json:"expires"`
+
+	pub *ecdsa.PublicKey
+}
+
+// keySet caches a registry's signing keys from /-/npm/v1/keys.
+type keySet struct {
+	tenant    *tenant
+	mu        sync.Mutex
+	keys      map[string]*registryKey
+	fetchedAt time.Time
+}
+
+var (
+	registryKeysMu sync.Mutex
+	registryKeys   = map[string]*keySet{} // by registry URL
+)
+
+// keysFor returns the key set of the tenant's registry.
+func keysFor(t *tenant) *keySet {
+	registryKeysMu.Lock()
+	defer registryKeysMu.Unlock()
+	s, ok := registryKeys[t.registry()]
+	if !ok {
+		s = &keySet{tenant: t}
+		registryKeys[t.registry()] = s
+	}
+	return s
+}
+
+// Refetching on an unknown key id is rate limited to this interval.
+const keyRefetchInterval = time.Minute
+
+func (s *keySet) get(keyID string) (*registryKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	age := time.Since(s.fetchedAt)
+	_, known := s.keys[keyID]
+	if s.keys == nil || age > config.SignatureKeysTTL.Duration || (!known && age > keyRefetchInterval) {
+		keys, err := fetchRegistryKeys(s.tenant)
+		if err != nil && s.keys == nil {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("refreshing registry keys, keeping the cached set: %s", err)
+		} else {
+			s.keys = keys
+		}
+		s.fetchedAt = time.Now()
+	}
+
+	return s.keys[keyID], nil
+}
+
+func fetchRegistryKeys(t *tenant) (map[string]*registryKey, error) {
+	req, err := newUpstreamRequest(t, http.MethodGet, t.registry()+"/-/npm/v1/keys")
+	if err != nil {
+		return nil, err
+	}
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching registry keys: %s", res.Status)
+	}
+
+	var doc struct {
+		Keys []*registryKey `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing registry keys: %w", err)
+	}
+
+	keys := map[string]*registryKey{}
+	for _, k := range doc.Keys {
+		der, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			log.Printf("skipping registry key %s: %s", k.KeyID, err)
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			log.Printf("skipping registry key %s: %s", k.KeyID, err)
+			continue
+		}
+		ec, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			log.Printf("skipping registry key %s: not an ECDSA key", k.KeyID)
+			continue
+		}
+		k.pub = ec
+		keys[k.KeyID] = k
+	}
+	return keys, nil
+}
+
+// verifySignatures checks a version's dist.signatures against the keys of
+// the tenant's registry. The signed message is "name@version:integrity". In
+// warn mode failures are only logged.
+func verifySignatures(t *tenant, pv *PackumentVersion, publishedAt time.Time) error {
+	mode := config.Signatures
+	if mode == "" || mode == signaturesOff {
+		return nil
+	}
+
+	err := checkSignatures(keysFor(t), pv, publishedAt)
+	if err != nil && mode == signaturesWarn {
+		log.Printf("signature verification of %s@%s failed, serving anyway: %s", pv.Name, pv.Version, err)
+		return nil
+	}
+	return err
+}
+
+func checkSignatures(keys *keySet, pv *PackumentVersion, publishedAt time.Time) error {
+	if len(pv.Dist.Signatures) == 0 {
+		return newError(http.StatusBadGateway, codeSignatureMissing, "%s@%s has no registry signature", pv.Name, pv.Version)
+	}
+	if pv.Dist.Integrity == "" {
+		return newError(http.StatusBadGateway, codeSignatureMissing, "%s@%s has no integrity to verify a signature against", pv.Name, pv.Version)
+	}
+
+	digest := sha256.Sum256([]byte(pv.Name + "@" + pv.Version + ":" + pv.Dist.Integrity))
+
+	for _, sig := range pv.Dist.Signatures {
+		key, err := keys.get(sig.KeyID)
+		if err != nil {
+			return wrapError(http.StatusBadGateway, codeUpstream, err, "loading registry keys")
+		}
+		if key == nil {
+			continue
+		}
+		if key.Expires != nil && !publishedAt.IsZero() && publishedAt.After(*key.Expires) {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(sig.Sig)
+		if err != nil {
+			continue
+		}
+		if ecdsa.VerifyASN1(key.pub, digest[:], raw) {
+			return nil
+		}
+	}
+
+	return newError(http.StatusBadGateway, codeSignatureInvalid, "no valid registry signature for %s@%s", pv.Name, pv.Version)
+}
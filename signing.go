@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With config.SigningKey, package files are served with
+//
+//	X-Repkg-Signature: keyid=<id>; file=<name@version/path>; sha256=<hex>; sig=<base64>
+//
+// where sig is the Ed25519 signature of signedMessage(file, sha256): the
+// file as escapePath renders it and the SHA-256 of its content, decoded,
+// that the manifest holds. Caches that don't trust the connection to us
+// check it against the keys of /api/signing-key.
+
+// signingPrefix starts every signed message, so that the signatures can't
+// be taken for anything else the key might sign.
+const signingPrefix = "repkg-signature-v1"
+
+// PreviousSigningKey is a public key that /api/signing-key keeps
+// publishing after a rotation, until Until, for responses cached while it
+// was current.
+type PreviousSigningKey struct {
+	// PublicKey is the base64 of the raw key, as /api/signing-key gives it.
+	PublicKey string    `json:"publicKey"`
+	Until     time.Time `json:"until"`
+}
+
+type signingKey struct {
+	KeyID     string     `json:"keyId"`
+	Algorithm string     `json:"algorithm"`
+	PublicKey string     `json:"publicKey"`
+	Current   bool       `json:"current,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+type signingKeys struct {
+	private ed25519.PrivateKey
+	id      string
+	keys    []signingKey
+}
+
+// signer is nil unless files are signed.
+var signer *signingKeys
+
+// keyID names a public key by the start of its SHA-256.
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// loadSigningKeys reads config.SigningKey and the previous keys.
+func loadSigningKeys(cfg Config) (*signingKeys, error) {
+	if cfg.SigningKey == "" {
+		if len(cfg.PreviousSigningKeys) > 0 {
+			return nil, errors.New("previousSigningKeys without a signingKey")
+		}
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", cfg.SigningKey)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.SigningKey, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", cfg.SigningKey)
+	}
+	pub := private.Public().(ed25519.PublicKey)
+	s := &signingKeys{private: private, id: keyID(pub)}
+	s.keys = append(s.keys, signingKey{KeyID: s.id, Algorithm: "ed25519", PublicKey: base64.StdEncoding.EncodeToString(pub), Current: true})
+	for i, k := range cfg.PreviousSigningKeys {
+		raw, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("previousSigningKeys[%d]: not a base64 Ed25519 public key", i)
+		}
+		if k.Until.IsZero() {
+			return nil, fmt.Errorf("previousSigningKeys[%d]: until is required", i)
+		}
+		until := k.Until
+		s.keys = append(s.keys, signingKey{KeyID: keyID(raw), Algorithm: "ed25519", PublicKey: k.PublicKey, Until: &until})
+	}
+	return s, nil
+}
+
+// signedMessage is what a signature is over.
+func signedMessage(file, sha256 string) []byte {
+	return []byte(signingPrefix + "\n" + file + "\n" + sha256)
+}
+
+// signFile returns the X-Repkg-Signature of a file, "" when files aren't
+// signed or the manifest has no hash for it.
+func signFile(m *Manifest, f *ManifestFile) string {
+	if signer == nil || f.SHA256 == "" {
+		return ""
+	}
+	file := m.Name + "@" + m.Version + "/" + escapePath(f.Path)
+	sig := ed25519.Sign(signer.private, signedMessage(file, f.SHA256))
+	return fmt.Sprintf("keyid=%s; file=%s; sha256=%s; sig=%s", signer.id, file, f.SHA256, base64.StdEncoding.EncodeToString(sig))
+}
+
+// serveSigningKey handles GET /api/signing-key, listing the current key
+// and the previous ones still within their grace period.
+func serveSigningKey(c *gin.Context) {
+	if signer == nil {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "files aren't signed; set signingKey"))
+		return
+	}
+	keys := []signingKey{}
+	for _, k := range signer.keys {
+		if k.Until == nil || time.Now().Before(*k.Until) {
+			keys = append(keys, k)
+		}
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	writeJSON(c, http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"sort"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// SizeStats is what a version costs a bundle, as reported by /api/size.
+type SizeStats struct {
+	Unpacked int64      `json:"unpacked"`
+	Gzip     int64      `json:"gzip"`
+	Brotli   int64      `json:"brotli"`
+	Files    int        `json:"files"`
+	Entry    *FileSize  `json:"entry,omitempty"`
+	Largest  []FileSize `json:"largest"`
+}
+
+type FileSize struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Gzip   int64  `json:"gzip"`
+	Brotli int64  `json:"brotli"`
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func gzipSize(data []byte) int64 {
+	var n countingWriter
+	w, _ := gzip.NewWriterLevel(&n, gzip.BestCompression)
+	w.Write(data)
+	w.Close()
+	return int64(n)
+}
+
+func brotliSize(data []byte) int64 {
+	var n countingWriter
+	w := brotli.NewWriterLevel(&n, brotliLevel)
+	w.Write(data)
+	w.Close()
+	return int64(n)
+}
+
+// computeSizes compresses every file of a version. Files already stored as
+// brotli blobs reuse the blob's size.
+func computeSizes(dir string, m *Manifest) (*SizeStats, error) {
+	s := &SizeStats{}
+	sizes := make([]FileSize, 0, len(m.Files))
+	for i := range m.Files {
+		f := &m.Files[i]
+		if deny.denied(f.Path) {
+			continue
+		}
+		data, err := readStoredFile(dir, f)
+		if err != nil {
+			return nil, err
+		}
+		fsize := FileSize{Path: f.Path, Size: f.Size, Gzip: gzipSize(data)}
+		if f.Stored == "br" {
+			fsize.Brotli = f.StoredSize
+		} else {
+			fsize.Brotli = brotliSize(data)
+		}
+		s.Unpacked += fsize.Size
+		s.Gzip += fsize.Gzip
+		s.Brotli += fsize.Brotli
+		sizes = append(sizes, fsize)
+	}
+	s.Files = len(sizes)
+
+	if entry, _, err := resolveEntry(dir, m, envProduction); err == nil {
+		for i := range sizes {
+			if sizes[i].Path == entry {
+				e := sizes[i]
+				s.Entry = &e
+			}
+		}
+	}
+
+	sort.SliceStable(sizes, func(i, j int) bool { return sizes[i].Size > sizes[j].Size })
+	s.Largest = sizes[:min(5, len(sizes))]
+	return s, nil
+}
+
+// serveSize handles /api/size/:scope/:name/:version. Sizes are computed on
+// the first request for a version and kept in its manifest.
+func serveSize(c *gin.Context) {
+	packageName, rest, err := parsePackageParams(c.Param("package"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	spec := ""
+	if len(rest) > 0 {
+		spec = rest[0]
+	}
+
+	ep, err := ensurePackage(packageName, spec, fetchOptions{Tenant: tenantOf(c), Admin: isAdmin(c.Request), FetchedBy: fetchedBy(c)})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	m := ep.Manifest
+
+	if m.Sizes == nil {
+		dir := versionDir(tenantOf(c), packageName, m.Version)
+		sizes, err := computeSizes(dir, m)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		m, err = updateManifest(tenantOf(c), dir, packageName, m.Version, func(m *Manifest) { m.Sizes = sizes })
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+	}
+
+	setResolveHeaders(c.Writer, ep)
+	c.JSON(http.StatusOK, gin.H{
+		"name":    m.Name,
+		"version": m.Version,
+		"sizes":   m.Sizes,
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// linkSourceMap prepares a transform's output for serving next to its
+// sidecar: the sources of the map are rewritten from the bundler namespace
+// to repkg URLs, so devtools never need the registry, and code gets a
+// sourceMappingURL relative to its own URL.
+func linkSourceMap(t *tenant, code, sourceMap []byte, name string) ([]byte, []byte, error) {
+	var sm map[string]any
+	if err := json.Unmarshal(sourceMap, &sm); err != nil {
+		return nil, nil, err
+	}
+	if sources, ok := sm["sources"].([]any); ok {
+		for i, s := range sources {
+			if src, ok := s.(string); ok {
+				sources[i] = sourceURL(t, src)
+			}
+		}
+	}
+	sm["file"] = name
+
+	out, err := json.Marshal(sm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	linked := append(append([]byte{}, code...), "//# sourceMappingURL="+url.PathEscape(name+".map")+"?tv="+strconv.Itoa(transformVersion)+"\n"...)
+	return linked, out, nil
+}
+
+// sourceURL maps "repkg:name@version/path" to the file's /packages URL.
+func sourceURL(t *tenant, src string) string {
+	rest, ok := strings.CutPrefix(src, bundleNamespace+":")
+	if !ok {
+		return src
+	}
+	pkgDir, rel := splitPackagePath(rest)
+	name, version := parsePkgDir(pkgDir)
+	return packageURL(t, name, version, rel)
+}
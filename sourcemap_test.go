@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSourceMapURLs(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("app", "1.0.0", map[string]string{
+		"package.json": `{"name": "app", "version": "1.0.0", "main": "index.js", "dependencies": {"pad": "^1.0.0"}}`,
+		"index.js":     `import pad from "pad"; export default function app() { return pad("app"); }`,
+		"lib/util.js":  `export const util = process.env.NODE_ENV === "production" ? "prod" : "dev";`,
+	})
+	reg.publish("pad", "1.0.0", map[string]string{
+		"package.json": `{"name": "pad", "version": "1.0.0", "main": "index.js"}`,
+		"index.js":     `export default function pad(s) { return " " + s; }`,
+	})
+	reg.publish("cjs", "1.0.0", map[string]string{
+		"package.json": `{"name": "cjs", "version": "1.0.0", "main": "main.js"}`,
+		"main.js":      `module.exports = { answer: require("./answer.js") };`,
+		"answer.js":    `module.exports = 42;`,
+	})
+	reg.publish("@scope/pkg", "1.0.0", map[string]string{
+		"package.json": `{"name": "@scope/pkg", "version": "1.0.0", "main": "lib/main.js"}`,
+		"lib/main.js":  `export const scoped = true;`,
+	})
+	s := newTestServer(t, reg, nil)
+
+	for _, tc := range []struct {
+		name, path string
+		sources    []string // in the order esbuild reads them
+	}{
+		{"ESM bundle", "/npm/app@1.0.0?bundle", []string{"/packages/pad@1.0.0/index.js", "/packages/app@1.0.0/index.js"}},
+		{"CommonJS converted to ESM", "/npm/cjs@1.0.0?bundle", []string{"/packages/cjs@1.0.0/answer.js", "/packages/cjs@1.0.0/main.js"}},
+		{"bundle of a file", "/npm/app@1.0.0/lib/util.js?bundle", []string{"/packages/app@1.0.0/lib/util.js"}},
+		{"development bundle", "/npm/app@1.0.0/lib/util.js?bundle&env=development", []string{"/packages/app@1.0.0/lib/util.js"}},
+		{"scoped package", "/npm/@scope/pkg@1.0.0?bundle", []string{"/packages/@scope/pkg@1.0.0/lib/main.js"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loc := s.follow(s.get(tc.path), 302)
+			artifact, _, _ := strings.Cut(loc, "?")
+			name := artifact[strings.LastIndex(artifact, "/")+1:]
+			code := strings.TrimRight(responseBody(t, s.get(loc), 200), "\n")
+			last := code[strings.LastIndex(code, "\n")+1:]
+			if want := "//# sourceMappingURL=" + name + ".map?tv=3"; last != want {
+				t.Fatalf("ends with %q, want %q", last, want)
+			}
+
+			// Resolved against the artifact's URL, as devtools do.
+			res := s.get(artifact + ".map?tv=3")
+			if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type %q", ct)
+			}
+			if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+				t.Errorf("Cache-Control %q", cc)
+			}
+			var sm struct {
+				File           string
+				Sources        []string
+				SourcesContent []string
+			}
+			if err := json.Unmarshal([]byte(responseBody(t, res, 200)), &sm); err != nil {
+				t.Fatal(err)
+			}
+			if sm.File != name {
+				t.Errorf("file %q, want %q", sm.File, name)
+			}
+			if !slices.Equal(sm.Sources, tc.sources) {
+				t.Errorf("sources %q, want %q", sm.Sources, tc.sources)
+			}
+			if len(sm.SourcesContent) != len(sm.Sources) {
+				t.Fatalf("%d sources, %d contents", len(sm.Sources), len(sm.SourcesContent))
+			}
+			for i, src := range sm.Sources {
+				if body := responseBody(t, s.get(src), 200); body != sm.SourcesContent[i] {
+					t.Errorf("%s: served %q, embedded %q", src, body, sm.SourcesContent[i])
+				}
+			}
+		})
+	}
+}
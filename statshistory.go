@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every config.StatsSnapshotInterval, the /api/stats document of each
+// tenant and what the counters of /metrics gained since the last snapshot
+// are written to a file of their own in statsDir, for deployments without
+// Prometheus to collect with a script. Snapshots older than
+// config.StatsSnapshotRetention are removed as new ones are written.
+
+// The layout of snapshot file names, which sort as they were taken.
+const statsSnapshotLayout = "20060102T150405Z"
+
+// statsSnapshot is one snapshot file.
+type statsSnapshot struct {
+	At time.Time `json:"at"`
+	// Since is when the counters were last snapshotted, or repkg
+	// started; Counters holds what they gained since, by name and
+	// labels as /metrics renders them, leaving out those that didn't.
+	Since    time.Time          `json:"since"`
+	Stats    gin.H              `json:"stats"`
+	Tenants  map[string]gin.H   `json:"tenants,omitempty"`
+	Counters map[string]float64 `json:"counters"`
+}
+
+func statsDir() string {
+	return filepath.Join(config.DataDir, internalDir, "stats")
+}
+
+// runStatsSnapshots writes a snapshot every interval.
+func runStatsSnapshots(interval time.Duration) {
+	since, last := time.Now(), map[string]float64{}
+	for range time.Tick(interval) {
+		now := time.Now().UTC()
+		counters := counterValues()
+		snap := &statsSnapshot{At: now, Since: since.UTC(), Stats: statsFor(nil, 20, ""), Counters: map[string]float64{}}
+		for k, v := range counters {
+			if d := v - last[k]; d != 0 {
+				snap.Counters[k] = d
+			}
+		}
+		if len(tenants) > 0 {
+			snap.Tenants = map[string]gin.H{}
+			for name, t := range tenants {
+				snap.Tenants[name] = statsFor(t, 20, "")
+			}
+		}
+		if err := writeStatsSnapshot(snap); err != nil {
+			log.Printf("stats snapshot: %s", err)
+			continue
+		}
+		since, last = now, counters
+		pruneStatsSnapshots(now.Add(-config.StatsSnapshotRetention.Duration))
+	}
+}
+
+// writeStatsSnapshot writes a snapshot to a temporary file and renames it
+// into place, so scripts never read one half written.
+func writeStatsSnapshot(snap *statsSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeDerived(filepath.Join(statsDir(), "stats-"+snap.At.Format(statsSnapshotLayout)+".json"), data)
+}
+
+// statsSnapshotTime returns when the snapshot of a file name was taken.
+func statsSnapshotTime(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, "stats-")
+	stamp, ok2 := strings.CutSuffix(stamp, ".json")
+	if !ok || !ok2 {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(statsSnapshotLayout, stamp)
+	return at, err == nil
+}
+
+// statsSnapshotFiles lists the snapshots taken after from, oldest first.
+func statsSnapshotFiles(from time.Time) []string {
+	entries, _ := os.ReadDir(statsDir())
+	var names []string
+	for _, e := range entries {
+		if at, ok := statsSnapshotTime(e.Name()); ok && at.After(from) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pruneStatsSnapshots(before time.Time) {
+	entries, _ := os.ReadDir(statsDir())
+	for _, e := range entries {
+		if at, ok := statsSnapshotTime(e.Name()); ok && at.Before(before) {
+			p := filepath.Join(statsDir(), e.Name())
+			if err := os.Remove(p); err != nil {
+				log.Printf("stats snapshot: %s", err)
+			}
+			index.removeFile(p)
+		}
+	}
+}
+
+// serveStatsHistory handles GET /api/stats/history, the snapshots of the
+// last ?hours= (24 by default), oldest first.
+func serveStatsHistory(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	if config.StatsSnapshotInterval.Duration <= 0 {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "stats snapshots are off; set statsSnapshotInterval"))
+		return
+	}
+	hours := 24
+	if q := c.Query("hours"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n <= 0 {
+			writeError(c, newError(http.StatusBadRequest, codeBadRequest, "invalid hours %q", q))
+			return
+		}
+		hours = min(n, 24*366*10)
+	}
+
+	snapshots := []json.RawMessage{}
+	for _, name := range statsSnapshotFiles(time.Now().Add(-time.Duration(hours) * time.Hour)) {
+		data, err := os.ReadFile(filepath.Join(statsDir(), name))
+		if err != nil || !json.Valid(data) {
+			// Pruned meanwhile.
+			continue
+		}
+		snapshots = append(snapshots, data)
+	}
+	writeJSON(c, http.StatusOK, gin.H{"interval": config.StatsSnapshotInterval.String(), "snapshots": snapshots})
+}
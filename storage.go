@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	storageRaw    = "raw"
+	storageBrotli = "brotli"
+)
+
+const (
+	brotliLevel = 9
+
+	// Smaller files don't shrink enough to be worth decompressing.
+	minCompressSize = 512
+)
+
+// Text formats worth storing compressed. Images, fonts, wasm and archives
+// are either compressed already or need to stay byte-addressable, so they
+// are always kept raw.
+var compressibleExts = map[string]bool{
+	".js": true, ".mjs": true, ".cjs": true, ".jsx": true,
+	".ts": true, ".mts": true, ".cts": true, ".tsx": true,
+	".json": true, ".map": true, ".css": true, ".scss": true, ".less": true,
+	".html": true, ".htm": true, ".svg": true, ".xml": true,
+	".md": true, ".markdown": true, ".txt": true, ".yml": true, ".yaml": true,
+	".flow": true, ".vue": true, ".svelte": true,
+}
+
+func compressible(p string) bool {
+	return compressibleExts[strings.ToLower(path.Ext(p))]
+}
+
+// compressVersion replaces the compressible files of a freshly extracted
+// version with brotli blobs when config.Storage asks for it, updating the
+// manifest entries in place.
+func compressVersion(dir string, m *Manifest) error {
+	if config.Storage != storageBrotli {
+		return nil
+	}
+	m.Storage = storageBrotli
+
+	paths := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		paths[f.Path] = true
+	}
+
+	for i := range m.Files {
+		f := &m.Files[i]
+		// A package shipping its own foo.js.br keeps foo.js raw.
+		if !compressible(f.Path) || f.Size < minCompressSize || paths[f.Path+".br"] {
+			continue
+		}
+
+		src := f.diskPath(dir)
+		n, err := brotliFile(src, src+".br")
+		if err != nil {
+			os.Remove(src + ".br")
+			return err
+		}
+		if n >= f.Size {
+			os.Remove(src + ".br")
+			continue
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+		f.Stored, f.StoredSize = "br", n
+	}
+	return nil
+}
+
+func brotliFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	w := brotli.NewWriterLevel(out, brotliLevel)
+	if _, err := io.Copy(w, in); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func readBrotli(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(brotli.NewReader(f))
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding allows enc.
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+func contentType(name string) string {
+	if t := typeByExtension(name); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// typeByExtension is mime.TypeByExtension, plus source maps and wasm.
+func typeByExtension(name string) string {
+	switch path.Ext(name) {
+	case ".map":
+		return "application/json; charset=utf-8"
+	case ".wasm":
+		// Not in every system's mime.types, and required by
+		// WebAssembly.instantiateStreaming.
+		return "application/wasm"
+	}
+	if t := fontType(name); t != "" {
+		return t
+	}
+	if t := moduleType(name); t != "" {
+		return t
+	}
+	return mime.TypeByExtension(path.Ext(name))
+}
+
+// sniffLen is how much of a file sniffType looks at, as much as
+// http.DetectContentType considers.
+const sniffLen = 512
+
+// sniffType guesses the type of a file with no telling extension from its
+// first bytes, head, of which there are more when truncated. Text is UTF-8
+// if it decodes as such and Latin-1 otherwise; scripts starting with "#!"
+// are text whatever else they hold.
+func sniffType(head []byte, truncated bool) string {
+	t := http.DetectContentType(head)
+	if t != "text/plain; charset=utf-8" {
+		if t == "application/octet-stream" && strings.HasPrefix(string(head), "#!") {
+			return "text/plain"
+		}
+		return t
+	}
+	text := strings.TrimPrefix(string(head), "\xef\xbb\xbf")
+	if truncated {
+		// Don't hold a character cut off at sniffLen against the file.
+		for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(text[i]) {
+				if !utf8.FullRuneInString(text[i:]) {
+					text = text[:i]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.ValidString(text) {
+		return "text/plain; charset=iso-8859-1"
+	}
+	return t
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tenants keep their versions, packuments and derived files under this
+// directory of config.DataDir, in a tree laid out like the data dir itself.
+// Like internalDir, it can't collide with a package name.
+const tenantsDir = ".tenants"
+
+// tenant is a configured tenant. The default tenant, made of the top-level
+// settings, is a nil *tenant: every method falls back to those, so
+// deployments without tenants work as if they didn't exist. Tenants share
+// the process, the in-memory caches and the eviction budget.
+type tenant struct {
+	name string
+	TenantConfig
+}
+
+var tenants = map[string]*tenant{}
+
+func setupTenants(cfg Config) map[string]*tenant {
+	list := map[string]*tenant{}
+	for name, tc := range cfg.Tenants {
+		list[name] = &tenant{name: name, TenantConfig: tc}
+	}
+	return list
+}
+
+// validTenantName accepts the names npm allows for a package without a
+// scope, so that they are safe in paths and URLs, except "default", which
+// labels the default tenant in metrics.
+func validTenantName(name string) bool {
+	return name != "default" && !strings.HasPrefix(name, "@") && validPackageName(name)
+}
+
+// allTenants returns the default tenant followed by the configured ones by
+// name.
+func allTenants() []*tenant {
+	list := []*tenant{nil}
+	for _, t := range tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list[1:], func(i, j int) bool { return list[i+1].name < list[j+1].name })
+	return list
+}
+
+func (t *tenant) dataDir() string {
+	if t == nil {
+		return config.DataDir
+	}
+	return filepath.Join(config.DataDir, tenantsDir, t.name)
+}
+
+func (t *tenant) registry() string {
+	if t == nil || t.Registry == "" {
+		return config.Registry
+	}
+	return t.Registry
+}
+
+func (t *tenant) registryToken() string {
+	if t == nil || t.Registry == "" {
+		return config.RegistryToken
+	}
+	return t.RegistryToken
+}
+
+func (t *tenant) registryAuth() *BasicAuth {
+	if t == nil || t.Registry == "" {
+		return config.RegistryAuth
+	}
+	return t.RegistryAuth
+}
+
+func (t *tenant) allowlist() []string {
+	if t == nil || len(t.Allowlist) == 0 {
+		return config.Allowlist
+	}
+	return t.Allowlist
+}
+
+// Name is the tenant's name, "" for the default tenant.
+func (t *tenant) Name() string {
+	if t == nil {
+		return ""
+	}
+	return t.name
+}
+
+// label names the tenant in metrics.
+func (t *tenant) label() string {
+	if t == nil {
+		return "default"
+	}
+	return t.name
+}
+
+// qualify prefixes key with the tenant's name, for maps shared by all
+// tenants. Keys of the default tenant are left as they are.
+func (t *tenant) qualify(key string) string {
+	if t == nil {
+		return key
+	}
+	return t.name + ":" + key
+}
+
+// urlPrefix is what the tenant's URLs start with.
+func (t *tenant) urlPrefix() string {
+	if t == nil {
+		return ""
+	}
+	return "/t/" + t.name
+}
+
+var (
+	tenantRequests = newCounter("repkg_tenant_requests_total", "Requests per tenant.")
+
+	_ = newGaugeVecFunc("repkg_tenant_cache_versions", "Package versions stored on disk per tenant.", "tenant", func() map[string]float64 {
+		return tenantTotals(func(versions int, _ int64) float64 { return float64(versions) })
+	})
+	_ = newGaugeVecFunc("repkg_tenant_cache_bytes", "Bytes stored on disk per tenant, including its packuments and derived files.", "tenant", func() map[string]float64 {
+		return tenantTotals(func(_ int, bytes int64) float64 { return float64(bytes) })
+	})
+)
+
+// tenantTotals maps each tenant to a value computed from its cache totals,
+// when there are tenants.
+func tenantTotals(value func(versions int, bytes int64) float64) map[string]float64 {
+	values := map[string]float64{}
+	if len(tenants) == 0 {
+		return values
+	}
+	for _, t := range allTenants() {
+		n, versionBytes, internalBytes := index.totalsFor(t)
+		values[t.label()] = value(n, versionBytes+internalBytes)
+	}
+	return values
+}
+
+const tenantKey = "repkg.tenant"
+
+// tenantOf returns the tenant a request was routed to.
+func tenantOf(c *gin.Context) *tenant {
+	t, _ := c.Get(tenantKey)
+	tt, _ := t.(*tenant)
+	return tt
+}
+
+// selectTenant picks the tenant whose API key a request carries in
+// X-Api-Key, the default tenant without one, and counts the request
+// against the tenant it was finally routed to.
+func selectTenant(c *gin.Context) {
+	if len(tenants) == 0 {
+		return
+	}
+	if key := c.GetHeader("X-Api-Key"); key != "" {
+		t := tenantByKey(key)
+		if t == nil {
+			writeError(c, newError(http.StatusUnauthorized, codeUnauthorized, "unknown API key"))
+			c.Abort()
+			return
+		}
+		c.Set(tenantKey, t)
+	}
+	c.Next()
+	tenantRequests.Inc("tenant", tenantOf(c).label())
+}
+
+func tenantByKey(key string) *tenant {
+	for _, t := range tenants {
+		if t.APIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(t.APIKey)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// requireTenant routes requests below /t/:tenant to that tenant. Tenants with
+// an API key only answer requests carrying it, or the admin token.
+func requireTenant(c *gin.Context) {
+	t, ok := tenants[c.Param("tenant")]
+	if !ok {
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "no tenant %q", c.Param("tenant")))
+		c.Abort()
+		return
+	}
+	if t.APIKey != "" && tenantOf(c) != t && !isAdmin(c.Request) {
+		writeError(c, newError(http.StatusUnauthorized, codeUnauthorized, "API key of tenant %s required", t.name))
+		c.Abort()
+		return
+	}
+	c.Set(tenantKey, t)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttled readers read at most this much at a time, so waits stay short
+// and concurrent downloads take turns.
+const throttleChunk = 32 << 10
+
+var (
+	upstreamBytes    = newCounter("repkg_upstream_bytes_total", "Tarball bytes downloaded from upstream.")
+	throttleWaits    = newCounter("repkg_upstream_throttle_waits_total", "Times a tarball download waited for bandwidth.")
+	throttledSeconds = newCounter("repkg_upstream_throttled_seconds_total", "Time tarball downloads spent waiting for bandwidth.")
+
+	_ = newGaugeFunc("repkg_upstream_throughput_bytes", "Tarball bytes downloaded per second, averaged over the last few seconds.", func() float64 {
+		return upstreamRate.rate()
+	})
+
+	upstreamRate = &rateMeter{}
+
+	// upstreamBucket is shared by every download when
+	// config.UpstreamBandwidth is set.
+	upstreamBucket     *tokenBucket
+	upstreamBucketOnce sync.Once
+)
+
+// tokenBucket hands out bytes at rate per second, with up to a second's
+// worth saved up while idle. Readers that take more than is there go into
+// debt and wait it off, so waiting readers are served in turn.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	return &tokenBucket{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// reserve takes n bytes and returns how long to wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledReader reads from r no faster than each of its buckets allows.
+type throttledReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	upstreamBytes.Add(float64(n))
+	upstreamRate.add(n)
+
+	var wait time.Duration
+	for _, b := range t.buckets {
+		if d := b.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		throttleWaits.Inc()
+		throttledSeconds.Add(wait.Seconds())
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// throttleDownload wraps the body of a tarball download with the
+// bandwidth limits in config: UpstreamBandwidth for all downloads
+// together and DownloadBandwidth for each. Zero limits are left out.
+func throttleDownload(r io.Reader) io.Reader {
+	return &throttledReader{r: r, buckets: downloadBuckets()}
+}
+
+// downloadBuckets returns the buckets for one download, which its readers
+// share.
+func downloadBuckets() []*tokenBucket {
+	var buckets []*tokenBucket
+	if config.UpstreamBandwidth > 0 {
+		upstreamBucketOnce.Do(func() { upstreamBucket = newTokenBucket(config.UpstreamBandwidth) })
+		buckets = append(buckets, upstreamBucket)
+	}
+	if config.DownloadBandwidth > 0 {
+		buckets = append(buckets, newTokenBucket(config.DownloadBandwidth))
+	}
+	return buckets
+}
+
+// rateMeter counts bytes in one-second slots to report recent throughput.
+type rateMeter struct {
+	mu    sync.Mutex
+	slots [5]struct {
+		second int64
+		bytes  int64
+	}
+}
+
+func (m *rateMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	s := &m.slots[now%int64(len(m.slots))]
+	if s.second != now {
+		s.second, s.bytes = now, 0
+	}
+	s.bytes += int64(n)
+}
+
+// rate averages the last complete seconds.
+func (m *rateMeter) rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	var total int64
+	for _, s := range m.slots {
+		if s.second < now && s.second >= now-int64(len(m.slots)-1) {
+			total += s.bytes
+		}
+	}
+	return float64(total) / float64(len(m.slots)-1)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fetchPhaseSeconds = newHistogram("repkg_fetch_phase_seconds", "Time spent in each phase of fetching a version.",
+	[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+
+// fetchTiming collects how long the phases of a request's fetches took:
+// queue (waiting for a prefetch worker), resolve, download, verify, extract
+// and transform. Phases that happen more than once, as when a bundle
+// fetches its dependencies, add up.
+type fetchTiming struct {
+	mu     sync.Mutex
+	phases []string
+	totals map[string]time.Duration
+
+	// span is what the phases are traced below, if anything.
+	span *span
+}
+
+func newFetchTiming(parent *span) *fetchTiming {
+	return &fetchTiming{totals: map[string]time.Duration{}, span: parent}
+}
+
+// parent returns the span the phases are traced below, if any.
+func (t *fetchTiming) parent() *span {
+	if t == nil {
+		return nil
+	}
+	return t.span
+}
+
+// begin starts a phase, which lasts until its span is finished. It may be
+// called on a nil fetchTiming.
+func (t *fetchTiming) begin(phase string) *span {
+	s := childSpan(t.parent(), phase, spanInternal)
+	s.timing = t
+	return s
+}
+
+// setServerTiming reports the phases of a request that fetched or built
+// something as a Server-Timing header. Cache hits get none.
+func setServerTiming(w http.ResponseWriter, t *fetchTiming) {
+	if t != nil && (t.has("download") || t.has("transform")) {
+		w.Header().Set("Server-Timing", t.serverTiming())
+	}
+}
+
+// record adds the time since start to a phase. It may be called on a nil
+// fetchTiming; the histogram is updated either way.
+func (t *fetchTiming) record(phase string, start time.Time) {
+	d := time.Since(start)
+	fetchPhaseSeconds.Observe(d.Seconds(), "phase", phase)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.totals[phase]; !ok {
+		t.phases = append(t.phases, phase)
+	}
+	t.totals[phase] += d
+}
+
+// has reports whether a phase was recorded.
+func (t *fetchTiming) has(phase string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.totals[phase]
+	return ok
+}
+
+// serverTiming renders the phases as a Server-Timing header value.
+func (t *fetchTiming) serverTiming() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, len(t.phases))
+	for i, phase := range t.phases {
+		parts[i] = fmt.Sprintf("%s;dur=%.1f", phase, float64(t.totals[phase].Microseconds())/1000)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String renders the phases for logs, as phase=duration pairs.
+func (t *fetchTiming) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, len(t.phases))
+	for i, phase := range t.phases {
+		parts[i] = phase + "=" + t.totals[phase].Round(time.Millisecond).String()
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tracing follows W3C Trace Context: requests join the trace of their
+// traceparent header, or start one for config.TraceSampleRatio of them, and
+// registry requests carry it on. Spans are sent to config.OTLPEndpoint with
+// OTLP over HTTP, as JSON; nothing is traced without one.
+
+// Span kinds, as OTLP numbers them.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// How spans are batched for export.
+const (
+	traceBatchSize     = 512
+	traceQueueMax      = 8192
+	traceFlushInterval = 5 * time.Second
+)
+
+var spansDropped = newCounter("repkg_trace_spans_dropped_total", "Spans not exported because the export queue was full or the collector failed.")
+
+// span is a timed operation. Spans of fetch phases also add to their
+// request's fetchTiming when they are finished. The trace fields are zero
+// when the operation isn't traced, and spans are only exported when sampled.
+type span struct {
+	name  string
+	kind  int
+	start time.Time
+	end   time.Time
+	// timing is set on the spans of fetch phases.
+	timing *fetchTiming
+
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	mu     sync.Mutex
+	attrs  []spanAttr
+	status string // the error the operation ended with
+}
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+func (s *span) traced() bool {
+	return s != nil && s.traceID != [16]byte{}
+}
+
+// childSpan starts a span below parent, traced if parent is.
+func childSpan(parent *span, name string, kind int) *span {
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent.traced() {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.id, parent.sampled
+		rand.Read(s.id[:])
+	}
+	return s
+}
+
+// set adds an attribute: a string, bool, integer or float.
+func (s *span) set(key string, value any) {
+	if !s.traced() {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+	s.mu.Unlock()
+}
+
+// fail records the error the operation failed with.
+func (s *span) fail(err error) {
+	if !s.traced() || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status = err.Error()
+	s.mu.Unlock()
+}
+
+// finish ends the span, adding it to its fetchTiming and queueing it for
+// export. It may be called on a nil span, and again once it has ended.
+func (s *span) finish() {
+	if s == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	if s.timing != nil {
+		s.timing.record(s.name, s.start)
+	}
+	if s.sampled {
+		traces.add(s)
+	}
+}
+
+// inject sets the traceparent header of an outgoing request.
+func (s *span) inject(h http.Header) {
+	if !s.traced() {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	h.Set("traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.id[:])+"-"+flags)
+}
+
+// traceUpstream starts a client span below parent for a request to a
+// registry or tarball host, and has the request carry it on.
+func traceUpstream(parent *span, req *http.Request) *span {
+	s := childSpan(parent, req.Method+" "+req.URL.Host, spanClient)
+	s.set("http.request.method", req.Method)
+	s.set("server.address", req.URL.Host)
+	s.set("url.full", redactURL(req.URL))
+	s.inject(req.Header)
+	return s
+}
+
+// done finishes the span of an upstream request with its outcome.
+func (s *span) done(res *http.Response, err error) {
+	if err != nil {
+		s.fail(err)
+	} else {
+		s.set("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= 400 {
+			s.fail(errors.New(res.Status))
+		}
+	}
+	s.finish()
+}
+
+// parseTraceparent reads a W3C traceparent header.
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// traceRequests starts a server span for each request, in the caller's
+// trace when it sent a traceparent, sampled as the caller decided.
+func traceRequests(c *gin.Context) {
+	if config.OTLPEndpoint == "" {
+		c.Next()
+		return
+	}
+	s := &span{kind: spanServer, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(c.GetHeader("traceparent")); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mathrand.Float64() < config.TraceSampleRatio
+	}
+	rand.Read(s.id[:])
+	c.Set("span", s)
+
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	s.name = c.Request.Method + " " + route
+	s.set("http.request.method", c.Request.Method)
+	s.set("http.route", route)
+	s.set("url.path", c.Request.URL.Path)
+	s.set("http.response.status_code", c.Writer.Status())
+	if t := tenantOf(c); t != nil {
+		s.set("repkg.tenant", t.name)
+	}
+	if c.Writer.Status() >= 500 {
+		s.fail(fmt.Errorf("%s", http.StatusText(c.Writer.Status())))
+	}
+	s.finish()
+}
+
+// requestSpan returns the server span of a request, nil when untraced.
+func requestSpan(c *gin.Context) *span {
+	s, _ := c.Value("span").(*span)
+	return s
+}
+
+type spanContextKey struct{}
+
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// spanExporter sends finished spans somewhere.
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+// spanQueue batches sampled spans for its exporter.
+type spanQueue struct {
+	mu       sync.Mutex
+	spans    []*span
+	exporter spanExporter
+	wake     chan struct{}
+}
+
+var traces = &spanQueue{wake: make(chan struct{}, 1)}
+
+func (q *spanQueue) add(s *span) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.exporter == nil {
+		return
+	}
+	if len(q.spans) >= traceQueueMax {
+		spansDropped.Inc()
+		return
+	}
+	q.spans = append(q.spans, s)
+	if len(q.spans) >= traceBatchSize {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the queued spans every traceFlushInterval, or as soon as a
+// batch is full, for as long as the process runs.
+func (q *spanQueue) run() {
+	tick := time.NewTicker(traceFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-q.wake:
+		}
+		q.flush()
+	}
+}
+
+// flush exports what is queued, in batches.
+func (q *spanQueue) flush() {
+	for {
+		q.mu.Lock()
+		n := min(len(q.spans), traceBatchSize)
+		batch := q.spans[:n:n]
+		q.spans = q.spans[n:]
+		exporter := q.exporter
+		q.mu.Unlock()
+		if n == 0 || exporter == nil {
+			return
+		}
+		if err := exporter.export(batch); err != nil {
+			log.Printf("trace: exporting %d spans: %s", n, err)
+			spansDropped.Inc()
+		}
+	}
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector as JSON.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{url: strings.TrimSuffix(endpoint, "/") + "/v1/traces", client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", res.Status)
+	}
+	return nil
+}
+
+// otlpRequest renders spans as an OTLP ExportTraceServiceRequest.
+func otlpRequest(spans []*span) map[string]any {
+	list := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.status != "" {
+			o["status"] = map[string]any{"code": 2, "message": s.status}
+		}
+		s.mu.Unlock()
+		list[i] = o
+	}
+	resource := otlpAttributes([]spanAttr{{"service.name", "repkg"}, {"service.version", currentBuildInfo().Version}})
+	return map[string]any{"resourceSpans": []any{map[string]any{
+		"resource":   map[string]any{"attributes": resource},
+		"scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "repkg"}, "spans": list}},
+	}}}
+}
+
+func otlpAttributes(attrs []spanAttr) []map[string]any {
+	list := make([]map[string]any, len(attrs))
+	for i, a := range attrs {
+		var v map[string]any
+		switch x := a.value.(type) {
+		case bool:
+			v = map[string]any{"boolValue": x}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		list[i] = map[string]any{"key": a.key, "value": v}
+	}
+	return list
+}
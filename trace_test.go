@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryExporter keeps the spans exported to it.
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (e *memoryExporter) export(spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// traceTo has sampled spans exported to memory until the test ends.
+func traceTo(t *testing.T) *memoryExporter {
+	e := &memoryExporter{}
+	traces.mu.Lock()
+	traces.exporter = e
+	traces.mu.Unlock()
+	t.Cleanup(func() {
+		traces.mu.Lock()
+		traces.exporter, traces.spans = nil, nil
+		traces.mu.Unlock()
+	})
+	return e
+}
+
+// spanTree renders spans as an indented tree, children in the order they
+// started, with the host of client spans left out.
+func spanTree(spans []*span, root [8]byte) string {
+	children := map[[8]byte][]*span{}
+	for _, s := range spans {
+		children[s.parentID] = append(children[s.parentID], s)
+	}
+	var b strings.Builder
+	var walk func(parent [8]byte, depth int)
+	walk = func(parent [8]byte, depth int) {
+		list := children[parent]
+		sort.SliceStable(list, func(i, j int) bool { return list[i].start.Before(list[j].start) })
+		for _, s := range list {
+			name := s.name
+			if s.kind == spanClient {
+				name, _, _ = strings.Cut(name, " ")
+			}
+			b.WriteString(strings.Repeat("  ", depth) + name + "\n")
+			walk(s.id, depth+1)
+		}
+	}
+	walk(root, 0)
+	return b.String()
+}
+
+func TestTraceColdFetch(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	var mu sync.Mutex
+	upstream := map[string]string{}
+	handler := reg.Config.Handler
+	reg.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		upstream[req.URL.Path] = req.Header.Get("traceparent")
+		mu.Unlock()
+		handler.ServeHTTP(w, req)
+	})
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.OTLPEndpoint = "http://collector.test"
+	})
+	e := traceTo(t)
+
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	s.follow(s.get("/npm/left-pad@1.0.0/index.js", "traceparent", "00-"+traceID+"-"+parentID+"-01"), 302)
+	traces.flush()
+
+	var parent [8]byte
+	hex.Decode(parent[:], []byte(parentID))
+	want := `GET /npm/*package
+  resolve
+    GET
+  download
+    GET
+  verify
+  extract
+`
+	if got := spanTree(e.spans, parent); got != want {
+		t.Errorf("spans:\n%s\nwant\n%s", got, want)
+	}
+	ids := map[string]*span{}
+	for _, s := range e.spans {
+		if hex.EncodeToString(s.traceID[:]) != traceID {
+			t.Errorf("%s isn't in the caller's trace", s.name)
+		}
+		if s.end.Before(s.start) {
+			t.Errorf("%s ended before it started", s.name)
+		}
+		ids[hex.EncodeToString(s.id[:])] = s
+	}
+
+	// Registry requests carry the trace on, each as its client span.
+	for _, p := range []string{"/left-pad", tarballPath("left-pad", "1.0.0")} {
+		tp := strings.Split(upstream[p], "-")
+		if len(tp) != 4 || tp[1] != traceID || tp[3] != "01" {
+			t.Errorf("%s: traceparent %q", p, upstream[p])
+			continue
+		}
+		if s := ids[tp[2]]; s == nil || s.kind != spanClient {
+			t.Errorf("%s: traceparent %q isn't a client span", p, upstream[p])
+		}
+	}
+
+	// Serving it from the cache is a request of its own, fetching nothing.
+	e.spans = nil
+	s.get("/packages/left-pad@1.0.0/index.js", "traceparent", "00-"+traceID+"-"+parentID+"-01")
+	traces.flush()
+	if got, want := spanTree(e.spans, parent), "GET /packages/*filepath\n  serve\n"; got != want {
+		t.Errorf("spans:\n%s\nwant\n%s", got, want)
+	}
+}
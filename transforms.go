@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transforms (bundles and inlined stylesheets) are CPU-bound, so at most
+// config.TransformWorkers of them run at once, GOMAXPROCS-1 by default,
+// leaving a core for serving. Up to config.TransformQueue more wait their
+// turn; past that a transform is refused with a 503 and Retry-After rather
+// than piling up. Requests for an artifact that is already being built
+// wait for that build instead of starting another. Nothing but transforms
+// goes through the pool: files of cached versions and artifacts already
+// built are served without ever waiting on it.
+
+var (
+	transformsRejected = newCounter("repkg_transforms_rejected_total", "Transforms refused because the transform queue was full.")
+	transformsShared   = newCounter("repkg_transforms_shared_total", "Transform requests that waited for the same artifact's build already under way.")
+	transformSeconds   = newHistogram("repkg_transform_seconds", "Time transforms took once running, by kind and result.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120})
+
+	_ = newGaugeFunc("repkg_transforms_queued", "Transforms waiting for a worker.", func() float64 {
+		return float64(transformPool.queued.Load())
+	})
+	_ = newGaugeFunc("repkg_transforms_running", "Transforms running.", func() float64 {
+		return float64(transformPool.running.Load())
+	})
+
+	transformPool = &workerPool{}
+)
+
+// transformWorkers is the size of the pool for config.TransformWorkers.
+func transformWorkers() int {
+	if config.TransformWorkers > 0 {
+		return config.TransformWorkers
+	}
+	return max(runtime.GOMAXPROCS(0)-1, 1)
+}
+
+type workerPool struct {
+	once    sync.Once
+	slots   chan struct{}
+	queued  atomic.Int64
+	running atomic.Int64
+
+	// building holds a *transformCall for each artifact being built, by
+	// path.
+	building sync.Map
+}
+
+type transformCall struct {
+	done chan struct{}
+	err  error
+}
+
+// runTransform builds the artifact at key with build, unless it is being
+// built already, in which case it waits for that build and returns its
+// error.
+func runTransform(key, kind string, timing *fetchTiming, build func() error) error {
+	call := &transformCall{done: make(chan struct{})}
+	if other, loaded := transformPool.building.LoadOrStore(key, call); loaded {
+		transformsShared.Inc("kind", kind)
+		<-other.(*transformCall).done
+		return other.(*transformCall).err
+	}
+	defer func() {
+		transformPool.building.Delete(key)
+		close(call.done)
+	}()
+	call.err = transformPool.run(kind, timing, build)
+	return call.err
+}
+
+// run waits for a worker, unless the queue is full, and runs fn on it.
+func (p *workerPool) run(kind string, timing *fetchTiming, fn func() error) error {
+	p.once.Do(func() { p.slots = make(chan struct{}, transformWorkers()) })
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		if p.queued.Add(1) > int64(config.TransformQueue) {
+			p.queued.Add(-1)
+			transformsRejected.Inc("kind", kind)
+			e := newError(http.StatusServiceUnavailable, codeTransformsBusy, "too many transforms are waiting; try again shortly")
+			e.Header = http.Header{"Retry-After": {"1"}}
+			return e
+		}
+		ts := timing.begin("transform-queue")
+		p.slots <- struct{}{}
+		ts.finish()
+		p.queued.Add(-1)
+	}
+	p.running.Add(1)
+	defer func() {
+		p.running.Add(-1)
+		<-p.slots
+	}()
+
+	start := time.Now()
+	err := fn()
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	transformSeconds.Observe(time.Since(start).Seconds(), "kind", kind, "result", result)
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Type declarations are found the way TypeScript finds them: from "types"
+// (or "typings", or "main") for the root of a package and from the import
+// path otherwise, through the package's "typesVersions" when it has some.
+// The first of its version ranges that the TypeScript version of ?ts=
+// satisfies, or without one that of the latest TypeScript, picks the path
+// mappings; the mapping whose pattern matches, exactly or else by the
+// longest prefix before its "*", has its substitutions tried in order.
+// When none of them resolves, the path is resolved as if unmapped.
+
+// latestTypeScript stands for whatever TypeScript is newest, for requests
+// without ?ts=.
+var latestTypeScript = semver{Major: 1 << 32}
+
+// Extensions tried, in order, for declarations, as TypeScript tries them.
+var typesExts = []string{".ts", ".tsx", ".d.ts"}
+
+// parseTSVersion reads ?ts=, a TypeScript version such as "5.4".
+func parseTSVersion(c *gin.Context) (semver, error) {
+	q := c.Query("ts")
+	if q == "" {
+		return latestTypeScript, nil
+	}
+	parts := strings.Split(q, ".")
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+	v, ok := parseSemver(strings.Join(parts, "."))
+	if !ok || len(parts) > 3 {
+		return semver{}, newError(http.StatusBadRequest, codeBadRequest, "invalid TypeScript version %q", q)
+	}
+	return v, nil
+}
+
+// resolveTypes returns the declarations of subpath ("" for the root of the
+// package, or a path like "helpers" or "lib/index.js") for TypeScript ts.
+func resolveTypes(dir string, m *Manifest, subpath string, ts semver) (string, bool) {
+	pkg := readPackageJSON(dir, m)
+	if subpath == "" {
+		subpath = "index"
+		for _, field := range []string{pkg.Types, pkg.Typings, pkg.Main} {
+			if field != "" {
+				subpath = path.Clean(strings.TrimPrefix(field, "./"))
+				break
+			}
+		}
+	}
+	for _, target := range typesVersionsTargets(pkg.TypesVersions, subpath, ts) {
+		if p, ok := resolveTypesFile(m, target); ok {
+			return p, true
+		}
+	}
+	return resolveTypesFile(m, subpath)
+}
+
+// typesVersionsTargets applies the typesVersions mappings for ts to
+// subpath, returning its substitutions in order, or nil when no range or no
+// pattern matches.
+func typesVersionsTargets(raw json.RawMessage, subpath string, ts semver) []string {
+	if len(raw) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return nil
+	}
+	decoded, err := decodeOrdered(json.NewDecoder(bytes.NewReader(raw)))
+	if err != nil {
+		return nil
+	}
+	versions, _ := decoded.(orderedObject)
+	var paths orderedObject
+	for _, field := range versions {
+		r, err := parseRange(field.Key)
+		if err != nil || !r.match(ts) {
+			continue
+		}
+		paths, _ = field.Value.(orderedObject)
+		break
+	}
+
+	var substitutions []any
+	matched, best := "", -1
+	for _, field := range paths {
+		if field.Key == subpath {
+			substitutions, matched, best = asList(field.Value), "", len(field.Key)+1
+			break
+		}
+		prefix, suffix, ok := strings.Cut(field.Key, "*")
+		if !ok || strings.Contains(suffix, "*") || len(prefix) <= best {
+			continue
+		}
+		if len(subpath) >= len(prefix)+len(suffix) && strings.HasPrefix(subpath, prefix) && strings.HasSuffix(subpath, suffix) {
+			substitutions, matched, best = asList(field.Value), subpath[len(prefix):len(subpath)-len(suffix)], len(prefix)
+		}
+	}
+	var targets []string
+	for _, s := range substitutions {
+		if s, ok := s.(string); ok && s != "" {
+			targets = append(targets, strings.Replace(s, "*", matched, 1))
+		}
+	}
+	return targets
+}
+
+func asList(v any) []any {
+	list, _ := v.([]any)
+	return list
+}
+
+// resolveTypesFile finds the declarations at p: p itself if they are, the
+// .d.ts of a JavaScript file, or p with a TypeScript extension or as a
+// directory with an index.
+func resolveTypesFile(m *Manifest, p string) (string, bool) {
+	p = path.Clean(strings.TrimPrefix(strings.TrimPrefix(p, "./"), "/"))
+	if isTypesFile(p) {
+		if f, ok := m.Lookup(p); ok {
+			return f.Path, true
+		}
+	}
+	for _, js := range [][2]string{{".js", ".d.ts"}, {".jsx", ".d.ts"}, {".mjs", ".d.mts"}, {".cjs", ".d.cts"}} {
+		if base, ok := strings.CutSuffix(p, js[0]); ok {
+			if f, ok := m.Lookup(base + js[1]); ok {
+				return f.Path, true
+			}
+			return "", false
+		}
+	}
+	for _, ext := range typesExts {
+		if f, ok := m.Lookup(p + ext); ok {
+			return f.Path, true
+		}
+	}
+	for _, ext := range typesExts {
+		if f, ok := m.Lookup(path.Join(p, "index"+ext)); ok {
+			return f.Path, true
+		}
+	}
+	return "", false
+}
+
+func isTypesFile(p string) bool {
+	for _, ext := range []string{".ts", ".tsx", ".mts", ".cts"} {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// setTypesHeader points TypeScript consumers of subpath at its
+// declarations, as Deno and esm.sh do, when there are some.
+func setTypesHeader(c *gin.Context, m *Manifest, subpath string) {
+	ts, err := parseTSVersion(c)
+	if err != nil {
+		return
+	}
+	t := tenantOf(c)
+	if p, ok := resolveTypes(versionDir(t, m.Name, m.Version), m, subpath, ts); ok {
+		c.Header("X-TypeScript-Types", withAccessKey(c, packageURL(t, m.Name, m.Version, p)))
+	}
+}
+
+// serveTypes answers ?dts with a redirect to the declarations of file, or
+// of the package's root.
+func serveTypes(c *gin.Context, ep *ensuredPackage, file string, ts semver) {
+	m := ep.Manifest
+	t := tenantOf(c)
+	p, ok := resolveTypes(versionDir(t, m.Name, m.Version), m, file, ts)
+	if !ok {
+		what := "its root"
+		if file != "" {
+			what = file
+		}
+		writeError(c, newError(http.StatusNotFound, codeNotFound, "%s@%s has no type declarations for %s", m.Name, m.Version, what))
+		return
+	}
+	setResolveHeaders(c.Writer, ep)
+	c.Redirect(http.StatusFound, withAccessKey(c, packageURL(t, m.Name, m.Version, p)))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// newYargsRegistry publishes a package laid out as yargs and its kind lay
+// out their declarations: built apart from the JavaScript, with older ones
+// for older TypeScript, mapped by typesVersions.
+func newYargsRegistry(t *testing.T) *fakeRegistry {
+	reg := newFakeRegistry(t)
+	reg.publish("yargs", "17.7.2", map[string]string{
+		"package.json": `{"name": "yargs", "version": "17.7.2", "main": "./index.cjs", "types": "./index.d.ts",
+			"typesVersions": {
+				">=4.5": {
+					"helpers": ["helpers/types.d.ts"],
+					"lib/*": ["missing/*", "build/lib-types/*"],
+					"*": ["build/types/*"]
+				},
+				">=3.8": {"*": ["ts3.8/*"]}
+			}}`,
+		"index.cjs":                          `module.exports = {};`,
+		"index.d.ts":                         `export {};`,
+		"browser.js":                         `export default {};`,
+		"browser.d.ts":                       `export {};`,
+		"helpers/index.js":                   `export const hideBin = () => [];`,
+		"helpers/types.d.ts":                 `export declare function hideBin(): string[];`,
+		"lib/yargs-factory.js":               `export default {};`,
+		"build/types/index.d.ts":             `export {};`,
+		"build/types/lib/yargs-factory.d.ts": `export {};`,
+		"build/lib-types/yargs-factory.d.ts": `export {};`,
+		"ts3.8/index.d.ts":                   `export {};`,
+		"ts3.8/lib/yargs-factory.d.ts":       `export {};`,
+		"locales/en.json":                    `{}`,
+	})
+	return reg
+}
+
+func TestTypesVersions(t *testing.T) {
+	s := newTestServer(t, newYargsRegistry(t), nil)
+	s.follow(s.get("/npm/yargs@17.7.2/index.cjs"), 302)
+
+	for _, tc := range []struct{ subpath, ts, want string }{
+		// "types", mapped by "*" for the latest TypeScript.
+		{"", "", "build/types/index.d.ts"},
+		{"", "5.4", "build/types/index.d.ts"},
+		// The first range satisfied wins, and without one, nothing is
+		// mapped.
+		{"", "4.0", "ts3.8/index.d.ts"},
+		{"", "3.5", "index.d.ts"},
+		// An exact pattern wins over "*".
+		{"helpers", "", "helpers/types.d.ts"},
+		{"helpers", "4.0", ""},
+		// The longest prefix wins, and its substitutions are tried in
+		// order.
+		{"lib/yargs-factory.js", "", "build/lib-types/yargs-factory.d.ts"},
+		{"lib/yargs-factory.js", "4.9.5", "build/lib-types/yargs-factory.d.ts"},
+		{"lib/yargs-factory.js", "4.0", "ts3.8/lib/yargs-factory.d.ts"},
+		// When no substitution resolves, the path is used unmapped.
+		{"browser.js", "", "browser.d.ts"},
+		{"locales/en.json", "", ""},
+	} {
+		query := ""
+		if tc.ts != "" {
+			query = "&ts=" + tc.ts
+		}
+		target := "/npm/yargs@17.7.2"
+		if tc.subpath != "" {
+			target += "/" + tc.subpath
+		}
+
+		res := s.get(target + "?dts" + query)
+		if tc.want == "" {
+			var e struct{ Code string }
+			if err := json.Unmarshal([]byte(responseBody(t, res, 404)), &e); err != nil || e.Code != codeNotFound {
+				t.Errorf("%s?dts%s: code %q, %v", target, query, e.Code, err)
+			}
+		} else if loc := s.follow(res, 302); loc != "/packages/yargs@17.7.2/"+tc.want {
+			t.Errorf("%s?dts%s: redirected to %s, want %s", target, query, loc, tc.want)
+		}
+
+		// The header points at the same declarations, for the root and
+		// for JavaScript files.
+		if tc.subpath == "helpers" {
+			continue
+		}
+		if tc.subpath == "" {
+			res = s.get(target + "?format=js" + query)
+		} else {
+			res = s.get(target + "?" + strings.TrimPrefix(query, "&"))
+		}
+		got := res.Header.Get("X-TypeScript-Types")
+		if want := "/packages/yargs@17.7.2/" + tc.want; tc.want != "" && got != want || tc.want == "" && got != "" {
+			t.Errorf("%s%s: X-TypeScript-Types %q, want %s", target, query, got, tc.want)
+		}
+	}
+
+	// Declarations don't point at themselves.
+	if res := s.get("/npm/yargs@17.7.2/build/types/index.d.ts"); res.Header.Get("X-TypeScript-Types") != "" {
+		t.Errorf("a declaration file had X-TypeScript-Types %q", res.Header.Get("X-TypeScript-Types"))
+	}
+
+	for _, ts := range []string{"five", "5.4.1.2", "5.x"} {
+		res := s.get("/npm/yargs@17.7.2?dts&ts=" + ts)
+		var e struct{ Code string }
+		if err := json.Unmarshal([]byte(responseBody(t, res, 400)), &e); err != nil || e.Code != codeBadRequest {
+			t.Errorf("ts=%s: code %q, %v", ts, e.Code, err)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// errUpstreamForbidden is returned for upstream requests to hosts other than
+// the registry and config.UpstreamHosts, and for connections to private
+// addresses when config.BlockPrivateNetworks is set.
+var errUpstreamForbidden = errors.New("upstream host not allowed")
+
+// errUpstreamAuth is returned when the registry answers 401 to the
+// credentials repkg sent, or to none.
+var errUpstreamAuth = errors.New("registry refused the credentials")
+
+var upstreamTransport = &http.Transport{
+	Proxy:                 upstreamProxy,
+	DialContext:           dialUpstream,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// proxyVariables are the variables http.ProxyFromEnvironment reads a proxy
+// from.
+var proxyVariables = []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"}
+
+// upstreamProxy is the proxy of the environment, but none with
+// config.BlockPrivateNetworks: through a proxy, dialUpstream would only see
+// the proxy's address, never the registry's or a tarball host's. NewServer
+// refuses that combination with environmentProxy, so this is only a
+// safeguard.
+func upstreamProxy(req *http.Request) (*url.URL, error) {
+	if config.BlockPrivateNetworks {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// environmentProxy is the first of proxyVariables that is set, or "".
+func environmentProxy() string {
+	for _, v := range proxyVariables {
+		if os.Getenv(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+var upstreamClient = &http.Client{
+	Transport:     upstreamRoundTripper,
+	CheckRedirect: checkUpstreamRedirect,
+	Timeout:       30 * time.Second,
+}
+
+// tarballClient is upstreamClient without the overall timeout, which large
+// tarballs could exceed.
+var tarballClient = &http.Client{
+	Transport:     upstreamRoundTripper,
+	CheckRedirect: checkUpstreamRedirect,
+}
+
+// allowedUpstream reports whether repkg may send requests to u: a
+// registry's own host, or one matching config.UpstreamHosts ("host",
+// "host:port" or "*.domain").
+func allowedUpstream(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, r := range registries() {
+		if registry, err := url.Parse(r); err == nil && r != "" && strings.EqualFold(u.Host, registry.Host) {
+			return true
+		}
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range config.UpstreamHosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case strings.Contains(pattern, ":"):
+			if strings.EqualFold(u.Host, pattern) {
+				return true
+			}
+		case host == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+// Values of config.RedirectAuth, which decides whether the Authorization
+// header of an upstream request is sent along when it is redirected.
+const (
+	redirectAuthSameOrigin = "same-origin"
+	redirectAuthAlways     = "always"
+	redirectAuthNever      = "never"
+)
+
+// newUpstreamRequest prepares a request to a tenant's registry or a tarball
+// host, with the tenant's registry token or basic auth attached for the
+// registry's own host.
+func newUpstreamRequest(t *tenant, method, URL string) (*http.Request, error) {
+	if config.ReadOnly {
+		return nil, notCached(URL)
+	}
+	req, err := http.NewRequest(method, URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := url.Parse(t.registry())
+	if err != nil || !sameOrigin(req.URL, registry) {
+		return req, nil
+	}
+	if auth := t.registryAuth(); auth != nil {
+		req.SetBasicAuth(auth.Username, auth.password)
+	} else if token := t.registryToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// checkUpstreamRedirect follows at most config.MaxRedirects hops, each to an
+// allowed host, carrying Authorization over as config.RedirectAuth says.
+func checkUpstreamRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > config.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects at %s", config.MaxRedirects, redactURL(req.URL))
+	}
+	if !allowedUpstream(req.URL) {
+		log.Printf("upstream: refusing redirect from %s to %s", redactURL(via[len(via)-1].URL), redactURL(req.URL))
+		return fmt.Errorf("redirect to %s: %w", req.URL.Host, errUpstreamForbidden)
+	}
+
+	first := via[0]
+	auth := first.Header.Get("Authorization")
+	switch {
+	case auth == "" || config.RedirectAuth == redirectAuthNever:
+		req.Header.Del("Authorization")
+	case config.RedirectAuth == redirectAuthAlways || sameOrigin(req.URL, first.URL):
+		req.Header.Set("Authorization", auth)
+	default:
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+// redactURL drops the query of a URL, which for blob storage often holds
+// signed credentials, so it can be logged and shown to clients.
+func redactURL(u *url.URL) string {
+	r := *u
+	r.RawQuery, r.Fragment, r.User = "", "", nil
+	return r.String()
+}
+
+// registryID names a registry by its normalized URL: host and path, in
+// lower case and without a trailing slash, so that "HTTPS://Npm.example.com/"
+// and "https://npm.example.com" are one. It is "" for URLs that don't parse.
+func registryID(registry string) string {
+	u, err := url.Parse(strings.TrimSpace(registry))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Host + strings.TrimRight(u.EscapedPath(), "/"))
+}
+
+// tarballURL returns where to download a version from: dist.tarball when the
+// registry gave one, as long as it points at an allowed host.
+func tarballURL(t *tenant, packageName string, pv *PackumentVersion) (string, error) {
+	if !validVersion(pv.Version) {
+		return "", newError(http.StatusBadGateway, codeUpstream, "no valid version of %s to fetch, got %q", packageName, pv.Version)
+	}
+	if pv.Dist.Tarball == "" {
+		return t.registry() + "/" + packageName + "/-/" + packageName + "-" + pv.Version + ".tgz", nil
+	}
+
+	u, err := url.Parse(pv.Dist.Tarball)
+	if err != nil || !allowedUpstream(u) {
+		log.Printf("upstream: refusing tarball URL %q for %s@%s", pv.Dist.Tarball, packageName, pv.Version)
+		return "", wrapUpstream(errUpstreamForbidden, "tarball of %s@%s is at %s", packageName, pv.Version, pv.Dist.Tarball)
+	}
+	return u.String(), nil
+}
+
+// wrapUpstream wraps an error from an upstream request, with its own code
+// when the request was refused by the outbound policy or never reached the
+// server, so a DNS or network outage can be told from a registry one.
+func wrapUpstream(err error, format string, args ...any) *apiError {
+	var circuitErr *errCircuitOpen
+	if errors.As(err, &circuitErr) {
+		// Shed while the host recovers; clients may come back when it's due.
+		e := wrapError(http.StatusServiceUnavailable, codeUpstreamUnavailable, err, format, args...)
+		secs := max(1, int(time.Until(circuitErr.Until).Seconds()+0.5))
+		e.Header = http.Header{"Retry-After": {strconv.Itoa(secs)}}
+		e.Details = map[string]any{"retryAfter": secs}
+		return e
+	}
+	return wrapError(http.StatusBadGateway, upstreamErrorCode(err), err, format, args...)
+}
+
+func upstreamErrorCode(err error) string {
+	var circuitErr *errCircuitOpen
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var contentErr *errWrongContent
+	switch {
+	case errors.As(err, &contentErr):
+		return codeUpstreamContent
+	case errors.Is(err, errUpstreamForbidden):
+		return codeUpstreamForbidden
+	case errors.Is(err, errUpstreamAuth):
+		return codeUpstreamAuth
+	case errors.As(err, &circuitErr):
+		return codeUpstreamUnavailable
+	case errors.As(err, &dnsErr):
+		return codeUpstreamDNS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return codeUpstreamUnreachable
+	}
+	return codeUpstream
+}
+
+// dialUpstream connects like the default transport, with the policies of
+// the config applied: config.HostOverrides and the DNS cache decide which
+// addresses a host is tried at, config.IPFamily which of them are used.
+// With config.BlockPrivateNetworks it refuses loopback, private and
+// link-local addresses, checked after name resolution so DNS can't be used
+// to get around it, except for the registry's own host.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialAddrs(ctx, network, addr)
+	if err != nil && !errors.Is(err, errUpstreamForbidden) {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			log.Printf("upstream: dns: resolving %s: %s", addr, err)
+		} else {
+			log.Printf("upstream: connect: %s: %s", addr, err)
+		}
+	}
+	return conn, err
+}
+
+func dialAddrs(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := upstreamDialer(addr)
+	switch config.IPFamily {
+	case ipFamilyIPv4:
+		network = "tcp4"
+	case ipFamilyIPv6:
+		network = "tcp6"
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupUpstream(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ips == nil {
+		// Left to the dialer, which races IPv4 and IPv6.
+		return d.DialContext(ctx, network, addr)
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			continue
+		}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no " + network + " address", Name: host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+func upstreamDialer(addr string) *net.Dialer {
+	d := &net.Dialer{Timeout: config.DialTimeout.Duration, KeepAlive: 30 * time.Second}
+	if config.BlockPrivateNetworks && !isRegistryAddr(addr) {
+		d.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+				log.Printf("upstream: refusing connection to %s (%s)", addr, address)
+				return fmt.Errorf("%s resolves to %s: %w", addr, host, errUpstreamForbidden)
+			}
+			return nil
+		}
+	}
+	return d
+}
+
+// Values of config.IPFamily.
+const (
+	ipFamilyDual = "dual"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+// lookupUpstream returns the addresses to try for host, or nil to leave
+// resolution to the dialer: for IP literals, and for hostnames when there
+// is neither an override nor a DNS cache.
+func lookupUpstream(ctx context.Context, host string) ([]net.IP, error) {
+	if ip, ok := config.HostOverrides[strings.ToLower(host)]; ok {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			return []net.IP{parsed}, nil
+		}
+	}
+	if net.ParseIP(host) != nil || config.DNSCacheTTL.Duration <= 0 {
+		return nil, nil
+	}
+	return upstreamDNS.lookup(ctx, host)
+}
+
+// dnsCache remembers successful lookups for config.DNSCacheTTL. Failures
+// are not cached.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var upstreamDNS = &dnsCache{entries: map[string]dnsEntry{}}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{ips: ips, expires: time.Now().Add(config.DNSCacheTTL.Duration)}
+	c.mu.Unlock()
+	return ips, nil
+}
+
+// registries lists the registries of every tenant and the fallback one.
+func registries() []string {
+	list := []string{config.FallbackRegistry}
+	for _, t := range allTenants() {
+		list = append(list, t.registry())
+	}
+	return list
+}
+
+func isRegistryAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, r := range registries() {
+		if registry, err := url.Parse(r); err == nil && r != "" && strings.EqualFold(host, registry.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackURL returns URL moved to config.FallbackRegistry when the request
+// to it failed because the registry's circuit is open.
+func fallbackURL(URL string, err error) (string, bool) {
+	var circuitErr *errCircuitOpen
+	if config.FallbackRegistry == "" || !errors.As(err, &circuitErr) {
+		return "", false
+	}
+	u, perr := url.Parse(URL)
+	registry, rerr := url.Parse(config.Registry)
+	if perr != nil || rerr != nil || !strings.EqualFold(u.Host, registry.Host) {
+		return "", false
+	}
+	// The path is kept below the fallback's own base path.
+	rel := strings.TrimPrefix(u.RequestURI(), strings.TrimSuffix(registry.RequestURI(), "/"))
+	return strings.TrimSuffix(config.FallbackRegistry, "/") + rel, true
+}
+
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// errWrongContent is returned when the registry, or a tarball host, answers
+// 200 with something other than what was asked for: most often the HTML of
+// a web UI or a proxy's login page, the registry URL being wrong.
+type errWrongContent struct {
+	who, want   string
+	html        bool
+	contentType string
+	url         string
+	hint        string
+}
+
+func (e *errWrongContent) Error() string {
+	got := "something else"
+	if e.html {
+		got = "HTML"
+	}
+	ct := e.contentType
+	if ct == "" {
+		ct = "no Content-Type"
+	}
+	return fmt.Sprintf("%s returned %s, not %s: %s; got %s from %s", e.who, got, e.want, e.hint, ct, e.url)
+}
+
+// registryHint says where a tenant's registry is configured.
+func registryHint(t *tenant) string {
+	if t == nil || t.Registry == "" {
+		return "check the registry setting (" + envName("registry") + ")"
+	}
+	return "check the registry of tenant " + t.name
+}
+
+// checkJSONResponse fails a registry response whose body isn't JSON. A
+// JSON body is accepted whatever its Content-Type says.
+func checkJSONResponse(t *tenant, res *http.Response, body []byte) error {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), " \t\r\n")
+	ct := res.Header.Get("Content-Type")
+	if bytes.HasPrefix(trimmed, []byte("{")) && !isHTMLType(ct) {
+		return nil
+	}
+	e := &errWrongContent{
+		who: "the registry", want: "JSON",
+		html:        isHTMLType(ct) || bytes.HasPrefix(trimmed, []byte("<")),
+		contentType: ct,
+		url:         redactURL(res.Request.URL),
+		hint:        registryHint(t),
+	}
+	log.Printf("upstream: %s", e)
+	debugf("upstream: %s began with %q", e.url, bodySnippet(body))
+	return e
+}
+
+// checkTarball fails a downloaded tarball that isn't gzipped, as when a
+// proxy answers 200 with an error page, before it is verified: an integrity
+// mismatch would tell nothing of the cause.
+func checkTarball(t *tenant, res *http.Response, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if bytes.HasPrefix(head, []byte{0x1f, 0x8b}) {
+		return nil
+	}
+	ct := res.Header.Get("Content-Type")
+	trimmed := bytes.TrimLeft(head, " \t\r\n")
+	e := &errWrongContent{
+		who: "the tarball host", want: "a gzipped tarball",
+		html:        isHTMLType(ct) || bytes.HasPrefix(trimmed, []byte("<")),
+		contentType: ct,
+		url:         redactURL(res.Request.URL),
+		hint:        registryHint(t) + " and any proxy in front of it",
+	}
+	log.Printf("upstream: %s", e)
+	debugf("upstream: %s began with %q", e.url, bodySnippet(head))
+	return e
+}
+
+func isHTMLType(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// bodySnippet returns the start of a body fit for a log line: at most 200
+// bytes, valid UTF-8, with control characters and runs of space folded to
+// one space.
+func bodySnippet(body []byte) string {
+	s := strings.ToValidUTF8(string(body[:min(len(body), 200)]), "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// redirectHost is a server answering requests for its paths with
+// redirects, or by passing them on to a registry, and recording the
+// Authorization of each.
+type redirectHost struct {
+	*httptest.Server
+	// base is the URL the host is addressed by, its own by default.
+	base      string
+	mu        sync.Mutex
+	redirects map[string]string // path to Location
+	serve     map[string]string // path to the registry path served in its place
+	auth      map[string]string // path to the Authorization it came with
+}
+
+func newRedirectHost(t *testing.T, reg *fakeRegistry) *redirectHost {
+	h := &redirectHost{redirects: map[string]string{}, serve: map[string]string{}, auth: map[string]string{}}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		h.auth[r.URL.Path] = r.Header.Get("Authorization")
+		location, redirect := h.redirects[r.URL.Path]
+		target, ok := h.serve[r.URL.Path]
+		h.mu.Unlock()
+		switch {
+		case redirect:
+			http.Redirect(w, r, location, http.StatusFound)
+		case ok:
+			// As the registry, with the URLs of its packuments pointing
+			// here.
+			r.URL.Path = target
+			rec := httptest.NewRecorder()
+			reg.Config.Handler.ServeHTTP(rec, r)
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			body := rec.Body.Bytes()
+			if !strings.HasSuffix(target, ".tgz") {
+				body = []byte(strings.ReplaceAll(string(body), reg.URL, h.base))
+				w.Header().Del("Content-Length")
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	h.base = h.URL
+	t.Cleanup(h.Close)
+	return h
+}
+
+// requested reports whether p was asked for, and with which Authorization.
+func (h *redirectHost) requested(p string) (auth string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	auth, ok = h.auth[p]
+	return auth, ok
+}
+
+func TestUpstreamRedirects(t *testing.T) {
+	tarball := tarballPath("left-pad", "1.0.0")
+	for _, tc := range []struct {
+		name string
+		// hops are the Locations the tarball is redirected through, on
+		// the registry ("reg"), an allowed host ("mirror") or another
+		// ("elsewhere"), the last serving it.
+		hops         []string
+		redirectAuth string
+		code         string
+		// auth is the Authorization each hop should get.
+		auth []string
+	}{
+		{name: "same host", hops: []string{"reg/moved.tgz"}, auth: []string{"Bearer t0ken"}},
+		{name: "same host, never", hops: []string{"reg/moved.tgz"}, redirectAuth: redirectAuthNever, auth: []string{""}},
+		{name: "allowed host", hops: []string{"mirror/left-pad.tgz"}, auth: []string{""}},
+		{name: "allowed host, always", hops: []string{"mirror/left-pad.tgz"}, redirectAuth: redirectAuthAlways, auth: []string{"Bearer t0ken"}},
+		{name: "allowed host and back", hops: []string{"mirror/a", "reg/moved.tgz"}, auth: []string{"", "Bearer t0ken"}},
+		{name: "blocked host", hops: []string{"elsewhere/left-pad.tgz"}, code: codeUpstreamForbidden},
+		{name: "blocked host after an allowed one", hops: []string{"mirror/a", "elsewhere/left-pad.tgz"}, code: codeUpstreamForbidden},
+		{name: "as many as allowed", hops: []string{"reg/1", "mirror/2", "reg/moved.tgz"}, auth: []string{"Bearer t0ken", "", "Bearer t0ken"}},
+		{name: "too many", hops: []string{"reg/1", "mirror/2", "reg/3", "reg/moved.tgz"}, code: codeUpstream},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := newFakeRegistry(t)
+			reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+			regHost := newRedirectHost(t, reg)
+			mirror := newRedirectHost(t, reg)
+			elsewhere := newRedirectHost(t, reg)
+			hosts := map[string]*redirectHost{"reg": regHost, "mirror": mirror, "elsewhere": elsewhere}
+
+			// The registry is reached through regHost, which redirects
+			// the tarball along the hops.
+			regHost.serve["/left-pad"] = "/left-pad"
+			from := regHost
+			fromPath := tarball
+			for i, hop := range tc.hops {
+				name, p, _ := strings.Cut(hop, "/")
+				to := hosts[name]
+				from.redirects[fromPath] = to.URL + "/" + p
+				if i == len(tc.hops)-1 {
+					to.serve["/"+p] = tarball
+				}
+				from, fromPath = to, "/"+p
+			}
+
+			mirrorURL, _ := url.Parse(mirror.URL)
+			s := newTestServer(t, reg, func(cfg *Config) {
+				cfg.Registry = regHost.URL
+				cfg.RegistryToken = "t0ken"
+				cfg.UpstreamHosts = []string{mirrorURL.Host}
+				cfg.MaxRedirects = 3
+				if tc.redirectAuth != "" {
+					cfg.RedirectAuth = tc.redirectAuth
+				}
+			})
+
+			res := s.get("/npm/left-pad@1.0.0/index.js")
+			if tc.code != "" {
+				if res.StatusCode != http.StatusBadGateway || responseCode(t, res) != tc.code {
+					t.Fatalf("got %s, want a 502 %s", res.Status, tc.code)
+				}
+				if _, ok := elsewhere.requested("/left-pad.tgz"); ok {
+					t.Errorf("the blocked host was asked for the tarball")
+				}
+				return
+			}
+			if body := responseBody(t, s.get(s.follow(res, 302)), 200); body != "padded" {
+				t.Fatalf("got %q", body)
+			}
+			if auth, _ := regHost.requested(tarball); auth != "Bearer t0ken" {
+				t.Errorf("the registry got Authorization %q", auth)
+			}
+			for i, hop := range tc.hops {
+				name, p, _ := strings.Cut(hop, "/")
+				auth, ok := hosts[name].requested("/" + p)
+				if !ok || auth != tc.auth[i] {
+					t.Errorf("hop %d, %s: Authorization %q, %v; want %q", i, hop, auth, ok, tc.auth[i])
+				}
+			}
+		})
+	}
+}
+
+// TestBlockPrivateNetworksProxy checks that repkg won't start with
+// blockPrivateNetworks and a proxy it couldn't be enforced through.
+func TestBlockPrivateNetworksProxy(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.publish("left-pad", "1.0.0", map[string]string{"index.js": "padded"})
+	for _, v := range proxyVariables {
+		t.Run(v, func(t *testing.T) {
+			for _, other := range proxyVariables {
+				t.Setenv(other, "")
+			}
+			t.Setenv(v, "http://proxy.example:3128")
+			cfg := defaultConfig()
+			cfg.DataDir = t.TempDir()
+			cfg.Registry = reg.URL
+			cfg.BlockPrivateNetworks = true
+			resetState()
+			if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), v) {
+				t.Errorf("NewServer: %v", err)
+			}
+
+			// A proxy is never used with blockPrivateNetworks anyway.
+			req, _ := http.NewRequest("GET", "http://registry.example/left-pad", nil)
+			if u, err := upstreamProxy(req); u != nil || err != nil {
+				t.Errorf("upstreamProxy = %v, %v", u, err)
+			}
+		})
+	}
+
+	// Without a proxy, the block holds for hosts other than the
+	// registry's, though they are allowed. The registry is localhost, so
+	// the mirror at 127.0.0.1 isn't taken for it.
+	tarball := tarballPath("left-pad", "1.0.0")
+	regHost, mirror := newRedirectHost(t, reg), newRedirectHost(t, reg)
+	regHost.base = strings.Replace(regHost.URL, "127.0.0.1", "localhost", 1)
+	regHost.serve["/left-pad"] = "/left-pad"
+	regHost.redirects[tarball] = mirror.URL + "/left-pad.tgz"
+	mirror.serve["/left-pad.tgz"] = tarball
+	mirrorURL, _ := url.Parse(mirror.URL)
+	s := newTestServer(t, reg, func(cfg *Config) {
+		cfg.Registry = regHost.base
+		cfg.UpstreamHosts = []string{mirrorURL.Host}
+		cfg.BlockPrivateNetworks = true
+	})
+	res := s.get("/npm/left-pad@1.0.0/index.js")
+	if res.StatusCode != http.StatusBadGateway || responseCode(t, res) != codeUpstreamForbidden {
+		t.Errorf("got %s", res.Status)
+	}
+	if _, ok := mirror.requested("/left-pad.tgz"); ok {
+		t.Errorf("the loopback mirror was reached")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Requests per cached version are counted in hourly buckets, kept for a
+// week. Versions that go unrequested for usageExpiry are forgotten.
+const (
+	usageWindow = 7 * 24
+	usageExpiry = 30 * 24 * time.Hour
+	usageFlush  = time.Minute
+)
+
+type versionUsage struct {
+	Hours    map[int64]int `json:"hours"` // requests by Unix hour
+	LastSeen time.Time     `json:"lastSeen"`
+}
+
+// usageStats counts requests per package version. Counts are only written
+// to disk by flush, which the maintenance loop calls every usageFlush.
+type usageStats struct {
+	mu       sync.Mutex
+	versions map[string]*versionUsage // by tenant-qualified name@version
+	dirty    bool
+}
+
+var usage = &usageStats{versions: map[string]*versionUsage{}}
+
+func usagePath() string {
+	return filepath.Join(config.DataDir, internalDir, "usage.json")
+}
+
+func (u *usageStats) record(t *tenant, name, version string) {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := t.qualify(name + "@" + version)
+	v, ok := u.versions[key]
+	if !ok {
+		v = &versionUsage{Hours: map[int64]int{}}
+		u.versions[key] = v
+	}
+	v.Hours[now.Unix()/3600]++
+	v.LastSeen = now
+	u.dirty = true
+}
+
+// counts returns the requests for a version in the last 24 hours and 7
+// days, and when it was last requested.
+func (u *usageStats) counts(t *tenant, name, version string) (day, week int, lastSeen time.Time) {
+	now := time.Now().Unix() / 3600
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	v, ok := u.versions[t.qualify(name+"@"+version)]
+	if !ok {
+		return 0, 0, time.Time{}
+	}
+	for hour, n := range v.Hours {
+		if now-hour < 24 {
+			day += n
+		}
+		if now-hour < usageWindow {
+			week += n
+		}
+	}
+	return day, week, v.LastSeen
+}
+
+func (u *usageStats) forget(t *tenant, name, version string) {
+	key := t.qualify(name + "@" + version)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.versions[key]; ok {
+		delete(u.versions, key)
+		u.dirty = true
+	}
+}
+
+// prune drops buckets older than the window and versions not requested
+// within usageExpiry.
+func (u *usageStats) prune(now time.Time) {
+	hour := now.Unix() / 3600
+	for key, v := range u.versions {
+		if now.Sub(v.LastSeen) > usageExpiry {
+			delete(u.versions, key)
+			u.dirty = true
+			continue
+		}
+		for h := range v.Hours {
+			if hour-h >= usageWindow {
+				delete(v.Hours, h)
+				u.dirty = true
+			}
+		}
+	}
+}
+
+func (u *usageStats) load() error {
+	data, err := os.ReadFile(usagePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	versions := map[string]*versionUsage{}
+	if err := json.Unmarshal(data, &versions); err != nil {
+		log.Printf("usage: ignoring %s: %s", usagePath(), err)
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.versions = versions
+	u.prune(time.Now())
+	return nil
+}
+
+// flush writes the counts to disk if they changed since the last flush.
+func (u *usageStats) flush() error {
+	u.mu.Lock()
+	u.prune(time.Now())
+	if !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(u.versions)
+	u.dirty = false
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	p := usagePath()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	index.setFileSize(p, int64(len(data)))
+	return nil
+}
+
+// packageUsage is an index entry with its request counts.
+type packageUsage struct {
+	indexEntry
+	Requests24h int        `json:"requests24h"`
+	Requests7d  int        `json:"requests7d"`
+	LastSeen    *time.Time `json:"lastRequested,omitempty"`
+}
+
+func withUsage(entries []indexEntry) []packageUsage {
+	list := make([]packageUsage, len(entries))
+	for i, e := range entries {
+		day, week, lastSeen := usage.counts(e.tenant, e.Name, e.Version)
+		list[i] = packageUsage{indexEntry: e, Requests24h: day, Requests7d: week}
+		if !lastSeen.IsZero() {
+			list[i].LastSeen = &lastSeen
+		}
+	}
+	return list
+}
+
+// popular returns the n versions of a tenant requested most over the last
+// week.
+func popular(t *tenant, n int) []packageUsage {
+	return popularOf(index.entriesFor(t), n)
+}
+
+func popularOf(entries []indexEntry, n int) []packageUsage {
+	list := withUsage(entries)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Requests7d != list[j].Requests7d {
+			return list[i].Requests7d > list[j].Requests7d
+		}
+		return list[i].Requests24h > list[j].Requests24h
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
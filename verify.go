@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// Values of config.VerifyQuarantine.
+const (
+	quarantineOff   = "off"
+	quarantineWarn  = "warn"
+	quarantineBlock = "block"
+)
+
+// Corruption records the files of a cached version that no longer match
+// their manifest.
+type Corruption struct {
+	Files []string  `json:"files"`
+	At    time.Time `json:"at"`
+	// Reason is "tampered" when the integrity guard found them.
+	Reason string `json:"reason,omitempty"`
+}
+
+// verifyMismatch is a version that failed verification.
+type verifyMismatch struct {
+	Package  string   `json:"package"`
+	Version  string   `json:"version"`
+	Files    []string `json:"files"`
+	Repaired bool     `json:"repaired,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// verifyRun is a verification of a tenant's cached versions. It is saved
+// after every version, so a run cut short by a restart picks up after the
+// last one it finished.
+type verifyRun struct {
+	Status   string     `json:"status"`
+	Tenant   string     `json:"tenant,omitempty"`
+	Package  string     `json:"package,omitempty"`
+	Version  string     `json:"version,omitempty"`
+	Repair   bool       `json:"repair"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Versions int        `json:"versions"`
+	Files    int        `json:"files"`
+	Bytes    int64      `json:"bytes"`
+
+	// Last is the last version ("name@version") verified.
+	Last       string           `json:"last,omitempty"`
+	Mismatches []verifyMismatch `json:"mismatches"`
+	// IntegrityWarnings are the versions cached despite not matching
+	// their published integrity, to be audited.
+	IntegrityWarnings []integrityWarning `json:"integrityWarnings"`
+
+	// With Upstream, the registry is asked whether the tarballs of the
+	// versions cached with validators are unchanged.
+	Upstream        bool             `json:"upstream,omitempty"`
+	UpstreamChecked int              `json:"upstreamChecked,omitempty"`
+	UpstreamChanges []upstreamChange `json:"upstreamChanges,omitempty"`
+}
+
+type integrityWarning struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	*IntegrityMismatch
+}
+
+var (
+	verifyMu     sync.Mutex
+	verification *verifyRun
+
+	verifyMismatches = newCounter("repkg_verify_mismatches_total", "Cached versions whose files failed verification.")
+)
+
+func verifyStatePath() string {
+	return filepath.Join(config.DataDir, internalDir, "verify.json")
+}
+
+// serveVerify starts verifying the tenant's cached versions, or those of
+// one package ({"package", "version"}), in the background. With
+// ?repair=true, mismatched versions are fetched again, and with
+// ?upstream=true the registry is asked whether their tarballs changed. GET
+// reports the current or last run.
+func serveVerify(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	if c.Request.Method == http.MethodGet {
+		c.JSON(http.StatusOK, verificationFor(tenantOf(c)))
+		return
+	}
+
+	var req versionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "invalid request"))
+		return
+	}
+	t := tenantOf(c)
+	if req.Package != "" {
+		if _, err := req.cachedVersions(t); err != nil {
+			writeError(c, err)
+			return
+		}
+	}
+
+	run := &verifyRun{Status: jobRunning, Package: req.Package, Version: req.Version, Repair: c.Query("repair") == "true", Upstream: c.Query("upstream") == "true", Started: time.Now(), Mismatches: []verifyMismatch{}, IntegrityWarnings: []integrityWarning{}}
+	if t != nil {
+		run.Tenant = t.name
+	}
+	verifyMu.Lock()
+	if verification != nil && verification.Status == jobRunning {
+		verifyMu.Unlock()
+		writeError(c, newError(http.StatusConflict, codeVerifyRunning, "a verification started at %s is still running", verification.Started.Format(time.RFC3339)))
+		return
+	}
+	verification = run
+	saved := *run
+	verifyMu.Unlock()
+
+	go runVerification(t, run)
+	c.JSON(http.StatusAccepted, saved)
+}
+
+// verificationFor returns a copy of the current or last run if it was for
+// t.
+func verificationFor(t *tenant) *verifyRun {
+	verifyMu.Lock()
+	defer verifyMu.Unlock()
+	if verification == nil || (t == nil) != (verification.Tenant == "") || (t != nil && t.name != verification.Tenant) {
+		return nil
+	}
+	run := *verification
+	run.Mismatches = slices.Clone(run.Mismatches)
+	run.IntegrityWarnings = slices.Clone(run.IntegrityWarnings)
+	run.UpstreamChanges = slices.Clone(run.UpstreamChanges)
+	return &run
+}
+
+// resumeVerification loads the last run and carries on with it if it was
+// cut short.
+func resumeVerification() {
+	data, err := os.ReadFile(verifyStatePath())
+	if err != nil {
+		return
+	}
+	run := &verifyRun{}
+	if err := json.Unmarshal(data, run); err != nil {
+		log.Printf("verify: %s: %s", verifyStatePath(), err)
+		return
+	}
+	var t *tenant
+	if run.Tenant != "" {
+		if t = tenants[run.Tenant]; t == nil {
+			return
+		}
+	}
+	verifyMu.Lock()
+	verification = run
+	verifyMu.Unlock()
+	if run.Status == jobRunning {
+		log.Printf("verify: resuming after %q", run.Last)
+		runVerification(t, run)
+	}
+}
+
+func runVerification(t *tenant, run *verifyRun) {
+	var list []indexEntry
+	for _, e := range index.entriesFor(t) {
+		if (run.Package == "" || e.Name == run.Package) && (run.Version == "" || e.Version == run.Version) {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name+"@"+list[i].Version < list[j].Name+"@"+list[j].Version })
+
+	var bucket *tokenBucket
+	if config.VerifyBandwidth > 0 {
+		bucket = newTokenBucket(config.VerifyBandwidth)
+	}
+	for _, e := range list {
+		key := e.Name + "@" + e.Version
+		if key <= run.Last {
+			continue
+		}
+		bad, files, n, warning, err := verifyVersion(t, e.Name, e.Version, bucket)
+		if errors.Is(err, os.ErrNotExist) {
+			// Evicted or purged since the run started.
+			err = nil
+		}
+		if err != nil {
+			log.Printf("verify: %s: %s", key, err)
+		}
+
+		var mismatch *verifyMismatch
+		if len(bad) > 0 {
+			log.Printf("verify: %s: %d files don't match the manifest: %v", key, len(bad), bad)
+			verifyMismatches.Inc()
+			mismatch = &verifyMismatch{Package: e.Name, Version: e.Version, Files: bad}
+			repairVersion(t, mismatch, run.Repair)
+		}
+		var change *upstreamChange
+		checked := false
+		if run.Upstream {
+			change, checked, err = checkUpstream(t, e.Name, e.Version)
+			if change != nil {
+				log.Printf("verify: %s: upstream tarball %s: %s%s", key, change.Status, change.ETag, change.Error)
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("verify: %s: %s", key, err)
+			}
+		}
+
+		verifyMu.Lock()
+		run.Versions++
+		run.Files += files
+		run.Bytes += n
+		run.Last = key
+		if mismatch != nil {
+			run.Mismatches = append(run.Mismatches, *mismatch)
+		}
+		if warning != nil {
+			run.IntegrityWarnings = append(run.IntegrityWarnings, integrityWarning{e.Name, e.Version, warning})
+		}
+		if checked {
+			run.UpstreamChecked++
+		}
+		if change != nil {
+			run.UpstreamChanges = append(run.UpstreamChanges, *change)
+		}
+		verifyMu.Unlock()
+		saveVerification(run)
+	}
+
+	verifyMu.Lock()
+	run.Status = jobDone
+	now := time.Now()
+	run.Finished = &now
+	log.Printf("verify: %d versions, %d files, %s checked, %d mismatched, %d cached despite their integrity", run.Versions, run.Files, formatBytes(run.Bytes), len(run.Mismatches), len(run.IntegrityWarnings))
+	if run.Upstream {
+		log.Printf("verify: %d upstream tarballs checked, %d changed or unreachable", run.UpstreamChecked, len(run.UpstreamChanges))
+	}
+	verifyMu.Unlock()
+	saveVerification(run)
+}
+
+func saveVerification(run *verifyRun) {
+	verifyMu.Lock()
+	data, err := json.Marshal(run)
+	verifyMu.Unlock()
+	if err == nil {
+		err = writeVerifyState(data)
+	}
+	if err != nil {
+		log.Printf("verify: saving progress: %s", err)
+	}
+}
+
+func writeVerifyState(data []byte) error {
+	p := verifyStatePath()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	index.setFileSize(p, int64(len(data)))
+	return nil
+}
+
+// verifyVersion hashes each file of a cached version, reading no faster
+// than bucket allows, and returns those whose size or hash differ from the
+// manifest, or that are gone, along with the integrity mismatch the
+// version was cached with, if any.
+func verifyVersion(t *tenant, name, version string, bucket *tokenBucket) (bad []string, files int, n int64, warning *IntegrityMismatch, err error) {
+	dir := versionDir(t, name, version)
+	m, err := loadManifest(dir, name, version)
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+	warning = m.IntegrityMismatch
+	for i := range m.Files {
+		f := &m.Files[i]
+		if f.SHA256 == "" {
+			continue
+		}
+		size, sum, err := hashStored(dir, f, bucket)
+		files++
+		n += size
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return bad, files, n, warning, err
+		}
+		if err != nil || size != f.Size || sum != f.SHA256 {
+			bad = append(bad, f.Path)
+		}
+	}
+	if len(bad) == 0 && m.Corrupt != nil && m.Corrupt.Reason == corruptTampered {
+		// Put back as it was, maybe, but only a fetch can tell.
+		bad = m.Corrupt.Files
+	}
+	return bad, files, n, warning, nil
+}
+
+// hashStored returns the size and SHA-256 of a file's original content.
+func hashStored(dir string, f *ManifestFile, bucket *tokenBucket) (int64, string, error) {
+	file, err := os.Open(f.storedPath(dir))
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	var r io.Reader = &pacedReader{r: file, bucket: bucket}
+	if f.Stored == "br" {
+		r = brotli.NewReader(r)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		// A blob that doesn't decode is as corrupt as one that
+		// doesn't hash right.
+		return n, "", nil
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pacedReader reads from r no faster than bucket allows, if there is one.
+type pacedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := p.r.Read(b)
+	if p.bucket != nil {
+		time.Sleep(p.bucket.reserve(n))
+	}
+	return n, err
+}
+
+// repairVersion quarantines a mismatched version as config.VerifyQuarantine
+// says and, with repair, fetches it again in its place.
+func repairVersion(t *tenant, mismatch *verifyMismatch, repair bool) {
+	name, version := mismatch.Package, mismatch.Version
+	dir := versionDir(t, name, version)
+	hotCache.invalidateVersion(dir)
+	if config.VerifyQuarantine != quarantineOff {
+		_, err := updateManifest(t, dir, name, version, func(m *Manifest) {
+			c := &Corruption{Files: mismatch.Files, At: time.Now()}
+			if m.Corrupt != nil {
+				// The guard's quarantine holds regardless of
+				// VerifyQuarantine.
+				c.Reason = m.Corrupt.Reason
+			}
+			m.Corrupt = c
+		})
+		if err != nil {
+			log.Printf("verify: quarantining %s@%s: %s", name, version, err)
+		}
+	}
+	if !repair {
+		return
+	}
+
+	pv, _, err := resolvePackage(t, name, version, nil)
+	if err == nil {
+		err = fetchPackage(name, pv, fetchOptions{Tenant: t, Refresh: true, Admin: true, Timing: newFetchTiming(nil)})
+	}
+	if err != nil {
+		log.Printf("verify: repairing %s@%s: %s", name, version, err)
+		mismatch.Error = err.Error()
+		return
+	}
+	log.Printf("verify: repaired %s@%s", name, version)
+	mismatch.Repaired = true
+}
+
+// checkCorrupt applies config.VerifyQuarantine to a version that failed
+// verification. It reports false when the response was written and the
+// version must not be served.
+func checkCorrupt(c *gin.Context, m *Manifest) bool {
+	switch {
+	case m.Corrupt == nil:
+		return true
+	case m.Corrupt.Reason == corruptTampered:
+		writeError(c, tamperedError(m))
+		return false
+	case config.VerifyQuarantine == quarantineOff:
+		return true
+	case config.VerifyQuarantine == quarantineWarn:
+		c.Header("Warning", `199 repkg "failed verification, awaiting repair"`)
+		return true
+	}
+	e := newError(http.StatusServiceUnavailable, codeCorrupt, "%s@%s failed verification and awaits repair", m.Name, m.Version)
+	e.Details = map[string]any{"files": m.Corrupt.Files, "detectedAt": m.Corrupt.At}
+	writeError(c, e)
+	return false
+}
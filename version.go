@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Left unset, they are taken from what the Go toolchain recorded, if
+// anything.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+var startTime = time.Now()
+
+// buildInfo describes the running build and the features its config turns
+// on. It never holds secrets or URLs; registry hosts are only listed with
+// config.VersionRegistryHosts.
+type buildInfo struct {
+	Version    string          `json:"version"`
+	Commit     string          `json:"commit,omitempty"`
+	BuildDate  string          `json:"buildDate,omitempty"`
+	GoVersion  string          `json:"goVersion"`
+	Uptime     string          `json:"uptime,omitempty"`
+	Features   map[string]bool `json:"features"`
+	Registries []string        `json:"registries,omitempty"`
+}
+
+func currentBuildInfo() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" {
+			b.Version = info.Main.Version
+		}
+		// The commit's time stands in for the build date, but not for
+		// another commit's.
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && commit == "" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			}
+		}
+	}
+	if b.Version == "" || b.Version == "(devel)" {
+		b.Version = "dev"
+	}
+
+	b.Features = map[string]bool{
+		"tenants":              len(config.Tenants) > 0,
+		"allowlist":            len(config.Allowlist) > 0,
+		"denylist":             !config.DisableDenylist,
+		"html":                 !config.DisableHTML,
+		"jsdelivrPaths":        pathStyle(pathStyleJSDelivr),
+		"unpkgPaths":           pathStyle(pathStyleUnpkg),
+		"signatures":           config.Signatures != signaturesOff,
+		"responseSigning":      config.SigningKey != "",
+		"brotliStorage":        config.Storage == storageBrotli,
+		"hotCache":             config.HotCacheMaxBytes > 0,
+		"eviction":             config.MaxCacheBytes > 0,
+		"quotas":               len(config.Quotas) > 0,
+		"throttling":           config.UpstreamBandwidth > 0 || config.DownloadBandwidth > 0,
+		"segmentedDownloads":   config.SegmentedDownloadThreshold > 0 && config.DownloadSegments > 1,
+		"refresh":              config.Refresh != refreshOff,
+		"staleIfError":         config.StaleIfError.Duration > 0,
+		"readOnly":             config.ReadOnly,
+		"tracing":              config.OTLPEndpoint != "",
+		"circuitBreaker":       config.CircuitFailures > 0,
+		"fallbackRegistry":     config.FallbackRegistry != "",
+		"blockPrivateNetworks": config.BlockPrivateNetworks,
+		"withdrawalChecks":     config.WithdrawalCheckInterval.Duration > 0,
+		"statsSnapshots":       config.StatsSnapshotInterval.Duration > 0,
+		"approvals":            config.Approvals,
+		"warmStart":            config.WarmStart != "" || config.WarmStartSave > 0,
+		"admin":                config.AdminToken != "",
+	}
+
+	if config.VersionRegistryHosts {
+		hosts := map[string]bool{}
+		for _, r := range []string{config.Registry, config.FallbackRegistry} {
+			if u, err := url.Parse(r); err == nil && u.Host != "" {
+				hosts[u.Host] = true
+			}
+		}
+		for _, t := range config.Tenants {
+			if u, err := url.Parse(t.Registry); err == nil && u.Host != "" {
+				hosts[u.Host] = true
+			}
+		}
+		for h := range hosts {
+			b.Registries = append(b.Registries, h)
+		}
+		sort.Strings(b.Registries)
+	}
+	return b
+}
+
+func serveVersion(c *gin.Context) {
+	b := currentBuildInfo()
+	b.Uptime = time.Since(startTime).Round(time.Second).String()
+	c.JSON(http.StatusOK, b)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The warm-start job can be polled at /api/prefetch/warm-start.
+const warmStartJobID = "warm-start"
+
+// warmStartSaveInterval is how often the most popular versions are written
+// for the next boot, with config.WarmStartSave.
+const warmStartSaveInterval = time.Hour
+
+func warmStartSavePath() string {
+	return filepath.Join(config.DataDir, internalDir, "warm-start.txt")
+}
+
+// warmStart queues the versions listed by config.WarmStart and those saved
+// by the previous run for prefetching, paced by config.WarmStartRate. It
+// runs in the background: a missing list or a failing entry is logged and
+// never holds up serving.
+func warmStart() {
+	var specs []string
+	if config.WarmStart != "" {
+		list, err := readWarmStartList(config.WarmStart)
+		if err != nil {
+			log.Printf("warm start: %s: %s", config.WarmStart, err)
+		}
+		specs = append(specs, list...)
+	}
+	if config.WarmStartSave > 0 {
+		list, err := readWarmStartList(warmStartSavePath())
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("warm start: %s: %s", warmStartSavePath(), err)
+		}
+		specs = append(specs, list...)
+	}
+
+	seen := map[string]bool{}
+	var items []*prefetchItem
+	for _, s := range specs {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		name, spec := parseSpec(s)
+		items = append(items, &prefetchItem{Package: name, Spec: spec})
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	var interval time.Duration
+	if config.WarmStartRate > 0 {
+		interval = time.Duration(float64(time.Second) / config.WarmStartRate)
+	}
+	job := enqueuePaced(warmStartJobID, items, fetchOptions{}, interval)
+	log.Printf("warm start: prefetching %d versions (job %s)", job.Total, job.ID)
+}
+
+// readWarmStartList reads package@version entries from a file or an
+// http(s) URL: a JSON array of strings, or one entry per line with
+// # comments.
+func readWarmStartList(source string) ([]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchWarmStartList(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var list []string
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	var list []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list, scanner.Err()
+}
+
+func fetchWarmStartList(URL string) ([]byte, error) {
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Get(URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responded %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 16<<20))
+}
+
+// saveWarmStart writes the config.WarmStartSave most requested versions of
+// the default tenant for the next boot to start with.
+func saveWarmStart() error {
+	if config.WarmStartSave <= 0 {
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# most requested versions, %s\n", time.Now().UTC().Format(time.RFC3339))
+	for _, p := range popular(nil, config.WarmStartSave) {
+		if p.Requests7d > 0 {
+			fmt.Fprintf(&b, "%s@%s\n", p.Name, p.Version)
+		}
+	}
+
+	p := warmStartSavePath()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	index.setFileSize(p, int64(b.Len()))
+	return nil
+}
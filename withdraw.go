@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of config.WithdrawnPolicy.
+const (
+	withdrawnBlock = "block"
+	withdrawnWarn  = "warn"
+)
+
+// Reasons a version is withdrawn.
+const (
+	withdrawnUnpublished = "unpublished"
+	withdrawnSecurity    = "security"
+)
+
+// Withdrawal records when and why the registry stopped serving a version.
+type Withdrawal struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+var (
+	versionsWithdrawn  = newCounter("repkg_versions_withdrawn_total", "Cached versions found withdrawn upstream.")
+	versionsReinstated = newCounter("repkg_versions_reinstated_total", "Withdrawn versions found published again.")
+)
+
+// withdrawalChange is a version whose status changed during a check.
+type withdrawalChange struct {
+	Package   string `json:"package"`
+	Version   string `json:"version"`
+	Withdrawn string `json:"withdrawn,omitempty"`
+}
+
+// checkWithdrawn applies config.WithdrawnPolicy to a withdrawn version. It
+// reports false when the response was written and the version must not be
+// served.
+func checkWithdrawn(c *gin.Context, m *Manifest) bool {
+	if m.Withdrawn == nil || m.Pinned {
+		return true
+	}
+	if config.WithdrawnPolicy == withdrawnWarn {
+		c.Header("Warning", `299 repkg "withdrawn upstream: `+m.Withdrawn.Reason+`"`)
+		return true
+	}
+
+	status := http.StatusGone
+	if m.Withdrawn.Reason == withdrawnSecurity {
+		status = http.StatusUnavailableForLegalReasons
+	}
+	e := newError(status, codeWithdrawn, "%s@%s was withdrawn upstream (%s)", m.Name, m.Version, m.Withdrawn.Reason)
+	e.Details = map[string]any{"reason": m.Withdrawn.Reason, "withdrawnAt": m.Withdrawn.At}
+	writeError(c, e)
+	return false
+}
+
+// runWithdrawalChecks rechecks every cached package each interval.
+func runWithdrawalChecks(interval time.Duration) {
+	for range time.Tick(interval) {
+		seen := map[string]bool{}
+		for _, e := range index.entries() {
+			if seen[e.tenant.qualify(e.Name)] {
+				continue
+			}
+			seen[e.tenant.qualify(e.Name)] = true
+			if _, err := recheckPackage(e.tenant, e.Name); err != nil {
+				log.Printf("withdrawal check: %s: %s", e.Name, err)
+			}
+		}
+	}
+}
+
+// recheckPackage asks the tenant's registry whether its cached versions of a
+// package are still published and records those that changed. Registry
+// errors other than 404 leave every version as it was.
+func recheckPackage(t *tenant, name string) ([]withdrawalChange, error) {
+	p, err := refreshPackument(t, name, nil)
+	var e *apiError
+	gone := errors.As(err, &e) && e.Status == http.StatusNotFound
+	if err != nil && !gone {
+		return nil, err
+	}
+
+	changes := []withdrawalChange{}
+	for _, entry := range index.entriesFor(t) {
+		if entry.Name != name {
+			continue
+		}
+
+		reason := ""
+		if gone {
+			reason = withdrawnUnpublished
+		} else if _, ok := p.Versions[entry.Version]; !ok {
+			reason = withdrawnUnpublished
+			for v := range p.Versions {
+				if strings.HasSuffix(v, "-security") {
+					reason = withdrawnSecurity
+				}
+			}
+		}
+		if reason == "" && !entry.Withdrawn {
+			continue
+		}
+
+		dir := versionDir(t, name, entry.Version)
+		m, err := loadManifest(dir, name, entry.Version)
+		if err != nil {
+			return changes, err
+		}
+		current := ""
+		if m.Withdrawn != nil {
+			current = m.Withdrawn.Reason
+		}
+		if current == reason {
+			continue
+		}
+
+		m, err = updateManifest(t, dir, name, entry.Version, func(m *Manifest) {
+			m.Withdrawn = nil
+			if reason != "" {
+				m.Withdrawn = &Withdrawal{Reason: reason, At: time.Now()}
+			}
+		})
+		if err != nil {
+			return changes, err
+		}
+		if reason != "" {
+			log.Printf("withdrawal check: %s@%s withdrawn upstream (%s)", name, entry.Version, reason)
+			versionsWithdrawn.Inc()
+			events.emit(cacheEvent{Type: eventWithdrawn, Tenant: t.Name(), Package: name, Version: entry.Version, Reason: reason})
+		} else {
+			log.Printf("withdrawal check: %s@%s published again", name, entry.Version)
+			versionsReinstated.Inc()
+		}
+		changes = append(changes, withdrawalChange{Package: name, Version: m.Version, Withdrawn: reason})
+	}
+	return changes, nil
+}
+
+// serveRegistryHook rechecks the package named in a registry webhook
+// ({"name": ...}, as npm hooks send). It is signed with config.HookSecret
+// or made with the admin token.
+func serveRegistryHook(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		writeError(c, wrapError(http.StatusBadRequest, codeBadRequest, err, "reading hook"))
+		return
+	}
+	if !isAdmin(c.Request) && !validHookSignature(c.GetHeader("X-Npm-Signature"), body) {
+		writeError(c, newError(http.StatusUnauthorized, codeUnauthorized, "invalid hook signature"))
+		return
+	}
+
+	var hook struct {
+		Name  string `json:"name"`
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal(body, &hook); err != nil || !validPackageName(hook.Name) {
+		writeError(c, newError(http.StatusBadRequest, codeBadRequest, "hook must name a package"))
+		return
+	}
+
+	changes, err := recheckPackage(tenantOf(c), hook.Name)
+	if err != nil {
+		writeError(c, wrapUpstream(err, "rechecking %s", hook.Name))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"package": hook.Name, "changes": changes})
+}
+
+// validHookSignature checks "sha256=<hex HMAC of the body>".
+func validHookSignature(header string, body []byte) bool {
+	if config.HookSecret == "" {
+		return false
+	}
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(config.HookSecret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}